@@ -0,0 +1,203 @@
+// Package configuration lit le config.yaml d'un daemon: décodage strict, où une clé
+// inconnue est une erreur, puis surcharge par les variables d'environnement et par les
+// options de la ligne de commande, dans cet ordre.
+package configuration
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lire décode le fichier yaml dans cible. Les clés inconnues sont refusées pour qu'une
+// faute de frappe ne passe pas inaperçue.
+func Lire(chemin string, cible any) error {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return err
+	}
+	decodeur := yaml.NewDecoder(bytes.NewReader(contenu))
+	decodeur.KnownFields(true)
+	if err := decodeur.Decode(cible); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %v", chemin, err)
+	}
+	return nil
+}
+
+// champ est une valeur de la config repérée par son chemin yaml, tls.cert par exemple
+type champ struct {
+	chemin string
+	valeur reflect.Value
+}
+
+// champs liste les valeurs modifiables de la struct pointée par cible
+func champs(cible any) []champ {
+	var liste []champ
+	var parcourir func(v reflect.Value, prefixe string)
+	parcourir = func(v reflect.Value, prefixe string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			nom, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if !f.IsExported() || nom == "" || nom == "-" {
+				continue
+			}
+			if f.Type.Kind() == reflect.Struct {
+				parcourir(v.Field(i), prefixe+nom+".")
+				continue
+			}
+			liste = append(liste, champ{chemin: prefixe + nom, valeur: v.Field(i)})
+		}
+	}
+	parcourir(reflect.ValueOf(cible).Elem(), "")
+	return liste
+}
+
+// affecter convertit texte dans le type de v: durée (30s), nombre, booléen, texte ou
+// liste de textes séparés par des virgules
+func affecter(v reflect.Value, texte string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(texte)
+		if err != nil {
+			return fmt.Errorf("durée invalide %q (exemple: 30s, 5m)", texte)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(texte)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(texte)
+		if err != nil {
+			return fmt.Errorf("booléen invalide %q", texte)
+		}
+		v.SetBool(b)
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(texte, 10, 64)
+		if err != nil {
+			return fmt.Errorf("entier invalide %q", texte)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64 || v.Kind() == reflect.Float32:
+		x, err := strconv.ParseFloat(texte, 64)
+		if err != nil {
+			return fmt.Errorf("nombre invalide %q", texte)
+		}
+		v.SetFloat(x)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var liste []string
+		for _, element := range strings.Split(texte, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				liste = append(liste, element)
+			}
+		}
+		v.Set(reflect.ValueOf(liste))
+	default:
+		return fmt.Errorf("type %s non surchargeable", v.Type())
+	}
+	return nil
+}
+
+// NomVariable renvoie la variable d'environnement d'une option: PREFIXE_TLS_CERT pour tls.cert
+func NomVariable(prefixe, chemin string) string {
+	return prefixe + "_" + strings.ToUpper(strings.ReplaceAll(chemin, ".", "_"))
+}
+
+// NomOption renvoie l'option de ligne de commande d'une option: -tls.cert, -http-addr
+func NomOption(chemin string) string {
+	return strings.ReplaceAll(chemin, "_", "-")
+}
+
+// Environnement applique les variables d'environnement PREFIXE_CHEMIN définies
+func Environnement(prefixe string, cible any) error {
+	var erreurs []error
+	for _, c := range champs(cible) {
+		nom := NomVariable(prefixe, c.chemin)
+		if texte, ok := os.LookupEnv(nom); ok {
+			if err := affecter(c.valeur, texte); err != nil {
+				erreurs = append(erreurs, fmt.Errorf("%s: %v", nom, err))
+			}
+		}
+	}
+	return errors.Join(erreurs...)
+}
+
+// Options garde les valeurs données en ligne de commande, appliquées après la lecture
+// du fichier et de l'environnement
+type Options struct {
+	valeurs map[string]string
+}
+
+// Declarer ajoute à fs une option par valeur de la config modele
+func Declarer(fs *flag.FlagSet, modele any) *Options {
+	o := &Options{valeurs: make(map[string]string)}
+	for _, c := range champs(modele) {
+		chemin, typ := c.chemin, c.valeur.Type()
+		fs.Func(NomOption(chemin), "remplace "+chemin+" du config.yaml", func(texte string) error {
+			if err := affecter(reflect.New(typ).Elem(), texte); err != nil {
+				return err
+			}
+			o.valeurs[chemin] = texte
+			return nil
+		})
+	}
+	return o
+}
+
+// Appliquer remplace dans cible les valeurs données en ligne de commande
+func (o *Options) Appliquer(cible any) error {
+	for _, c := range champs(cible) {
+		if texte, ok := o.valeurs[c.chemin]; ok {
+			if err := affecter(c.valeur, texte); err != nil {
+				return fmt.Errorf("-%s: %v", NomOption(c.chemin), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Adresse vérifie une adresse d'écoute ou de connexion hôte:port. Le port 0 n'est
+// accepté que pour une écoute (port libre choisi par le système).
+func Adresse(adresse string, ecoute bool) error {
+	hote, port, err := net.SplitHostPort(adresse)
+	if err != nil {
+		return fmt.Errorf("adresse invalide %q, attendu hôte:port", adresse)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 || (n == 0 && !ecoute) {
+		return fmt.Errorf("port invalide dans %q", adresse)
+	}
+	if !ecoute && hote == "" {
+		return fmt.Errorf("hôte manquant dans %q", adresse)
+	}
+	return nil
+}
+
+// Duree vérifie qu'une durée est comprise entre min et max
+func Duree(d, min, max time.Duration) error {
+	if d < min || d > max {
+		return fmt.Errorf("%s hors des bornes [%s, %s]", d, min, max)
+	}
+	return nil
+}
+
+// Fichier vérifie qu'un fichier référencé par la config existe
+func Fichier(chemin string) error {
+	info, err := os.Stat(chemin)
+	if err != nil {
+		return fmt.Errorf("fichier %s introuvable", chemin)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s est un dossier", chemin)
+	}
+	return nil
+}
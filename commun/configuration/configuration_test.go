@@ -0,0 +1,167 @@
+package configuration
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configTest reprend la forme des configs du master et du worker
+type configTest struct {
+	Home     string        `yaml:"-"`
+	HTTPAddr string        `yaml:"http_addr"`
+	Workers  []string      `yaml:"workers_ip"`
+	Poll     time.Duration `yaml:"poll_interval"`
+	Max      int           `yaml:"max_finished_jobs"`
+	TLS      struct {
+		Cert string `yaml:"cert"`
+	} `yaml:"tls"`
+}
+
+func ecrireConfig(t *testing.T, contenu string) string {
+	t.Helper()
+	chemin := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(chemin, []byte(contenu), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return chemin
+}
+
+func TestLire(t *testing.T) {
+	cas := []struct {
+		nom     string
+		contenu string
+		erreur  string // vide si la lecture doit réussir
+	}{
+		{"vide", "", ""},
+		{"complet", "http_addr: \":8082\"\nworkers_ip: [\"w1:8080\"]\npoll_interval: 2s\ntls:\n  cert: a.pem\n", ""},
+		{"clé inconnue", "http_adr: \":8082\"\n", "http_adr"},
+		{"clé inconnue imbriquée", "tls:\n  certificat: a.pem\n", "certificat"},
+		{"clé interne", "home: /tmp\n", "home"},
+		{"durée illisible", "poll_interval: souvent\n", "souvent"},
+	}
+	for _, c := range cas {
+		var config configTest
+		err := Lire(ecrireConfig(t, c.contenu), &config)
+		switch {
+		case c.erreur == "" && err != nil:
+			t.Errorf("%s: %v", c.nom, err)
+		case c.erreur != "" && (err == nil || !strings.Contains(err.Error(), c.erreur)):
+			t.Errorf("%s: erreur %v, attendu une erreur sur %s", c.nom, err, c.erreur)
+		}
+	}
+}
+
+func TestSurcharges(t *testing.T) {
+	cas := []struct {
+		nom           string
+		environnement map[string]string
+		options       []string
+		attendu       configTest
+		erreur        bool
+	}{
+		{"fichier seul", nil, nil, configTest{HTTPAddr: ":8082", Workers: []string{"w1:8080"}, Poll: 2 * time.Second}, false},
+		{"environnement", map[string]string{"TEST_HTTP_ADDR": ":9000", "TEST_WORKERS_IP": "w2:8080, w3:8080", "TEST_TLS_CERT": "b.pem"}, nil,
+			configTest{HTTPAddr: ":9000", Workers: []string{"w2:8080", "w3:8080"}, Poll: 2 * time.Second, TLS: struct {
+				Cert string `yaml:"cert"`
+			}{"b.pem"}}, false},
+		{"option après environnement", map[string]string{"TEST_HTTP_ADDR": ":9000", "TEST_POLL_INTERVAL": "5s"}, []string{"-http-addr", ":9100"},
+			configTest{HTTPAddr: ":9100", Workers: []string{"w1:8080"}, Poll: 5 * time.Second}, false},
+		{"nombre", map[string]string{"TEST_MAX_FINISHED_JOBS": "10"}, []string{"-max-finished-jobs", "20"},
+			configTest{HTTPAddr: ":8082", Workers: []string{"w1:8080"}, Poll: 2 * time.Second, Max: 20}, false},
+		{"durée d'environnement illisible", map[string]string{"TEST_POLL_INTERVAL": "2"}, nil, configTest{}, true},
+		{"entier d'environnement illisible", map[string]string{"TEST_MAX_FINISHED_JOBS": "beaucoup"}, nil, configTest{}, true},
+	}
+	chemin := ecrireConfig(t, "http_addr: \":8082\"\nworkers_ip: [\"w1:8080\"]\npoll_interval: 2s\n")
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			for nom, valeur := range c.environnement {
+				t.Setenv(nom, valeur)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			options := Declarer(fs, &configTest{})
+			if err := fs.Parse(c.options); err != nil {
+				t.Fatal(err)
+			}
+
+			var config configTest
+			if err := Lire(chemin, &config); err != nil {
+				t.Fatal(err)
+			}
+			err := Environnement("TEST", &config)
+			if err == nil {
+				err = options.Appliquer(&config)
+			}
+			if c.erreur {
+				if err == nil {
+					t.Fatal("surcharge invalide acceptée")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, c.attendu) {
+				t.Fatalf("config %+v, attendu %+v", config, c.attendu)
+			}
+		})
+	}
+}
+
+func TestOptionInvalide(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	Declarer(fs, &configTest{})
+	for _, option := range [][]string{{"-poll-interval", "vite"}, {"-max-finished-jobs", "1.5"}, {"-http_addr", ":1"}} {
+		if err := fs.Parse(option); err == nil {
+			t.Errorf("%v accepté", option)
+		}
+	}
+}
+
+func TestAdresse(t *testing.T) {
+	cas := []struct {
+		adresse string
+		ecoute  bool
+		valide  bool
+	}{
+		{":8082", true, true},
+		{"127.0.0.1:0", true, true},
+		{"[::1]:8080", false, true},
+		{"worker1:8080", false, true},
+		{":8080", false, false},     // hôte manquant pour une connexion
+		{"worker1:0", false, false}, // port libre seulement en écoute
+		{"worker1", false, false},   // pas de port
+		{"worker1:http", false, false},
+		{"worker1:70000", true, false},
+		{"::1:8080", false, false},
+	}
+	for _, c := range cas {
+		if err := Adresse(c.adresse, c.ecoute); (err == nil) != c.valide {
+			t.Errorf("Adresse(%q, %v): %v", c.adresse, c.ecoute, err)
+		}
+	}
+}
+
+func TestDuree(t *testing.T) {
+	cas := []struct {
+		d      time.Duration
+		valide bool
+	}{
+		{time.Second, true},
+		{time.Minute, true},
+		{time.Hour, true},
+		{999 * time.Millisecond, false},
+		{-time.Second, false},
+		{time.Hour + 1, false},
+	}
+	for _, c := range cas {
+		if err := Duree(c.d, time.Second, time.Hour); (err == nil) != c.valide {
+			t.Errorf("Duree(%v): %v", c.d, err)
+		}
+	}
+}
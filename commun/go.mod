@@ -0,0 +1,5 @@
+module commun
+
+go 1.23.0
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,125 @@
+package journalisation
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Socket du protocole natif de journald
+const socketJournald = "/run/systemd/journal/socket"
+
+// journald envoie chaque message à journald avec ses champs: component devient COMPONENT,
+// job_id JOB_ID..., consultables avec journalctl -o verbose ou filtrables (JOB_ID=...).
+type journald struct {
+	conn        *net.UnixConn
+	mu          *sync.Mutex
+	identifiant string
+	attrs       []slog.Attr // champs ajoutés par With, noms de groupes déjà appliqués
+	groupe      string      // préfixe des champs suivants (WithGroup)
+}
+
+func nouveauJournald(identifiant string) (*journald, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketJournald, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journald{conn: conn, mu: &sync.Mutex{}, identifiant: identifiant}, nil
+}
+
+func (j *journald) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (j *journald) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	ecrireChamp(&b, "MESSAGE", r.Message)
+	ecrireChamp(&b, "PRIORITY", fmt.Sprint(priorite(r.Level)))
+	ecrireChamp(&b, "SYSLOG_IDENTIFIER", j.identifiant)
+	for _, a := range j.attrs {
+		ecrireAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		ecrireAttr(&b, j.groupe, a)
+		return true
+	})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+func (j *journald) WithAttrs(attrs []slog.Attr) slog.Handler {
+	copie := *j
+	copie.attrs = append([]slog.Attr(nil), j.attrs...)
+	for _, a := range attrs {
+		if j.groupe != "" {
+			a.Key = j.groupe + a.Key
+		}
+		copie.attrs = append(copie.attrs, a)
+	}
+	return &copie
+}
+
+func (j *journald) WithGroup(nom string) slog.Handler {
+	copie := *j
+	copie.groupe = j.groupe + nom + "_"
+	return &copie
+}
+
+// priorite convertit un niveau slog en priorité syslog
+func priorite(niveau slog.Level) int {
+	switch {
+	case niveau >= slog.LevelError:
+		return 3
+	case niveau >= slog.LevelWarn:
+		return 4
+	case niveau >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func ecrireAttr(b *bytes.Buffer, prefixe string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		for _, sous := range a.Value.Group() {
+			ecrireAttr(b, prefixe+a.Key+"_", sous)
+		}
+		return
+	}
+	ecrireChamp(b, nomChamp(prefixe+a.Key), a.Value.String())
+}
+
+// nomChamp met la clé au format des champs journald: majuscules, chiffres et _, sans _ ni
+// chiffre au début
+func nomChamp(cle string) string {
+	nom := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, cle)
+	nom = strings.TrimLeft(nom, "_0123456789")
+	if nom == "" {
+		return "CHAMP"
+	}
+	return nom
+}
+
+// ecrireChamp écrit NOM=valeur, ou la forme binaire si la valeur contient un retour à la ligne
+func ecrireChamp(b *bytes.Buffer, nom, valeur string) {
+	if !strings.Contains(valeur, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", nom, valeur)
+		return
+	}
+	b.WriteString(nom + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(valeur)))
+	b.WriteString(valeur + "\n")
+}
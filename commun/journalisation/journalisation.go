@@ -0,0 +1,260 @@
+// Package journalisation construit le logger slog d'un daemon: texte ou JSON, niveau
+// réglable par composant, fichier avec rotation et compression, et envoi à journald.
+//
+// Chaque partie du daemon journalise avec logger.With("component", nom): le niveau de
+// ce composant s'applique alors à tous ses messages.
+package journalisation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Clés des champs de contexte communes aux daemons
+const (
+	CleComposant = "component"
+	CleJob       = "job_id"
+	CleWorker    = "worker"
+	CleCommande  = "command"
+)
+
+// Config est la section log du config.yaml
+type Config struct {
+	File   string `yaml:"file"`   // fichier de log, "-" pour ne pas écrire de fichier
+	Format string `yaml:"format"` // text (par défaut) ou json
+	Level  string `yaml:"level"`  // debug, info (par défaut), warn ou error
+	// Niveaux propres à certains composants, "jobs=debug" par exemple
+	Levels []string `yaml:"levels"`
+	// Rotation du fichier quand il dépasse max_size_mb (100 par défaut) ou qu'il est
+	// ouvert depuis rotate_every (pas de rotation périodique par défaut)
+	MaxSizeMB   int           `yaml:"max_size_mb"`
+	RotateEvery time.Duration `yaml:"rotate_every"`
+	MaxBackups  int           `yaml:"max_backups"` // anciens fichiers conservés, 7 par défaut
+	Compress    bool          `yaml:"compress"`    // compression gzip des anciens fichiers
+	// Journald envoie les messages et leurs champs à journald au lieu de la sortie standard
+	Journald bool `yaml:"journald"`
+}
+
+// AvecDefauts renvoie la config où les valeurs non renseignées ont leur valeur par défaut
+func (c Config) AvecDefauts() Config {
+	if c.Format == "" {
+		c.Format = "text"
+	}
+	if c.Level == "" {
+		c.Level = "info"
+	}
+	if c.MaxSizeMB == 0 {
+		c.MaxSizeMB = 100
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = 7
+	}
+	return c
+}
+
+// Valider vérifie la config, préfixe compris pour les messages d'erreur (log.level...)
+func (c Config) Valider(prefixe string) error {
+	c = c.AvecDefauts()
+	var erreurs []error
+	verifier := func(cle string, err error) {
+		if err != nil {
+			erreurs = append(erreurs, fmt.Errorf("%s%s: %v", prefixe, cle, err))
+		}
+	}
+
+	if c.Format != "text" && c.Format != "json" {
+		verifier("format", fmt.Errorf("format %q inconnu, attendu text ou json", c.Format))
+	}
+	_, err := lireNiveau(c.Level)
+	verifier("level", err)
+	_, err = lireNiveaux(c.Levels)
+	verifier("levels", err)
+	if c.MaxSizeMB < 0 {
+		verifier("max_size_mb", fmt.Errorf("taille négative %d", c.MaxSizeMB))
+	}
+	if c.RotateEvery != 0 && c.RotateEvery < time.Minute {
+		verifier("rotate_every", fmt.Errorf("%s inférieur à 1m", c.RotateEvery))
+	}
+	if c.MaxBackups < 0 {
+		verifier("max_backups", fmt.Errorf("nombre négatif %d", c.MaxBackups))
+	}
+	if c.File != "" && c.File != "-" {
+		if info, err := os.Stat(filepath.Dir(c.File)); err != nil || !info.IsDir() {
+			verifier("file", fmt.Errorf("dossier %s introuvable", filepath.Dir(c.File)))
+		}
+	}
+	if c.Journald {
+		if _, err := os.Stat(socketJournald); err != nil {
+			verifier("journald", fmt.Errorf("journald indisponible (%s introuvable)", socketJournald))
+		}
+	}
+	return errors.Join(erreurs...)
+}
+
+// Journal est le logger d'un daemon avec les fichiers et connexions qu'il a ouverts
+type Journal struct {
+	Logger *slog.Logger
+	// fermer est appelé par Close, dans l'ordre
+	fermer []func() error
+}
+
+// Ouvrir crée le logger décrit par c
+func Ouvrir(c Config) (*Journal, error) {
+	c = c.AvecDefauts()
+	if err := c.Valider("log."); err != nil {
+		return nil, err
+	}
+	niveau, _ := lireNiveau(c.Level)
+	niveaux, _ := lireNiveaux(c.Levels)
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // le filtre décide du niveau
+	nouveauHandler := func(w io.Writer) slog.Handler {
+		if c.Format == "json" {
+			return slog.NewJSONHandler(w, options)
+		}
+		return slog.NewTextHandler(w, options)
+	}
+
+	j := &Journal{}
+	var handlers []slog.Handler
+	if c.File != "" && c.File != "-" {
+		fichier, err := ouvrirFichierTournant(c.File, int64(c.MaxSizeMB)<<20, c.RotateEvery, c.MaxBackups, c.Compress)
+		if err != nil {
+			return nil, fmt.Errorf("ouverture du fichier de log: %v", err)
+		}
+		j.fermer = append(j.fermer, fichier.Close)
+		handlers = append(handlers, nouveauHandler(fichier))
+	}
+	if c.Journald {
+		jd, err := nouveauJournald(filepath.Base(os.Args[0]))
+		if err != nil {
+			j.Close()
+			return nil, fmt.Errorf("connexion à journald: %v", err)
+		}
+		j.fermer = append(j.fermer, jd.conn.Close)
+		handlers = append(handlers, jd)
+	} else {
+		handlers = append(handlers, nouveauHandler(os.Stdout))
+	}
+
+	var h slog.Handler = multi(handlers)
+	if len(handlers) == 1 {
+		h = handlers[0]
+	}
+	j.Logger = slog.New(&filtre{suivant: h, defaut: niveau, niveau: niveau, niveaux: niveaux})
+	return j, nil
+}
+
+// Close ferme le fichier de log, en attendant la compression des fichiers tournés
+func (j *Journal) Close() error {
+	var erreurs []error
+	for _, f := range j.fermer {
+		erreurs = append(erreurs, f())
+	}
+	return errors.Join(erreurs...)
+}
+
+func lireNiveau(texte string) (slog.Level, error) {
+	var niveau slog.Level
+	if err := niveau.UnmarshalText([]byte(texte)); err != nil {
+		return 0, fmt.Errorf("niveau %q inconnu, attendu debug, info, warn ou error", texte)
+	}
+	return niveau, nil
+}
+
+// lireNiveaux décode les entrées composant=niveau
+func lireNiveaux(entrees []string) (map[string]slog.Level, error) {
+	niveaux := make(map[string]slog.Level, len(entrees))
+	for _, entree := range entrees {
+		composant, texte, ok := strings.Cut(entree, "=")
+		if !ok || composant == "" {
+			return nil, fmt.Errorf("%q: attendu composant=niveau", entree)
+		}
+		niveau, err := lireNiveau(texte)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", composant, err)
+		}
+		niveaux[composant] = niveau
+	}
+	return niveaux, nil
+}
+
+// filtre applique le niveau du composant, connu dès que le logger reçoit le champ component
+type filtre struct {
+	suivant slog.Handler
+	defaut  slog.Level
+	niveau  slog.Level
+	niveaux map[string]slog.Level
+}
+
+func (f *filtre) Enabled(_ context.Context, niveau slog.Level) bool {
+	return niveau >= f.niveau
+}
+
+func (f *filtre) Handle(ctx context.Context, r slog.Record) error {
+	return f.suivant.Handle(ctx, r)
+}
+
+func (f *filtre) WithAttrs(attrs []slog.Attr) slog.Handler {
+	copie := *f
+	copie.suivant = f.suivant.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == CleComposant {
+			copie.niveau = f.defaut
+			if niveau, ok := f.niveaux[a.Value.String()]; ok {
+				copie.niveau = niveau
+			}
+		}
+	}
+	return &copie
+}
+
+func (f *filtre) WithGroup(nom string) slog.Handler {
+	copie := *f
+	copie.suivant = f.suivant.WithGroup(nom)
+	return &copie
+}
+
+// multi envoie chaque message à plusieurs handlers
+type multi []slog.Handler
+
+func (m multi) Enabled(ctx context.Context, niveau slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, niveau) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multi) Handle(ctx context.Context, r slog.Record) error {
+	var erreurs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			erreurs = append(erreurs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(erreurs...)
+}
+
+func (m multi) WithAttrs(attrs []slog.Attr) slog.Handler {
+	copie := make(multi, len(m))
+	for i, h := range m {
+		copie[i] = h.WithAttrs(attrs)
+	}
+	return copie
+}
+
+func (m multi) WithGroup(nom string) slog.Handler {
+	copie := make(multi, len(m))
+	for i, h := range m {
+		copie[i] = h.WithGroup(nom)
+	}
+	return copie
+}
@@ -0,0 +1,172 @@
+package journalisation
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fichierTournant est un fichier de log renommé puis remplacé quand il dépasse sa taille
+// maximale ou sa durée d'ouverture. Les anciens fichiers portent la date de la rotation
+// (masterc_cb.log.20261019-104641.000), compressés en .gz si demandé.
+type fichierTournant struct {
+	chemin     string
+	tailleMax  int64         // 0: pas de rotation sur la taille
+	periode    time.Duration // 0: pas de rotation périodique
+	conserves  int
+	compresser bool
+
+	mu        sync.Mutex
+	f         *os.File
+	taille    int64
+	ouverture time.Time
+	renomme   string         // fichier tourné dans lequel on écrit encore, le nouveau n'a pas pu être ouvert
+	nettoyage sync.WaitGroup // compressions et suppressions en cours
+}
+
+func ouvrirFichierTournant(chemin string, tailleMax int64, periode time.Duration, conserves int, compresser bool) (*fichierTournant, error) {
+	ft := &fichierTournant{chemin: chemin, tailleMax: tailleMax, periode: periode, conserves: conserves, compresser: compresser}
+	if err := ft.ouvrir(); err != nil {
+		return nil, err
+	}
+	return ft, nil
+}
+
+func (ft *fichierTournant) ouvrir() error {
+	f, err := os.OpenFile(ft.chemin, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ft.f, ft.taille, ft.ouverture = f, info.Size(), time.Now()
+	return nil
+}
+
+func (ft *fichierTournant) Write(p []byte) (int, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.f == nil {
+		return 0, os.ErrClosed
+	}
+	depasse := ft.tailleMax > 0 && ft.taille > 0 && ft.taille+int64(len(p)) > ft.tailleMax
+	if ft.renomme != "" {
+		ft.rouvrir()
+	} else if depasse || (ft.periode > 0 && time.Since(ft.ouverture) >= ft.periode) {
+		if err := ft.tourner(); err != nil {
+			// on continue d'écrire dans le fichier actuel plutôt que de perdre le message
+			ft.ouverture = time.Now()
+		}
+	}
+	n, err := ft.f.Write(p)
+	ft.taille += int64(n)
+	return n, err
+}
+
+// tourner renomme le fichier actuel et en ouvre un nouveau
+func (ft *fichierTournant) tourner() error {
+	ancien := ft.chemin + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(ft.chemin, ancien); err != nil {
+		return err
+	}
+	ft.renomme = ancien
+	return ft.rouvrir()
+}
+
+// rouvrir remplace le fichier renommé par un nouveau fichier. Si l'ouverture échoue, on
+// garde l'ancien descripteur, les messages vont dans le fichier renommé, et Write
+// réessaie au message suivant.
+func (ft *fichierTournant) rouvrir() error {
+	precedent := ft.f
+	if err := ft.ouvrir(); err != nil {
+		return err
+	}
+	precedent.Close()
+	ancien := ft.renomme
+	ft.renomme = ""
+	ft.nettoyage.Add(1)
+	go func() {
+		defer ft.nettoyage.Done()
+		if ft.compresser {
+			compresserFichier(ancien)
+		}
+		ft.supprimerAnciens()
+	}()
+	return nil
+}
+
+// compresserFichier remplace chemin par chemin.gz
+func compresserFichier(chemin string) error {
+	source, err := os.Open(chemin)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.OpenFile(chemin+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(destination)
+	if _, err := io.Copy(gz, source); err != nil {
+		destination.Close()
+		os.Remove(chemin + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		destination.Close()
+		os.Remove(chemin + ".gz")
+		return err
+	}
+	if err := destination.Close(); err != nil {
+		return err
+	}
+	return os.Remove(chemin)
+}
+
+// supprimerAnciens ne garde que les conserves fichiers tournés les plus récents
+func (ft *fichierTournant) supprimerAnciens() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	anciens, err := filepath.Glob(ft.chemin + ".*")
+	if err != nil {
+		return
+	}
+	// une compression en cours laisse les deux fichiers: on ne compte que la date
+	dates := make(map[string][]string)
+	for _, chemin := range anciens {
+		date := strings.TrimSuffix(strings.TrimPrefix(chemin, ft.chemin+"."), ".gz")
+		dates[date] = append(dates[date], chemin)
+	}
+	ordre := make([]string, 0, len(dates))
+	for date := range dates {
+		ordre = append(ordre, date)
+	}
+	sort.Strings(ordre)
+	for len(ordre) > ft.conserves {
+		for _, chemin := range dates[ordre[0]] {
+			os.Remove(chemin)
+		}
+		ordre = ordre[1:]
+	}
+}
+
+// Close ferme le fichier après la fin des compressions en cours
+func (ft *fichierTournant) Close() error {
+	ft.nettoyage.Wait()
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.f == nil {
+		return nil
+	}
+	err := ft.f.Close()
+	ft.f = nil
+	return err
+}
@@ -0,0 +1,154 @@
+package journalisation
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lire(t *testing.T, chemin string) string {
+	t.Helper()
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contenu)
+}
+
+// lireTournes renvoie le contenu des fichiers tournés de chemin, du plus ancien au plus
+// récent, et s'ils sont compressés
+func lireTournes(t *testing.T, chemin string) (contenus []string, compresses []bool) {
+	t.Helper()
+	anciens, err := filepath.Glob(chemin + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(anciens)
+	for _, ancien := range anciens {
+		if !strings.HasSuffix(ancien, ".gz") {
+			contenus, compresses = append(contenus, lire(t, ancien)), append(compresses, false)
+			continue
+		}
+		f, err := os.Open(ancien)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contenu, err := io.ReadAll(gz)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contenus, compresses = append(contenus, string(contenu)), append(compresses, true)
+	}
+	return contenus, compresses
+}
+
+func TestFichierTournant(t *testing.T) {
+	cas := []struct {
+		nom        string
+		tailleMax  int64
+		periode    time.Duration
+		conserves  int
+		compresser bool
+		pause      time.Duration // entre deux messages
+		tournes    []string      // contenu attendu des fichiers tournés, du plus ancien
+		actuel     string
+	}{
+		{"sans rotation", 0, 0, 5, false, 0, nil, "m1\nm2\nm3\nm4\n"},
+		{"taille", 7, 0, 5, false, 0, []string{"m1\nm2\n"}, "m3\nm4\n"},
+		{"message plus grand que la taille", 2, 0, 5, false, 0, []string{"m1\n", "m2\n", "m3\n"}, "m4\n"},
+		{"période", 0, 100 * time.Millisecond, 5, false, 60 * time.Millisecond, []string{"m1\nm2\n", "m3\nm4\n"}, ""},
+		{"rétention", 3, 0, 2, false, 0, []string{"m2\n", "m3\n"}, "m4\n"},
+		{"compression", 7, 0, 5, true, 0, []string{"m1\nm2\n"}, "m3\nm4\n"},
+		{"compression et rétention", 3, 0, 1, true, 0, []string{"m3\n"}, "m4\n"},
+	}
+	for _, c := range cas {
+		t.Run(c.nom, func(t *testing.T) {
+			chemin := filepath.Join(t.TempDir(), "cb.log")
+			ft, err := ouvrirFichierTournant(chemin, c.tailleMax, c.periode, c.conserves, c.compresser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 4; i++ {
+				if _, err := fmt.Fprintf(ft, "m%d\n", i); err != nil {
+					t.Fatal(err)
+				}
+				// les fichiers tournés sont nommés à la milliseconde
+				time.Sleep(c.pause + 2*time.Millisecond)
+			}
+			// la période est mesurée à l'écriture: un dernier message vide la déclenche
+			if c.periode > 0 {
+				time.Sleep(c.periode)
+				ft.Write(nil)
+			}
+			if err := ft.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tournes, compresses := lireTournes(t, chemin)
+			if strings.Join(tournes, "|") != strings.Join(c.tournes, "|") {
+				t.Errorf("fichiers tournés %q, attendu %q", tournes, c.tournes)
+			}
+			for i, compresse := range compresses {
+				if compresse != c.compresser {
+					t.Errorf("fichier tourné %d compressé: %v", i, compresse)
+				}
+			}
+			if actuel := lire(t, chemin); actuel != c.actuel {
+				t.Errorf("fichier actuel %q, attendu %q", actuel, c.actuel)
+			}
+		})
+	}
+}
+
+// La réouverture qui suit la rotation échoue: les messages vont dans le fichier tourné,
+// puis dans le nouveau fichier dès qu'il peut être créé
+func TestFichierTournantReouverture(t *testing.T) {
+	chemin := filepath.Join(t.TempDir(), "cb.log")
+	ft, err := ouvrirFichierTournant(chemin, 0, 0, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ft.Close()
+	ft.Write([]byte("avant\n"))
+
+	// rotation dont la réouverture échoue: un dossier occupe le chemin du log
+	tourne := chemin + ".20261019-104641.000"
+	if err := os.Rename(chemin, tourne); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(chemin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ft.mu.Lock()
+	ft.renomme = tourne
+	err = ft.rouvrir()
+	ft.mu.Unlock()
+	if err == nil {
+		t.Fatal("la réouverture aurait dû échouer")
+	}
+	if _, err := ft.Write([]byte("pendant\n")); err != nil {
+		t.Fatalf("écriture perdue après l'échec de la réouverture: %v", err)
+	}
+
+	os.Remove(chemin)
+	if _, err := ft.Write([]byte("apres\n")); err != nil {
+		t.Fatal(err)
+	}
+	if contenu := lire(t, tourne); contenu != "avant\npendant\n" {
+		t.Errorf("fichier tourné: %q", contenu)
+	}
+	if contenu := lire(t, chemin); contenu != "apres\n" {
+		t.Errorf("nouveau fichier: %q", contenu)
+	}
+}
@@ -0,0 +1,173 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Fichiers de la CA dans son dossier
+const (
+	FichierCA    = "ca.pem"
+	FichierCleCA = "ca-key.pem"
+)
+
+// Usage d'un certificat émis par la CA
+type Usage int
+
+const (
+	UsageMaster Usage = iota // client: le master se connecte aux workers
+	UsageWorker              // serveur: le worker accepte les connexions du master
+)
+
+// InitCA crée la CA du cluster dans dossier. Une CA existante n'est pas écrasée.
+func InitCA(dossier, nom string, validite time.Duration) error {
+	if _, err := os.Stat(filepath.Join(dossier, FichierCleCA)); err == nil {
+		return fmt.Errorf("une CA existe déjà dans %s", dossier)
+	}
+	cle, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serie, err := numeroSerie()
+	if err != nil {
+		return err
+	}
+	modele := &x509.Certificate{
+		SerialNumber:          serie,
+		Subject:               pkix.Name{CommonName: nom},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validite),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, modele, modele, &cle.PublicKey, cle)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dossier, 0700); err != nil {
+		return err
+	}
+	if err := ecrireCle(filepath.Join(dossier, FichierCleCA), cle); err != nil {
+		return err
+	}
+	return ecrirePEM(filepath.Join(dossier, FichierCA), "CERTIFICATE", der, 0644)
+}
+
+// Emettre signe avec la CA de dossier un certificat nom.pem / nom-key.pem pour le master
+// ou un worker. hotes liste les noms et adresses IP par lesquels un worker est joint.
+// Les fichiers existants sont gardés en .old: réémettre un certificat suffit à le faire
+// tourner, les daemons relisent les fichiers modifiés.
+func Emettre(dossier, nom string, usage Usage, hotes []string, validite time.Duration) error {
+	ca, cleCA, err := chargerCleCA(dossier)
+	if err != nil {
+		return err
+	}
+	if usage == UsageWorker && len(hotes) == 0 {
+		return errors.New("au moins un nom d'hôte ou une adresse IP est nécessaire pour un worker")
+	}
+	cle, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serie, err := numeroSerie()
+	if err != nil {
+		return err
+	}
+	modele := &x509.Certificate{
+		SerialNumber: serie,
+		Subject:      pkix.Name{CommonName: nom},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validite),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if usage == UsageMaster {
+		modele.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		modele.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	for _, hote := range hotes {
+		if ip := net.ParseIP(hote); ip != nil {
+			modele.IPAddresses = append(modele.IPAddresses, ip)
+		} else {
+			modele.DNSNames = append(modele.DNSNames, hote)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, modele, ca, &cle.PublicKey, cleCA)
+	if err != nil {
+		return err
+	}
+
+	cert := filepath.Join(dossier, nom+".pem")
+	key := filepath.Join(dossier, nom+"-key.pem")
+	for _, fichier := range []string{cert, key} {
+		if err := os.Rename(fichier, fichier+".old"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// la clé est écrite avant le certificat, que les daemons surveillent
+	if err := ecrireCle(key, cle); err != nil {
+		return err
+	}
+	return ecrirePEM(cert, "CERTIFICATE", der, 0644)
+}
+
+func chargerCleCA(dossier string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pemCA, err := os.ReadFile(filepath.Join(dossier, FichierCA))
+	if err != nil {
+		return nil, nil, fmt.Errorf("CA introuvable, lancer d'abord \"ca init\": %v", err)
+	}
+	bloc, _ := pem.Decode(pemCA)
+	if bloc == nil {
+		return nil, nil, fmt.Errorf("%s illisible", FichierCA)
+	}
+	ca, err := x509.ParseCertificate(bloc.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	pemCle, err := os.ReadFile(filepath.Join(dossier, FichierCleCA))
+	if err != nil {
+		return nil, nil, err
+	}
+	bloc, _ = pem.Decode(pemCle)
+	if bloc == nil {
+		return nil, nil, fmt.Errorf("%s illisible", FichierCleCA)
+	}
+	cle, err := x509.ParseECPrivateKey(bloc.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, cle, nil
+}
+
+func numeroSerie() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func ecrireCle(chemin string, cle *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(cle)
+	if err != nil {
+		return err
+	}
+	return ecrirePEM(chemin, "EC PRIVATE KEY", der, 0600)
+}
+
+func ecrirePEM(chemin, typeBloc string, der []byte, mode os.FileMode) error {
+	temporaire := chemin + ".tmp"
+	if err := os.WriteFile(temporaire, pem.EncodeToMemory(&pem.Block{Type: typeBloc, Bytes: der}), mode); err != nil {
+		return err
+	}
+	return os.Rename(temporaire, chemin)
+}
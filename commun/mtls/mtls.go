@@ -0,0 +1,142 @@
+// Package mtls chiffre et authentifie les connexions entre le master et les workers:
+// chacun présente un certificat signé par la CA du cluster et vérifie celui de l'autre.
+// Les certificats sont émis par "master_test ca".
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config est la section tls du config.yaml du master et des workers, TLS est désactivé
+// si la section est absente
+type Config struct {
+	CA   string `yaml:"ca"`   // certificat de la CA du cluster
+	Cert string `yaml:"cert"` // certificat de ce daemon, signé par la CA
+	Key  string `yaml:"key"`  // clé privée du certificat
+}
+
+func (c Config) Active() bool {
+	return c.Cert != "" || c.Key != "" || c.CA != ""
+}
+
+// Certificat garde la paire certificat/clé en mémoire et la relit quand les fichiers
+// changent, pour que la rotation des certificats ne demande pas de redémarrage
+type Certificat struct {
+	cert, key string
+	mu        sync.Mutex
+	modifie   time.Time
+	paire     *tls.Certificate
+}
+
+func NouveauCertificat(cert, key string) (*Certificat, error) {
+	c := &Certificat{cert: cert, key: key}
+	if _, err := c.Charger(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Charger renvoie la paire en cours, relue si le certificat ou la clé ont été modifiés
+func (c *Certificat) Charger() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modifie, err := dateModification(c.cert, c.key)
+	if err != nil {
+		if c.paire != nil {
+			return c.paire, nil // fichiers en cours de remplacement, on garde l'ancienne paire
+		}
+		return nil, err
+	}
+	if c.paire != nil && !modifie.After(c.modifie) {
+		return c.paire, nil
+	}
+	paire, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		if c.paire != nil {
+			return c.paire, nil
+		}
+		return nil, fmt.Errorf("lecture du certificat %s impossible: %v", c.cert, err)
+	}
+	c.paire, c.modifie = &paire, modifie
+	return c.paire, nil
+}
+
+func dateModification(fichiers ...string) (time.Time, error) {
+	var derniere time.Time
+	for _, fichier := range fichiers {
+		info, err := os.Stat(fichier)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(derniere) {
+			derniere = info.ModTime()
+		}
+	}
+	return derniere, nil
+}
+
+// chargerCA lit le certificat de la CA du cluster
+func chargerCA(chemin string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, fmt.Errorf("lecture de la CA impossible: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("aucun certificat dans %s", chemin)
+	}
+	return pool, nil
+}
+
+// ClientConfig renvoie la configuration TLS du master pour se connecter aux workers:
+// le certificat du worker doit être signé par la CA et valide pour son adresse
+func ClientConfig(c Config) (*tls.Config, error) {
+	if c.CA == "" || c.Cert == "" || c.Key == "" {
+		return nil, fmt.Errorf("tls: ca, cert et key sont nécessaires")
+	}
+	pool, err := chargerCA(c.CA)
+	if err != nil {
+		return nil, err
+	}
+	certificat, err := NouveauCertificat(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificat.Charger()
+		},
+	}, nil
+}
+
+// ServeurConfig renvoie la configuration TLS du worker: seul un client présentant un
+// certificat du master signé par la CA peut envoyer des commandes
+func ServeurConfig(c Config) (*tls.Config, error) {
+	if c.CA == "" || c.Cert == "" || c.Key == "" {
+		return nil, fmt.Errorf("tls: ca, cert et key sont nécessaires")
+	}
+	pool, err := chargerCA(c.CA)
+	if err != nil {
+		return nil, err
+	}
+	certificat, err := NouveauCertificat(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS13,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificat.Charger()
+		},
+	}, nil
+}
@@ -0,0 +1,160 @@
+// Package signature signe les commandes envoyées aux workers. Chaque commande porte un
+// nonce, l'heure d'envoi et l'adresse du worker destinataire, signés avec la commande: le
+// worker rejette une commande falsifiée, trop ancienne, déjà reçue ou destinée à un autre.
+// Les clés sont créées par "master_test signkey".
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ConfigSignataire est la section signing du config.yaml du master, une seule clé est utilisée
+type ConfigSignataire struct {
+	HMACKey    string `yaml:"hmac_key"`    // fichier du secret partagé avec les workers
+	Ed25519Key string `yaml:"ed25519_key"` // fichier de la clé privée, les workers ont la clé publique
+}
+
+func (c ConfigSignataire) Active() bool {
+	return c.HMACKey != "" || c.Ed25519Key != ""
+}
+
+// Message renvoie les octets signés d'une commande, par le master et par le worker. worker est
+// l'adresse du worker destinataire telle que le master la joint: une commande signée pour un
+// worker est refusée par les autres. epoch est celle du bail du leader qui l'envoie.
+// execution porte l'environnement demandé par le job (image, venv, requirements).
+func Message(worker string, epoch int64, command string, args []string, jobID string, execution map[string]string, nonce string, timestamp int64) []byte {
+	if execution == nil {
+		execution = map[string]string{}
+	}
+	message, _ := json.Marshal([]any{"v3", worker, epoch, command, args, jobID, execution, nonce, timestamp})
+	return message
+}
+
+// Signataire signe les commandes avec la clé du master
+type Signataire struct {
+	hmac    []byte
+	ed25519 ed25519.PrivateKey
+}
+
+func ChargerSignataire(c ConfigSignataire) (*Signataire, error) {
+	switch {
+	case c.HMACKey != "" && c.Ed25519Key != "":
+		return nil, errors.New("signing: hmac_key et ed25519_key sont exclusifs")
+	case c.HMACKey != "":
+		secret, err := lireSecret(c.HMACKey)
+		if err != nil {
+			return nil, err
+		}
+		return &Signataire{hmac: secret}, nil
+	case c.Ed25519Key != "":
+		cle, err := lireClePrivee(c.Ed25519Key)
+		if err != nil {
+			return nil, err
+		}
+		return &Signataire{ed25519: cle}, nil
+	}
+	return nil, errors.New("signing: aucune clé configurée")
+}
+
+// Signer renvoie le nonce, l'heure d'envoi (unix ms) et la signature de la commande envoyée au worker
+func (s *Signataire) Signer(worker string, epoch int64, command string, args []string, jobID string, execution map[string]string) (nonce string, timestamp int64, sig string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce = hex.EncodeToString(b)
+	timestamp = time.Now().UnixMilli()
+	message := Message(worker, epoch, command, args, jobID, execution, nonce, timestamp)
+	if s.ed25519 != nil {
+		return nonce, timestamp, "ed25519:" + base64.StdEncoding.EncodeToString(ed25519.Sign(s.ed25519, message))
+	}
+	mac := hmac.New(sha256.New, s.hmac)
+	mac.Write(message)
+	return nonce, timestamp, "hmac-sha256:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// lireSecret lit un secret HMAC écrit en hexadécimal
+func lireSecret(chemin string) ([]byte, error) {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, fmt.Errorf("lecture du secret de signature impossible: %v", err)
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(contenu)))
+	if err != nil || len(secret) < 32 {
+		return nil, fmt.Errorf("%s: le secret doit faire au moins 32 octets en hexadécimal", chemin)
+	}
+	return secret, nil
+}
+
+func lireClePrivee(chemin string) (ed25519.PrivateKey, error) {
+	contenu, err := os.ReadFile(chemin)
+	if err != nil {
+		return nil, fmt.Errorf("lecture de la clé de signature impossible: %v", err)
+	}
+	bloc, _ := pem.Decode(contenu)
+	if bloc == nil {
+		return nil, fmt.Errorf("%s: pas de clé PEM", chemin)
+	}
+	cle, err := x509.ParsePKCS8PrivateKey(bloc.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privee, ok := cle.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: la clé n'est pas une clé Ed25519", chemin)
+	}
+	return privee, nil
+}
+
+// GenererHMAC écrit un nouveau secret partagé, à copier sur le master et les workers
+func GenererHMAC(chemin string) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	return ecrire(chemin, []byte(hex.EncodeToString(secret)+"\n"), 0600)
+}
+
+// GenererEd25519 écrit une paire de clés: la privée pour le master, la publique pour les workers
+func GenererEd25519(privee, publique string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	derPriv, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	derPub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if err := ecrire(privee, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derPriv}), 0600); err != nil {
+		return err
+	}
+	return ecrire(publique, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derPub}), 0644)
+}
+
+// ecrire crée un fichier de clé sans écraser une clé existante
+func ecrire(chemin string, contenu []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(chemin, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contenu); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,158 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigVerificateur est la section signing du config.yaml du worker. Si une clé est configurée,
+// les commandes non signées sont refusées.
+type ConfigVerificateur struct {
+	HMACKey          string        `yaml:"hmac_key"`           // fichier du secret partagé avec le master
+	Ed25519PublicKey string        `yaml:"ed25519_public_key"` // fichier de la clé publique du master
+	MaxAge           time.Duration `yaml:"max_age"`            // écart toléré avec l'heure d'envoi, 30s par défaut
+	// Adresses de ce worker dans workers_ip du master: les commandes signées pour une autre
+	// adresse sont refusées. Par défaut, le nom de la machine et ses adresses IP avec le port
+	// d'écoute, voir le worker.
+	Addresses []string `yaml:"addresses"`
+}
+
+func (c ConfigVerificateur) Active() bool {
+	return c.HMACKey != "" || c.Ed25519PublicKey != ""
+}
+
+// Raisons de refus d'une commande
+var (
+	ErrNonSignee = errors.New("commande non signée")
+	ErrSignature = errors.New("signature invalide")
+	ErrPerimee   = errors.New("commande périmée")
+	ErrRejouee   = errors.New("commande rejouée")
+	// ErrDestinataire: la commande a été signée pour un autre worker
+	ErrDestinataire = errors.New("commande destinée à un autre worker")
+)
+
+// Verificateur vérifie les signatures et garde les nonces reçus le temps de leur validité
+type Verificateur struct {
+	hmac    []byte
+	ed25519 ed25519.PublicKey
+	maxAge  time.Duration
+	// adresses acceptées comme destinataire, en minuscules
+	adresses map[string]bool
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // nonce -> fin de validité
+	purge  time.Time
+}
+
+func ChargerVerificateur(c ConfigVerificateur) (*Verificateur, error) {
+	v := &Verificateur{maxAge: c.MaxAge, nonces: make(map[string]time.Time), adresses: make(map[string]bool)}
+	if v.maxAge <= 0 {
+		v.maxAge = 30 * time.Second
+	}
+	if len(c.Addresses) == 0 {
+		return nil, errors.New("signing: aucune adresse de worker (addresses)")
+	}
+	for _, adresse := range c.Addresses {
+		if _, _, err := net.SplitHostPort(adresse); err != nil {
+			return nil, fmt.Errorf("signing: adresse %q invalide, attendu hôte:port", adresse)
+		}
+		v.adresses[strings.ToLower(adresse)] = true
+	}
+	switch {
+	case c.HMACKey != "" && c.Ed25519PublicKey != "":
+		return nil, errors.New("signing: hmac_key et ed25519_public_key sont exclusifs")
+	case c.HMACKey != "":
+		secret, err := lireSecret(c.HMACKey)
+		if err != nil {
+			return nil, err
+		}
+		v.hmac = secret
+	case c.Ed25519PublicKey != "":
+		contenu, err := os.ReadFile(c.Ed25519PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("lecture de la clé publique impossible: %v", err)
+		}
+		bloc, _ := pem.Decode(contenu)
+		if bloc == nil {
+			return nil, fmt.Errorf("%s: pas de clé PEM", c.Ed25519PublicKey)
+		}
+		cle, err := x509.ParsePKIXPublicKey(bloc.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publique, ok := cle.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: la clé n'est pas une clé Ed25519", c.Ed25519PublicKey)
+		}
+		v.ed25519 = publique
+	default:
+		return nil, errors.New("signing: aucune clé configurée")
+	}
+	return v, nil
+}
+
+// Verifier renvoie une erreur ErrNonSignee, ErrSignature, ErrDestinataire, ErrPerimee ou
+// ErrRejouee si la commande doit être refusée. worker et epoch sont l'adresse destinataire et
+// l'epoch du leader portées par la commande.
+func (v *Verificateur) Verifier(worker string, epoch int64, command string, args []string, jobID string, execution map[string]string, nonce string, timestamp int64, sig string) error {
+	if sig == "" || nonce == "" || timestamp == 0 {
+		return ErrNonSignee
+	}
+	message := Message(worker, epoch, command, args, jobID, execution, nonce, timestamp)
+	algo, valeur, _ := strings.Cut(sig, ":")
+	signature, err := base64.StdEncoding.DecodeString(valeur)
+	if err != nil {
+		return ErrSignature
+	}
+	switch {
+	case algo == "ed25519" && v.ed25519 != nil:
+		if !ed25519.Verify(v.ed25519, message, signature) {
+			return ErrSignature
+		}
+	case algo == "hmac-sha256" && v.hmac != nil:
+		mac := hmac.New(sha256.New, v.hmac)
+		mac.Write(message)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrSignature
+		}
+	default:
+		return ErrSignature
+	}
+
+	// la signature est valide: on vérifie le destinataire, la fraîcheur puis l'unicité du nonce
+	if !v.adresses[strings.ToLower(worker)] {
+		return ErrDestinataire
+	}
+	maintenant := time.Now()
+	envoi := time.UnixMilli(timestamp)
+	if envoi.Before(maintenant.Add(-v.maxAge)) || envoi.After(maintenant.Add(v.maxAge)) {
+		return ErrPerimee
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if maintenant.After(v.purge) {
+		for n, fin := range v.nonces {
+			if maintenant.After(fin) {
+				delete(v.nonces, n)
+			}
+		}
+		v.purge = maintenant.Add(v.maxAge)
+	}
+	if _, vu := v.nonces[nonce]; vu {
+		return ErrRejouee
+	}
+	// une commande plus ancienne que maxAge est périmée, le nonce peut être oublié ensuite
+	v.nonces[nonce] = envoi.Add(v.maxAge)
+	return nil
+}
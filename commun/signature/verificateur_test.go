@@ -0,0 +1,132 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signerA signe une commande pour worker avec l'heure d'envoi donnée, ce que Signer ne
+// permet pas
+func signerA(s *Signataire, worker string, epoch int64, command string, args []string, nonce string, envoi time.Time) string {
+	mac := hmac.New(sha256.New, s.hmac)
+	mac.Write(Message(worker, epoch, command, args, "job-1", nil, nonce, envoi.UnixMilli()))
+	return "hmac-sha256:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifier(t *testing.T) {
+	cle := filepath.Join(t.TempDir(), "hmac.key")
+	if err := GenererHMAC(cle); err != nil {
+		t.Fatal(err)
+	}
+	signataire, err := ChargerSignataire(ConfigSignataire{HMACKey: cle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verificateur, err := ChargerVerificateur(ConfigVerificateur{HMACKey: cle, MaxAge: 30 * time.Second, Addresses: []string{"Worker1:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	maintenant := time.Now()
+	args := []string{"a.laz"}
+
+	type commande struct {
+		worker string
+		args   []string
+		nonce  string
+		envoi  time.Time
+		sig    string
+	}
+	valide := func(nonce string) commande {
+		return commande{"worker1:8080", args, nonce, maintenant, signerA(signataire, "worker1:8080", 3, "run_python", args, nonce, maintenant)}
+	}
+	cas := []struct {
+		nom     string
+		cmd     commande
+		attendu error
+	}{
+		{"signée", valide("n1"), nil},
+		{"rejouée", valide("n1"), ErrRejouee},
+		{"non signée", commande{"worker1:8080", args, "n2", maintenant, ""}, ErrNonSignee},
+		{"signature falsifiée", commande{"worker1:8080", args, "n3", maintenant, "hmac-sha256:" + base64.StdEncoding.EncodeToString([]byte("faux"))}, ErrSignature},
+		{"signature illisible", commande{"worker1:8080", args, "n4", maintenant, "hmac-sha256:pas du base64"}, ErrSignature},
+		{"algorithme inconnu", commande{"worker1:8080", args, "n5", maintenant, "rsa:" + base64.StdEncoding.EncodeToString([]byte("x"))}, ErrSignature},
+		{"arguments modifiés", func() commande { c := valide("n6"); c.args = []string{"b.laz"}; return c }(), ErrSignature},
+		{"autre worker", func() commande {
+			c := valide("n7")
+			c.worker = "worker2:8080"
+			c.sig = signerA(signataire, c.worker, 3, "run_python", args, c.nonce, c.envoi)
+			return c
+		}(), ErrDestinataire},
+		{"destinataire réécrit", func() commande { c := valide("n8"); c.worker = "worker2:8080"; return c }(), ErrSignature},
+		{"périmée", commande{"worker1:8080", args, "n9", maintenant.Add(-time.Minute),
+			signerA(signataire, "worker1:8080", 3, "run_python", args, "n9", maintenant.Add(-time.Minute))}, ErrPerimee},
+		{"datée du futur", commande{"worker1:8080", args, "n10", maintenant.Add(time.Minute),
+			signerA(signataire, "worker1:8080", 3, "run_python", args, "n10", maintenant.Add(time.Minute))}, ErrPerimee},
+		{"nonce d'une commande refusée", valide("n9"), nil},
+	}
+	for _, c := range cas {
+		err := verificateur.Verifier(c.cmd.worker, 3, "run_python", c.cmd.args, "job-1", nil, c.cmd.nonce, c.cmd.envoi.UnixMilli(), c.cmd.sig)
+		if !errors.Is(err, c.attendu) || (c.attendu == nil && err != nil) {
+			t.Errorf("%s: %v, attendu %v", c.nom, err, c.attendu)
+		}
+	}
+}
+
+func TestVerifierEd25519(t *testing.T) {
+	dossier := t.TempDir()
+	privee, publique := filepath.Join(dossier, "sign.key"), filepath.Join(dossier, "sign.pub")
+	if err := GenererEd25519(privee, publique); err != nil {
+		t.Fatal(err)
+	}
+	signataire, err := ChargerSignataire(ConfigSignataire{Ed25519Key: privee})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verificateur, err := ChargerVerificateur(ConfigVerificateur{Ed25519PublicKey: publique, Addresses: []string{"10.0.0.5:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	execution := map[string]string{"image": "registry.local/pdal:2.6"}
+
+	nonce, ts, sig := signataire.Signer("10.0.0.5:8080", 2, "run_python", []string{"a.laz"}, "job-1", execution)
+	if err := verificateur.Verifier("10.0.0.5:8080", 2, "run_python", []string{"a.laz"}, "job-1", execution, nonce, ts, sig); err != nil {
+		t.Fatal("commande signée refusée:", err)
+	}
+	// l'epoch et l'environnement sont couverts par la signature
+	nonce, ts, sig = signataire.Signer("10.0.0.5:8080", 2, "run_python", []string{"a.laz"}, "job-1", execution)
+	if err := verificateur.Verifier("10.0.0.5:8080", 3, "run_python", []string{"a.laz"}, "job-1", execution, nonce, ts, sig); !errors.Is(err, ErrSignature) {
+		t.Fatalf("epoch modifiée: %v, attendu ErrSignature", err)
+	}
+	if err := verificateur.Verifier("10.0.0.5:8080", 2, "run_python", []string{"a.laz"}, "job-1", nil, nonce, ts, sig); !errors.Is(err, ErrSignature) {
+		t.Fatalf("image retirée: %v, attendu ErrSignature", err)
+	}
+}
+
+func TestChargerVerificateur(t *testing.T) {
+	cle := filepath.Join(t.TempDir(), "hmac.key")
+	if err := GenererHMAC(cle); err != nil {
+		t.Fatal(err)
+	}
+	cas := []struct {
+		nom    string
+		config ConfigVerificateur
+		valide bool
+	}{
+		{"hmac", ConfigVerificateur{HMACKey: cle, Addresses: []string{"w:8080"}}, true},
+		{"sans adresse", ConfigVerificateur{HMACKey: cle}, false},
+		{"adresse sans port", ConfigVerificateur{HMACKey: cle, Addresses: []string{"w"}}, false},
+		{"deux clés", ConfigVerificateur{HMACKey: cle, Ed25519PublicKey: cle, Addresses: []string{"w:8080"}}, false},
+		{"clé absente", ConfigVerificateur{HMACKey: cle + ".absent", Addresses: []string{"w:8080"}}, false},
+		{"clé publique illisible", ConfigVerificateur{Ed25519PublicKey: cle, Addresses: []string{"w:8080"}}, false},
+	}
+	for _, c := range cas {
+		if _, err := ChargerVerificateur(c.config); (err == nil) != c.valide {
+			t.Errorf("%s: erreur %v", c.nom, err)
+		}
+	}
+}
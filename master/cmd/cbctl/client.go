@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client appelle l'API HTTP du master
+type client struct {
+	url         string
+	jeton       string
+	utilisateur string
+	motDePasse  string
+	http        *http.Client
+
+	leader *url.URL // API du leader, lue avec GET /leader à la première redirection
+}
+
+func nouveauClient(adresse, jeton, utilisateur string) *client {
+	c := &client{url: adresse, jeton: jeton}
+	c.utilisateur, c.motDePasse, _ = strings.Cut(utilisateur, ":")
+	c.http = &http.Client{
+		// un master qui n'est pas leader redirige les actions vers le leader: les
+		// identifiants ne suivent la redirection que vers l'adresse du leader annoncée par
+		// le master configuré, jamais vers une autre machine
+		CheckRedirect: func(r *http.Request, precedentes []*http.Request) error {
+			if len(precedentes) >= 5 {
+				return fmt.Errorf("trop de redirections")
+			}
+			if leader, err := c.urlLeader(); err == nil && memeServeur(r.URL, leader) {
+				c.authentifier(r)
+			} else {
+				// net/http garde l'en-tête pour un autre port de la même machine
+				r.Header.Del("Authorization")
+			}
+			return nil
+		},
+	}
+	return c
+}
+
+// urlLeader renvoie l'adresse de l'API du leader, celle du master configuré s'il est
+// leader ou si le leader n'annonce pas d'adresse
+func (c *client) urlLeader() (*url.URL, error) {
+	if c.leader != nil {
+		return c.leader, nil
+	}
+	r, err := http.NewRequest("GET", c.url+"/leader", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authentifier(r)
+	// requête sans redirection, avec son propre client pour ne pas repasser par CheckRedirect
+	reponse, err := (&http.Client{Timeout: 10 * time.Second, Transport: c.http.Transport}).Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer reponse.Body.Close()
+	if reponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /leader: %s", reponse.Status)
+	}
+	var etat struct {
+		Leader bool `json:"leader"`
+		Bail   struct {
+			URL string `json:"url"`
+		} `json:"lease"`
+	}
+	if err := json.NewDecoder(reponse.Body).Decode(&etat); err != nil {
+		return nil, fmt.Errorf("réponse de GET /leader illisible: %v", err)
+	}
+	adresse := c.url
+	if !etat.Leader && etat.Bail.URL != "" {
+		adresse = strings.TrimRight(etat.Bail.URL, "/")
+	}
+	if c.leader, err = url.Parse(adresse); err != nil {
+		return nil, err
+	}
+	return c.leader, nil
+}
+
+// memeServeur indique si a et b désignent le même serveur, schéma compris
+func memeServeur(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+func (c *client) authentifier(r *http.Request) {
+	if c.jeton != "" {
+		r.Header.Set("Authorization", "Bearer "+c.jeton)
+	} else if c.utilisateur != "" {
+		r.SetBasicAuth(c.utilisateur, c.motDePasse)
+	}
+}
+
+// requete envoie la requête et renvoie la réponse si son statut est un succès
+func (c *client) requete(methode, chemin string, corps io.Reader, typeContenu string, delai time.Duration) (*http.Response, error) {
+	r, err := http.NewRequest(methode, c.url+chemin, corps)
+	if err != nil {
+		return nil, err
+	}
+	if typeContenu != "" {
+		r.Header.Set("Content-Type", typeContenu)
+	}
+	c.authentifier(r)
+	c.http.Timeout = delai
+	reponse, err := c.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if reponse.StatusCode >= 300 {
+		defer reponse.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(reponse.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s (%s)", methode, chemin, strings.TrimSpace(string(message)), reponse.Status)
+	}
+	return reponse, nil
+}
+
+// json envoie corps en JSON (s'il n'est pas nil) et décode la réponse dans resultat
+func (c *client) json(methode, chemin string, corps, resultat any) error {
+	var lecteur io.Reader
+	typeContenu := ""
+	if corps != nil {
+		contenu, err := json.Marshal(corps)
+		if err != nil {
+			return err
+		}
+		lecteur, typeContenu = bytes.NewReader(contenu), "application/json"
+	}
+	reponse, err := c.requete(methode, chemin, lecteur, typeContenu, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer reponse.Body.Close()
+	if resultat == nil || reponse.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(reponse.Body).Decode(resultat); err != nil && err != io.EOF {
+		return fmt.Errorf("réponse du master illisible: %v", err)
+	}
+	return nil
+}
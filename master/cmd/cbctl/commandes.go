@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Réponses de l'API du master, limitées aux champs affichés par cbctl
+
+type drain struct {
+	Since    int64 `json:"since"`
+	Deadline int64 `json:"deadline,omitempty"`
+}
+
+type worker struct {
+	Address        string             `json:"address"`
+	CPUUsage       map[string]float64 `json:"cpu_usage"`
+	MemoryUsage    float64            `json:"memory_usage"`
+	Machine        string             `json:"nom_machine"`
+	DateConnection string             `json:"date_connection"`
+	Drain          *drain             `json:"drain,omitempty"`
+}
+
+type commande struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Image   string   `json:"image,omitempty"`
+	Venv    string   `json:"venv,omitempty"`
+	// Requirements est le contenu du requirements.txt du job
+	Requirements string `json:"requirements,omitempty"`
+}
+
+type progression struct {
+	Percent float64 `json:"percent"`
+	Stage   string  `json:"stage,omitempty"`
+}
+
+type ressources struct {
+	ExitCode    int     `json:"exit_code"`
+	WallSeconds float64 `json:"wall_seconds"`
+	MaxRSSBytes int64   `json:"max_rss_bytes"`
+}
+
+type job struct {
+	ID          string       `json:"id"`
+	WorkerAddr  string       `json:"worker_addr"`
+	Command     commande     `json:"command"`
+	State       string       `json:"state"`
+	Error       string       `json:"error,omitempty"`
+	CreatedAt   int64        `json:"created_at"`
+	StartedAt   int64        `json:"started_at,omitempty"`
+	FinishedAt  int64        `json:"finished_at,omitempty"`
+	Progress    *progression `json:"progress,omitempty"`
+	Resources   *ressources  `json:"resources,omitempty"`
+	ETA         int64        `json:"eta,omitempty"`
+	Attempts    int          `json:"attempts"`
+	SubmittedBy string       `json:"submitted_by,omitempty"`
+}
+
+type ligneLog struct {
+	Seq       int64  `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+	Stream    string `json:"stream"`
+	Text      string `json:"text"`
+}
+
+type historique struct {
+	JobID        string   `json:"job_id"`
+	WorkerAddr   string   `json:"worker_addr"`
+	Command      string   `json:"command"`
+	Args         []string `json:"args"`
+	Timestamp    int64    `json:"timestamp"`
+	Status       string   `json:"status"`
+	ErrorMessage string   `json:"error_message"`
+	ExitCode     int32    `json:"exit_code"`
+	WallSeconds  float64  `json:"wall_seconds"`
+}
+
+type point struct {
+	Timestamp int64              `json:"t"`
+	Values    map[string]float64 `json:"values"`
+}
+
+func commandeWorkers(c *client, args []string) error {
+	f := drapeaux("workers", "")
+	f.Parse(args)
+
+	var workers map[string]worker
+	if err := c.json("GET", "/workers", nil, &workers); err != nil {
+		return err
+	}
+	var jobs []job
+	if err := c.json("GET", "/jobs", nil, &jobs); err != nil {
+		return err
+	}
+	enCours := make(map[string]int)
+	for _, j := range jobs {
+		if j.State == "running" {
+			enCours[j.WorkerAddr]++
+		}
+	}
+
+	adresses := make([]string, 0, len(workers))
+	for adresse := range workers {
+		adresses = append(adresses, adresse)
+	}
+	sort.Strings(adresses)
+	t := tableau{entetes: []string{"WORKER", "MACHINE", "CPU %", "MEMOIRE %", "JOBS", "ETAT", "CONNECTE DEPUIS"}}
+	for _, adresse := range adresses {
+		w := workers[adresse]
+		cpu := 0.0
+		for _, usage := range w.CPUUsage {
+			cpu += usage
+		}
+		if len(w.CPUUsage) > 0 {
+			cpu /= float64(len(w.CPUUsage))
+		}
+		etat := "disponible"
+		if w.Drain != nil {
+			etat = "maintenance"
+			if w.Drain.Deadline != 0 {
+				etat += " jusqu'à " + date(w.Drain.Deadline)
+			}
+		}
+		t.ajouter(adresse, w.Machine, pourcentage(cpu), pourcentage(w.MemoryUsage), strconv.Itoa(enCours[adresse]), etat, w.DateConnection)
+	}
+	return afficher(workers, t)
+}
+
+func commandeMetrics(c *client, args []string) error {
+	f := drapeaux("metrics", "<worker>")
+	from := f.String("from", "-1h", "début: timestamp unix ou durée relative")
+	to := f.String("to", "", "fin: timestamp unix ou durée relative (maintenant par défaut)")
+	step := f.String("step", "", "intervalle d'agrégation (ex: 5m)")
+	f.Parse(args)
+	adresse := argumentUnique(f)
+
+	q := url.Values{}
+	for cle, valeur := range map[string]string{"from": *from, "to": *to, "step": *step} {
+		if valeur != "" {
+			q.Set(cle, valeur)
+		}
+	}
+	var reponse struct {
+		Points []point `json:"points"`
+	}
+	if err := c.json("GET", "/workers/"+url.PathEscape(adresse)+"/metrics?"+q.Encode(), nil, &reponse); err != nil {
+		return err
+	}
+
+	series := make(map[string]bool)
+	for _, p := range reponse.Points {
+		for serie := range p.Values {
+			series[serie] = true
+		}
+	}
+	t := tableau{entetes: []string{"DATE"}}
+	for serie := range series {
+		t.entetes = append(t.entetes, serie)
+	}
+	sort.Strings(t.entetes[1:])
+	for _, p := range reponse.Points {
+		ligne := []string{date(p.Timestamp)}
+		for _, serie := range t.entetes[1:] {
+			ligne = append(ligne, strconv.FormatFloat(p.Values[serie], 'f', 1, 64))
+		}
+		t.ajouter(ligne...)
+	}
+	return afficher(reponse, t)
+}
+
+func commandeJobs(c *client, args []string) error {
+	f := drapeaux("jobs", "")
+	etat := f.String("state", "", "n'afficher que les jobs dans cet état (queued, running, success, failed, canceled)")
+	adresse := f.String("worker", "", "n'afficher que les jobs de ce worker")
+	f.Parse(args)
+
+	var jobs []job
+	if err := c.json("GET", "/jobs", nil, &jobs); err != nil {
+		return err
+	}
+	filtres := []job{}
+	for _, j := range jobs {
+		if (*etat == "" || j.State == *etat) && (*adresse == "" || j.WorkerAddr == *adresse) {
+			filtres = append(filtres, j)
+		}
+	}
+	t := tableau{entetes: []string{"ID", "ETAT", "WORKER", "ARGUMENTS", "CREE", "AVANCEMENT", "FIN PREVUE", "PAR"}}
+	for _, j := range filtres {
+		avancement := ""
+		if j.Progress != nil {
+			avancement = pourcentage(j.Progress.Percent) + "%"
+		}
+		t.ajouter(j.ID, j.State, j.WorkerAddr, strings.Join(j.Command.Args, " "), date(j.CreatedAt), avancement, date(j.ETA), j.SubmittedBy)
+	}
+	return afficher(filtres, t)
+}
+
+func commandeJob(c *client, args []string) error {
+	f := drapeaux("job", "<id>")
+	f.Parse(args)
+	var j job
+	if err := c.json("GET", "/jobs/"+url.PathEscape(argumentUnique(f)), nil, &j); err != nil {
+		return err
+	}
+	return afficher(j, tableauJob(j))
+}
+
+// tableauJob présente un job champ par champ
+func tableauJob(j job) tableau {
+	t := tableau{entetes: []string{"CHAMP", "VALEUR"}}
+	t.ajouter("id", j.ID)
+	t.ajouter("etat", j.State)
+	t.ajouter("worker", j.WorkerAddr)
+	t.ajouter("commande", strings.TrimSpace(j.Command.Command+" "+strings.Join(j.Command.Args, " ")))
+	if j.Command.Image != "" {
+		t.ajouter("image", j.Command.Image)
+	}
+	if j.Command.Venv != "" {
+		t.ajouter("venv", j.Command.Venv)
+	}
+	if j.Command.Requirements != "" {
+		t.ajouter("requirements", strings.Join(strings.Fields(j.Command.Requirements), " "))
+	}
+	t.ajouter("soumis par", j.SubmittedBy)
+	t.ajouter("cree", date(j.CreatedAt))
+	t.ajouter("demarre", date(j.StartedAt))
+	t.ajouter("termine", date(j.FinishedAt))
+	t.ajouter("tentatives", strconv.Itoa(j.Attempts))
+	if j.Progress != nil {
+		t.ajouter("avancement", strings.TrimSpace(pourcentage(j.Progress.Percent)+"% "+j.Progress.Stage))
+	}
+	if j.ETA != 0 {
+		t.ajouter("fin prevue", date(j.ETA))
+	}
+	if j.Resources != nil {
+		t.ajouter("code de sortie", strconv.Itoa(j.Resources.ExitCode))
+		t.ajouter("duree", duree(j.Resources.WallSeconds))
+		t.ajouter("RSS max", fmt.Sprintf("%d Mo", j.Resources.MaxRSSBytes/(1024*1024)))
+	}
+	if j.Error != "" {
+		t.ajouter("erreur", j.Error)
+	}
+	return t
+}
+
+// commandeSubmit soumet un job. Avec -file, le fichier est envoyé dans le dossier data
+// du master et son nom devient l'argument du job.
+func commandeSubmit(c *client, args []string) error {
+	f := drapeaux("submit", "[-file fichier | arguments...]")
+	fichier := f.String("file", "", "fichier à envoyer dans le dossier data du master")
+	adresse := f.String("worker", "", "worker sur lequel lancer le job (choisi par le master sinon)")
+	image := f.String("image", "", "image du conteneur du job (celle du worker sinon)")
+	venv := f.String("venv", "", "environnement python existant sur le worker (chemin absolu)")
+	requirements := f.String("requirements", "", "requirements.txt dont le worker crée l'environnement python")
+	suivre := f.Bool("follow", false, "suivre les logs du job jusqu'à sa fin")
+	f.Parse(args)
+
+	environnement := map[string]string{"image": *image, "venv": *venv}
+	if *requirements != "" {
+		contenu, err := os.ReadFile(*requirements)
+		if err != nil {
+			return err
+		}
+		environnement["requirements"] = string(contenu)
+	}
+
+	var j job
+	if *fichier != "" {
+		if f.NArg() > 0 {
+			return fmt.Errorf("les arguments d'un job soumis avec -file sont le nom du fichier")
+		}
+		if err := envoyerFichier(c, *fichier, *adresse, environnement, &j); err != nil {
+			return err
+		}
+	} else {
+		if f.NArg() == 0 {
+			f.Usage()
+			os.Exit(2)
+		}
+		soumission := map[string]any{"worker_addr": *adresse, "args": f.Args()}
+		for cle, valeur := range environnement {
+			soumission[cle] = valeur
+		}
+		if err := c.json("POST", "/jobs", soumission, &j); err != nil {
+			return err
+		}
+	}
+	if !*suivre {
+		return afficher(j, tableauJob(j))
+	}
+	fmt.Fprintln(os.Stderr, "Job", j.ID, "soumis")
+	return suivreLogs(c, j.ID)
+}
+
+// envoyerFichier soumet un job avec le fichier chemin, les champs de environnement vides
+// ne sont pas envoyés
+func envoyerFichier(c *client, chemin, adresse string, environnement map[string]string, j *job) error {
+	source, err := os.Open(chemin)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// le corps lu au fil de l'envoi ne peut pas suivre une redirection d'un follower:
+	// le fichier est envoyé directement au leader
+	leader, err := c.urlLeader()
+	if err != nil {
+		return err
+	}
+	versLeader := *c
+	versLeader.url = leader.String()
+
+	// le fichier est lu au fil de l'envoi plutôt que chargé en mémoire
+	lecteur, ecrivain := io.Pipe()
+	formulaire := multipart.NewWriter(ecrivain)
+	go func() {
+		if adresse != "" {
+			if err := formulaire.WriteField("worker_addr", adresse); err != nil {
+				ecrivain.CloseWithError(err)
+				return
+			}
+		}
+		for cle, valeur := range environnement {
+			if valeur == "" {
+				continue
+			}
+			if err := formulaire.WriteField(cle, valeur); err != nil {
+				ecrivain.CloseWithError(err)
+				return
+			}
+		}
+		partie, err := formulaire.CreateFormFile("file", filepath.Base(chemin))
+		if err == nil {
+			_, err = io.Copy(partie, source)
+		}
+		if err == nil {
+			err = formulaire.Close()
+		}
+		ecrivain.CloseWithError(err)
+	}()
+
+	reponse, err := versLeader.requete("POST", "/jobs", lecteur, formulaire.FormDataContentType(), 0)
+	if err != nil {
+		return err
+	}
+	defer reponse.Body.Close()
+	return json.NewDecoder(reponse.Body).Decode(j)
+}
+
+func commandeLogs(c *client, args []string) error {
+	f := drapeaux("logs", "<id>")
+	suivre := f.Bool("f", false, "suivre les logs en direct jusqu'à la fin du job")
+	f.Parse(args)
+	id := argumentUnique(f)
+	if *suivre {
+		return suivreLogs(c, id)
+	}
+
+	var lignes []ligneLog
+	if err := c.json("GET", "/jobs/"+url.PathEscape(id)+"/logs", nil, &lignes); err != nil {
+		return err
+	}
+	if format == "table" {
+		for _, l := range lignes {
+			afficherLigne(l)
+		}
+		return nil
+	}
+	t := tableau{entetes: []string{"SEQ", "DATE", "FLUX", "TEXTE"}}
+	for _, l := range lignes {
+		t.ajouter(strconv.FormatInt(l.Seq, 10), date(l.Timestamp), l.Stream, l.Text)
+	}
+	return afficher(lignes, t)
+}
+
+// suivreLogs affiche les logs du job en direct (SSE) et renvoie une erreur si le job
+// ne se termine pas avec succès
+func suivreLogs(c *client, id string) error {
+	reponse, err := c.requete("GET", "/jobs/"+url.PathEscape(id)+"/logs?follow=true", nil, "", 0)
+	if err != nil {
+		return err
+	}
+	defer reponse.Body.Close()
+
+	csvEntetes := format == "csv"
+	lecteur := bufio.NewReader(reponse.Body)
+	var evenement string
+	for {
+		ligne, err := lecteur.ReadString('\n')
+		ligne = strings.TrimRight(ligne, "\r\n")
+		switch {
+		case strings.HasPrefix(ligne, "event: "):
+			evenement = strings.TrimPrefix(ligne, "event: ")
+		case strings.HasPrefix(ligne, "data: ") && evenement == "end":
+			etat := strings.TrimPrefix(ligne, "data: ")
+			fmt.Fprintln(os.Stderr, "Job", id, "terminé:", etat)
+			if etat != "success" {
+				return fmt.Errorf("job %s %s", id, etat)
+			}
+			return nil
+		case strings.HasPrefix(ligne, "data: "):
+			var l ligneLog
+			if json.Unmarshal([]byte(strings.TrimPrefix(ligne, "data: ")), &l) != nil {
+				continue
+			}
+			switch format {
+			case "json":
+				fmt.Println(strings.TrimPrefix(ligne, "data: "))
+			case "csv":
+				t := tableau{lignes: [][]string{{strconv.FormatInt(l.Seq, 10), date(l.Timestamp), l.Stream, l.Text}}}
+				if csvEntetes {
+					t.entetes, csvEntetes = []string{"SEQ", "DATE", "FLUX", "TEXTE"}, false
+				}
+				afficherCSV(t)
+			default:
+				afficherLigne(l)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("connexion au master fermée avant la fin du job")
+			}
+			return err
+		}
+	}
+}
+
+// afficherLigne écrit une ligne de log: sortie standard et erreurs du script telles
+// quelles, avancement et messages du master préfixés
+func afficherLigne(l ligneLog) {
+	switch l.Stream {
+	case "stdout":
+		fmt.Println(l.Text)
+	case "stderr":
+		fmt.Fprintln(os.Stderr, l.Text)
+	default:
+		fmt.Printf("[%s] %s\n", time.Unix(l.Timestamp, 0).Format("15:04:05"), l.Text)
+	}
+}
+
+func commandeCancel(c *client, args []string) error {
+	f := drapeaux("cancel", "<id>")
+	f.Parse(args)
+	var j job
+	if err := c.json("POST", "/jobs/"+url.PathEscape(argumentUnique(f))+"/cancel", nil, &j); err != nil {
+		return err
+	}
+	return afficher(j, tableauJob(j))
+}
+
+func commandeDrain(c *client, args []string) error {
+	f := drapeaux("drain", "<worker>")
+	echeance := f.String("deadline", "", "délai après lequel les jobs encore en cours sont relancés ailleurs (ex: 10m)")
+	f.Parse(args)
+	chemin := "/workers/" + url.PathEscape(argumentUnique(f)) + "/drain"
+	if *echeance != "" {
+		chemin += "?deadline=" + url.QueryEscape(*echeance)
+	}
+	var reponse map[string]any
+	if err := c.json("POST", chemin, nil, &reponse); err != nil {
+		return err
+	}
+	return afficherAction(reponse, "worker "+f.Arg(0)+" en maintenance")
+}
+
+func commandeUndrain(c *client, args []string) error {
+	f := drapeaux("undrain", "<worker>")
+	f.Parse(args)
+	var reponse map[string]any
+	if err := c.json("POST", "/workers/"+url.PathEscape(argumentUnique(f))+"/undrain", nil, &reponse); err != nil {
+		return err
+	}
+	return afficherAction(reponse, "worker "+f.Arg(0)+" remis en service")
+}
+
+// afficherAction affiche la réponse du master en json, un message sinon
+func afficherAction(reponse any, message string) error {
+	if format == "json" {
+		return afficher(reponse, tableau{})
+	}
+	return afficher(reponse, tableau{entetes: []string{"RESULTAT"}, lignes: [][]string{{message}}})
+}
+
+func commandeHistory(c *client, args []string) error {
+	f := drapeaux("history", "")
+	from := f.String("from", "", "début: timestamp unix, date (2006-01-02) ou durée relative (-24h)")
+	to := f.String("to", "", "fin, même format que -from")
+	adresse := f.String("worker", "", "worker")
+	nomCommande := f.String("command", "", "commande (run_python...)")
+	statut := f.String("status", "", "statut (success, failed, interrupted, canceled)")
+	limite := f.Int("limit", 100, "nombre maximal de lignes, 0 pour toutes")
+	f.Parse(args)
+
+	q := url.Values{}
+	for cle, valeur := range map[string]string{"from": *from, "to": *to} {
+		if valeur == "" {
+			continue
+		}
+		ts, err := instant(valeur)
+		if err != nil {
+			return err
+		}
+		q.Set(cle, strconv.FormatInt(ts, 10))
+	}
+	for cle, valeur := range map[string]string{"worker": *adresse, "command": *nomCommande, "status": *statut} {
+		if valeur != "" {
+			q.Set(cle, valeur)
+		}
+	}
+	if *limite > 0 {
+		q.Set("limit", strconv.Itoa(*limite))
+	}
+
+	var lignes []historique
+	if err := c.json("GET", "/history?"+q.Encode(), nil, &lignes); err != nil {
+		return err
+	}
+	t := tableau{entetes: []string{"DATE", "JOB", "WORKER", "COMMANDE", "ARGUMENTS", "STATUT", "CODE", "DUREE", "ERREUR"}}
+	for _, h := range lignes {
+		t.ajouter(date(h.Timestamp), h.JobID, h.WorkerAddr, h.Command, strings.Join(h.Args, " "), h.Status,
+			strconv.Itoa(int(h.ExitCode)), duree(h.WallSeconds), h.ErrorMessage)
+	}
+	return afficher(lignes, t)
+}
@@ -0,0 +1,96 @@
+// cbctl est le client en ligne de commande de l'API du master: workers, jobs,
+// maintenance et historique, sans passer par le dossier data ni les logs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: cbctl [-url URL] [-o table|json|csv] <commande> [options] [arguments]
+
+Commandes:
+  workers                         liste les workers, leur charge et leurs jobs en cours
+  metrics <worker>                relevés CPU / mémoire d'un worker (-from -6h, -to, -step 5m)
+  jobs                            liste les jobs (-state running, -worker ip:port)
+  job <id>                        détail d'un job
+  submit [-file f] [args...]      soumet un job, avec envoi du fichier dans data (-worker, -image, -venv, -requirements, -follow)
+  logs <id>                       logs d'un job (-f pour les suivre en direct)
+  cancel <id>                     annule un job en attente ou en cours
+  drain <worker>                  met un worker en maintenance (-deadline 10m)
+  undrain <worker>                remet un worker en service
+  history                         historique des commandes (-from, -to, -worker, -command, -status, -limit)
+
+Connexion au master: -url ou $MASTER_URL (http://localhost:8082 par défaut),
+authentification par $MASTER_TOKEN (jeton) ou $MASTER_USER (nom:mot_de_passe).
+`
+
+// format de sortie choisi avec -o, commun à toutes les commandes
+var format = "table"
+
+func main() {
+	global := flag.NewFlagSet("cbctl", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	url := global.String("url", envOuDefaut("MASTER_URL", "http://localhost:8082"), "adresse du master")
+	global.StringVar(&format, "o", format, "format de sortie: table, json ou csv")
+	global.Parse(os.Args[1:])
+
+	if global.NArg() < 1 {
+		global.Usage()
+		os.Exit(2)
+	}
+	c := nouveauClient(strings.TrimRight(*url, "/"), os.Getenv("MASTER_TOKEN"), os.Getenv("MASTER_USER"))
+
+	commandes := map[string]func(*client, []string) error{
+		"workers": commandeWorkers,
+		"metrics": commandeMetrics,
+		"jobs":    commandeJobs,
+		"job":     commandeJob,
+		"submit":  commandeSubmit,
+		"logs":    commandeLogs,
+		"cancel":  commandeCancel,
+		"drain":   commandeDrain,
+		"undrain": commandeUndrain,
+		"history": commandeHistory,
+	}
+	nom := global.Arg(0)
+	commande, ok := commandes[nom]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Commande inconnue:", nom)
+		global.Usage()
+		os.Exit(2)
+	}
+	if err := commande(c, global.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		os.Exit(1)
+	}
+}
+
+// drapeaux crée les options d'une commande, -o y est aussi accepté
+func drapeaux(nom, arguments string) *flag.FlagSet {
+	f := flag.NewFlagSet("cbctl "+nom, flag.ExitOnError)
+	f.StringVar(&format, "o", format, "format de sortie: table, json ou csv")
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cbctl %s [options] %s\n", nom, arguments)
+		f.PrintDefaults()
+	}
+	return f
+}
+
+// argumentUnique renvoie le seul argument attendu par la commande
+func argumentUnique(f *flag.FlagSet) string {
+	if f.NArg() != 1 {
+		f.Usage()
+		os.Exit(2)
+	}
+	return f.Arg(0)
+}
+
+func envOuDefaut(variable, defaut string) string {
+	if valeur := os.Getenv(variable); valeur != "" {
+		return valeur
+	}
+	return defaut
+}
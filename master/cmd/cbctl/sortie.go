@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// tableau est le rendu d'une réponse en lignes et colonnes, pour les formats table et csv
+type tableau struct {
+	entetes []string
+	lignes  [][]string
+}
+
+func (t *tableau) ajouter(cellules ...string) {
+	t.lignes = append(t.lignes, cellules)
+}
+
+// afficher écrit la réponse dans le format choisi: brute en json, sinon sous forme de tableau
+func afficher(brut any, t tableau) error {
+	switch format {
+	case "json":
+		encodeur := json.NewEncoder(os.Stdout)
+		encodeur.SetIndent("", "  ")
+		return encodeur.Encode(brut)
+	case "csv":
+		return afficherCSV(t)
+	case "table":
+		ecrivain := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(ecrivain, strings.Join(t.entetes, "\t"))
+		for _, ligne := range t.lignes {
+			fmt.Fprintln(ecrivain, strings.Join(ligne, "\t"))
+		}
+		return ecrivain.Flush()
+	}
+	return fmt.Errorf("format de sortie inconnu: %s", format)
+}
+
+// afficherCSV écrit les lignes du tableau en CSV, précédées des entêtes s'il y en a
+func afficherCSV(t tableau) error {
+	ecrivain := csv.NewWriter(os.Stdout)
+	if t.entetes != nil {
+		ecrivain.Write(t.entetes)
+	}
+	return ecrivain.WriteAll(t.lignes)
+}
+
+// date formate un timestamp unix, vide s'il est nul
+func date(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	if format == "csv" {
+		return time.Unix(ts, 0).Format(time.RFC3339)
+	}
+	return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+}
+
+func duree(secondes float64) string {
+	if secondes == 0 {
+		return ""
+	}
+	return (time.Duration(secondes * float64(time.Second))).Round(100 * time.Millisecond).String()
+}
+
+func pourcentage(valeur float64) string {
+	return fmt.Sprintf("%.1f", valeur)
+}
+
+// instant accepte un timestamp unix, une date (2006-01-02 ou RFC3339) ou une durée
+// relative à maintenant (-24h), et renvoie le timestamp unix correspondant
+func instant(valeur string) (int64, error) {
+	if ts, err := strconv.ParseInt(valeur, 10, 64); err == nil {
+		return ts, nil
+	}
+	for _, disposition := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(disposition, valeur, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	d, err := time.ParseDuration(valeur)
+	if err != nil {
+		return 0, fmt.Errorf("date invalide %q: timestamp, 2006-01-02, RFC3339 ou durée (-24h)", valeur)
+	}
+	return time.Now().Add(d).Unix(), nil
+}
@@ -0,0 +1,207 @@
+// Package estimation prédit la durée d'un job à partir de l'historique des commandes.
+//
+// Pour chaque tâche, la durée est modélisée par une régression linéaire sur la taille
+// des entrées (durée = a + b * octets) calculée sur des durées normalisées par la
+// vitesse de chaque worker. Le facteur de vitesse d'un worker est la moyenne du rapport
+// entre ses durées réelles et celles prédites par le modèle de la tâche (1 = vitesse
+// moyenne, 2 = deux fois plus lent). Les deux sont ajustés alternativement.
+package estimation
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// nombre d'ajustements alternés entre régressions et facteurs de vitesse
+const iterations = 5
+
+// Observations gardées, les plus anciennes sont oubliées: l'ajustement reste borné et suit
+// les changements de vitesse des workers
+const maxObservations = 5000
+
+// Observation est une exécution passée d'une tâche
+type Observation struct {
+	Task       string
+	Worker     string
+	InputBytes int64
+	Seconds    float64
+}
+
+// TaskModel est la régression d'une tâche: durée = Intercept + Slope * octets
+type TaskModel struct {
+	Intercept    float64 `json:"intercept_seconds"`
+	Slope        float64 `json:"seconds_per_byte"`
+	Observations int     `json:"observations"`
+}
+
+// Estimate est la durée prédite d'une tâche sur un worker
+type Estimate struct {
+	Task        string  `json:"task"`
+	Worker      string  `json:"worker"`
+	InputBytes  int64   `json:"input_bytes"`
+	Seconds     float64 `json:"seconds"`
+	WorkerSpeed float64 `json:"worker_speed_factor"`
+}
+
+// Model conserve les observations et les paramètres ajustés
+type Model struct {
+	mu           sync.Mutex
+	observations []Observation
+	taches       map[string]TaskModel
+	facteurs     map[string]float64
+	aJour        bool
+}
+
+func New() *Model {
+	return &Model{taches: map[string]TaskModel{}, facteurs: map[string]float64{}}
+}
+
+// Add ajoute une exécution terminée au modèle
+func (m *Model) Add(obs Observation) {
+	if obs.Seconds <= 0 || obs.Task == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, obs)
+	if len(m.observations) > maxObservations {
+		m.observations = m.observations[len(m.observations)-maxObservations:]
+	}
+	m.aJour = false
+}
+
+// Estimate prédit la durée de task sur worker pour des entrées de inputBytes octets.
+// Le booléen est faux si la tâche n'a jamais été observée.
+func (m *Model) Estimate(task, worker string, inputBytes int64) (Estimate, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ajuster()
+
+	tache, ok := m.taches[task]
+	if !ok {
+		return Estimate{}, false
+	}
+	facteur, ok := m.facteurs[worker]
+	if !ok {
+		facteur = 1 // worker jamais observé, supposé de vitesse moyenne
+	}
+	secondes := math.Max(tache.Intercept+tache.Slope*float64(inputBytes), 0) * facteur
+	return Estimate{Task: task, Worker: worker, InputBytes: inputBytes, Seconds: secondes, WorkerSpeed: facteur}, true
+}
+
+// Params renvoie les modèles de chaque tâche et les facteurs de vitesse des workers
+func (m *Model) Params() (map[string]TaskModel, map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ajuster()
+
+	taches := make(map[string]TaskModel, len(m.taches))
+	for k, v := range m.taches {
+		taches[k] = v
+	}
+	facteurs := make(map[string]float64, len(m.facteurs))
+	for k, v := range m.facteurs {
+		facteurs[k] = v
+	}
+	return taches, facteurs
+}
+
+// ajuster recalcule les paramètres si de nouvelles observations sont arrivées
+func (m *Model) ajuster() {
+	if m.aJour {
+		return
+	}
+	m.aJour = true
+
+	facteurs := make(map[string]float64)
+	for _, obs := range m.observations {
+		facteurs[obs.Worker] = 1
+	}
+	parTache := make(map[string][]Observation)
+	for _, obs := range m.observations {
+		parTache[obs.Task] = append(parTache[obs.Task], obs)
+	}
+
+	taches := make(map[string]TaskModel)
+	for i := 0; i < iterations; i++ {
+		for task, observations := range parTache {
+			taches[task] = regression(observations, facteurs)
+		}
+
+		// facteur de vitesse: moyenne géométrique des rapports durée réelle / durée prédite
+		sommes := make(map[string]float64)
+		nombres := make(map[string]int)
+		for _, obs := range m.observations {
+			tache := taches[obs.Task]
+			prevu := tache.Intercept + tache.Slope*float64(obs.InputBytes)
+			if prevu <= 0 {
+				continue
+			}
+			sommes[obs.Worker] += math.Log(obs.Seconds / prevu)
+			nombres[obs.Worker]++
+		}
+		for worker, n := range nombres {
+			facteurs[worker] = math.Exp(sommes[worker] / float64(n))
+		}
+		normaliser(facteurs)
+	}
+	m.taches = taches
+	m.facteurs = facteurs
+}
+
+// regression ajuste durée/facteur = a + b * octets par moindres carrés
+func regression(observations []Observation, facteurs map[string]float64) TaskModel {
+	n := float64(len(observations))
+	var sx, sy, sxx, sxy float64
+	for _, obs := range observations {
+		x := float64(obs.InputBytes)
+		y := obs.Seconds / facteurs[obs.Worker]
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	modele := TaskModel{Intercept: sy / n, Observations: len(observations)}
+	denominateur := n*sxx - sx*sx
+	// avec une seule taille d'entrée observée, on se contente de la durée moyenne
+	if denominateur <= 0 || math.Abs(denominateur) < 1e-9*n*sxx {
+		return modele
+	}
+	pente := (n*sxy - sx*sy) / denominateur
+	if pente < 0 {
+		// une durée qui diminue avec la taille n'a pas de sens, c'est du bruit
+		return modele
+	}
+	modele.Slope = pente
+	modele.Intercept = (sy - pente*sx) / n
+	if modele.Intercept < 0 {
+		// on force le passage par l'origine plutôt que de prédire des durées négatives
+		modele.Intercept = 0
+		if sxx > 0 {
+			modele.Slope = sxy / sxx
+		}
+	}
+	return modele
+}
+
+// normaliser ramène la moyenne géométrique des facteurs à 1 pour que les modèles des
+// tâches correspondent à un worker moyen
+func normaliser(facteurs map[string]float64) {
+	if len(facteurs) == 0 {
+		return
+	}
+	workers := make([]string, 0, len(facteurs))
+	for w := range facteurs {
+		workers = append(workers, w)
+	}
+	sort.Strings(workers)
+	var somme float64
+	for _, w := range workers {
+		somme += math.Log(facteurs[w])
+	}
+	moyenne := math.Exp(somme / float64(len(workers)))
+	for _, w := range workers {
+		facteurs[w] /= moyenne
+	}
+}
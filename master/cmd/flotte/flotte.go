@@ -0,0 +1,376 @@
+// Package flotte simule des workers dans le processus des tests: chaque worker écoute sur
+// un port local, parle le protocole du vrai worker (infos, vivantoupas, run_python,
+// attach, cancel, jobs) et suit un comportement scriptable (lent, en échec, qui coupe
+// la connexion, qui s'arrête, chargé). Les scripts ne sont pas lancés, leur sortie est
+// générée.
+package flotte
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ligne de fin d'un job réussi, identique à celle du vrai worker
+const LigneSucces = "T'as réussi bg le script s'est exécuté!"
+
+// Comportement décrit comment un worker simulé répond au master
+type Comportement struct {
+	CPU        float64       // charge CPU reportée par infos, en %
+	Memoire    float64       // mémoire utilisée reportée par infos, en %
+	Lignes     int           // lignes de sortie produites par un job
+	Intervalle time.Duration // délai avant chaque ligne: un worker lent
+	Echec      bool          // le script se termine en erreur
+	// CoupureApres ferme la connexion du master après ce nombre de lignes, une seule fois
+	// par job: le job continue et le master doit s'y rattacher
+	CoupureApres int
+	// Arret simule l'arrêt du worker pendant le job: Leaving puis Interrupted
+	Arret bool
+	// EnvironnementEnEchec fait échouer la préparation de l'environnement python des jobs
+	// qui en demandent un (venv, requirements): Erreur_env sans lancer le script
+	EnvironnementEnEchec bool
+}
+
+// Commande est la commande reçue du master
+type Commande struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	JobID   string   `json:"job_id,omitempty"`
+	// Environnement python demandé par le job
+	Venv         string `json:"venv,omitempty"`
+	Requirements string `json:"requirements,omitempty"`
+}
+
+type job struct {
+	id      string
+	sortie  []string
+	termine bool
+	debut   time.Time
+	fin     time.Time
+	coupe   bool // la connexion a déjà été coupée selon CoupureApres
+	annule  chan struct{}
+	nouveau *sync.Cond
+}
+
+// Worker est un worker simulé
+type Worker struct {
+	Addr string
+	Nom  string
+
+	mu           sync.Mutex
+	comportement Comportement
+	listener     net.Listener
+	connexions   map[net.Conn]struct{}
+	jobs         map[string]*job
+	recues       []Commande
+	lancements   map[string]int
+}
+
+// Demarrer lance un worker simulé sur un port libre de 127.0.0.1
+func Demarrer(nom string, c Comportement) (*Worker, error) {
+	w := &Worker{Nom: nom, comportement: c}
+	if err := w.ecouter("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	w.Addr = w.listener.Addr().String()
+	return w, nil
+}
+
+func (w *Worker) ecouter(adresse string) error {
+	listener, err := net.Listen("tcp", adresse)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.listener = listener
+	w.connexions = make(map[net.Conn]struct{})
+	w.jobs = make(map[string]*job)
+	w.lancements = make(map[string]int)
+	w.mu.Unlock()
+	go w.accepter(listener)
+	return nil
+}
+
+func (w *Worker) accepter(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		w.mu.Lock()
+		w.connexions[conn] = struct{}{}
+		w.mu.Unlock()
+		go w.servir(conn)
+	}
+}
+
+// Changer modifie le comportement du worker pour les prochaines commandes
+func (w *Worker) Changer(c Comportement) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.comportement = c
+}
+
+// Arreter simule la mort du worker: plus aucune connexion acceptée, celles en cours
+// coupées et les jobs perdus
+func (w *Worker) Arreter() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.listener != nil {
+		w.listener.Close()
+		w.listener = nil
+	}
+	for conn := range w.connexions {
+		conn.Close()
+	}
+	for _, j := range w.jobs {
+		if !j.termine {
+			close(j.annule)
+		}
+	}
+	w.jobs = make(map[string]*job)
+}
+
+// Redemarrer relance le worker sur la même adresse, sans ses jobs précédents
+func (w *Worker) Redemarrer() error {
+	return w.ecouter(w.Addr)
+}
+
+// Recues renvoie les commandes reçues depuis le démarrage du worker
+func (w *Worker) Recues() []Commande {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Commande(nil), w.recues...)
+}
+
+// Lancements renvoie le nombre de fois où le job a été lancé sur ce worker
+func (w *Worker) Lancements(jobID string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lancements[jobID]
+}
+
+func (w *Worker) servir(conn net.Conn) {
+	defer func() {
+		w.mu.Lock()
+		delete(w.connexions, conn)
+		w.mu.Unlock()
+		conn.Close()
+	}()
+	var cmd Commande
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&cmd); err != nil {
+		return
+	}
+	w.mu.Lock()
+	w.recues = append(w.recues, cmd)
+	c := w.comportement
+	w.mu.Unlock()
+
+	switch cmd.Command {
+	case "infos":
+		json.NewEncoder(conn).Encode(map[string]any{
+			"address":         w.Addr,
+			"cpu_usage":       map[string]float64{"cpu0": c.CPU},
+			"memory_usage":    c.Memoire,
+			"nom_machine":     w.Nom,
+			"date_connection": time.Now().Format("2006-01-02 15:04:05"),
+		})
+	case "vivantoupas":
+		json.NewEncoder(conn).Encode(map[string]string{"etat": "disponible", "commande_non_executee": ""})
+	case "run_python":
+		w.lancer(conn, cmd, c)
+	case "attach":
+		w.rattacher(conn, cmd)
+	case "cancel":
+		w.annuler(conn, cmd)
+	case "jobs":
+		w.lister(conn)
+	default:
+		fmt.Fprintln(conn, "Commande inconnue")
+	}
+}
+
+func (w *Worker) lancer(conn net.Conn, cmd Commande, c Comportement) {
+	if len(cmd.Args) < 1 {
+		fmt.Fprintln(conn, "Erreur: nombre d'arguments insuffisant")
+		return
+	}
+	if c.EnvironnementEnEchec && (cmd.Venv != "" || cmd.Requirements != "") {
+		fmt.Fprintln(conn, "Erreur_env: installation des requirements: aucune wheel ne correspond")
+		return
+	}
+	w.mu.Lock()
+	j, existe := w.jobs[cmd.JobID]
+	if !existe {
+		j = &job{id: cmd.JobID, debut: time.Now(), annule: make(chan struct{}), nouveau: sync.NewCond(&w.mu)}
+		w.jobs[cmd.JobID] = j
+		w.lancements[cmd.JobID]++
+	}
+	w.mu.Unlock()
+	if !existe {
+		go w.executer(j, c)
+	}
+	w.suivre(conn, j, 0, c.CoupureApres)
+}
+
+// executer produit la sortie du job selon le comportement
+func (w *Worker) executer(j *job, c Comportement) {
+	ajouter := func(ligne string) {
+		w.mu.Lock()
+		j.sortie = append(j.sortie, ligne)
+		j.nouveau.Broadcast()
+		w.mu.Unlock()
+	}
+	terminer := func(ligne string) {
+		w.mu.Lock()
+		j.sortie = append(j.sortie, ligne)
+		j.termine, j.fin = true, time.Now()
+		j.nouveau.Broadcast()
+		w.mu.Unlock()
+	}
+	debut := time.Now()
+	for i := 0; i < c.Lignes; i++ {
+		select {
+		case <-time.After(c.Intervalle):
+		case <-j.annule:
+			terminer("Erreur3: signal: killed")
+			return
+		}
+		ajouter(fmt.Sprintf("Output: ligne %d", i))
+		if c.Arret && i == c.Lignes/2 {
+			ajouter("Leaving: arrêt du worker simulé")
+			terminer("Interrupted: job tué par l'arrêt du worker")
+			return
+		}
+	}
+	code := 0
+	if c.Echec {
+		code = 1
+	}
+	ajouter(fmt.Sprintf(`Resources: {"exit_code":%d,"wall_seconds":%.3f}`, code, time.Since(debut).Seconds()))
+	if c.Echec {
+		terminer("Erreur3: exit status 1")
+		return
+	}
+	terminer(LigneSucces)
+}
+
+// suivre envoie la sortie du job à partir de la ligne depuis, comme le vrai worker, et
+// coupe la connexion après coupure lignes si demandé
+func (w *Worker) suivre(conn net.Conn, j *job, depuis, coupure int) {
+	if _, err := fmt.Fprintf(conn, "Attached: %d\n", depuis); err != nil {
+		return
+	}
+	for {
+		w.mu.Lock()
+		for depuis >= len(j.sortie) && !j.termine {
+			j.nouveau.Wait()
+		}
+		lignes := append([]string(nil), j.sortie[depuis:]...)
+		fini := j.termine
+		couper := coupure > 0 && !j.coupe && depuis+len(lignes) >= coupure
+		if couper {
+			j.coupe = true
+			lignes = lignes[:coupure-depuis]
+		}
+		w.mu.Unlock()
+
+		for _, ligne := range lignes {
+			if _, err := fmt.Fprintln(conn, ligne); err != nil {
+				return
+			}
+		}
+		depuis += len(lignes)
+		if couper || fini {
+			return
+		}
+	}
+}
+
+func (w *Worker) rattacher(conn net.Conn, cmd Commande) {
+	if len(cmd.Args) < 1 {
+		fmt.Fprintln(conn, "Erreur: nombre d'arguments insuffisant")
+		return
+	}
+	w.mu.Lock()
+	j, existe := w.jobs[cmd.Args[0]]
+	w.mu.Unlock()
+	if !existe {
+		fmt.Fprintln(conn, "Erreur: job inconnu "+cmd.Args[0])
+		return
+	}
+	depuis := 0
+	if len(cmd.Args) > 1 {
+		depuis, _ = strconv.Atoi(cmd.Args[1])
+	}
+	w.suivre(conn, j, depuis, 0)
+}
+
+func (w *Worker) annuler(conn net.Conn, cmd Commande) {
+	if len(cmd.Args) < 1 {
+		fmt.Fprintln(conn, "Erreur: nombre d'arguments insuffisant")
+		return
+	}
+	w.mu.Lock()
+	j, existe := w.jobs[cmd.Args[0]]
+	enCours := existe && !j.termine
+	if enCours {
+		close(j.annule)
+	}
+	w.mu.Unlock()
+	if !enCours {
+		fmt.Fprintln(conn, "Erreur: job inconnu "+cmd.Args[0])
+		return
+	}
+	fmt.Fprintln(conn, "Job annulé "+cmd.Args[0])
+}
+
+func (w *Worker) lister(conn net.Conn) {
+	w.mu.Lock()
+	liste := []map[string]any{}
+	for id, j := range w.jobs {
+		ligne := map[string]any{"job_id": id, "command": "run_python", "state": "running", "lines": len(j.sortie), "started_at": j.debut.Unix()}
+		if j.termine {
+			ligne["state"], ligne["finished_at"] = "finished", j.fin.Unix()
+		}
+		liste = append(liste, ligne)
+	}
+	w.mu.Unlock()
+	json.NewEncoder(conn).Encode(liste)
+}
+
+// Flotte est un ensemble de workers simulés
+type Flotte []*Worker
+
+// Lancer démarre n workers simulés avec le même comportement
+func Lancer(n int, c Comportement) (Flotte, error) {
+	var f Flotte
+	for i := 0; i < n; i++ {
+		w, err := Demarrer(fmt.Sprintf("simu%d", i), c)
+		if err != nil {
+			f.Arreter()
+			return nil, err
+		}
+		f = append(f, w)
+	}
+	return f, nil
+}
+
+// Adresses renvoie les adresses des workers, à donner au master comme workers_ip
+func (f Flotte) Adresses() []string {
+	adresses := make([]string, len(f))
+	for i, w := range f {
+		adresses[i] = w.Addr
+	}
+	return adresses
+}
+
+func (f Flotte) Arreter() {
+	for _, w := range f {
+		w.Arreter()
+	}
+}
@@ -0,0 +1,220 @@
+package joblog
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flux possibles d'une ligne de log de job
+const (
+	StreamStdout   = "stdout"
+	StreamStderr   = "stderr"
+	StreamProgress = "progress"
+)
+
+// Line représente une ligne de sortie d'un job
+type Line struct {
+	Seq       int64  `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+	Stream    string `json:"stream"`
+	Text      string `json:"text"`
+}
+
+// Log garde les dernières lignes d'un job dans un buffer circulaire borné,
+// les recopie sur disque et les diffuse aux clients abonnés (suivi en direct).
+// Le buffer grandit avec les lignes reçues jusqu'à sa capacité.
+type Log struct {
+	mu       sync.Mutex
+	lines    []Line
+	capacite int
+	debut    int // index de la plus ancienne ligne dans le buffer, une fois plein
+	seq      int64
+	fichier  *os.File
+	abonnes  map[chan Line]struct{}
+	ferme    bool
+	done     chan struct{}
+}
+
+// New crée le log d'un job. Si dossier n'est pas vide, toutes les lignes sont aussi
+// écrites dans dossier/<jobID>.log.
+func New(jobID string, capacite int, dossier string) (*Log, error) {
+	if capacite <= 0 {
+		capacite = 1000
+	}
+	l := &Log{
+		capacite: capacite,
+		abonnes:  make(map[chan Line]struct{}),
+		done:     make(chan struct{}),
+	}
+	if dossier != "" {
+		if err := os.MkdirAll(dossier, 0755); err != nil {
+			return l, fmt.Errorf("création du dossier de logs impossible: %v", err)
+		}
+		f, err := os.OpenFile(filepath.Join(dossier, jobID+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return l, fmt.Errorf("ouverture du fichier de log du job impossible: %v", err)
+		}
+		l.fichier = f
+	}
+	return l, nil
+}
+
+// Reprendre recrée le log d'un job après un redémarrage du master: les dernières lignes
+// du fichier dossier/<jobID>.log sont rechargées dans le buffer et les suivantes y sont ajoutées.
+func Reprendre(jobID string, capacite int, dossier string) (*Log, error) {
+	anciennes, errLecture := lireFichier(filepath.Join(dossier, jobID+".log"))
+	l, err := New(jobID, capacite, dossier)
+	for _, line := range anciennes {
+		l.seq++
+		line.Seq = l.seq
+		l.ajouterAuBuffer(line)
+	}
+	if err != nil {
+		return l, err
+	}
+	return l, errLecture
+}
+
+// lireFichier relit les lignes d'un fichier de log écrit par Append
+func lireFichier(chemin string) ([]Line, error) {
+	f, err := os.Open(chemin)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []Line
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// format: 2006-01-02T15:04:05 [stream] texte
+		date, reste, ok := strings.Cut(scanner.Text(), " [")
+		if !ok {
+			continue
+		}
+		stream, texte, ok := strings.Cut(reste, "] ")
+		if !ok {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04:05", date, time.Local)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, Line{Timestamp: t.Unix(), Stream: stream, Text: texte})
+	}
+	return lines, scanner.Err()
+}
+
+func (l *Log) ajouterAuBuffer(line Line) {
+	if len(l.lines) < l.capacite {
+		l.lines = append(l.lines, line)
+		return
+	}
+	// buffer plein, on écrase la plus ancienne ligne
+	l.lines[l.debut] = line
+	l.debut = (l.debut + 1) % l.capacite
+}
+
+// Append ajoute une ligne au log et la transmet aux abonnés
+func (l *Log) Append(stream, text string) Line {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	line := Line{Seq: l.seq, Timestamp: time.Now().Unix(), Stream: stream, Text: text}
+	if l.ferme {
+		return line
+	}
+
+	l.ajouterAuBuffer(line)
+
+	if l.fichier != nil {
+		fmt.Fprintf(l.fichier, "%s [%s] %s\n", time.Unix(line.Timestamp, 0).Format("2006-01-02T15:04:05"), stream, text)
+	}
+
+	for ch := range l.abonnes {
+		select {
+		case ch <- line:
+		default:
+			// client trop lent, on ne bloque pas le job pour lui
+		}
+	}
+	return line
+}
+
+// Lines renvoie une copie des lignes encore présentes dans le buffer
+func (l *Log) Lines() []Line {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.linesLocked()
+}
+
+func (l *Log) linesLocked() []Line {
+	out := make([]Line, 0, len(l.lines))
+	for i := 0; i < len(l.lines); i++ {
+		out = append(out, l.lines[(l.debut+i)%len(l.lines)])
+	}
+	return out
+}
+
+// Subscribe renvoie les lignes déjà présentes ainsi qu'un canal recevant les suivantes.
+// Le canal est fermé quand le log est fermé ou quand la fonction d'annulation est appelée.
+func (l *Log) Subscribe() ([]Line, <-chan Line, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ch := make(chan Line, 256)
+	historique := l.linesLocked()
+	if l.ferme {
+		close(ch)
+		return historique, ch, func() {}
+	}
+	l.abonnes[ch] = struct{}{}
+
+	var once sync.Once
+	annuler := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if _, ok := l.abonnes[ch]; ok {
+				delete(l.abonnes, ch)
+				close(ch)
+			}
+		})
+	}
+	return historique, ch, annuler
+}
+
+// Close termine le log: les abonnés sont déconnectés et le fichier est fermé
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ferme {
+		return nil
+	}
+	l.ferme = true
+	// le buffer ne change plus: on ne garde que les lignes, sans la place libre
+	l.lines, l.debut = l.linesLocked(), 0
+	close(l.done)
+	for ch := range l.abonnes {
+		delete(l.abonnes, ch)
+		close(ch)
+	}
+	if l.fichier != nil {
+		return l.fichier.Close()
+	}
+	return nil
+}
+
+// Done est fermé lorsque le log est terminé
+func (l *Log) Done() <-chan struct{} {
+	return l.done
+}
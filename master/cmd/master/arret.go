@@ -0,0 +1,268 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"master/cmd/joblog"
+)
+
+// Délais accordés à chaque étape de l'arrêt du master
+const (
+	delaiArretJobs = 5 * time.Second // détachement des jobs en cours sur les workers
+	delaiArretHTTP = 5 * time.Second // fin des requêtes HTTP en cours
+)
+
+// EtatMaster est l'état sauvegardé à l'arrêt du master et rechargé au démarrage suivant
+type EtatMaster struct {
+	SavedAt  int64                  `json:"saved_at"`
+	Jobs     []Job                  `json:"jobs"`
+	Drains   map[string]*Drain      `json:"drains"`
+	Workers  map[string]*WorkerInfo `json:"workers"`
+	Fichiers []string               `json:"fichiers"`        // fichiers du dossier data déjà pris en compte
+	Epoch    int64                  `json:"epoch,omitempty"` // epoch du bail du leader qui a écrit l'état
+}
+
+func (m *Master) cheminEtat() string {
+	return filepath.Join(m.dossierEtat, "master.json")
+}
+
+func (m *Master) enregistrerConnexion(conn net.Conn) {
+	m.connexionsJobsMutex.Lock()
+	defer m.connexionsJobsMutex.Unlock()
+	m.connexionsJobs[conn] = struct{}{}
+}
+
+func (m *Master) retirerConnexion(conn net.Conn) {
+	m.connexionsJobsMutex.Lock()
+	defer m.connexionsJobsMutex.Unlock()
+	delete(m.connexionsJobs, conn)
+}
+
+// fermerConnexions coupe les connexions encore ouvertes vers les workers
+func (m *Master) fermerConnexions() {
+	m.connexionsJobsMutex.Lock()
+	defer m.connexionsJobsMutex.Unlock()
+	for conn := range m.connexionsJobs {
+		conn.Close()
+	}
+}
+
+// attendreJobs attend la fin des goroutines executerJob, renvoie faux si le délai est dépassé
+func (m *Master) attendreJobs(delai time.Duration) bool {
+	fini := make(chan struct{})
+	go func() {
+		m.jobsActifs.Wait()
+		close(fini)
+	}()
+	select {
+	case <-fini:
+		return true
+	case <-time.After(delai):
+		return false
+	}
+}
+
+// sauverEtat écrit l'état du master sur disque. Le fichier est remplacé d'un bloc pour
+// ne jamais laisser un état à moitié écrit.
+func (m *Master) sauverEtat(fichiers map[string]os.FileInfo) error {
+	etat := EtatMaster{SavedAt: time.Now().Unix(), Epoch: m.epoch.Load()}
+
+	m.jobsMutex.Lock()
+	for _, job := range m.jobs {
+		etat.Jobs = append(etat.Jobs, *job)
+	}
+	m.jobsMutex.Unlock()
+	sort.Slice(etat.Jobs, func(i, j int) bool { return etat.Jobs[i].CreatedAt < etat.Jobs[j].CreatedAt })
+
+	for nom := range fichiers {
+		etat.Fichiers = append(etat.Fichiers, nom)
+	}
+	sort.Strings(etat.Fichiers)
+
+	m.mutex.Lock()
+	etat.Drains = m.drains
+	etat.Workers = m.workersInfo
+	contenu, err := json.MarshalIndent(etat, "", "  ")
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.cheminEtat()), 0755); err != nil {
+		return err
+	}
+	if m.finMandat.Load() != 0 {
+		// l'état n'est écrit que par le détenteur du bail, sous son verrou: un ancien leader
+		// ne peut pas écraser celui du nouveau
+		deverrouiller, err := verrouillerBail(m.dossierEtat)
+		if err != nil {
+			return err
+		}
+		defer deverrouiller()
+		if err := m.verifierBail(m.dossierEtat); err != nil {
+			return err
+		}
+	}
+	temporaire := m.cheminEtat() + ".tmp"
+	if err := os.WriteFile(temporaire, contenu, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaire, m.cheminEtat())
+}
+
+// chargerEtat relit l'état sauvegardé au dernier arrêt: les jobs terminés restent
+// consultables, ceux qui n'étaient pas terminés sont repris et les maintenances
+// reprennent. Renvoie les fichiers du dossier data déjà pris en compte, nil sans état, et
+// l'heure de la sauvegarde, zéro sans état.
+func (m *Master) chargerEtat() (map[string]bool, time.Time) {
+	contenu, err := os.ReadFile(m.cheminEtat())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.log.Error("Erreur de lecture de l'état du master", "error", err)
+		}
+		return nil, time.Time{}
+	}
+	var etat EtatMaster
+	if err := json.Unmarshal(contenu, &etat); err != nil {
+		m.log.Error("Etat du master illisible, ignoré", "error", err)
+		return nil, time.Time{}
+	}
+	m.log.Info("Reprise de l'état du master", "saved_at", time.Unix(etat.SavedAt, 0))
+	// l'état n'est repris qu'une fois: après un arrêt brutal les jobs ne sont pas relancés deux fois
+	if err := os.Rename(m.cheminEtat(), m.cheminEtat()+".repris"); err != nil {
+		m.log.Error("Erreur d'archivage de l'état du master", "error", err)
+	}
+
+	m.mutex.Lock()
+	for addr, info := range etat.Workers {
+		if _, existe := m.workersInfo[addr]; !existe {
+			m.workersInfo[addr] = info
+		}
+	}
+	m.mutex.Unlock()
+
+	for addr, drain := range etat.Drains {
+		var delai time.Duration
+		if drain.Deadline > 0 {
+			// une échéance dépassée pendant l'arrêt est appliquée tout de suite
+			delai = max(time.Until(time.Unix(drain.Deadline, 0)), time.Second)
+		}
+		m.drainerWorker(addr, delai).Since = drain.Since
+	}
+
+	for i := range etat.Jobs {
+		m.reprendreJob(&etat.Jobs[i])
+	}
+
+	fichiers := make(map[string]bool, len(etat.Fichiers))
+	for _, nom := range etat.Fichiers {
+		fichiers[nom] = true
+	}
+	return fichiers, time.Unix(etat.SavedAt, 0)
+}
+
+// reprendreJob réenregistre un job sauvegardé: un job en cours est suivi à nouveau sur son
+// worker, un job en attente est relancé
+func (m *Master) reprendreJob(job *Job) {
+	job.m = m
+	job.creation = time.Unix(job.CreatedAt, 0)
+	logs, err := joblog.Reprendre(job.ID, tailleBufferLogs, m.dossierLogsJobs())
+	if err != nil {
+		job.log().Warn("Log du job non repris", "error", err)
+	}
+	job.logs = logs
+
+	termine := job.estTermine()
+	switch {
+	case termine:
+		job.logs.Close()
+	case job.State == JobRunning:
+		// le job a continué sur son worker pendant l'arrêt, executerJob s'y rattache
+		job.demarrage = time.Unix(job.StartedAt, 0)
+		job.logs.Append(joblog.StreamProgress, "Redémarrage du master, rattachement au job sur "+job.WorkerAddr)
+	default:
+		job.State = JobQueued
+		job.Progress = nil
+		job.Resources = nil
+		job.StartedAt = 0
+		job.logs.Append(joblog.StreamProgress, "Redémarrage du master, job remis en file d'attente")
+	}
+
+	m.jobsMutex.Lock()
+	m.jobs[job.ID] = job
+	m.jobsMutex.Unlock()
+
+	if !termine {
+		job.log().Info("Job repris après redémarrage du master")
+		m.jobsActifs.Add(1)
+		go m.executerJob(job)
+	}
+}
+
+// fermerLogsJobs ferme les logs des jobs non terminés, ce qui termine aussi les
+// suivis en direct pour que le serveur HTTP puisse s'arrêter
+func (m *Master) fermerLogsJobs() {
+	m.jobsMutex.Lock()
+	defer m.jobsMutex.Unlock()
+	for _, job := range m.jobs {
+		if !job.estTermine() {
+			job.logs.Close()
+		}
+	}
+}
+
+// arreterMaster arrête proprement le master: plus de nouveaux jobs, détachement de ceux
+// en cours qui continuent sur les workers, puis sauvegarde de l'état, des métriques et
+// arrêt du serveur HTTP
+func (m *Master) arreterMaster(serveur *http.Server, fichiers map[string]os.FileInfo) {
+	m.arretEnCours.Store(true)
+	m.log.Info("Arrêt du master demandé")
+
+	// les jobs en cours se poursuivent sur les workers, le master s'y rattachera au redémarrage
+	m.fermerConnexions()
+	if !m.attendreJobs(delaiArretJobs) {
+		m.log.Warn("Des jobs n'ont pas rendu la main avant la sauvegarde de l'état")
+	}
+
+	// écrit les lignes d'historique encore en attente
+	m.viderHistorique(true)
+
+	if err := m.sauverEtat(fichiers); err != nil {
+		m.log.Error("Erreur de sauvegarde de l'état du master", "error", err)
+	} else {
+		m.log.Info("Etat du master sauvegardé", "file", m.cheminEtat())
+	}
+	m.metriques.Flush()
+	m.fermerLogsJobs()
+	m.libererBail(m.dossierEtat)
+
+	ctx, cancel := context.WithTimeout(context.Background(), delaiArretHTTP)
+	defer cancel()
+	if err := serveur.Shutdown(ctx); err != nil {
+		m.logAPI.Error("Erreur à l'arrêt du serveur HTTP", "error", err)
+	}
+	m.log.Info("Master arrêté")
+}
+
+// arreterFollower arrête un master qui n'est pas leader: il n'a pas d'état à sauvegarder,
+// et les jobs d'un leader qui a perdu son bail sont laissés au nouveau leader
+func (m *Master) arreterFollower(serveur *http.Server) {
+	m.arretEnCours.Store(true)
+	m.fermerConnexions()
+	m.attendreJobs(delaiArretJobs)
+	m.metriques.Flush()
+	m.fermerLogsJobs()
+	ctx, cancel := context.WithTimeout(context.Background(), delaiArretHTTP)
+	defer cancel()
+	if err := serveur.Shutdown(ctx); err != nil {
+		m.logAPI.Error("Erreur à l'arrêt du serveur HTTP", "error", err)
+	}
+	m.log.Info("Master arrêté")
+}
@@ -0,0 +1,383 @@
+package master
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Role détermine les actions permises sur l'API, chaque rôle inclut les précédents
+type Role int
+
+const (
+	RoleViewer    Role = iota + 1 // consultation des workers, jobs, historique et métriques
+	RoleSubmitter                 // soumission et annulation de jobs
+	RoleOperator                  // maintenance des workers
+	RoleAdmin                     // configuration et journal d'audit
+)
+
+var nomsRoles = map[string]Role{
+	"viewer":    RoleViewer,
+	"submitter": RoleSubmitter,
+	"operator":  RoleOperator,
+	"admin":     RoleAdmin,
+}
+
+func (r Role) String() string {
+	for nom, role := range nomsRoles {
+		if role == r {
+			return nom
+		}
+	}
+	return "aucun"
+}
+
+// Utilisateur est une entrée du fichier users_file. Il s'authentifie en basic auth avec
+// son mot de passe, ou avec un des jetons dont le hash est listé (Authorization: Bearer).
+type Utilisateur struct {
+	Name         string   `yaml:"name"`
+	Role         string   `yaml:"role"`
+	PasswordHash string   `yaml:"password_hash"` // bcrypt, voir "master_test passwd"
+	TokenHashes  []string `yaml:"token_hashes"`  // sha256 hexadécimal, voir "master_test token"
+}
+
+type fichierUtilisateurs struct {
+	Users []Utilisateur `yaml:"users"`
+}
+
+// Identite est l'utilisateur authentifié d'une requête
+type Identite struct {
+	Nom  string
+	Role Role
+}
+
+type cleIdentite struct{}
+
+// Durée pendant laquelle un mot de passe vérifié n'est pas revérifié avec bcrypt
+const dureeCacheMotsDePasse = 5 * time.Minute
+
+// annuaire lit le fichier des utilisateurs et le relit quand il est modifié
+type annuaire struct {
+	chemin  string
+	log     *slog.Logger
+	mu      sync.Mutex
+	modifie time.Time
+	users   []Utilisateur
+	verifie map[string]time.Time // sha256(nom:mot de passe) vérifiés récemment
+}
+
+func chargerAnnuaire(chemin string, journal *slog.Logger) (*annuaire, error) {
+	a := &annuaire{chemin: chemin, log: journal}
+	if err := a.relire(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// relire recharge le fichier s'il a changé. Un fichier devenu invalide est ignoré et
+// les utilisateurs précédents restent en vigueur.
+func (a *annuaire) relire() error {
+	info, err := os.Stat(a.chemin)
+	if err != nil {
+		return err
+	}
+	if !a.modifie.IsZero() && !info.ModTime().After(a.modifie) {
+		return nil
+	}
+	contenu, err := os.ReadFile(a.chemin)
+	if err != nil {
+		return err
+	}
+	var fichier fichierUtilisateurs
+	decodeur := yaml.NewDecoder(strings.NewReader(string(contenu)))
+	decodeur.KnownFields(true)
+	if err := decodeur.Decode(&fichier); err != nil {
+		return fmt.Errorf("fichier des utilisateurs %s invalide: %v", a.chemin, err)
+	}
+	for _, u := range fichier.Users {
+		if _, ok := nomsRoles[u.Role]; !ok {
+			return fmt.Errorf("rôle inconnu %q pour l'utilisateur %s", u.Role, u.Name)
+		}
+	}
+	a.users = fichier.Users
+	a.modifie = info.ModTime()
+	a.verifie = make(map[string]time.Time)
+	a.log.Info("Utilisateurs de l'API chargés", "file", a.chemin, "users", len(a.users))
+	return nil
+}
+
+// hashFactice est comparé au mot de passe d'un utilisateur inconnu, pour que la réponse
+// prenne le même temps que pour un utilisateur existant
+var hashFactice = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("utilisateur inconnu"), bcrypt.DefaultCost)
+	return hash
+})
+
+// authentifier renvoie l'utilisateur correspondant aux identifiants de la requête. bcrypt
+// tourne hors du verrou: une rafale de mauvais mots de passe ne bloque pas les autres requêtes.
+func (a *annuaire) authentifier(r *http.Request) (Identite, bool) {
+	a.mu.Lock()
+	if err := a.relire(); err != nil {
+		a.log.Error("Erreur de lecture des utilisateurs de l'API", "error", err)
+	}
+	// relire remplace la liste sans la modifier, elle peut être parcourue hors du verrou
+	users, version := a.users, a.modifie
+	a.mu.Unlock()
+
+	if jeton, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(jeton)))
+		for _, u := range users {
+			for _, attendu := range u.TokenHashes {
+				if attendu, err := hex.DecodeString(attendu); err == nil && subtle.ConstantTimeCompare(hash[:], attendu) == 1 {
+					return Identite{u.Name, nomsRoles[u.Role]}, true
+				}
+			}
+		}
+		return Identite{}, false
+	}
+
+	nom, motDePasse, ok := r.BasicAuth()
+	if !ok {
+		return Identite{}, false
+	}
+	var utilisateur *Utilisateur
+	for i := range users {
+		if users[i].Name == nom && users[i].PasswordHash != "" {
+			utilisateur = &users[i]
+			break
+		}
+	}
+	if utilisateur == nil {
+		bcrypt.CompareHashAndPassword(hashFactice(), []byte(motDePasse))
+		return Identite{}, false
+	}
+	identite := Identite{utilisateur.Name, nomsRoles[utilisateur.Role]}
+	empreinte := sha256.Sum256([]byte(nom + ":" + motDePasse))
+	cle := hex.EncodeToString(empreinte[:])
+	a.mu.Lock()
+	expiration, verifie := a.verifie[cle]
+	a.mu.Unlock()
+	if verifie && time.Now().Before(expiration) {
+		return identite, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(utilisateur.PasswordHash), []byte(motDePasse)) != nil {
+		return Identite{}, false
+	}
+	a.mu.Lock()
+	// le fichier a pu changer pendant la vérification: le cache ne vaut que pour cette version
+	if a.modifie.Equal(version) {
+		a.verifie[cle] = time.Now().Add(dureeCacheMotsDePasse)
+	}
+	a.mu.Unlock()
+	return identite, true
+}
+
+// avecRole réserve un handler aux utilisateurs ayant au moins le rôle demandé. Les
+// actions qui modifient l'état et les refus sont inscrits au journal d'audit.
+func (m *Master) avecRole(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.utilisateurs == nil {
+			h(w, r)
+			return
+		}
+		identite, ok := m.utilisateurs.authentifier(r)
+		if !ok {
+			m.auditer(r, Identite{}, http.StatusUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Basic realm="compute_balancer"`)
+			http.Error(w, "authentification nécessaire", http.StatusUnauthorized)
+			return
+		}
+		if identite.Role < role {
+			m.auditer(r, identite, http.StatusForbidden)
+			http.Error(w, "rôle "+role.String()+" nécessaire", http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), cleIdentite{}, identite))
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+		enregistreur := &statutReponse{ResponseWriter: w, statut: http.StatusOK}
+		h(enregistreur, r)
+		m.auditer(r, identite, enregistreur.statut)
+	}
+}
+
+// identiteRequete renvoie l'utilisateur authentifié, vide si l'API n'est pas protégée
+func identiteRequete(r *http.Request) Identite {
+	identite, _ := r.Context().Value(cleIdentite{}).(Identite)
+	return identite
+}
+
+type statutReponse struct {
+	http.ResponseWriter
+	statut int
+}
+
+func (s *statutReponse) WriteHeader(statut int) {
+	s.statut = statut
+	s.ResponseWriter.WriteHeader(statut)
+}
+
+// EntreeAudit est une ligne du journal d'audit
+type EntreeAudit struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Role   string    `json:"role,omitempty"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Remote string    `json:"remote"`
+}
+
+func (m *Master) auditer(r *http.Request, identite Identite, statut int) {
+	entree := EntreeAudit{
+		Time:   time.Now(),
+		User:   identite.Nom,
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Status: statut,
+		Remote: r.RemoteAddr,
+	}
+	if identite.Role != 0 {
+		entree.Role = identite.Role.String()
+	}
+	ligne, err := json.Marshal(entree)
+	if err != nil {
+		return
+	}
+	m.journalAuditMutex.Lock()
+	defer m.journalAuditMutex.Unlock()
+	if m.journalAudit == nil {
+		return
+	}
+	if _, err := m.journalAudit.Write(append(ligne, '\n')); err != nil {
+		m.logAPI.Error("Erreur d'écriture du journal d'audit", "error", err)
+	}
+}
+
+// ouvrirJournalAudit ouvre le journal d'audit en ajout
+func (m *Master) ouvrirJournalAudit(chemin string) error {
+	if err := os.MkdirAll(filepath.Dir(chemin), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(chemin, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	m.journalAuditMutex.Lock()
+	m.journalAudit = f
+	m.journalAuditMutex.Unlock()
+	return nil
+}
+
+// fermerJournalAudit ferme le journal d'audit à l'arrêt du master
+func (m *Master) fermerJournalAudit() {
+	m.journalAuditMutex.Lock()
+	defer m.journalAuditMutex.Unlock()
+	if m.journalAudit != nil {
+		m.journalAudit.Close()
+		m.journalAudit = nil
+	}
+}
+
+// Nombre maximal d'entrées renvoyées par /audit
+const maxEntreesAudit = 10000
+
+// auditHandler renvoie les dernières entrées du journal d'audit (?limit=, 200 par défaut).
+// Le journal est lu depuis la fin, jusqu'au nombre d'entrées demandé.
+func (m *Master) auditHandler(w http.ResponseWriter, r *http.Request) {
+	limite := 200
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limite, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || limite <= 0 || limite > maxEntreesAudit {
+			http.Error(w, fmt.Sprintf("paramètre limit invalide, entre 1 et %d", maxEntreesAudit), http.StatusBadRequest)
+			return
+		}
+	}
+	m.journalAuditMutex.Lock()
+	var chemin string
+	if m.journalAudit != nil {
+		chemin = m.journalAudit.Name()
+	}
+	m.journalAuditMutex.Unlock()
+
+	entrees := []EntreeAudit{}
+	if chemin != "" {
+		lignes, err := dernieresLignes(chemin, limite)
+		if err != nil {
+			http.Error(w, "lecture du journal d'audit impossible: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, ligne := range lignes {
+			var entree EntreeAudit
+			if json.Unmarshal([]byte(ligne), &entree) == nil {
+				entrees = append(entrees, entree)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entrees)
+}
+
+// dernieresLignes renvoie les n dernières lignes non vides du fichier, dans l'ordre, en le
+// lisant par blocs depuis la fin
+func dernieresLignes(chemin string, n int) ([]string, error) {
+	f, err := os.Open(chemin)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const tailleBloc = 64 << 10
+	var lignes []string
+	var reste []byte // début de ligne lu, dont la suite est dans le bloc précédent
+	for fin := info.Size(); fin > 0 && len(lignes) < n; {
+		debut := max(fin-tailleBloc, 0)
+		bloc := make([]byte, fin-debut, int(fin-debut)+len(reste))
+		if _, err := f.ReadAt(bloc, debut); err != nil {
+			return nil, err
+		}
+		bloc = append(bloc, reste...)
+		fin = debut
+		// la première ligne du bloc peut commencer dans le bloc précédent
+		i := bytes.IndexByte(bloc, '\n')
+		if fin > 0 && i < 0 {
+			reste = bloc
+			continue
+		}
+		if fin > 0 {
+			reste, bloc = bloc[:i], bloc[i+1:]
+		} else {
+			reste = nil
+		}
+		morceaux := strings.Split(string(bloc), "\n")
+		for j := len(morceaux) - 1; j >= 0 && len(lignes) < n; j-- {
+			if ligne := strings.TrimSpace(morceaux[j]); ligne != "" {
+				lignes = append(lignes, ligne)
+			}
+		}
+	}
+	slices.Reverse(lignes)
+	return lignes, nil
+}
@@ -0,0 +1,171 @@
+package master
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"commun/configuration"
+	"commun/journalisation"
+	"commun/mtls"
+	"commun/signature"
+)
+
+// Préfixe des variables d'environnement qui surchargent la config: MASTER_HTTP_ADDR...
+const PrefixeEnvironnement = "MASTER"
+
+// Config est la configuration d'un master, lue dans $MASTER_HOME/config/config.yaml. Les
+// valeurs vides prennent leur valeur par défaut (AvecDefauts).
+type Config struct {
+	// Home est le dossier du master ($MASTER_HOME): config, data, history et logs
+	Home       string   `yaml:"-"`
+	HTTPAddr   string   `yaml:"http_addr"` // adresse de l'API HTTP, :8082 par défaut
+	WorkersIP  []string `yaml:"workers_ip"`
+	DataDir    string   `yaml:"data_dir"`    // dossier surveillé, $MASTER_HOME/data par défaut
+	HistoryDir string   `yaml:"history_dir"` // historique parquet, $MASTER_HOME/history par défaut
+	LogsDir    string   `yaml:"logs_dir"`    // logs des jobs et journal d'audit, $MASTER_HOME/logs par défaut
+	MetricsDir string   `yaml:"metrics_dir"` // vide: pas de conservation des métriques sur disque
+	// Journalisation: fichier (/var/log/masterc_cb.log par défaut), format, niveaux, rotation
+	Log journalisation.Config `yaml:"log"`
+	// Logger reçoit les messages du master, slog.Default() si nil
+	Logger *slog.Logger `yaml:"-"`
+	// Relevé des workers et surveillance du dossier data, 2s par défaut
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Délai de connexion à un worker pour les reprises de contact, rattachements et annulations, 5s par défaut
+	WorkerTimeout time.Duration `yaml:"worker_timeout"`
+	// Jobs terminés gardés en mémoire (API, état sauvegardé): pendant job_retention, 24h par
+	// défaut, et au plus max_finished_jobs, 1000 par défaut. L'historique parquet et les logs
+	// des jobs restent sur disque.
+	JobRetention    time.Duration `yaml:"job_retention"`
+	MaxFinishedJobs int           `yaml:"max_finished_jobs"`
+	// Haute disponibilité: les masters qui partagent state_dir élisent un leader
+	StateDir      string        `yaml:"state_dir"`      // $MASTER_HOME/state par défaut
+	LeaseDuration time.Duration `yaml:"lease_duration"` // 15s par défaut
+	AdvertiseURL  string        `yaml:"advertise_url"`  // adresse de l'API de ce master, pour les redirections des followers
+	// Connexions aux workers en TLS mutuel, en clair si la section est absente
+	TLS mtls.Config `yaml:"tls"`
+	// Protection de l'API HTTP: utilisateurs et rôles, API ouverte à tous si vide
+	UsersFile string `yaml:"users_file"`
+	AuditLog  string `yaml:"audit_log"` // logs_dir/audit.log par défaut
+	// Signature des commandes envoyées aux workers, commandes non signées si absent
+	Signing signature.ConfigSignataire `yaml:"signing"`
+}
+
+// ChargerConfig lit la config du master dans home/config/config.yaml, puis applique les
+// variables d'environnement MASTER_*. Une clé inconnue ou une valeur illisible est une
+// erreur. La config n'est pas encore validée, voir Valider.
+func ChargerConfig(home string) (Config, error) {
+	config := Config{Home: home}
+	if err := configuration.Lire(fichierConfig(home), &config); err != nil {
+		return config, err
+	}
+	if err := configuration.Environnement(PrefixeEnvironnement, &config); err != nil {
+		return config, err
+	}
+	config.Home = home
+	return config, nil
+}
+
+// fichierConfig renvoie le chemin du config.yaml d'un master
+func fichierConfig(home string) string {
+	return filepath.Join(home, "config", "config.yaml")
+}
+
+// AvecDefauts renvoie la config où les valeurs non renseignées ont leur valeur par défaut
+func (c Config) AvecDefauts() Config {
+	if c.HTTPAddr == "" {
+		c.HTTPAddr = ":8082"
+	}
+	if c.Log.File == "" {
+		c.Log.File = "/var/log/masterc_cb.log"
+	}
+	c.Log = c.Log.AvecDefauts()
+	if c.DataDir == "" {
+		c.DataDir = filepath.Join(c.Home, "data")
+	}
+	if c.HistoryDir == "" {
+		c.HistoryDir = filepath.Join(c.Home, "history")
+	}
+	if c.LogsDir == "" {
+		c.LogsDir = filepath.Join(c.Home, "logs")
+	}
+	if c.AuditLog == "" {
+		c.AuditLog = filepath.Join(c.LogsDir, "audit.log")
+	}
+	if c.StateDir == "" {
+		c.StateDir = filepath.Join(c.Home, "state")
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 2 * time.Second
+	}
+	if c.WorkerTimeout == 0 {
+		c.WorkerTimeout = 5 * time.Second
+	}
+	if c.JobRetention == 0 {
+		c.JobRetention = 24 * time.Hour
+	}
+	if c.MaxFinishedJobs == 0 {
+		c.MaxFinishedJobs = 1000
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = 15 * time.Second
+	}
+	return c
+}
+
+// Valider vérifie la config avec ses valeurs par défaut et renvoie toutes les erreurs
+// trouvées, une par ligne, chacune préfixée de la clé yaml concernée
+func (c Config) Valider() error {
+	c = c.AvecDefauts()
+	var erreurs []error
+	verifier := func(cle string, err error) {
+		if err != nil {
+			erreurs = append(erreurs, fmt.Errorf("%s: %v", cle, err))
+		}
+	}
+
+	if c.Home == "" {
+		verifier("home", errors.New("dossier du master (MASTER_HOME) non défini"))
+	}
+	verifier("http_addr", configuration.Adresse(c.HTTPAddr, true))
+	if err := c.Log.Valider("log."); err != nil {
+		erreurs = append(erreurs, err)
+	}
+	vus := make(map[string]bool, len(c.WorkersIP))
+	for _, addr := range c.WorkersIP {
+		verifier("workers_ip", configuration.Adresse(addr, false))
+		if vus[addr] {
+			verifier("workers_ip", fmt.Errorf("%s présent deux fois", addr))
+		}
+		vus[addr] = true
+	}
+	verifier("poll_interval", configuration.Duree(c.PollInterval, 100*time.Millisecond, time.Hour))
+	verifier("worker_timeout", configuration.Duree(c.WorkerTimeout, 100*time.Millisecond, 5*time.Minute))
+	verifier("job_retention", configuration.Duree(c.JobRetention, time.Minute, 365*24*time.Hour))
+	if c.MaxFinishedJobs < 1 {
+		verifier("max_finished_jobs", fmt.Errorf("au moins 1, pas %d", c.MaxFinishedJobs))
+	}
+	verifier("lease_duration", configuration.Duree(c.LeaseDuration, time.Second, 10*time.Minute))
+	if c.AdvertiseURL != "" {
+		if u, err := url.Parse(c.AdvertiseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			verifier("advertise_url", fmt.Errorf("URL invalide %q, attendu http(s)://hôte:port", c.AdvertiseURL))
+		}
+	}
+	if c.TLS.Active() {
+		_, err := mtls.ClientConfig(c.TLS)
+		verifier("tls", err)
+	}
+	if c.UsersFile != "" {
+		_, err := chargerAnnuaire(c.UsersFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		verifier("users_file", err)
+	}
+	if c.Signing.Active() {
+		_, err := signature.ChargerSignataire(c.Signing)
+		verifier("signing", err)
+	}
+	return errors.Join(erreurs...)
+}
@@ -0,0 +1,57 @@
+package master
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"commun/signature"
+)
+
+func TestValiderConfig(t *testing.T) {
+	cas := []struct {
+		nom     string
+		config  Config
+		erreurs []string // clés en erreur, aucune si la config est valide
+	}{
+		{"défauts", Config{Home: "/srv/master"}, nil},
+		{"complète", Config{Home: "/srv/master", HTTPAddr: "127.0.0.1:0", WorkersIP: []string{"w1:8080", "10.0.0.2:8080"},
+			LeaseDuration: time.Minute, AdvertiseURL: "https://master1:8082"}, nil},
+		{"sans home", Config{}, []string{"home"}},
+		{"worker sans port", Config{Home: "/srv/master", WorkersIP: []string{"w1"}}, []string{"workers_ip"}},
+		{"worker sans hôte", Config{Home: "/srv/master", WorkersIP: []string{":8080"}}, []string{"workers_ip"}},
+		{"worker en double", Config{Home: "/srv/master", WorkersIP: []string{"w1:8080", "w1:8080"}}, []string{"workers_ip"}},
+		{"écoute invalide", Config{Home: "/srv/master", HTTPAddr: "8082"}, []string{"http_addr"}},
+		{"url annoncée sans schéma", Config{Home: "/srv/master", AdvertiseURL: "master1:8082"}, []string{"advertise_url"}},
+		{"bail trop court", Config{Home: "/srv/master", LeaseDuration: 100 * time.Millisecond}, []string{"lease_duration"}},
+		{"relevé trop fréquent", Config{Home: "/srv/master", PollInterval: time.Millisecond}, []string{"poll_interval"}},
+		{"rétention trop courte", Config{Home: "/srv/master", JobRetention: time.Second}, []string{"job_retention"}},
+		{"aucun job terminé gardé", Config{Home: "/srv/master", MaxFinishedJobs: -1}, []string{"max_finished_jobs"}},
+		{"clé de signature absente", Config{Home: "/srv/master", Signing: signature.ConfigSignataire{HMACKey: "/absent/hmac.key"}}, []string{"signing"}},
+		{"plusieurs erreurs", Config{HTTPAddr: "x", WorkersIP: []string{"w1"}}, []string{"home", "http_addr", "workers_ip"}},
+	}
+	for _, c := range cas {
+		err := c.config.Valider()
+		if len(c.erreurs) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", c.nom, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: config acceptée, attendu une erreur sur %v", c.nom, c.erreurs)
+			continue
+		}
+		// une erreur par ligne, préfixée de sa clé
+		lignes := strings.Split(err.Error(), "\n")
+		if len(lignes) != len(c.erreurs) {
+			t.Errorf("%s: %d erreurs, attendu %d:\n%v", c.nom, len(lignes), len(c.erreurs), err)
+			continue
+		}
+		for i, cle := range c.erreurs {
+			if !strings.HasPrefix(lignes[i], cle+": ") {
+				t.Errorf("%s: erreur %q, attendu la clé %s", c.nom, lignes[i], cle)
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package master
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"commun/journalisation"
+)
+
+// Drain décrit un worker retiré de la rotation: aucun nouveau job ne lui est envoyé,
+// ceux en cours se terminent, et sont annulés puis relancés ailleurs à l'échéance.
+type Drain struct {
+	Since    int64 `json:"since"`
+	Deadline int64 `json:"deadline,omitempty"`
+	timer    *time.Timer
+}
+
+// drainerWorker retire workerAddr de la rotation. Si delai est positif, les jobs
+// encore en cours sur le worker à l'échéance sont annulés et relancés ailleurs.
+func (m *Master) drainerWorker(workerAddr string, delai time.Duration) *Drain {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	drain, existe := m.drains[workerAddr]
+	if !existe {
+		drain = &Drain{Since: time.Now().Unix()}
+		m.drains[workerAddr] = drain
+	}
+	if drain.timer != nil {
+		drain.timer.Stop()
+		drain.timer = nil
+		drain.Deadline = 0
+	}
+	if delai > 0 {
+		drain.Deadline = time.Now().Add(delai).Unix()
+		drain.timer = time.AfterFunc(delai, func() { m.echeanceDrain(workerAddr) })
+	}
+	m.logWorkers.Info("Worker en maintenance", journalisation.CleWorker, workerAddr, "deadline", delai)
+	return drain
+}
+
+// undrainWorker remet le worker dans la rotation, renvoie faux s'il n'était pas en maintenance
+func (m *Master) undrainWorker(workerAddr string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	drain, existe := m.drains[workerAddr]
+	if !existe {
+		return false
+	}
+	if drain.timer != nil {
+		drain.timer.Stop()
+	}
+	delete(m.drains, workerAddr)
+	m.logWorkers.Info("Worker remis en service", journalisation.CleWorker, workerAddr)
+	return true
+}
+
+func (m *Master) estDraine(workerAddr string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, existe := m.drains[workerAddr]
+	return existe
+}
+
+// echeanceDrain annule les jobs encore en cours sur le worker pour les relancer ailleurs.
+// Seuls les jobs dont le worker confirme l'arrêt sont relancés.
+func (m *Master) echeanceDrain(workerAddr string) {
+	m.jobsMutex.Lock()
+	var aAnnuler []*Job
+	for _, job := range m.jobs {
+		if job.WorkerAddr == workerAddr && job.State == JobRunning {
+			job.annulations++
+			aAnnuler = append(aAnnuler, job)
+		}
+	}
+	m.jobsMutex.Unlock()
+
+	for _, job := range aAnnuler {
+		job.log().Warn("Echéance de maintenance: annulation du job pour relance", journalisation.CleWorker, workerAddr)
+		if err := m.annulerEnCours(job, workerAddr, true); err != nil {
+			job.log().Error("Erreur d'annulation du job, il continue sur le worker", journalisation.CleWorker, workerAddr, "error", err)
+		}
+	}
+}
+
+// annulerEnCours demande au worker de tuer un job en cours, compté dans ses annulations
+// par l'appelant. Le job n'est annulé, ou relancé si relance, que si le worker confirme.
+func (m *Master) annulerEnCours(job *Job, workerAddr string, relance bool) error {
+	err := m.annulerSurWorker(workerAddr, job.ID)
+	job.finAnnulation(err == nil, relance)
+	return err
+}
+
+// Temps laissé au worker pour tuer un job, conteneur compris, avant de répondre
+const delaiReponseAnnulation = 15 * time.Second
+
+// annulerSurWorker demande au worker de tuer le processus d'un job. Une erreur signifie
+// que le worker n'a pas confirmé l'arrêt: job inconnu, déjà terminé ou worker injoignable.
+func (m *Master) annulerSurWorker(workerAddr, jobID string) error {
+	delai := m.conf().WorkerTimeout
+	conn, err := m.dialWorker(workerAddr, delai)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(delai + delaiReponseAnnulation))
+
+	if err := m.envoyerCommande(conn, workerAddr, Command{Command: "cancel", Args: []string{jobID}}); err != nil {
+		return err
+	}
+	reponse, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(reponse) >= 6 && reponse[:6] == "Erreur" {
+		return fmt.Errorf("%s", reponse)
+	}
+	return nil
+}
+
+// drainHandler met un worker en maintenance, avec ?deadline=10m pour annuler et relancer
+// ailleurs les jobs qui ne seraient pas terminés après ce délai
+func (m *Master) drainHandler(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	if !m.workerConnu(addr) {
+		http.Error(w, "worker inconnu: "+addr, http.StatusNotFound)
+		return
+	}
+	var delai time.Duration
+	if v := r.URL.Query().Get("deadline"); v != "" {
+		var err error
+		if delai, err = time.ParseDuration(v); err != nil || delai < 0 {
+			http.Error(w, "paramètre deadline invalide", http.StatusBadRequest)
+			return
+		}
+	}
+	drain := m.drainerWorker(addr, delai)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drain)
+}
+
+func (m *Master) undrainHandler(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	if !m.undrainWorker(addr) {
+		http.Error(w, "worker pas en maintenance: "+addr, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
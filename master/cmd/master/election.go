@@ -0,0 +1,307 @@
+package master
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"master/cmd/joblog"
+)
+
+// Bail est le droit d'être leader, écrit dans le dossier d'état partagé entre les masters.
+// Seul le leader surveille le dossier data et envoie des jobs aux workers, les autres
+// masters servent l'API en lecture seule et prennent le relais si le bail n'est pas renouvelé.
+//
+// Epoch augmente à chaque changement de leader: l'état sauvegardé et les commandes envoyées
+// aux workers le portent, un worker refuse les commandes d'un leader plus ancien que le
+// dernier qu'il a vu.
+type Bail struct {
+	Holder    string    `json:"holder"`
+	URL       string    `json:"url,omitempty"` // adresse de l'API du leader, pour y rediriger les écritures
+	ExpiresAt time.Time `json:"expires_at"`
+	Epoch     int64     `json:"epoch"`
+}
+
+// errMandatExpire: le bail n'a pas été renouvelé à temps, ce master ne doit plus agir en leader
+var errMandatExpire = errors.New("mandat de leader expiré")
+
+// instances numérote les masters créés par le processus, pour que chacun ait sa propre
+// identité dans le bail
+var instances atomic.Int64
+
+func nomMaster() string {
+	hote, err := os.Hostname()
+	if err != nil {
+		hote = "master"
+	}
+	if n := instances.Add(1); n > 1 {
+		return fmt.Sprintf("%s-%d-%d", hote, os.Getpid(), n)
+	}
+	return fmt.Sprintf("%s-%d", hote, os.Getpid())
+}
+
+// verrouillerBail prend le verrou sur leader.lock, qui sérialise les masters qui partagent
+// le dossier. La fonction renvoyée le relâche.
+func verrouillerBail(dossier string) (func(), error) {
+	verrou, err := os.OpenFile(filepath.Join(dossier, "leader.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(verrou.Fd()), syscall.LOCK_EX); err != nil {
+		verrou.Close()
+		return nil, fmt.Errorf("verrouillage du bail impossible: %v", err)
+	}
+	return func() {
+		syscall.Flock(int(verrou.Fd()), syscall.LOCK_UN)
+		verrou.Close()
+	}, nil
+}
+
+// lireBail lit le bail en vigueur, vide s'il n'y en a pas encore. Appelé sous le verrou.
+func (m *Master) lireBail(dossier string) (Bail, error) {
+	var bail Bail
+	contenu, err := os.ReadFile(filepath.Join(dossier, "leader.lease"))
+	if os.IsNotExist(err) {
+		return bail, nil
+	} else if err != nil {
+		return bail, err
+	}
+	if err := json.Unmarshal(contenu, &bail); err != nil {
+		m.logElection.Warn("Bail illisible, il est considéré comme expiré", "error", err)
+		return Bail{}, nil
+	}
+	return bail, nil
+}
+
+// ecrireBail remplace le bail, appelé sous le verrou
+func ecrireBail(dossier string, bail Bail) error {
+	contenu, err := json.Marshal(bail)
+	if err != nil {
+		return err
+	}
+	chemin := filepath.Join(dossier, "leader.lease")
+	temporaire := chemin + ".tmp"
+	if err := os.WriteFile(temporaire, contenu, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaire, chemin)
+}
+
+// prendreBail renouvelle le bail s'il est à nous, le prend s'il a expiré avec l'epoch
+// suivante, et renvoie le bail en vigueur
+func (m *Master) prendreBail(dossier, url string, duree time.Duration) (Bail, error) {
+	deverrouiller, err := verrouillerBail(dossier)
+	if err != nil {
+		return Bail{}, err
+	}
+	defer deverrouiller()
+
+	bail, err := m.lireBail(dossier)
+	if err != nil {
+		return Bail{}, err
+	}
+	maintenant := time.Now()
+	if bail.Holder != m.idMaster && maintenant.Before(bail.ExpiresAt) {
+		return bail, nil
+	}
+	epoch := bail.Epoch
+	if bail.Holder != m.idMaster || epoch == 0 {
+		epoch++
+	}
+	bail = Bail{Holder: m.idMaster, URL: url, ExpiresAt: maintenant.Add(duree), Epoch: epoch}
+	return bail, ecrireBail(dossier, bail)
+}
+
+// verifierBail renvoie errMandatExpire si le bail n'est plus à ce master avec son epoch.
+// Appelé sous le verrou, avant d'écrire l'état partagé.
+func (m *Master) verifierBail(dossier string) error {
+	bail, err := m.lireBail(dossier)
+	if err != nil {
+		return err
+	}
+	if bail.Holder != m.idMaster || bail.Epoch != m.epoch.Load() {
+		return fmt.Errorf("%w: bail détenu par %s (epoch %d)", errMandatExpire, bail.Holder, bail.Epoch)
+	}
+	return nil
+}
+
+// libererBail fait expirer le bail s'il est à nous, pour qu'un autre master prenne le
+// relais sans attendre. L'epoch est gardée pour que le suivant prenne la suivante.
+func (m *Master) libererBail(dossier string) {
+	deverrouiller, err := verrouillerBail(dossier)
+	if err != nil {
+		m.logElection.Error("Erreur de libération du bail", "error", err)
+		return
+	}
+	defer deverrouiller()
+
+	bail, err := m.lireBail(dossier)
+	if err != nil || bail.Holder != m.idMaster {
+		return
+	}
+	bail.ExpiresAt = time.Now()
+	if err := ecrireBail(dossier, bail); err != nil {
+		m.logElection.Error("Erreur de libération du bail", "error", err)
+		return
+	}
+	m.logElection.Info("Bail de leader libéré")
+}
+
+// mandatValide indique si ce master peut encore envoyer des jobs et écrire l'état: son bail
+// a été renouvelé il y a moins de deux tiers de sa durée. La marge laisse le temps aux
+// commandes en vol d'arriver avant qu'un autre master ne puisse prendre le bail. Sans
+// élection (master qui n'est pas lancé par Run), rien n'est restreint.
+func (m *Master) mandatValide() bool {
+	fin := m.finMandat.Load()
+	return fin == 0 || time.Now().UnixNano() < fin
+}
+
+// attendreMandat attend que le bail soit renouvelé si le mandat de ce master a expiré, et
+// renvoie faux si le master s'arrête entre-temps
+func (m *Master) attendreMandat() bool {
+	for !m.mandatValide() {
+		select {
+		case <-m.arret:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// election tente de prendre puis renouvelle le bail tous les tiers de sa durée, jusqu'à
+// l'arrêt du master. promotion est fermé quand ce master devient leader. Un leader qui n'a
+// pas pu renouveler son bail avant la fin de son mandat (deux tiers de la durée du bail)
+// cesse d'envoyer des jobs et s'arrête: ses jobs continuent sur les workers et le nouveau
+// leader s'y rattache.
+func (m *Master) election(dossier, url string, duree time.Duration, promotion chan<- struct{}) {
+	for {
+		tentative := time.Now()
+		bail, err := m.prendreBail(dossier, url, duree)
+		switch {
+		case err != nil:
+			m.logElection.Error("Erreur de renouvellement du bail", "error", err)
+			if m.estLeader.Load() && !m.mandatValide() {
+				m.echouer(fmt.Errorf("bail de leader non renouvelé avant la fin du mandat"))
+				return
+			}
+		case bail.Holder == m.idMaster:
+			// le bail court depuis tentative au plus tôt
+			m.finMandat.Store(tentative.Add(duree - duree/3).UnixNano())
+			m.epoch.Store(bail.Epoch)
+			if !m.estLeader.Swap(true) {
+				m.logElection.Info("Ce master devient leader", "master", m.idMaster, "epoch", bail.Epoch)
+				close(promotion)
+			}
+		case m.estLeader.Load():
+			m.echouer(fmt.Errorf("bail de leader pris par %s", bail.Holder))
+			return
+		}
+		if err == nil {
+			m.bailActuelMutex.Lock()
+			m.bailActuel = bail
+			m.bailActuelMutex.Unlock()
+		}
+		attente := duree / 3
+		if m.estLeader.Load() {
+			// au pire, réveil à la fin du mandat pour s'arrêter à temps
+			if reste := time.Duration(m.finMandat.Load() - time.Now().UnixNano()); reste < attente {
+				attente = max(reste, 0)
+			}
+		}
+		select {
+		case <-m.arret:
+			return
+		case <-time.After(attente):
+		}
+	}
+}
+
+// leaderSeulement réserve un handler au leader: un follower redirige vers le leader
+// s'il en connaît l'adresse
+func (m *Master) leaderSeulement(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.estLeader.Load() {
+			h(w, r)
+			return
+		}
+		m.bailActuelMutex.Lock()
+		bail := m.bailActuel
+		m.bailActuelMutex.Unlock()
+		if bail.URL != "" && time.Now().Before(bail.ExpiresAt) {
+			http.Redirect(w, r, bail.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		http.Error(w, "ce master n'est pas leader, réessayer plus tard", http.StatusServiceUnavailable)
+	}
+}
+
+// leaderHandler indique si ce master est leader et lequel l'est
+func (m *Master) leaderHandler(w http.ResponseWriter, r *http.Request) {
+	m.bailActuelMutex.Lock()
+	bail := m.bailActuel
+	m.bailActuelMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID     string `json:"id"`
+		Leader bool   `json:"leader"`
+		Bail   Bail   `json:"lease"`
+	}{m.idMaster, m.estLeader.Load(), bail})
+}
+
+// chargerVue recopie l'état sauvegardé par le leader pour servir l'API en lecture seule
+// sur un follower. Les logs des jobs ne sont pas disponibles sur un follower.
+func (m *Master) chargerVue() {
+	contenu, err := os.ReadFile(m.cheminEtat())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logElection.Error("Erreur de lecture de l'état du leader", "error", err)
+		}
+		return
+	}
+	var etat EtatMaster
+	if err := json.Unmarshal(contenu, &etat); err != nil {
+		m.logElection.Error("Etat du leader illisible", "error", err)
+		return
+	}
+
+	// la vue est remplacée d'un bloc: les jobs oubliés par le leader disparaissent aussi
+	jobs := make(map[string]*Job, len(etat.Jobs))
+	m.jobsMutex.Lock()
+	for i := range etat.Jobs {
+		job := etat.Jobs[i]
+		if existant, ok := m.jobs[job.ID]; ok {
+			job.logs = existant.logs
+		} else {
+			job.logs, _ = joblog.New(job.ID, 1, "")
+			job.logs.Close()
+		}
+		job.m = m
+		jobs[job.ID] = &job
+	}
+	m.jobs = jobs
+	m.jobsMutex.Unlock()
+
+	m.mutex.Lock()
+	m.drains = make(map[string]*Drain, len(etat.Drains))
+	for addr, drain := range etat.Drains {
+		m.drains[addr] = drain
+	}
+	m.mutex.Unlock()
+}
+
+// oublierVue efface la vue recopiée du leader avant que ce master ne reprenne l'état
+func (m *Master) oublierVue() {
+	m.jobsMutex.Lock()
+	m.jobs = make(map[string]*Job)
+	m.jobsMutex.Unlock()
+	m.mutex.Lock()
+	m.drains = make(map[string]*Drain)
+	m.mutex.Unlock()
+}
@@ -0,0 +1,238 @@
+package master
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"master/cmd/estimation"
+)
+
+// chargerEstimateur alimente l'estimateur avec les jobs réussis de l'historique
+func (m *Master) chargerEstimateur() {
+	lignes, err := m.lireHistorique(FiltreHistorique{Status: JobSucceeded})
+	if err != nil {
+		m.log.Error("Erreur de lecture de l'historique pour l'estimation des durées", "error", err)
+		return
+	}
+	// de la plus ancienne à la plus récente: l'estimateur oublie les plus anciennes
+	for i := len(lignes) - 1; i >= 0; i-- {
+		h := lignes[i]
+		if h.WallSeconds > 0 {
+			tache := h.Task
+			if tache == "" {
+				// ligne écrite avant que la tâche ne soit enregistrée
+				tache = h.Command
+			}
+			m.estimateur.Add(estimation.Observation{Task: tache, Worker: h.WorkerAddr, InputBytes: h.InputBytes, Seconds: h.WallSeconds})
+		}
+	}
+	m.log.Info("Estimation des durées initialisée", "jobs", len(lignes))
+}
+
+// fichierEntree renvoie les informations de l'argument s'il est un fichier du dossier data
+func (m *Master) fichierEntree(arg string) (os.FileInfo, bool) {
+	info, err := os.Stat(filepath.Join(m.conf().DataDir, filepath.Base(arg)))
+	return info, err == nil && !info.IsDir()
+}
+
+// tailleEntree renvoie la taille cumulée des arguments qui sont des fichiers du dossier data
+func (m *Master) tailleEntree(args []string) int64 {
+	var taille int64
+	for _, arg := range args {
+		if info, ok := m.fichierEntree(arg); ok {
+			taille += info.Size()
+		}
+	}
+	return taille
+}
+
+// tacheJob renvoie la tâche d'une commande pour l'estimation des durées: la commande, les
+// arguments qui ne sont pas des fichiers d'entrée (options du script) et l'environnement
+// d'exécution. Les fichiers d'entrée changent à chaque job, seule leur taille compte.
+func (m *Master) tacheJob(cmd Command) string {
+	parties := []string{cmd.Command}
+	for _, arg := range cmd.Args {
+		if _, ok := m.fichierEntree(arg); !ok {
+			parties = append(parties, arg)
+		}
+	}
+	if cmd.Image != "" {
+		parties = append(parties, "image="+cmd.Image)
+	}
+	if cmd.Venv != "" {
+		parties = append(parties, "venv="+cmd.Venv)
+	}
+	if cmd.Requirements != "" {
+		somme := sha256.Sum256([]byte(cmd.Requirements))
+		parties = append(parties, "requirements="+hex.EncodeToString(somme[:4]))
+	}
+	return strings.Join(parties, " ")
+}
+
+// apprendreDuJob ajoute un job réussi à l'estimateur
+func (m *Master) apprendreDuJob(job Job) {
+	if job.State != JobSucceeded || job.Resources == nil {
+		return
+	}
+	m.estimateur.Add(estimation.Observation{
+		Task:       job.tache(),
+		Worker:     job.WorkerAddr,
+		InputBytes: job.InputBytes,
+		Seconds:    job.Resources.WallSeconds,
+	})
+}
+
+// tache renvoie la tâche du job, la commande seule pour un job repris d'un état sauvegardé
+// avant que la tâche n'y soit enregistrée
+func (job Job) tache() string {
+	if job.Task == "" {
+		return job.Command.Command
+	}
+	return job.Task
+}
+
+// avecEstimation complète un job en attente ou en cours avec sa durée estimée et son heure
+// de fin prévue. Ne pas appeler avec jobsMutex: l'estimateur peut devoir se réajuster.
+func (m *Master) avecEstimation(job Job) Job {
+	jobs := []Job{job}
+	m.avecEstimations(jobs)
+	return jobs[0]
+}
+
+// avecEstimations complète chaque job de jobs comme avecEstimation. L'heure de fin d'un job
+// en attente comprend l'attente des jobs devant lui (attenteFile), calculée une seule fois.
+func (m *Master) avecEstimations(jobs []Job) {
+	var attente map[string]float64
+	calculee := false
+	for i, job := range jobs {
+		if job.State != JobQueued && job.State != JobRunning {
+			continue
+		}
+		estimation, ok := m.estimateur.Estimate(job.tache(), job.WorkerAddr, job.InputBytes)
+		if !ok {
+			continue
+		}
+		jobs[i].Estimate = &estimation
+		if job.State == JobRunning {
+			debut := time.Now().Unix()
+			if job.StartedAt != 0 {
+				debut = job.StartedAt
+			}
+			jobs[i].ETA = debut + int64(estimation.Seconds)
+			continue
+		}
+		if !calculee {
+			attente, calculee = m.attenteFile(), true
+		}
+		// sans worker pour recevoir les jobs, l'attente et donc l'heure de fin sont inconnues
+		if secondes, ok := attente[job.ID]; ok {
+			jobs[i].ETA = time.Now().Unix() + int64(secondes+estimation.Seconds)
+		}
+	}
+}
+
+// attenteFile estime l'attente de chaque job en file: le temps restant des jobs en cours et
+// la durée des jobs en attente créés avant lui, répartis sur les cœurs des workers qui
+// peuvent recevoir des jobs. Un job dont la durée est inconnue ne compte pas. Renvoie nil
+// si aucun worker ne peut recevoir de job.
+func (m *Master) attenteFile() map[string]float64 {
+	capacite := m.capaciteWorkers()
+	if capacite == 0 {
+		return nil
+	}
+
+	m.jobsMutex.Lock()
+	var actifs []Job
+	for _, job := range m.jobs {
+		if job.State == JobQueued || job.State == JobRunning {
+			actifs = append(actifs, *job)
+		}
+	}
+	m.jobsMutex.Unlock()
+	// ordre d'envoi aux workers: les plus anciens d'abord
+	sort.Slice(actifs, func(i, j int) bool {
+		if !actifs[i].creation.Equal(actifs[j].creation) {
+			return actifs[i].creation.Before(actifs[j].creation)
+		}
+		return actifs[i].ID < actifs[j].ID
+	})
+
+	maintenant := time.Now().Unix()
+	devant := 0.0
+	for _, job := range actifs {
+		if job.State != JobRunning {
+			continue
+		}
+		debut := job.StartedAt
+		if debut == 0 {
+			debut = maintenant
+		}
+		if estimation, ok := m.estimateur.Estimate(job.tache(), job.WorkerAddr, job.InputBytes); ok {
+			devant += max(float64(debut)+estimation.Seconds-float64(maintenant), 0)
+		}
+	}
+	attente := make(map[string]float64)
+	for _, job := range actifs {
+		if job.State != JobQueued {
+			continue
+		}
+		attente[job.ID] = devant / float64(capacite)
+		if estimation, ok := m.estimateur.Estimate(job.tache(), job.WorkerAddr, job.InputBytes); ok {
+			devant += estimation.Seconds
+		}
+	}
+	return attente
+}
+
+// capaciteWorkers renvoie le nombre de cœurs des workers disponibles et hors maintenance
+func (m *Master) capaciteWorkers() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	capacite := 0
+	for addr, info := range m.workersInfo {
+		if _, draine := m.drains[addr]; draine || !m.disponibles[addr] {
+			continue
+		}
+		capacite += max(len(info.CPUUsage), 1)
+	}
+	return capacite
+}
+
+// estimatesHandler renvoie l'estimation d'une tâche avec ?task=&worker=&input_bytes=,
+// ou sans paramètre les modèles de chaque tâche et les facteurs de vitesse des workers
+func (m *Master) estimatesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+
+	if q.Get("task") == "" {
+		taches, facteurs := m.estimateur.Params()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tasks":          taches,
+			"worker_factors": facteurs,
+		})
+		return
+	}
+
+	var inputBytes int64
+	if v := q.Get("input_bytes"); v != "" {
+		var err error
+		if inputBytes, err = strconv.ParseInt(v, 10, 64); err != nil || inputBytes < 0 {
+			http.Error(w, "paramètre input_bytes invalide", http.StatusBadRequest)
+			return
+		}
+	}
+	estimation, ok := m.estimateur.Estimate(q.Get("task"), q.Get("worker"), inputBytes)
+	if !ok {
+		http.Error(w, "aucun historique pour cette tâche", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(estimation)
+}
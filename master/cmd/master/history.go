@@ -0,0 +1,328 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// L'historique est écrit par segments: un fichier parquet ne permet pas l'ajout, chaque
+// lot de lignes est donc écrit dans un nouveau fichier et les segments sont fusionnés à
+// la lecture. Un lot est écrit quand il atteint tailleLotHistorique lignes, après
+// delaiLotHistorique, ou à l'arrêt du master. Les segments des jours précédents sont
+// regroupés en un fichier par jour toutes les intervalleFusionHistorique.
+const (
+	tailleLotHistorique = 200
+	delaiLotHistorique  = 10 * time.Second
+	// au delà, les lignes qui n'ont pas pu être écrites sont abandonnées
+	maxAttenteHistorique       = 10000
+	intervalleFusionHistorique = time.Hour
+)
+
+// ajouterHistorique met une ligne en attente du prochain segment
+func (m *Master) ajouterHistorique(ligne CommandHistory) error {
+	m.historyMutex.Lock()
+	defer m.historyMutex.Unlock()
+	if len(m.historiqueAttente) == 0 {
+		m.historiqueDepuis = time.Now()
+	}
+	m.historiqueAttente = append(m.historiqueAttente, ligne)
+	if len(m.historiqueAttente) < tailleLotHistorique {
+		return nil
+	}
+	return m.ecrireSegment()
+}
+
+// viderHistorique écrit les lignes en attente depuis plus de delaiLotHistorique, ou
+// toutes si tout est vrai
+func (m *Master) viderHistorique(tout bool) {
+	m.historyMutex.Lock()
+	defer m.historyMutex.Unlock()
+	if len(m.historiqueAttente) == 0 || (!tout && time.Since(m.historiqueDepuis) < delaiLotHistorique) {
+		return
+	}
+	m.ecrireSegment()
+}
+
+// ecrireSegment écrit les lignes en attente dans un nouveau fichier. Le segment est écrit
+// sous un nom temporaire puis renommé: un segment visible est toujours complet, et aucun
+// fichier existant n'est réécrit. En cas d'échec les lignes restent en attente.
+// historyMutex doit être tenu.
+func (m *Master) ecrireSegment() (err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		m.prom.historyWriteErrors.Inc()
+		m.log.Error("Ecriture de l'historique impossible", "rows", len(m.historiqueAttente), "error", err)
+		if perdues := len(m.historiqueAttente) - maxAttenteHistorique; perdues > 0 {
+			m.log.Error("Lignes d'historique abandonnées", "rows", perdues)
+			m.historiqueAttente = m.historiqueAttente[perdues:]
+		}
+	}()
+	nom := fmt.Sprintf("command_history_%s_%s.parquet", m.historiqueDepuis.Format("2006-01-02_150405"), nouvelIDJob())
+	chemin := filepath.Join(m.conf().HistoryDir, nom)
+	if err := ecrireParquet(chemin+".tmp", m.historiqueAttente); err != nil {
+		return err
+	}
+	if err := os.Rename(chemin+".tmp", chemin); err != nil {
+		os.Remove(chemin + ".tmp")
+		return fmt.Errorf("failed to write Parquet segment: %v", err)
+	}
+	m.historiqueAttente = nil
+	return nil
+}
+
+// ecrireParquet écrit les lignes dans le fichier temporaire, supprimé en cas d'échec
+func ecrireParquet(temporaire string, lignes []CommandHistory) (err error) {
+	f, err := local.NewLocalFileWriter(temporaire)
+	if err != nil {
+		return fmt.Errorf("failed to open Parquet file: %v", err)
+	}
+	pw, err := writer.NewParquetWriter(f, new(CommandHistory), 4)
+	if err != nil {
+		f.Close()
+		os.Remove(temporaire)
+		return fmt.Errorf("failed to create Parquet writer: %v", err)
+	}
+	for _, ligne := range lignes {
+		if err = pw.Write(ligne); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pw.WriteStop()
+	}
+	if errFermeture := f.Close(); err == nil {
+		err = errFermeture
+	}
+	if err != nil {
+		os.Remove(temporaire)
+		return fmt.Errorf("failed to write Parquet segment: %v", err)
+	}
+	return nil
+}
+
+// fusionnerHistorique regroupe les segments des jours précédents dans un fichier par jour,
+// command_history_<date>.parquet, pour que leur nombre ne croisse pas sans limite. Le
+// fichier du jour est écrit à côté puis mis en place, avec la suppression des segments,
+// sous fichiersHistoriqueMutex: une lecture voit les segments ou le fichier du jour, jamais
+// les deux. Un jour dont un fichier est illisible est laissé tel quel.
+func (m *Master) fusionnerHistorique() {
+	dossier := m.conf().HistoryDir
+	segments, err := filepath.Glob(filepath.Join(dossier, "command_history_*_*.parquet"))
+	if err != nil {
+		return
+	}
+	aujourdhui := time.Now().Format("2006-01-02")
+	parJour := make(map[string][]string)
+	for _, segment := range segments {
+		date, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(segment), "command_history_"), "_")
+		if len(date) == len("2006-01-02") && date < aujourdhui {
+			parJour[date] = append(parJour[date], segment)
+		}
+	}
+	for date, segments := range parJour {
+		journalier := filepath.Join(dossier, "command_history_"+date+".parquet")
+		sources := segments
+		if _, err := os.Stat(journalier); err == nil {
+			sources = append([]string{journalier}, segments...)
+		}
+		var lignes []CommandHistory
+		lisibles := true
+		for _, source := range sources {
+			contenu, err := lireFichierHistorique(source)
+			if err != nil {
+				m.log.Warn("Fusion de l'historique impossible, fichier illisible", "file", source, "error", err)
+				lisibles = false
+				break
+			}
+			lignes = append(lignes, contenu...)
+		}
+		if !lisibles {
+			continue
+		}
+		sort.Slice(lignes, func(i, j int) bool { return lignes[i].Timestamp < lignes[j].Timestamp })
+		if err := ecrireParquet(journalier+".tmp", lignes); err != nil {
+			m.log.Error("Fusion de l'historique impossible", "date", date, "error", err)
+			continue
+		}
+		m.fichiersHistoriqueMutex.Lock()
+		err := os.Rename(journalier+".tmp", journalier)
+		if err == nil {
+			for _, segment := range segments {
+				os.Remove(segment)
+			}
+		}
+		m.fichiersHistoriqueMutex.Unlock()
+		if err != nil {
+			os.Remove(journalier + ".tmp")
+			m.log.Error("Fusion de l'historique impossible", "date", date, "error", err)
+			continue
+		}
+		m.log.Info("Segments d'historique fusionnés", "date", date, "segments", len(segments), "rows", len(lignes))
+	}
+}
+
+// lireFichierHistorique lit toutes les lignes d'un fichier parquet d'historique.
+// Le fichier est lu avec son propre schéma puis les colonnes sont associées par nom,
+// ce qui permet de relire les fichiers écrits avant l'ajout de nouvelles colonnes.
+func lireFichierHistorique(chemin string) (lignes []CommandHistory, err error) {
+	fr, err := local.NewLocalFileReader(chemin)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	// parquet-go panique sur certains fichiers corrompus
+	defer func() {
+		if r := recover(); r != nil {
+			lignes, err = nil, fmt.Errorf("fichier parquet invalide: %v", r)
+		}
+	}()
+
+	pr, err := reader.NewParquetReader(fr, nil, 4)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+
+	brutes, err := pr.ReadByNumber(int(pr.GetNumRows()))
+	if err != nil {
+		return nil, err
+	}
+	// les structures générées par parquet-go ont des champs nommés d'après les colonnes
+	// (ex: Worker_addr), que le décodage json associe aux tags sans tenir compte de la casse
+	data, err := json.Marshal(brutes)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &lignes); err != nil {
+		return nil, err
+	}
+	return lignes, nil
+}
+
+// FiltreHistorique restreint les lignes renvoyées par lireHistorique
+type FiltreHistorique struct {
+	From       int64
+	To         int64
+	WorkerAddr string
+	Command    string
+	Status     string
+}
+
+func (f FiltreHistorique) accepte(h CommandHistory) bool {
+	if f.From != 0 && h.Timestamp < f.From {
+		return false
+	}
+	if f.To != 0 && h.Timestamp > f.To {
+		return false
+	}
+	if f.WorkerAddr != "" && h.WorkerAddr != f.WorkerAddr {
+		return false
+	}
+	if f.Command != "" && h.Command != f.Command {
+		return false
+	}
+	if f.Status != "" && h.Status != f.Status {
+		return false
+	}
+	return true
+}
+
+// lireHistorique fusionne tous les fichiers d'historique et les lignes pas encore écrites,
+// et renvoie les lignes correspondant au filtre, de la plus récente à la plus ancienne.
+// La liste des fichiers et les lignes en attente sont relevées ensemble, puis les fichiers
+// sont lus sans bloquer l'ajout de nouvelles lignes.
+func (m *Master) lireHistorique(filtre FiltreHistorique) ([]CommandHistory, error) {
+	// pris avant historyMutex: une fusion en attente ne bloque pas l'ajout de lignes
+	m.fichiersHistoriqueMutex.RLock()
+	defer m.fichiersHistoriqueMutex.RUnlock()
+
+	m.historyMutex.Lock()
+	fichiers, err := filepath.Glob(filepath.Join(m.conf().HistoryDir, "command_history_*.parquet"))
+	attente := append([]CommandHistory(nil), m.historiqueAttente...)
+	m.historyMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	resultat := []CommandHistory{}
+	for _, h := range attente {
+		if filtre.accepte(h) {
+			resultat = append(resultat, h)
+		}
+	}
+	for _, fichier := range fichiers {
+		if info, err := os.Stat(fichier); err != nil || info.Size() == 0 {
+			continue
+		}
+		lignes, err := lireFichierHistorique(fichier)
+		if err != nil {
+			// un fichier corrompu ne doit pas empêcher la lecture des autres, il est laissé tel quel
+			m.log.Warn("Fichier d'historique illisible", "file", fichier, "error", err)
+			continue
+		}
+		for _, h := range lignes {
+			if filtre.accepte(h) {
+				resultat = append(resultat, h)
+			}
+		}
+	}
+	sort.Slice(resultat, func(i, j int) bool { return resultat[i].Timestamp > resultat[j].Timestamp })
+	return resultat, nil
+}
+
+// historyHandler expose l'historique des commandes avec les filtres
+// ?from=&to= (timestamps unix), &worker=, &command=, &status= et &limit=
+func (m *Master) historyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filtre := FiltreHistorique{
+		WorkerAddr: q.Get("worker"),
+		Command:    q.Get("command"),
+		Status:     q.Get("status"),
+	}
+	var err error
+	if v := q.Get("from"); v != "" {
+		if filtre.From, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "paramètre from invalide", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filtre.To, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "paramètre to invalide", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := -1
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || limit < 0 {
+			http.Error(w, "paramètre limit invalide", http.StatusBadRequest)
+			return
+		}
+	}
+
+	lignes, err := m.lireHistorique(filtre)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if limit >= 0 && limit < len(lignes) {
+		lignes = lignes[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lignes)
+}
@@ -0,0 +1,80 @@
+package master
+
+// Types reçus du worker dans la réponse "infos", voir worker/cmd/informationmachine
+
+type LoadAvg struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// CPUDetail répartit le temps CPU global (tous cœurs confondus) en pourcentages
+type CPUDetail struct {
+	User   float64 `json:"user"`
+	System float64 `json:"system"`
+	IOWait float64 `json:"iowait"`
+	Steal  float64 `json:"steal"`
+	Idle   float64 `json:"idle"`
+}
+
+type MemoryInfo struct {
+	TotalBytes      uint64  `json:"total_bytes"`
+	AvailableBytes  uint64  `json:"available_bytes"`
+	UsedBytes       uint64  `json:"used_bytes"`
+	UsedPercent     float64 `json:"used_percent"`
+	SwapTotalBytes  uint64  `json:"swap_total_bytes"`
+	SwapUsedBytes   uint64  `json:"swap_used_bytes"`
+	SwapUsedPercent float64 `json:"swap_used_percent"`
+}
+
+type DiskInfo struct {
+	Mount            string  `json:"mount"`
+	Device           string  `json:"device"`
+	FSType           string  `json:"fs_type"`
+	TotalBytes       uint64  `json:"total_bytes"`
+	UsedBytes        uint64  `json:"used_bytes"`
+	AvailableBytes   uint64  `json:"available_bytes"`
+	UsedPercent      float64 `json:"used_percent"`
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+}
+
+type NetInfo struct {
+	Interface     string  `json:"interface"`
+	RxBytes       uint64  `json:"rx_bytes"`
+	TxBytes       uint64  `json:"tx_bytes"`
+	RxBytesPerSec float64 `json:"rx_bytes_per_sec"`
+	TxBytesPerSec float64 `json:"tx_bytes_per_sec"`
+}
+
+// PressureInfo reprend les moyennes de /proc/pressure/<ressource> (pourcentage de temps bloqué)
+type PressureInfo struct {
+	SomeAvg10  float64 `json:"some_avg10"`
+	SomeAvg60  float64 `json:"some_avg60"`
+	SomeAvg300 float64 `json:"some_avg300"`
+	FullAvg10  float64 `json:"full_avg10"`
+	FullAvg60  float64 `json:"full_avg60"`
+	FullAvg300 float64 `json:"full_avg300"`
+}
+
+// ProcessInfo décrit un processus du worker: CPU sur l'intervalle du relevé (100% pour un
+// cœur entier) et mémoire résidente
+type ProcessInfo struct {
+	PID        int     `json:"pid"`
+	Name       string  `json:"name"`
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+}
+
+// HostInfo regroupe l'état de la machine au-delà de l'utilisation par cœur
+type HostInfo struct {
+	Load     LoadAvg                 `json:"load"`
+	CPU      CPUDetail               `json:"cpu"`
+	Memory   MemoryInfo              `json:"memory"`
+	Disks    []DiskInfo              `json:"disks"`
+	Network  []NetInfo               `json:"network"`
+	Pressure map[string]PressureInfo `json:"pressure,omitempty"` // absent si le noyau ne fournit pas le PSI
+	// Processus qui consomment le plus de CPU et de mémoire, absents des workers plus anciens
+	TopCPU []ProcessInfo `json:"top_cpu,omitempty"`
+	TopRSS []ProcessInfo `json:"top_rss,omitempty"`
+}
@@ -0,0 +1,711 @@
+package master
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"commun/journalisation"
+	"master/cmd/estimation"
+	"master/cmd/joblog"
+)
+
+// Etats possibles d'un job
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "success"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Nombre de lignes de sortie gardées en mémoire par job
+const tailleBufferLogs = 1000
+
+// Progress est le dernier avancement structuré reporté par le script d'un job
+type Progress struct {
+	Percent   float64 `json:"percent"`
+	Stage     string  `json:"stage,omitempty"`
+	ETA       int64   `json:"eta,omitempty"`
+	UpdatedAt int64   `json:"updated_at"`
+}
+
+// ResourceUsage est le bilan des ressources consommées par un job, transmis par le worker
+type ResourceUsage struct {
+	ExitCode      int     `json:"exit_code"`
+	WallSeconds   float64 `json:"wall_seconds"`
+	UserSeconds   float64 `json:"user_cpu_seconds"`
+	SystemSeconds float64 `json:"system_cpu_seconds"`
+	MaxRSSBytes   int64   `json:"max_rss_bytes"`
+	ReadBytes     int64   `json:"read_bytes"`
+	WriteBytes    int64   `json:"write_bytes"`
+}
+
+type Job struct {
+	ID            string               `json:"id"`
+	WorkerAddr    string               `json:"worker_addr"`
+	Command       Command              `json:"command"`
+	State         string               `json:"state"`
+	Error         string               `json:"error,omitempty"`
+	CreatedAt     int64                `json:"created_at"`
+	StartedAt     int64                `json:"started_at,omitempty"`
+	FinishedAt    int64                `json:"finished_at,omitempty"`
+	Progress      *Progress            `json:"progress,omitempty"`
+	Resources     *ResourceUsage       `json:"resources,omitempty"`
+	InputBytes    int64                `json:"input_bytes"`
+	Task          string               `json:"task,omitempty"`     // tâche du job pour l'estimation des durées
+	Estimate      *estimation.Estimate `json:"estimate,omitempty"` // durée prévue, pour les jobs en attente ou en cours
+	ETA           int64                `json:"eta,omitempty"`      // heure de fin prévue (timestamp unix), attente comprise
+	Attempts      int                  `json:"attempts"`
+	SubmittedBy   string               `json:"submitted_by,omitempty"`   // utilisateur de l'API ayant soumis le job
+	ReceivedLines int                  `json:"received_lines,omitempty"` // lignes de sortie du worker déjà reçues, pour s'y rattacher
+	logs          *joblog.Log
+	creation      time.Time
+	demarrage     time.Time
+	aRelancer     bool // le job a été annulé pour être relancé sur un autre worker
+	annule        bool // l'annulation du job a été demandée via l'API et confirmée par le worker
+	annulations   int  // annulations envoyées au worker, sans réponse encore
+	m             *Master
+}
+
+func nouvelIDJob() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// creerJob enregistre un nouveau job et prépare son log
+func (m *Master) creerJob(workerAddr string, cmd Command) *Job {
+	job := &Job{
+		m:          m,
+		ID:         nouvelIDJob(),
+		WorkerAddr: workerAddr,
+		State:      JobQueued,
+		CreatedAt:  time.Now().Unix(),
+		creation:   time.Now(),
+	}
+	cmd.JobID = job.ID
+	job.Command = cmd
+	job.InputBytes = m.tailleEntree(cmd.Args)
+	job.Task = m.tacheJob(cmd)
+
+	logs, err := joblog.New(job.ID, tailleBufferLogs, m.dossierLogsJobs())
+	if err != nil {
+		job.log().Warn("Log du job non persisté", "error", err)
+	}
+	job.logs = logs
+
+	m.jobsMutex.Lock()
+	m.jobs[job.ID] = job
+	m.jobsMutex.Unlock()
+	return job
+}
+
+// log renvoie le journal des jobs avec l'id de ce job
+func (job *Job) log() *slog.Logger {
+	return job.m.logJobs.With(journalisation.CleJob, job.ID)
+}
+
+func (m *Master) getJob(id string) (*Job, bool) {
+	m.jobsMutex.Lock()
+	defer m.jobsMutex.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// oublierJobsTermines retire de la mémoire les jobs terminés depuis plus de job_retention,
+// puis les plus anciens au delà de max_finished_jobs. Leur historique et leur fichier de
+// log restent sur disque.
+func (m *Master) oublierJobsTermines() {
+	conf := m.conf()
+	limite := time.Now().Add(-conf.JobRetention).Unix()
+	m.jobsMutex.Lock()
+	defer m.jobsMutex.Unlock()
+	var termines []*Job
+	for id, job := range m.jobs {
+		switch {
+		case job.FinishedAt == 0:
+		case job.FinishedAt < limite:
+			delete(m.jobs, id)
+		default:
+			termines = append(termines, job)
+		}
+	}
+	if len(termines) <= conf.MaxFinishedJobs {
+		return
+	}
+	sort.Slice(termines, func(i, j int) bool { return termines[i].FinishedAt < termines[j].FinishedAt })
+	for _, job := range termines[:len(termines)-conf.MaxFinishedJobs] {
+		delete(m.jobs, job.ID)
+	}
+}
+
+// attendreWorker renvoie le worker du job, en choisissant un worker disponible s'il
+// n'en a pas encore. Le job reste en attente tant qu'aucun worker ne peut le recevoir,
+// une chaîne vide est renvoyée si le master s'arrête entre temps.
+func (job *Job) attendreWorker() string {
+	if job.m.arretEnCours.Load() || job.estAnnule() {
+		return ""
+	}
+	job.m.jobsMutex.Lock()
+	workerAddr := job.WorkerAddr
+	job.m.jobsMutex.Unlock()
+	if workerAddr != "" {
+		return workerAddr
+	}
+	for {
+		if workerAddr = job.m.choisirWorker(); workerAddr != "" {
+			break
+		}
+		time.Sleep(job.m.conf().PollInterval)
+		if job.m.arretEnCours.Load() || job.estAnnule() {
+			return ""
+		}
+	}
+	job.m.jobsMutex.Lock()
+	job.WorkerAddr = workerAddr
+	job.m.jobsMutex.Unlock()
+	return workerAddr
+}
+
+// estTermine indique si le job a atteint un état final, à appeler verrou jobsMutex pris
+func (job *Job) estTermine() bool {
+	return job.State == JobSucceeded || job.State == JobFailed || job.State == JobCanceled
+}
+
+func (job *Job) estARelancer() bool {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	return job.aRelancer
+}
+
+// relancer remet en attente un job annulé pour être relancé, et renvoie faux
+// si le job n'était pas à relancer
+func (job *Job) relancer() bool {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	if !job.aRelancer || job.annule {
+		return false
+	}
+	job.aRelancer = false
+	job.State = JobQueued
+	job.WorkerAddr = ""
+	job.Progress = nil
+	job.Resources = nil
+	job.ReceivedLines = 0
+	job.logs.Append(joblog.StreamProgress, "Job interrompu, remis en file d'attente")
+	return true
+}
+
+// finAnnulation enregistre la réponse du worker à une annulation du job. Le job n'est
+// marqué à relancer (relance) ou annulé que si le worker a confirmé l'avoir tué: s'il
+// n'a pas pu être joint, le job continue et son résultat est gardé.
+func (job *Job) finAnnulation(confirmee, relance bool) {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	job.annulations--
+	if confirmee && !job.estTermine() {
+		if relance {
+			job.aRelancer = true
+		} else {
+			job.annule = true
+		}
+	}
+	job.m.annulationsFinies.Broadcast()
+}
+
+// attendreAnnulations attend la réponse du worker aux annulations en cours, qui décident
+// de l'issue du job
+func (job *Job) attendreAnnulations() {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	for job.annulations > 0 {
+		job.m.annulationsFinies.Wait()
+	}
+}
+
+// garderReussite oublie une annulation confirmée trop tard: le script a réussi avant
+// d'être tué, il n'est ni annulé ni relancé
+func (job *Job) garderReussite() {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	job.aRelancer = false
+	job.annule = false
+}
+
+func (job *Job) estAnnule() bool {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	return job.annule
+}
+
+// annuler marque annulé un job en attente. Un job en cours n'est marqué annulé que
+// lorsque son worker confirme l'avoir tué: annuler renvoie alors le worker à prévenir
+// avec annulerEnCours. Renvoie une erreur si le job est déjà terminé.
+func (job *Job) annuler() (workerAddr string, err error) {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	if job.estTermine() {
+		return "", fmt.Errorf("job déjà terminé (%s)", job.State)
+	}
+	if job.State != JobRunning {
+		job.annule = true
+		return "", nil
+	}
+	job.annulations++
+	return job.WorkerAddr, nil
+}
+
+func (job *Job) demarrer() {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	job.State = JobRunning
+	job.Attempts++
+	job.demarrage = time.Now()
+	job.StartedAt = job.demarrage.Unix()
+	job.m.prom.dispatchLatency.Observe(job.demarrage.Sub(job.creation).Seconds())
+}
+
+// terminer fixe l'état final du job et ferme son log
+func (job *Job) terminer(err error) {
+	job.m.jobsMutex.Lock()
+	job.FinishedAt = time.Now().Unix()
+	if job.annule {
+		job.State = JobCanceled
+	} else if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.State = JobSucceeded
+	}
+	if !job.demarrage.IsZero() {
+		job.m.prom.jobDuration.WithLabelValues(job.State).Observe(time.Since(job.demarrage).Seconds())
+	}
+	termine := *job
+	job.m.jobsMutex.Unlock()
+	job.logs.Close()
+	job.m.apprendreDuJob(termine)
+}
+
+// ressources renvoie le bilan transmis par le worker, nil s'il n'est pas (encore) connu
+func (job *Job) ressources() *ResourceUsage {
+	job.m.jobsMutex.Lock()
+	defer job.m.jobsMutex.Unlock()
+	return job.Resources
+}
+
+// snapshot renvoie une copie du job lisible sans verrou. L'estimation est calculée après
+// la copie, hors du verrou des jobs.
+func (job *Job) snapshot() Job {
+	job.m.jobsMutex.Lock()
+	copie := *job
+	job.m.jobsMutex.Unlock()
+	return job.m.avecEstimation(copie)
+}
+
+// ajouterSortie range une ligne reçue du worker dans le bon flux du log du job
+func (job *Job) ajouterSortie(ligne string) {
+	ligne = strings.TrimRight(ligne, "\r\n")
+	job.m.jobsMutex.Lock()
+	job.ReceivedLines++
+	job.m.jobsMutex.Unlock()
+	switch {
+	case strings.HasPrefix(ligne, "Output: "):
+		job.logs.Append(joblog.StreamStdout, strings.TrimPrefix(ligne, "Output: "))
+	case strings.HasPrefix(ligne, "Stderr: "):
+		job.logs.Append(joblog.StreamStderr, strings.TrimPrefix(ligne, "Stderr: "))
+	case strings.HasPrefix(ligne, "Progress: "):
+		var p Progress
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(ligne, "Progress: ")), &p); err != nil {
+			job.log().Warn("Progression du job illisible", "error", err)
+			job.logs.Append(joblog.StreamProgress, ligne)
+			return
+		}
+		p.UpdatedAt = time.Now().Unix()
+		job.m.jobsMutex.Lock()
+		job.Progress = &p
+		job.m.jobsMutex.Unlock()
+		job.logs.Append(joblog.StreamProgress, p.String())
+	case strings.HasPrefix(ligne, "Leaving: "):
+		// le worker s'arrête: plus aucun job ne doit lui être envoyé
+		job.m.jobsMutex.Lock()
+		workerAddr := job.WorkerAddr
+		job.m.jobsMutex.Unlock()
+		job.log().Warn("Le worker s'arrête", journalisation.CleWorker, workerAddr, "message", strings.TrimPrefix(ligne, "Leaving: "))
+		job.m.marquerIndisponible(workerAddr)
+		job.logs.Append(joblog.StreamProgress, ligne)
+	case strings.HasPrefix(ligne, "Interrupted: "):
+		job.m.jobsMutex.Lock()
+		job.aRelancer = true
+		job.m.jobsMutex.Unlock()
+		job.logs.Append(joblog.StreamProgress, ligne)
+	case strings.HasPrefix(ligne, "Resources: "):
+		var usage ResourceUsage
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(ligne, "Resources: ")), &usage); err != nil {
+			job.log().Warn("Ressources du job illisibles", "error", err)
+			job.logs.Append(joblog.StreamProgress, ligne)
+			return
+		}
+		job.m.jobsMutex.Lock()
+		job.Resources = &usage
+		job.m.jobsMutex.Unlock()
+		job.logs.Append(joblog.StreamProgress, fmt.Sprintf("Code de sortie %d, %.1fs (CPU %.1fs), RSS max %d Mo",
+			usage.ExitCode, usage.WallSeconds, usage.UserSeconds+usage.SystemSeconds, usage.MaxRSSBytes/(1024*1024)))
+	default:
+		job.logs.Append(joblog.StreamProgress, ligne)
+	}
+}
+
+func (p Progress) String() string {
+	texte := fmt.Sprintf("%.1f%%", p.Percent)
+	if p.Stage != "" {
+		texte += " - " + p.Stage
+	}
+	if p.ETA > 0 {
+		texte += fmt.Sprintf(" (reste %s)", time.Duration(p.ETA)*time.Second)
+	}
+	return texte
+}
+
+func (m *Master) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	m.jobsMutex.Lock()
+	liste := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		liste = append(liste, *job)
+	}
+	m.jobsMutex.Unlock()
+	m.avecEstimations(liste)
+
+	sort.Slice(liste, func(i, j int) bool { return liste[i].CreatedAt > liste[j].CreatedAt })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(liste)
+}
+
+// SoumissionJob est le corps attendu par POST /jobs, sans worker_addr le worker est
+// choisi parmi ceux disponibles. Image demande l'exécution dans un conteneur de cette
+// image, qui doit être autorisée par les workers (section container de leur config).
+// Venv désigne un environnement python existant sur le worker, Requirements le contenu
+// d'un requirements.txt dont le worker crée l'environnement (section venv de sa config).
+type SoumissionJob struct {
+	WorkerAddr   string   `json:"worker_addr"`
+	Args         []string `json:"args"`
+	Image        string   `json:"image,omitempty"`
+	Venv         string   `json:"venv,omitempty"`
+	Requirements string   `json:"requirements,omitempty"`
+}
+
+// PrefixeErreurEnvironnement commence la réponse d'un worker qui n'a pas pu préparer
+// l'environnement python d'un job: le job échoue sans que son script ait été lancé
+const PrefixeErreurEnvironnement = "Erreur_env: "
+
+// Taille maximale des requirements d'un job
+const tailleMaxRequirements = 64 << 10
+
+// verifierEnvironnement vérifie l'environnement demandé par une soumission
+func verifierEnvironnement(soumission SoumissionJob) error {
+	switch {
+	case soumission.Image != "" && !formatImage.MatchString(soumission.Image):
+		return fmt.Errorf("nom d'image invalide: %s", soumission.Image)
+	case soumission.Venv != "" && soumission.Requirements != "":
+		return errors.New("venv et requirements sont exclusifs")
+	case soumission.Image != "" && (soumission.Venv != "" || soumission.Requirements != ""):
+		return errors.New("un job en conteneur trouve ses paquets dans son image, sans venv ni requirements")
+	case soumission.Venv != "" && !filepath.IsAbs(soumission.Venv):
+		return fmt.Errorf("chemin absolu attendu pour venv: %s", soumission.Venv)
+	case len(soumission.Requirements) > tailleMaxRequirements:
+		return fmt.Errorf("requirements de plus de %d octets", tailleMaxRequirements)
+	}
+	return nil
+}
+
+// Une référence d'image: registre, chemin, tag et digest, sans espace ni option du CLI
+// du runtime, comme le vérifie le worker
+var formatImage = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/:@+-]*$`)
+
+// submitJobHandler crée un job run_python sur le worker demandé
+func (m *Master) submitJobHandler(w http.ResponseWriter, r *http.Request) {
+	if m.arretEnCours.Load() {
+		http.Error(w, "master en cours d'arrêt", http.StatusServiceUnavailable)
+		return
+	}
+	var soumission SoumissionJob
+	depot := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if depot {
+		r.Body = http.MaxBytesReader(w, r.Body, tailleMaxDepot)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, "formulaire invalide: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		soumission = SoumissionJob{WorkerAddr: r.FormValue("worker_addr"), Image: r.FormValue("image"),
+			Venv: r.FormValue("venv"), Requirements: r.FormValue("requirements")}
+	} else if err := json.NewDecoder(r.Body).Decode(&soumission); err != nil {
+		http.Error(w, "corps de requête invalide: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if len(soumission.Args) < 1 {
+		http.Error(w, "au moins un argument est nécessaire", http.StatusBadRequest)
+		return
+	}
+	if err := verifierEnvironnement(soumission); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if soumission.WorkerAddr != "" && !m.workerConnu(soumission.WorkerAddr) {
+		http.Error(w, "worker inconnu: "+soumission.WorkerAddr, http.StatusBadRequest)
+		return
+	}
+	if soumission.WorkerAddr != "" && m.estDraine(soumission.WorkerAddr) {
+		http.Error(w, "worker en maintenance: "+soumission.WorkerAddr, http.StatusConflict)
+		return
+	}
+	// le fichier n'est déposé dans data qu'une fois la soumission acceptée: une soumission
+	// refusée ne laisse pas de fichier que la surveillance du dossier ignorerait
+	if depot {
+		nom, statut, err := m.deposerFichier(r)
+		if err != nil {
+			http.Error(w, err.Error(), statut)
+			return
+		}
+		soumission.Args = []string{nom}
+	}
+
+	job := m.envoiCommande(soumission.WorkerAddr, Command{Command: "run_python", Args: soumission.Args,
+		Image: soumission.Image, Venv: soumission.Venv, Requirements: soumission.Requirements})
+	if identite := identiteRequete(r); identite.Nom != "" {
+		m.jobsMutex.Lock()
+		job.SubmittedBy = identite.Nom
+		m.jobsMutex.Unlock()
+		job.log().Info("Job soumis via l'API", "user", identite.Nom)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// Taille maximale d'un fichier envoyé avec POST /jobs
+const tailleMaxDepot = 512 << 20
+
+// deposerFichier écrit dans le dossier data le fichier "file" d'une soumission
+// multipart déjà lue et renvoie son nom, qui devient l'argument du job
+func (m *Master) deposerFichier(r *http.Request) (string, int, error) {
+	source, entete, err := r.FormFile("file")
+	if err != nil {
+		return "", http.StatusBadRequest, fmt.Errorf("fichier manquant: %v", err)
+	}
+	defer source.Close()
+
+	nom := filepath.Base(entete.Filename)
+	if nom == "." || nom == "/" || strings.HasPrefix(nom, ".") {
+		return "", http.StatusBadRequest, fmt.Errorf("nom de fichier invalide: %q", entete.Filename)
+	}
+	dossier := m.conf().DataDir
+	temporaire, err := os.CreateTemp(dossier, ".depot-*")
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	defer os.Remove(temporaire.Name())
+	if _, err := io.Copy(temporaire, source); err != nil {
+		temporaire.Close()
+		return "", http.StatusBadRequest, fmt.Errorf("réception du fichier impossible: %v", err)
+	}
+	if err := temporaire.Close(); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	// le fichier n'apparaît dans data qu'une fois complet, et jamais à la place d'un autre
+	m.fichiersDeposesMutex.Lock()
+	defer m.fichiersDeposesMutex.Unlock()
+	if err := os.Link(temporaire.Name(), filepath.Join(dossier, nom)); err != nil {
+		if os.IsExist(err) {
+			return "", http.StatusConflict, fmt.Errorf("un fichier %s existe déjà dans data", nom)
+		}
+		return "", http.StatusInternalServerError, err
+	}
+	m.fichiersDeposes[nom] = true
+	m.logAPI.Info("Fichier déposé via l'API", "file", nom)
+	return nom, 0, nil
+}
+
+// prendreFichierDepose renvoie vrai, une seule fois, si le fichier a été déposé via l'API
+func (m *Master) prendreFichierDepose(nom string) bool {
+	m.fichiersDeposesMutex.Lock()
+	defer m.fichiersDeposesMutex.Unlock()
+	if !m.fichiersDeposes[nom] {
+		return false
+	}
+	delete(m.fichiersDeposes, nom)
+	return true
+}
+
+// cancelJobHandler annule un job en attente, ou tue son processus s'il est en cours
+func (m *Master) cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.getJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job inconnu", http.StatusNotFound)
+		return
+	}
+	workerAddr, err := job.annuler()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	message := "Annulation demandée"
+	if identite := identiteRequete(r); identite.Nom != "" {
+		message += " par " + identite.Nom
+	}
+	job.logs.Append(joblog.StreamProgress, message)
+	job.log().Info(message)
+	if workerAddr != "" {
+		if err := m.annulerEnCours(job, workerAddr, false); err != nil {
+			job.logs.Append(joblog.StreamProgress, "Annulation impossible, le job continue")
+			job.log().Warn("Annulation sur le worker impossible, le job continue", journalisation.CleWorker, workerAddr, "error", err)
+			http.Error(w, "annulation sur le worker impossible: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+func (m *Master) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.getJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job inconnu", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// jobLogsHandler renvoie les logs d'un job, ou les suit en direct en SSE avec ?follow=true
+func (m *Master) jobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.getJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job inconnu", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("follow") != "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job.logs.Lines())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming non supporté", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	historique, lignes, annuler := job.logs.Subscribe()
+	defer annuler()
+
+	envoyer := func(line joblog.Line) bool {
+		data, _ := json.Marshal(line)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", line.Seq, line.Stream, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for _, line := range historique {
+		if !envoyer(line) {
+			return
+		}
+	}
+	for {
+		select {
+		case line, ouvert := <-lignes:
+			if !ouvert {
+				fmt.Fprintf(w, "event: end\ndata: %s\n\n", job.snapshot().State)
+				flusher.Flush()
+				return
+			}
+			if !envoyer(line) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// intervallePingWebSocket espace les pings envoyés aux clients de jobLogsWebSocket: un
+// client disparu sans fermer la connexion est détecté au ping suivant
+const intervallePingWebSocket = 30 * time.Second
+
+// codecPing envoie une trame ping vide
+var codecPing = websocket.Codec{Marshal: func(any) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// jobLogsWebSocket envoie les logs d'un job en direct sur une WebSocket, une ligne JSON par message
+func (m *Master) jobLogsWebSocket(w http.ResponseWriter, r *http.Request) {
+	job, ok := m.getJob(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job inconnu", http.StatusNotFound)
+		return
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		historique, lignes, annuler := job.logs.Subscribe()
+		defer annuler()
+
+		// le client n'envoie rien: la lecture ne sert qu'à voir la fermeture ou la coupure
+		// de la connexion, pour ne pas garder l'abonnement d'un client parti
+		ferme := make(chan struct{})
+		go func() {
+			defer close(ferme)
+			var message []byte
+			for websocket.Message.Receive(ws, &message) == nil {
+			}
+		}()
+
+		envoyer := func(v any, codec websocket.Codec) bool {
+			ws.SetWriteDeadline(time.Now().Add(intervallePingWebSocket))
+			return codec.Send(ws, v) == nil
+		}
+		for _, line := range historique {
+			if !envoyer(line, websocket.JSON) {
+				return
+			}
+		}
+		ping := time.NewTicker(intervallePingWebSocket)
+		defer ping.Stop()
+		for {
+			select {
+			case line, ouvert := <-lignes:
+				if !ouvert || !envoyer(line, websocket.JSON) {
+					return
+				}
+			case <-ping.C:
+				if !envoyer(nil, codecPing) {
+					return
+				}
+			case <-ferme:
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+}
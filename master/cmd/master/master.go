@@ -0,0 +1,915 @@
+package master
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"commun/journalisation"
+	"commun/mtls"
+	"commun/signature"
+	"master/cmd/estimation"
+	"master/cmd/timeseries"
+	"master/static"
+)
+
+type Command struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	JobID   string   `json:"job_id,omitempty"`
+	// Image du conteneur dans lequel le worker exécute le job, celle du worker si vide
+	Image string `json:"image,omitempty"`
+	// Environnement python du job sur le worker: chemin d'un venv existant ou contenu d'un
+	// requirements.txt, l'interpréteur du worker si les deux sont vides
+	Venv         string `json:"venv,omitempty"`
+	Requirements string `json:"requirements,omitempty"`
+	// Epoch du bail du leader qui envoie la commande: le worker refuse les jobs et
+	// annulations d'un leader plus ancien que le dernier qu'il a vu
+	Epoch int64 `json:"epoch,omitempty"`
+	// Signature de la commande, ajoutée à l'envoi si une clé de signature est configurée. Worker
+	// est l'adresse du destinataire (workers_ip), signée pour qu'un autre worker la refuse.
+	Worker    string `json:"worker,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`
+	Signature string `json:"sig,omitempty"`
+}
+
+// execution renvoie l'environnement demandé par la commande, couvert par sa signature
+func (c Command) execution() map[string]string {
+	execution := map[string]string{}
+	for cle, valeur := range map[string]string{"image": c.Image, "venv": c.Venv, "requirements": c.Requirements} {
+		if valeur != "" {
+			execution[cle] = valeur
+		}
+	}
+	return execution
+}
+
+type CommandHistory struct {
+	JobID        string   `parquet:"name=job_id, type=BYTE_ARRAY, convertedtype=UTF8" json:"job_id"`
+	WorkerAddr   string   `parquet:"name=worker_addr, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY" json:"worker_addr"`
+	Command      string   `parquet:"name=command, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY" json:"command"`
+	Args         []string `parquet:"name=args, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REPEATED" json:"args"`
+	Timestamp    int64    `parquet:"name=timestamp, type=INT64" json:"timestamp"`
+	Status       string   `parquet:"name=status, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY" json:"status"`
+	ErrorMessage string   `parquet:"name=error_message, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY" json:"error_message"`
+	InputBytes   int64    `parquet:"name=input_bytes, type=INT64" json:"input_bytes"`
+	// Tâche du job pour l'estimation des durées, vide dans les fichiers plus anciens
+	Task string `parquet:"name=task, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY" json:"task"`
+	// Ressources consommées par le job, à zéro si le worker ne les a pas transmises
+	ExitCode      int32   `parquet:"name=exit_code, type=INT32" json:"exit_code"`
+	WallSeconds   float64 `parquet:"name=wall_seconds, type=DOUBLE" json:"wall_seconds"`
+	UserSeconds   float64 `parquet:"name=user_cpu_seconds, type=DOUBLE" json:"user_cpu_seconds"`
+	SystemSeconds float64 `parquet:"name=system_cpu_seconds, type=DOUBLE" json:"system_cpu_seconds"`
+	MaxRSSBytes   int64   `parquet:"name=max_rss_bytes, type=INT64" json:"max_rss_bytes"`
+	ReadBytes     int64   `parquet:"name=read_bytes, type=INT64" json:"read_bytes"`
+	WriteBytes    int64   `parquet:"name=write_bytes, type=INT64" json:"write_bytes"`
+}
+
+type WorkerInfo struct {
+	Address            string             `json:"address"`
+	CPUUsage           map[string]float64 `json:"cpu_usage"` // Map pour chaque core, moyenne lissée côté worker
+	CPUUsageInstant    map[string]float64 `json:"cpu_usage_instant,omitempty"`
+	MemoryUsage        float64            `json:"memory_usage"`
+	MemoryUsageInstant float64            `json:"memory_usage_instant,omitempty"`
+	Commands           []Command          `json:"commands"`
+	Machine            string             `json:"nom_machine"`
+	DateConnection     string             `json:"date_connection"`
+	Host               *HostInfo          `json:"host,omitempty"`
+	Drain              *Drain             `json:"drain,omitempty"` // présent si le worker est en maintenance
+}
+
+type WorkerEnVie struct {
+	EtatWorker           string `json:"etat"`
+	CommandeNonExectutee string `json:"commande_non_executee"`
+}
+
+// Master répartit les jobs entre les workers et sert l'API HTTP. Chaque master a son
+// propre état: plusieurs masters peuvent tourner dans le même processus.
+type Master struct {
+	// config est remplacée à chaque rechargement (Recharger), à lire avec conf()
+	config            Config
+	configMutex       sync.RWMutex
+	relire            func() (Config, error) // lecture de la config lors d'un rechargement
+	rechargementMutex sync.Mutex
+	dateConfig        time.Time // date de modification du config.yaml au dernier relevé
+
+	// journaux par composant, leur niveau se règle avec log.levels (jobs=debug...)
+	log         *slog.Logger // démarrage, arrêt, état et config du master
+	logJobs     *slog.Logger
+	logWorkers  *slog.Logger // relevés, maintenances et reprises de contact des workers
+	logElection *slog.Logger
+	logAPI      *slog.Logger
+
+	dossierEtat string
+	urlAnnoncee string
+	dureeBail   time.Duration
+
+	// signataire signe les commandes envoyées aux workers, nil pour des commandes non signées
+	signataire *signature.Signataire
+	// tlsWorkers chiffre et authentifie les connexions aux workers, nil pour des connexions en clair
+	tlsWorkers *tls.Config
+
+	// utilisateurs est nil si l'API n'est pas protégée (pas de users_file)
+	utilisateurs      *annuaire
+	journalAudit      *os.File
+	journalAuditMutex sync.Mutex
+
+	// metriques conserve l'historique des relevés de chaque worker
+	metriques *timeseries.Store
+	// estimateur prédit la durée des jobs à partir de l'historique
+	estimateur *estimation.Model
+	prom       *metriquesProm
+	// historyMutex protège les lignes d'historique pas encore écrites, et sérialise
+	// l'écriture des segments parquet
+	historyMutex      sync.Mutex
+	historiqueAttente []CommandHistory
+	historiqueDepuis  time.Time // arrivée de la plus ancienne ligne en attente
+	// fichiersHistoriqueMutex empêche une fusion de retirer des segments pendant leur
+	// lecture: les lectures le prennent en lecture, la mise en place d'une fusion en écriture
+	fichiersHistoriqueMutex sync.RWMutex
+	historiqueFusion        time.Time // dernière fusion des segments, boucle du leader
+
+	// mutex protège workersInfo, disponibles et drains
+	mutex       sync.Mutex
+	workersInfo map[string]*WorkerInfo
+	disponibles map[string]bool // workers ayant répondu au dernier relevé
+	drains      map[string]*Drain
+	// retires liste les workers retirés de la config qui terminent leurs jobs, avec vrai
+	// si c'est le retrait qui les a mis en maintenance
+	retires map[string]bool
+
+	jobs      map[string]*Job
+	jobsMutex sync.Mutex
+	// annulationsFinies est signalé quand un worker répond à une annulation (jobsMutex)
+	annulationsFinies *sync.Cond
+
+	// fichiersDeposes liste les fichiers écrits dans data par l'API, pour lesquels un job
+	// est déjà créé: la surveillance du dossier ne doit pas en créer un second
+	fichiersDeposes      map[string]bool
+	fichiersDeposesMutex sync.Mutex
+
+	// arretEnCours passe à vrai dès que l'arrêt est demandé: plus aucun job n'est accepté
+	// ni envoyé aux workers
+	arretEnCours atomic.Bool
+	// jobsActifs compte les goroutines executerJob qui n'ont pas encore rendu la main
+	jobsActifs sync.WaitGroup
+	// connexionsJobs garde les connexions ouvertes vers les workers pour les fermer à l'arrêt
+	connexionsJobs      map[net.Conn]struct{}
+	connexionsJobsMutex sync.Mutex
+
+	// estLeader est vrai quand ce master détient le bail
+	estLeader       atomic.Bool
+	bailActuel      Bail // dernier bail lu, protégé par bailActuelMutex
+	bailActuelMutex sync.Mutex
+	idMaster        string // identité de ce master dans le bail
+	// epoch du bail détenu par ce leader, envoyée aux workers avec chaque commande
+	epoch atomic.Int64
+	// finMandat (unix ns) est l'heure à partir de laquelle ce master n'envoie plus de jobs ni
+	// n'écrit l'état sans avoir renouvelé son bail, 0 sans élection
+	finMandat atomic.Int64
+
+	mux      *http.ServeMux
+	listener net.Listener
+	pret     chan struct{} // fermé quand l'API écoute
+	arret    chan struct{} // fermé par Stop, ou par un arrêt forcé
+	arretUne sync.Once
+	cause    error // raison d'un arrêt forcé, lisible une fois arret fermé
+}
+
+// New prépare un master: utilisateurs de l'API, signature, TLS, métriques et estimation
+// des durées. Rien n'est lancé avant Run.
+func New(config Config) (*Master, error) {
+	config = config.AvecDefauts()
+	if err := config.Valider(); err != nil {
+		return nil, fmt.Errorf("config invalide:\n%w", err)
+	}
+	m := &Master{
+		config:          config,
+		dossierEtat:     config.StateDir,
+		dureeBail:       config.LeaseDuration,
+		urlAnnoncee:     strings.TrimSuffix(config.AdvertiseURL, "/"),
+		estimateur:      estimation.New(),
+		workersInfo:     make(map[string]*WorkerInfo),
+		disponibles:     make(map[string]bool),
+		drains:          make(map[string]*Drain),
+		retires:         make(map[string]bool),
+		jobs:            make(map[string]*Job),
+		fichiersDeposes: make(map[string]bool),
+		connexionsJobs:  make(map[net.Conn]struct{}),
+		idMaster:        nomMaster(),
+		pret:            make(chan struct{}),
+		arret:           make(chan struct{}),
+	}
+	m.annulationsFinies = sync.NewCond(&m.jobsMutex)
+	m.relire = func() (Config, error) { return ChargerConfig(config.Home) }
+	journal := config.Logger
+	if journal == nil {
+		journal = slog.Default()
+	}
+	m.log = journal.With(journalisation.CleComposant, "master")
+	m.logJobs = journal.With(journalisation.CleComposant, "jobs")
+	m.logWorkers = journal.With(journalisation.CleComposant, "workers")
+	m.logElection = journal.With(journalisation.CleComposant, "election")
+	m.logAPI = journal.With(journalisation.CleComposant, "api")
+
+	var err error
+	if config.Signing.Active() {
+		if m.signataire, err = signature.ChargerSignataire(config.Signing); err != nil {
+			return nil, fmt.Errorf("configuration de signature invalide: %v", err)
+		}
+		m.log.Info("Commandes aux workers signées")
+	}
+	if config.TLS.Active() {
+		if m.tlsWorkers, err = mtls.ClientConfig(config.TLS); err != nil {
+			return nil, fmt.Errorf("configuration TLS invalide: %v", err)
+		}
+		m.log.Info("Connexions aux workers en TLS mutuel")
+	}
+	if config.UsersFile != "" {
+		if m.utilisateurs, err = chargerAnnuaire(config.UsersFile, m.logAPI); err != nil {
+			return nil, fmt.Errorf("utilisateurs de l'API: %v", err)
+		}
+		if err := m.ouvrirJournalAudit(config.AuditLog); err != nil {
+			return nil, fmt.Errorf("ouverture du journal d'audit impossible: %v", err)
+		}
+	} else {
+		m.logAPI.Warn("Pas de users_file: l'API HTTP est ouverte à tous")
+	}
+
+	// Historique des métriques des workers
+	m.metriques, err = timeseries.New(config.MetricsDir, config.PollInterval, journal.With(journalisation.CleComposant, "metrics"))
+	if err != nil {
+		m.log.Error("Erreur au chargement des métriques des workers", "error", err)
+	}
+
+	// Estimation des durées des jobs à partir de l'historique
+	m.chargerEstimateur()
+
+	m.prom = nouvellesMetriquesProm(m)
+	m.mux = m.routes()
+	return m, nil
+}
+
+// Stop demande l'arrêt du master, Run rend la main une fois l'arrêt terminé
+func (m *Master) Stop() {
+	m.arretUne.Do(func() { close(m.arret) })
+}
+
+// echouer arrête le master sur une erreur, renvoyée par Run
+func (m *Master) echouer(err error) {
+	m.log.Error("Arrêt du master", "error", err)
+	m.arretUne.Do(func() {
+		m.cause = err
+		close(m.arret)
+	})
+}
+
+// Addr renvoie l'adresse sur laquelle écoute l'API, en attendant que Run l'ait ouverte.
+// Elle est vide si le master est arrêté avant.
+func (m *Master) Addr() string {
+	select {
+	case <-m.pret:
+		return m.listener.Addr().String()
+	case <-m.arret:
+		return ""
+	}
+}
+
+// dossierLogsJobs renvoie le dossier des logs persistés des jobs
+func (m *Master) dossierLogsJobs() string {
+	return filepath.Join(m.conf().LogsDir, "jobs")
+}
+
+// Handler renvoie l'API HTTP du master, pour la servir depuis un autre serveur
+func (m *Master) Handler() http.Handler {
+	return m.mux
+}
+
+// logCommandToParquet ajoute une ligne à l'historique des commandes, écrite dans le
+// prochain segment parquet
+func (m *Master) logCommandToParquet(workerAddr string, job *Job, status, errorMsg string, usage *ResourceUsage) error {
+	history := CommandHistory{
+		JobID:        job.ID,
+		WorkerAddr:   workerAddr,
+		Command:      job.Command.Command,
+		Args:         job.Command.Args,
+		Task:         job.Task,
+		Timestamp:    time.Now().Unix(),
+		Status:       status,
+		ErrorMessage: errorMsg,
+		InputBytes:   job.InputBytes,
+	}
+	if usage != nil {
+		history.ExitCode = int32(usage.ExitCode)
+		history.WallSeconds = usage.WallSeconds
+		history.UserSeconds = usage.UserSeconds
+		history.SystemSeconds = usage.SystemSeconds
+		history.MaxRSSBytes = usage.MaxRSSBytes
+		history.ReadBytes = usage.ReadBytes
+		history.WriteBytes = usage.WriteBytes
+	}
+	return m.ajouterHistorique(history)
+}
+
+// dialWorker ouvre une connexion vers un worker, en TLS mutuel si configuré. Un délai
+// nul n'impose pas de limite à la connexion.
+func (m *Master) dialWorker(workerAddr string, delai time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: delai}
+	if m.tlsWorkers == nil {
+		return dialer.Dial("tcp", workerAddr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", workerAddr, m.tlsWorkers)
+}
+
+// envoyerCommande envoie une commande au worker workerAddr, signée pour lui si une clé est configurée
+func (m *Master) envoyerCommande(conn net.Conn, workerAddr string, cmd Command) error {
+	if (cmd.Command == "run_python" || cmd.Command == "cancel") && !m.mandatValide() {
+		return errMandatExpire
+	}
+	cmd.Epoch = m.epoch.Load()
+	if m.signataire != nil {
+		cmd.Worker = workerAddr
+		cmd.Nonce, cmd.Timestamp, cmd.Signature = m.signataire.Signer(workerAddr, cmd.Epoch, cmd.Command, cmd.Args, cmd.JobID, cmd.execution())
+	}
+	return json.NewEncoder(conn).Encode(cmd)
+}
+
+func (m *Master) sendCommandToWorker(workerAddr string, job *Job) error {
+	cmd := job.Command
+	conn, err := m.dialWorker(workerAddr, 0)
+	if err != nil {
+		m.logCommandToParquet(workerAddr, job, "failed", err.Error(), nil) // Log en cas d'erreur de connexion
+		return fmt.Errorf("erreur de connection au worker pour envoie commande: %v", err)
+	}
+	defer conn.Close()
+	m.enregistrerConnexion(conn)
+	defer m.retirerConnexion(conn)
+	if m.arretEnCours.Load() || !m.attendreMandat() {
+		// le master s'arrête, ou a perdu son bail: le job n'est pas envoyé et reste en
+		// attente, repris au redémarrage ou par le prochain leader
+		return errDetache
+	}
+
+	if err := m.envoyerCommande(conn, workerAddr, cmd); err != nil {
+		m.logCommandToParquet(workerAddr, job, "failed", err.Error(), nil) // Log en cas d'échec d'envoi
+		return err
+	}
+	job.demarrer()
+	return m.suivreSortieWorker(workerAddr, job, bufio.NewReader(conn))
+}
+
+// suivreSortieWorker lit les réponses du worker pour le job jusqu'à la fermeture de la
+// connexion et enregistre le résultat dans l'historique
+func (m *Master) suivreSortieWorker(workerAddr string, job *Job, reader *bufio.Reader) error {
+	var erreurWorker error
+	termine := false // le worker a envoyé la dernière ligne du job
+	reussi := false  // la dernière ligne est celle de la réussite du script
+	for {
+		status, err := reader.ReadString('\n')
+		switch {
+		case status == "":
+		case strings.HasPrefix(status, "Attached: "):
+			job.rattacher(status)
+		case strings.HasPrefix(status, "Erreur: job inconnu"):
+			// le worker ne connait plus le job (il a redémarré entre temps), on le relance
+			job.ajouterSortie(status)
+			m.jobsMutex.Lock()
+			job.aRelancer = true
+			m.jobsMutex.Unlock()
+			termine = true
+		default:
+			job.ajouterSortie(status)
+			if strings.HasPrefix(status, "Erreur") || strings.HasPrefix(status, "Commande inconnue") {
+				erreurWorker = fmt.Errorf("%s", strings.TrimSpace(status))
+			}
+			reussi = erreurWorker == nil && strings.HasPrefix(status, "T'as réussi")
+			termine = termine || erreurWorker != nil || strings.HasPrefix(status, "Interrupted: ") || reussi
+		}
+		if err != nil {
+			if m.arretEnCours.Load() && !job.estARelancer() {
+				return errDetache // le job continue sur le worker
+			}
+			if err != io.EOF {
+				return fmt.Errorf("%w: %v", errConnexionPerdue, err)
+			}
+			if !termine {
+				// connexion fermée sans fin de job: le worker s'est arrêté ou l'a coupée
+				return fmt.Errorf("%w: connexion fermée avant la fin du job", errConnexionPerdue)
+			}
+			break // Sortir de la boucle si la connexion est fermée
+		}
+	}
+	// une annulation en cours peut encore marquer le job annulé ou à relancer
+	job.attendreAnnulations()
+	if reussi {
+		// le job s'est terminé avant que l'annulation ne le tue: sa réussite est gardée
+		job.garderReussite()
+	}
+	if job.estAnnule() {
+		m.logCommandToParquet(workerAddr, job, JobCanceled, "job annulé via l'API", job.ressources())
+		return fmt.Errorf("job annulé sur %s", workerAddr)
+	}
+	if job.estARelancer() {
+		m.logCommandToParquet(workerAddr, job, "interrupted", "job interrompu, relancé sur un autre worker", job.ressources())
+		return fmt.Errorf("job interrompu sur %s", workerAddr)
+	}
+	if erreurWorker != nil {
+		statut := "failed"
+		if strings.HasPrefix(erreurWorker.Error(), PrefixeErreurEnvironnement) {
+			// l'environnement python du job n'a pas pu être préparé, le script n'a pas tourné
+			statut = "env_failed"
+		}
+		m.logCommandToParquet(workerAddr, job, statut, erreurWorker.Error(), job.ressources()) // Log en cas d'échec du job
+		return erreurWorker
+	}
+	m.logCommandToParquet(workerAddr, job, "success", "", job.ressources()) // Log de la réussite
+	return nil
+}
+
+func findMissing(list1, list2 []string) (missing []string) {
+	set := make(map[string]struct{}, len(list2))
+	for _, v := range list2 {
+		set[v] = struct{}{}
+	}
+	for _, v := range list1 {
+		if _, found := set[v]; !found {
+			missing = append(missing, v)
+		}
+	}
+	return
+}
+
+// echangerAvecWorker envoie une commande au worker et décode sa réponse dans reponse. La
+// connexion et l'échange sont limités à worker_timeout chacun: un worker bloqué ne
+// retient pas le relevé.
+func (m *Master) echangerAvecWorker(workerAddr string, cmd Command, reponse any) error {
+	delai := m.conf().WorkerTimeout
+	conn, err := m.dialWorker(workerAddr, delai)
+	if err != nil {
+		return fmt.Errorf("connexion impossible: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(delai))
+	if err := m.envoyerCommande(conn, workerAddr, cmd); err != nil {
+		return fmt.Errorf("envoi de la commande %s impossible: %v", cmd.Command, err)
+	}
+	if err := json.NewDecoder(conn).Decode(reponse); err != nil {
+		return fmt.Errorf("réponse illisible: %v", err)
+	}
+	return nil
+}
+
+// commandeInfos demande au worker son état: charge, mémoire, machine
+var commandeInfos = Command{
+	Command: "infos",
+	Args:    []string{"cpu_usage", "memory_usage", "nom_worker", "date", "disponible"}, //argument se sert actuellement a rien
+}
+
+func (m *Master) recupInfosWorkers(workersAddr []string) []string {
+	var nouvIpDispos []string
+	// On boucle sur les adresses ip disponibles et on met à jour leurs états et on signale si un des workers est dead
+	for _, workerAddr := range workersAddr {
+		var info WorkerInfo
+		if err := m.echangerAvecWorker(workerAddr, commandeInfos, &info); err != nil {
+			m.logWorkers.Warn("Relevé du worker impossible", journalisation.CleWorker, workerAddr, "error", err)
+			continue
+		}
+		nouvIpDispos = append(nouvIpDispos, workerAddr)
+		m.updateWorkerInfo(workerAddr, info)
+	}
+	m.majDisponibilite(workersAddr, nouvIpDispos)
+	missing := findMissing(nouvIpDispos, workersAddr)
+	if len(missing) != 0 {
+		m.logWorkers.Warn("Perte de contact avec des workers", "workers", missing)
+	}
+	return nouvIpDispos
+}
+
+func (m *Master) firstConnectionToWorker(workersAddr []string) []string {
+	var IPdispos []string
+	// On boucle sur les adresses ip présentent dans le yaml et on renvoie les adresses ip des workers disponibles.
+	for _, workerAddr := range workersAddr {
+		var info WorkerInfo
+		if err := m.echangerAvecWorker(workerAddr, commandeInfos, &info); err != nil {
+			m.logWorkers.Warn("Relevé du worker impossible", journalisation.CleWorker, workerAddr, "error", err)
+			continue
+		}
+		IPdispos = append(IPdispos, workerAddr)
+		m.logWorkers.Info("Worker disponible", journalisation.CleWorker, workerAddr, "machine", info.Machine)
+		m.updateWorkerInfo(workerAddr, info)
+	}
+	m.majDisponibilite(workersAddr, IPdispos)
+	return IPdispos
+}
+
+// majDisponibilite enregistre quels workers ont répondu au dernier relevé
+func (m *Master) majDisponibilite(workersAddr []string, dispos []string) {
+	m.mutex.Lock()
+	for _, addr := range workersAddr {
+		m.disponibles[addr] = false
+	}
+	for _, addr := range dispos {
+		m.disponibles[addr] = true
+	}
+	m.mutex.Unlock()
+	m.prom.majWorkersUp(workersAddr, dispos)
+}
+
+// marquerIndisponible retire un worker qui s'arrête des workers pouvant recevoir des jobs,
+// jusqu'au prochain relevé où il répondra
+func (m *Master) marquerIndisponible(workerAddr string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.disponibles[workerAddr] = false
+}
+
+func (m *Master) workerConnu(workerAddr string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, connu := m.workersInfo[workerAddr]
+	return connu
+}
+
+// choisirWorker renvoie le worker disponible et hors maintenance le moins chargé en CPU,
+// ou une chaîne vide si aucun worker ne peut recevoir de job
+func (m *Master) choisirWorker() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	choisi := ""
+	meilleureCharge := 0.0
+	for addr, info := range m.workersInfo {
+		if _, draine := m.drains[addr]; draine || !m.disponibles[addr] {
+			continue
+		}
+		charge := 0.0
+		for _, usage := range info.CPUUsage {
+			charge += usage
+		}
+		if len(info.CPUUsage) > 0 {
+			charge /= float64(len(info.CPUUsage))
+		}
+		if choisi == "" || charge < meilleureCharge || (charge == meilleureCharge && addr < choisi) {
+			choisi, meilleureCharge = addr, charge
+		}
+	}
+	return choisi
+}
+
+// function qui envoie une commande python à workerAddr (ip:port) avec les arguments args.
+// Si workerAddr est vide, le worker est choisi au moment de l'envoi.
+func (m *Master) envoiCommandePython(workerAddr string, args ...string) *Job {
+	return m.envoiCommande(workerAddr, Command{
+		Command: "run_python",
+		Args:    args, //le chemin du scrypt python ne sera pas à donner
+	})
+}
+
+// envoiCommande crée le job de la commande cmd et l'envoie à workerAddr, choisi au
+// moment de l'envoi s'il est vide
+func (m *Master) envoiCommande(workerAddr string, cmd Command) *Job {
+	job := m.creerJob(workerAddr, cmd)
+	champs := []any{journalisation.CleCommande, cmd.Command, "args", cmd.Args}
+	if cmd.Image != "" {
+		champs = append(champs, "image", cmd.Image)
+	}
+	if cmd.Venv != "" {
+		champs = append(champs, "venv", cmd.Venv)
+	}
+	if cmd.Requirements != "" {
+		champs = append(champs, "requirements_lines", strings.Count(strings.TrimSpace(cmd.Requirements), "\n")+1)
+	}
+	job.log().Info("Job créé", champs...)
+	m.jobsActifs.Add(1)
+	go m.executerJob(job) // utilisation d'un go routine pour envoyer la commande python
+	return job
+}
+
+// executerJob envoie la commande du job à son worker et attend la fin de son exécution.
+// Un job annulé à l'échéance d'une maintenance est remis en attente puis relancé ailleurs.
+// Un job déjà en cours (reprise après redémarrage du master, coupure de connexion) est
+// rattaché à sa sortie sur le worker. A l'arrêt du master, le job continue sur le worker
+// ou reste en attente, pour être repris au prochain démarrage.
+func (m *Master) executerJob(job *Job) {
+	defer m.jobsActifs.Done()
+	m.jobsMutex.Lock()
+	rattacher := job.State == JobRunning && job.WorkerAddr != ""
+	m.jobsMutex.Unlock()
+	tentatives := 0
+	for {
+		var workerAddr string
+		var err error
+		if rattacher {
+			workerAddr = job.snapshot().WorkerAddr
+			job.log().Info("Rattachement au job", journalisation.CleWorker, workerAddr)
+			err = m.reattacherJob(workerAddr, job)
+		} else {
+			workerAddr = job.attendreWorker()
+			if workerAddr == "" && job.estAnnule() {
+				job.log().Info("Job annulé avant son envoi")
+				job.terminer(nil)
+				return
+			}
+			if workerAddr == "" {
+				job.log().Info("Arrêt du master, job laissé en attente")
+				return
+			}
+			job.log().Info("Worker choisi", journalisation.CleWorker, workerAddr)
+			err = m.sendCommandToWorker(workerAddr, job)
+		}
+		if errors.Is(err, errDetache) {
+			job.log().Info("Job détaché par l'arrêt du master", journalisation.CleWorker, workerAddr)
+			return
+		}
+		if errors.Is(err, errConnexionPerdue) && tentatives < tentativesRattachement && !job.estAnnule() {
+			tentatives++
+			job.log().Warn("Nouvelle tentative de rattachement", journalisation.CleWorker, workerAddr, "error", err, "tentative", tentatives)
+			time.Sleep(2 * time.Second)
+			rattacher = true
+			continue
+		}
+		if job.relancer() {
+			if m.arretEnCours.Load() {
+				job.log().Info("Job interrompu, relancé au redémarrage du master", journalisation.CleWorker, workerAddr)
+				return
+			}
+			job.log().Warn("Job interrompu, relance sur un autre worker", journalisation.CleWorker, workerAddr)
+			rattacher, tentatives = false, 0
+			continue
+		}
+		job.terminer(err)
+		if err != nil {
+			job.log().Error("Job en échec", journalisation.CleWorker, workerAddr, "error", err)
+		} else {
+			job.log().Info("Job terminé", journalisation.CleWorker, workerAddr)
+		}
+		return
+	}
+}
+
+func (m *Master) updateWorkerInfo(workerAddr string, info WorkerInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.workersInfo[workerAddr] = &info
+	m.metriques.Add(workerAddr, pointDepuisInfo(info))
+	m.logWorkers.Debug("Relevé du worker", journalisation.CleWorker, workerAddr, "cpu", info.CPUUsage, "memory", info.MemoryUsage)
+}
+
+func (m *Master) workerInfoHandler(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	reponse := make(map[string]WorkerInfo, len(m.workersInfo))
+	for addr, info := range m.workersInfo {
+		copie := *info
+		copie.Drain = m.drains[addr]
+		reponse[addr] = copie
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reponse)
+}
+
+// routes enregistre les endpoints de l'API HTTP du master
+func (m *Master) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Serve the web interface embedded in the binary
+	fs := http.FileServer(http.FS(static.Files))
+	mux.Handle("/", m.avecRole(RoleViewer, fs.ServeHTTP))
+
+	// Endpoint to get worker information
+	mux.HandleFunc("/workers", m.avecRole(RoleViewer, m.workerInfoHandler))
+	mux.HandleFunc("GET /workers/{addr}/metrics", m.avecRole(RoleViewer, m.workerMetricsHandler))
+	mux.HandleFunc("POST /workers/{addr}/drain", m.avecRole(RoleOperator, m.leaderSeulement(m.drainHandler)))
+	mux.HandleFunc("POST /workers/{addr}/undrain", m.avecRole(RoleOperator, m.leaderSeulement(m.undrainHandler)))
+	mux.HandleFunc("GET /workers/{addr}/jobs", m.avecRole(RoleViewer, m.workerJobsHandler))
+
+	// Endpoint Prometheus
+	mux.HandleFunc("GET /metrics", m.avecRole(RoleViewer, m.prom.handler().ServeHTTP))
+
+	// Endpoints de suivi des jobs
+	mux.HandleFunc("GET /jobs", m.avecRole(RoleViewer, m.jobsHandler))
+	mux.HandleFunc("POST /jobs", m.avecRole(RoleSubmitter, m.leaderSeulement(m.submitJobHandler)))
+	mux.HandleFunc("GET /jobs/{id}", m.avecRole(RoleViewer, m.jobHandler))
+	mux.HandleFunc("POST /jobs/{id}/cancel", m.avecRole(RoleSubmitter, m.leaderSeulement(m.cancelJobHandler)))
+	mux.HandleFunc("GET /jobs/{id}/logs", m.avecRole(RoleViewer, m.jobLogsHandler))
+	mux.HandleFunc("GET /jobs/{id}/logs/ws", m.avecRole(RoleViewer, m.jobLogsWebSocket))
+
+	// Endpoint de consultation de l'historique des commandes
+	mux.HandleFunc("GET /history", m.avecRole(RoleViewer, m.historyHandler))
+
+	// Estimation des durées des jobs
+	mux.HandleFunc("GET /estimates", m.avecRole(RoleViewer, m.estimatesHandler))
+
+	// Master leader, les écritures envoyées à un follower y sont redirigées
+	mux.HandleFunc("GET /leader", m.avecRole(RoleViewer, m.leaderHandler))
+
+	// Journal des actions privilégiées et des accès refusés
+	mux.HandleFunc("GET /audit", m.avecRole(RoleAdmin, m.auditHandler))
+	return mux
+}
+
+// startHTTPServer sert l'API sur listener et renvoie le serveur pour pouvoir l'arrêter
+func (m *Master) startHTTPServer(listener net.Listener) *http.Server {
+	serveur := &http.Server{Handler: m.mux}
+	go func() {
+		m.logAPI.Info("API HTTP en écoute", "addr", listener.Addr().String())
+		if err := serveur.Serve(listener); err != nil && err != http.ErrServerClosed {
+			m.logAPI.Error("Erreur du serveur HTTP", "error", err)
+		}
+	}()
+	return serveur
+}
+
+func lireFichiers(dossier string) (map[string]os.FileInfo, error) {
+	fichiers := make(map[string]os.FileInfo)
+	listeFichiers, err := ioutil.ReadDir(dossier)
+	if err != nil {
+		return nil, err
+	}
+	for _, fichier := range listeFichiers {
+		if strings.HasPrefix(fichier.Name(), ".") {
+			continue // fichiers cachés ou en cours de dépôt
+		}
+		fichiers[fichier.Name()] = fichier
+	}
+	return fichiers, nil
+}
+
+// testRepriseContact renvoie les workers de la config absents de worker_actuel qui
+// répondent de nouveau
+func (m *Master) testRepriseContact(config_ip []string, worker_actuel []string) (retrouves []string) {
+	missing := findMissing(config_ip, worker_actuel) // si l'on perd des workers on rentre dans la boucle
+	for _, workerAddr := range missing {
+		cmd := Command{
+			Command: "vivantoupas",
+			Args:    []string{"est-ce que t'es vivant"}, //argument se sert actuellement a rien
+		}
+		var retour WorkerEnVie
+		if err := m.echangerAvecWorker(workerAddr, cmd, &retour); err != nil {
+			m.logWorkers.Debug("Worker toujours injoignable", journalisation.CleWorker, workerAddr, "error", err)
+			continue
+		}
+		m.logWorkers.Info("Contact repris avec le worker", journalisation.CleWorker, workerAddr, "etat", retour.EtatWorker)
+		retrouves = append(retrouves, workerAddr)
+	}
+	return retrouves
+}
+
+// Run fait tourner le master jusqu'à l'annulation de ctx ou l'appel de Stop, puis l'arrête
+// proprement. Une erreur est renvoyée si le master n'a pas pu démarrer, ou s'il a dû
+// s'arrêter de lui-même (bail de leader perdu).
+func (m *Master) Run(ctx context.Context) error {
+	if err := os.MkdirAll(m.dossierEtat, 0755); err != nil {
+		return fmt.Errorf("création du dossier d'état %s impossible: %v", m.dossierEtat, err)
+	}
+	listener, err := net.Listen("tcp", m.conf().HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("écoute de l'API sur %s impossible: %v", m.conf().HTTPAddr, err)
+	}
+	m.listener = listener
+	close(m.pret)
+	defer m.fermerJournalAudit()
+
+	// pour chaque worker renseigné on essaye de se connecter à lui et de récupérer ses informations
+	WorkersDispos := m.firstConnectionToWorker(m.conf().WorkersIP)
+	m.logWorkers.Info("Workers disponibles", "workers", WorkersDispos, "config", m.conf().WorkersIP)
+
+	serveur := m.startHTTPServer(listener) // Démarrer le serveur HTTP dans une goroutine
+
+	// Seul le master qui détient le bail surveille le dossier data et envoie des jobs
+	promotion := make(chan struct{})
+	go m.election(m.dossierEtat, m.urlAnnoncee, m.dureeBail, promotion)
+
+	dossier := m.conf().DataDir
+	var fichiersPrecedents map[string]os.FileInfo
+	leader := false
+	retrouves := make(chan []string, 1) // workers perdus qui répondent de nouveau
+	for {
+		// config.yaml modifié: workers, intervalle de relevé et dossier data peuvent changer
+		m.surveillerConfig()
+		m.oublierWorkersRetires()
+		select {
+		case liste := <-retrouves:
+			WorkersDispos = append(WorkersDispos, findMissing(liste, WorkersDispos)...)
+		default:
+		}
+		WorkersDispos = m.recupInfosWorkers(garderWorkers(WorkersDispos, m.workersSurveilles()))
+		if d := m.conf().DataDir; d != dossier {
+			m.log.Info("Changement du dossier surveillé", "dir", d, "precedent", dossier)
+			dossier = d
+			if leader {
+				// les fichiers déjà présents dans le nouveau dossier ne sont pas traités
+				if fichiersPrecedents, err = lireFichiers(dossier); err != nil {
+					m.log.Error("Erreur de lecture du dossier", "dir", dossier, "error", err)
+				}
+			}
+		}
+
+		if !leader {
+			select {
+			case <-promotion:
+				leader = true
+				fichiersPrecedents = m.prendreLaMain(WorkersDispos, dossier)
+			default:
+				m.chargerVue()
+			}
+		}
+
+		if leader {
+			fichiersActuels, err := lireFichiers(dossier)
+			if err != nil {
+				m.log.Error("Erreur de lecture du dossier", "dir", dossier, "error", err)
+			} else {
+				// Chercher les nouveaux fichiers en comparant avec les précédents
+				for fichier := range fichiersActuels {
+					if _, existaitDeja := fichiersPrecedents[fichier]; !existaitDeja && !m.prendreFichierDepose(fichier) {
+						m.logJobs.Info("Nouveau fichier détecté", "file", fichier)
+						// le worker est choisi au moment de l'envoi parmi ceux hors maintenance
+						m.envoiCommandePython("", fichier)
+					}
+				}
+
+				// Mettre à jour l'état précédent avec l'état actuel
+				fichiersPrecedents = fichiersActuels
+			}
+
+			m.oublierJobsTermines()
+			m.viderHistorique(false)
+			if time.Since(m.historiqueFusion) >= intervalleFusionHistorique {
+				m.historiqueFusion = time.Now()
+				m.fusionnerHistorique()
+			}
+			// sauvegarde régulière de l'état, pour qu'un autre master puisse prendre le relais
+			if err := m.sauverEtat(fichiersPrecedents); err != nil {
+				m.log.Error("Erreur de sauvegarde de l'état du master", "error", err)
+			}
+		}
+
+		// Pause avant la prochaine vérification (poll_interval), interrompue par l'arrêt
+		select {
+		case <-ctx.Done():
+			m.log.Info("Arrêt demandé", "cause", context.Cause(ctx))
+			m.Stop()
+		case <-m.arret:
+		case <-time.After(m.conf().PollInterval):
+		}
+		select {
+		case <-m.arret:
+			if leader && m.cause == nil {
+				m.arreterMaster(serveur, fichiersPrecedents)
+			} else {
+				// un leader qui a perdu son bail ne touche plus à l'état, repris par le nouveau leader
+				m.arreterFollower(serveur)
+			}
+			return m.cause
+		default:
+		}
+
+		go func(dispos []string) {
+			if liste := m.testRepriseContact(m.workersSurveilles(), dispos); len(liste) > 0 {
+				select {
+				case retrouves <- liste:
+				case <-m.arret:
+				}
+			}
+		}(WorkersDispos)
+	}
+}
+
+// prendreLaMain reprend l'état sauvegardé par le leader précédent (ou au dernier arrêt),
+// puis les jobs que les workers exécutent sans que le master les connaisse. Renvoie les
+// fichiers du dossier data à considérer comme déjà traités.
+func (m *Master) prendreLaMain(workersAddr []string, dossier string) map[string]os.FileInfo {
+	m.oublierVue()
+	fichiersTraites, sauvegarde := m.chargerEtat()
+	m.adopterJobsWorkers(workersAddr, sauvegarde)
+
+	fichiersPrecedents, err := lireFichiers(dossier)
+	if err != nil {
+		m.log.Error("Erreur de lecture du dossier", "dir", dossier, "error", err)
+	}
+	if fichiersTraites != nil {
+		// les fichiers arrivés sans leader sont traités comme nouveaux
+		for fichier := range fichiersPrecedents {
+			if !fichiersTraites[fichier] {
+				delete(fichiersPrecedents, fichier)
+			}
+		}
+	}
+	return fichiersPrecedents
+}
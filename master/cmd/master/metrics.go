@@ -0,0 +1,95 @@
+package master
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var jobsParEtatDesc = prometheus.NewDesc(
+	"compute_balancer_master_jobs",
+	"Nombre de jobs connus du master, par état.",
+	[]string{"state"}, nil,
+)
+
+// metriquesProm sont les métriques Prometheus d'un master, dans son propre registre pour
+// que plusieurs masters puissent tourner dans le même processus
+type metriquesProm struct {
+	registre           *prometheus.Registry
+	dispatchLatency    prometheus.Histogram
+	jobDuration        *prometheus.HistogramVec
+	workerUp           *prometheus.GaugeVec
+	historyWriteErrors prometheus.Counter
+	configReloads      *prometheus.CounterVec
+}
+
+func nouvellesMetriquesProm(m *Master) *metriquesProm {
+	p := &metriquesProm{
+		registre: prometheus.NewRegistry(),
+		dispatchLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "compute_balancer_master_dispatch_latency_seconds",
+			Help:    "Délai entre la création d'un job et son démarrage sur un worker.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "compute_balancer_master_job_duration_seconds",
+			Help:    "Durée d'exécution des jobs terminés, par état final.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		}, []string{"state"}),
+		workerUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compute_balancer_master_worker_up",
+			Help: "1 si le worker répond au master, 0 sinon.",
+		}, []string{"worker"}),
+		historyWriteErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "compute_balancer_master_history_write_errors_total",
+			Help: "Nombre d'échecs d'écriture dans l'historique des commandes.",
+		}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "compute_balancer_master_config_reloads_total",
+			Help: "Nombre de rechargements de la config, par résultat (success, failure).",
+		}, []string{"result"}),
+	}
+	p.registre.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		p.dispatchLatency, p.jobDuration, p.workerUp, p.historyWriteErrors, p.configReloads, jobsCollector{m},
+	)
+	return p
+}
+
+// jobsCollector compte les jobs par état au moment du scrape
+type jobsCollector struct {
+	m *Master
+}
+
+func (jobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jobsParEtatDesc
+}
+
+func (c jobsCollector) Collect(ch chan<- prometheus.Metric) {
+	compteurs := map[string]int{JobQueued: 0, JobRunning: 0, JobSucceeded: 0, JobFailed: 0, JobCanceled: 0}
+	c.m.jobsMutex.Lock()
+	for _, job := range c.m.jobs {
+		compteurs[job.State]++
+	}
+	c.m.jobsMutex.Unlock()
+	for etat, n := range compteurs {
+		ch <- prometheus.MustNewConstMetric(jobsParEtatDesc, prometheus.GaugeValue, float64(n), etat)
+	}
+}
+
+// majWorkersUp met à jour l'état up/down de chaque worker de la config
+func (p *metriquesProm) majWorkersUp(configIP []string, dispos []string) {
+	for _, addr := range findMissing(configIP, dispos) {
+		p.workerUp.WithLabelValues(addr).Set(0)
+	}
+	for _, addr := range dispos {
+		p.workerUp.WithLabelValues(addr).Set(1)
+	}
+}
+
+func (p *metriquesProm) handler() http.Handler {
+	return promhttp.HandlerFor(p.registre, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,192 @@
+package master
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"commun/journalisation"
+	"master/cmd/joblog"
+)
+
+var (
+	// errDetache: le master s'arrête, le job continue sur le worker et sera repris au redémarrage
+	errDetache = errors.New("suivi du job interrompu par l'arrêt du master")
+	// errConnexionPerdue: la connexion au worker a été coupée avant la fin du job
+	errConnexionPerdue = errors.New("connexion au worker perdue")
+)
+
+// Nombre de tentatives de rattachement à un job après une coupure de connexion
+const tentativesRattachement = 3
+
+// JobWorker décrit un job tel que listé par la commande "jobs" du worker
+type JobWorker struct {
+	JobID   string   `json:"job_id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Image   string   `json:"image,omitempty"`
+	Venv    string   `json:"venv,omitempty"`
+	// Requirements est le contenu du requirements.txt du job
+	Requirements string `json:"requirements,omitempty"`
+	State        string `json:"state"` // running ou finished
+	StartedAt    int64  `json:"started_at"`
+	FinishedAt   int64  `json:"finished_at,omitempty"`
+	Lines        int    `json:"lines"`
+}
+
+// listerJobsWorker demande au worker ses jobs en cours et terminés récemment
+func (m *Master) listerJobsWorker(workerAddr string) ([]JobWorker, error) {
+	conn, err := m.dialWorker(workerAddr, m.conf().WorkerTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := m.envoyerCommande(conn, workerAddr, Command{Command: "jobs"}); err != nil {
+		return nil, err
+	}
+	var liste []JobWorker
+	if err := json.NewDecoder(conn).Decode(&liste); err != nil {
+		return nil, fmt.Errorf("réponse du worker illisible: %v", err)
+	}
+	return liste, nil
+}
+
+// reattacherJob reprend le suivi d'un job déjà lancé sur workerAddr, à partir de la
+// dernière ligne de sortie reçue
+func (m *Master) reattacherJob(workerAddr string, job *Job) error {
+	conn, err := m.dialWorker(workerAddr, 0)
+	if err != nil {
+		m.logCommandToParquet(workerAddr, job, "failed", err.Error(), job.ressources())
+		return fmt.Errorf("%w: rattachement impossible: %v", errConnexionPerdue, err)
+	}
+	defer conn.Close()
+	m.enregistrerConnexion(conn)
+	defer m.retirerConnexion(conn)
+
+	m.jobsMutex.Lock()
+	depuis := job.ReceivedLines
+	m.jobsMutex.Unlock()
+	attach := Command{Command: "attach", Args: []string{job.ID, strconv.Itoa(depuis)}, JobID: job.ID}
+	if err := m.envoyerCommande(conn, workerAddr, attach); err != nil {
+		m.logCommandToParquet(workerAddr, job, "failed", err.Error(), job.ressources())
+		return err
+	}
+	return m.suivreSortieWorker(workerAddr, job, bufio.NewReader(conn))
+}
+
+// rattacher recale la position du job dans la sortie du worker sur la ligne "Attached: n"
+func (job *Job) rattacher(ligne string) {
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(ligne, "Attached: ")))
+	if err != nil {
+		job.log().Warn("Rattachement du job illisible", "line", ligne)
+		return
+	}
+	job.m.jobsMutex.Lock()
+	perdues := n - job.ReceivedLines
+	job.ReceivedLines = n
+	job.m.jobsMutex.Unlock()
+	if perdues > 0 {
+		job.logs.Append(joblog.StreamProgress, fmt.Sprintf("%d lignes de sortie perdues par le worker", perdues))
+	}
+}
+
+// adopterJobsWorkers reprend le suivi des jobs que les workers exécutent ou ont terminé
+// sans que le master les connaisse, par exemple après un arrêt brutal du master. Un job
+// terminé n'est repris que s'il a fini après la sauvegarde de l'état (zéro sans état) et
+// n'est pas déjà dans l'historique: sinon le master l'a déjà enregistré, puis oublié.
+func (m *Master) adopterJobsWorkers(workersAddr []string, sauvegarde time.Time) {
+	listes := make(map[string][]JobWorker, len(workersAddr))
+	var debutTermines time.Time // début du plus ancien job terminé à vérifier dans l'historique
+	for _, workerAddr := range workersAddr {
+		liste, err := m.listerJobsWorker(workerAddr)
+		if err != nil {
+			m.logWorkers.Warn("Liste des jobs du worker indisponible", journalisation.CleWorker, workerAddr, "error", err)
+			continue
+		}
+		listes[workerAddr] = liste
+		for _, jw := range liste {
+			if debut := time.Unix(jw.StartedAt, 0); jw.State == "finished" && (debutTermines.IsZero() || debut.Before(debutTermines)) {
+				debutTermines = debut
+			}
+		}
+	}
+	var historique map[string]bool
+	if !debutTermines.IsZero() {
+		historique = m.jobsDeLHistorique(debutTermines)
+	}
+
+	for _, workerAddr := range workersAddr {
+		for _, jw := range listes[workerAddr] {
+			if _, connu := m.getJob(jw.JobID); connu || strings.HasPrefix(jw.JobID, "pid-") {
+				continue
+			}
+			if jw.State == "finished" && (jw.FinishedAt <= sauvegarde.Unix() || historique[jw.JobID]) {
+				continue
+			}
+			job := &Job{
+				m:          m,
+				ID:         jw.JobID,
+				WorkerAddr: workerAddr,
+				Command: Command{Command: jw.Command, Args: jw.Args, JobID: jw.JobID,
+					Image: jw.Image, Venv: jw.Venv, Requirements: jw.Requirements},
+				State:      JobRunning,
+				CreatedAt:  jw.StartedAt,
+				StartedAt:  jw.StartedAt,
+				InputBytes: m.tailleEntree(jw.Args),
+				Attempts:   1,
+				creation:   time.Unix(jw.StartedAt, 0),
+				demarrage:  time.Unix(jw.StartedAt, 0),
+			}
+			logs, err := joblog.New(job.ID, tailleBufferLogs, m.dossierLogsJobs())
+			if err != nil {
+				job.log().Warn("Log du job non persisté", "error", err)
+			}
+			job.logs = logs
+
+			m.jobsMutex.Lock()
+			m.jobs[job.ID] = job
+			m.jobsMutex.Unlock()
+			job.log().Info("Job inconnu trouvé sur un worker, rattachement", journalisation.CleWorker, workerAddr, "state", jw.State)
+			m.jobsActifs.Add(1)
+			go m.executerJob(job)
+		}
+	}
+}
+
+// jobsDeLHistorique renvoie les jobs inscrits dans l'historique depuis le début du plus
+// ancien job terminé que garde un worker
+func (m *Master) jobsDeLHistorique(depuis time.Time) map[string]bool {
+	ids := make(map[string]bool)
+	lignes, err := m.lireHistorique(FiltreHistorique{From: depuis.Unix()})
+	if err != nil {
+		m.log.Warn("Historique illisible, jobs terminés des workers repris", "error", err)
+		return ids
+	}
+	for _, ligne := range lignes {
+		ids[ligne.JobID] = true
+	}
+	return ids
+}
+
+// workerJobsHandler renvoie les jobs connus du worker lui-même
+func (m *Master) workerJobsHandler(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	if !m.workerConnu(addr) {
+		http.Error(w, "worker inconnu: "+addr, http.StatusNotFound)
+		return
+	}
+	liste, err := m.listerJobsWorker(addr)
+	if err != nil {
+		http.Error(w, "worker injoignable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(liste)
+}
@@ -0,0 +1,188 @@
+package master
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"commun/journalisation"
+)
+
+// conf renvoie la config en vigueur, qui peut changer à chaque rechargement
+func (m *Master) conf() Config {
+	m.configMutex.RLock()
+	defer m.configMutex.RUnlock()
+	return m.config
+}
+
+// SourceConfig remplace la lecture de la config lors d'un rechargement, ChargerConfig(home)
+// par défaut. Le programme qui lance le master y ajoute par exemple ses options de la ligne
+// de commande.
+func (m *Master) SourceConfig(relire func() (Config, error)) {
+	m.rechargementMutex.Lock()
+	defer m.rechargementMutex.Unlock()
+	m.relire = relire
+}
+
+// Recharger relit la config et l'applique sans redémarrer: workers ajoutés ou retirés,
+// poll_interval, worker_timeout, dossiers surveillés et rétention des jobs. Une config
+// invalide est rejetée en entier et la config précédente reste en vigueur. Les autres clés
+// ne sont prises en compte qu'au redémarrage du master: écoute de l'API, journal, élection,
+// certificats, clés et utilisateurs sont ouverts ou chargés au démarrage.
+func (m *Master) Recharger() error {
+	m.rechargementMutex.Lock()
+	defer m.rechargementMutex.Unlock()
+
+	nouvelle, err := m.relire()
+	if err == nil {
+		nouvelle = nouvelle.AvecDefauts()
+		err = nouvelle.Valider()
+	}
+	if err != nil {
+		m.prom.configReloads.WithLabelValues("failure").Inc()
+		err = fmt.Errorf("config rejetée, la config précédente reste en vigueur:\n%w", err)
+		m.log.Error("Rechargement de la config", "error", err)
+		return err
+	}
+
+	ancienne := m.conf()
+	appliquee := ancienne
+	appliquee.WorkersIP = nouvelle.WorkersIP
+	appliquee.PollInterval = nouvelle.PollInterval
+	appliquee.WorkerTimeout = nouvelle.WorkerTimeout
+	appliquee.DataDir = nouvelle.DataDir
+	appliquee.HistoryDir = nouvelle.HistoryDir
+	appliquee.LogsDir = nouvelle.LogsDir
+	appliquee.JobRetention = nouvelle.JobRetention
+	appliquee.MaxFinishedJobs = nouvelle.MaxFinishedJobs
+	if ignorees := clesModifiees(appliquee, nouvelle); len(ignorees) > 0 {
+		m.log.Warn("Rechargement de la config: redémarrage nécessaire", "keys", ignorees)
+	}
+
+	m.configMutex.Lock()
+	m.config = appliquee
+	m.configMutex.Unlock()
+	m.majPoolWorkers(ancienne.WorkersIP, appliquee.WorkersIP)
+	m.metriques.Intervalle(appliquee.PollInterval)
+
+	m.prom.configReloads.WithLabelValues("success").Inc()
+	if modifiees := clesModifiees(ancienne, appliquee); len(modifiees) > 0 {
+		m.log.Info("Config rechargée", "keys", modifiees)
+	} else {
+		m.log.Info("Config rechargée, aucun changement")
+	}
+	return nil
+}
+
+// clesModifiees renvoie les clés yaml dont la valeur diffère entre a et b
+func clesModifiees(a, b Config) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var cles []string
+	for i := 0; i < va.NumField(); i++ {
+		cle, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("yaml"), ",")
+		if cle == "" || cle == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			cles = append(cles, cle)
+		}
+	}
+	return cles
+}
+
+// surveillerConfig recharge la config quand le fichier config.yaml a été modifié depuis
+// le dernier passage. Sans fichier (master configuré par programme), rien n'est surveillé.
+func (m *Master) surveillerConfig() {
+	info, err := os.Stat(fichierConfig(m.conf().Home))
+	if err != nil {
+		return
+	}
+	if m.dateConfig.IsZero() {
+		m.dateConfig = info.ModTime()
+		return
+	}
+	if info.ModTime().Equal(m.dateConfig) {
+		return
+	}
+	// la date est retenue même si la config est rejetée, pour ne pas la relire en boucle
+	m.dateConfig = info.ModTime()
+	m.log.Info("Fichier de config modifié, rechargement")
+	m.Recharger()
+}
+
+// majPoolWorkers ajoute les nouveaux workers de la config, qui seront contactés au prochain
+// relevé, et met en maintenance ceux qui en ont été retirés: ils terminent leurs jobs en
+// cours puis sont oubliés (oublierWorkersRetires). Un worker remis dans la config avant
+// d'être oublié sort de la maintenance, si c'est le retrait qui l'y avait mis.
+func (m *Master) majPoolWorkers(anciens, nouveaux []string) {
+	for _, addr := range findMissing(nouveaux, anciens) {
+		m.mutex.Lock()
+		drainParRetrait, retire := m.retires[addr]
+		delete(m.retires, addr)
+		m.mutex.Unlock()
+		if retire && drainParRetrait {
+			m.undrainWorker(addr)
+		}
+		m.logWorkers.Info("Worker ajouté à la config", journalisation.CleWorker, addr)
+	}
+	for _, addr := range findMissing(anciens, nouveaux) {
+		drainParRetrait := !m.estDraine(addr)
+		if drainParRetrait {
+			m.drainerWorker(addr, 0)
+		}
+		m.mutex.Lock()
+		m.retires[addr] = drainParRetrait
+		m.mutex.Unlock()
+		m.logWorkers.Info("Worker retiré de la config, oublié à la fin de ses jobs", journalisation.CleWorker, addr)
+	}
+}
+
+// workersSurveilles renvoie les workers de la config et ceux qui en ont été retirés mais
+// exécutent encore des jobs
+func (m *Master) workersSurveilles() []string {
+	workers := append([]string(nil), m.conf().WorkersIP...)
+	n := len(workers)
+	m.mutex.Lock()
+	for addr := range m.retires {
+		workers = append(workers, addr)
+	}
+	m.mutex.Unlock()
+	sort.Strings(workers[n:])
+	return workers
+}
+
+// oublierWorkersRetires oublie les workers retirés de la config qui n'ont plus de job en cours
+func (m *Master) oublierWorkersRetires() {
+	m.jobsMutex.Lock()
+	occupes := make(map[string]bool)
+	for _, job := range m.jobs {
+		if job.State == JobRunning {
+			occupes[job.WorkerAddr] = true
+		}
+	}
+	m.jobsMutex.Unlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for addr := range m.retires {
+		if occupes[addr] {
+			continue
+		}
+		if drain, existe := m.drains[addr]; existe && drain.timer != nil {
+			drain.timer.Stop()
+		}
+		delete(m.drains, addr)
+		delete(m.workersInfo, addr)
+		delete(m.disponibles, addr)
+		delete(m.retires, addr)
+		m.prom.workerUp.DeleteLabelValues(addr)
+		m.logWorkers.Info("Worker retiré de la config et sans job en cours, oublié", journalisation.CleWorker, addr)
+	}
+}
+
+// garderWorkers renvoie les workers de liste présents dans surveilles
+func garderWorkers(liste, surveilles []string) []string {
+	return findMissing(liste, findMissing(liste, surveilles))
+}
@@ -0,0 +1,1015 @@
+package master
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
+
+	"master/cmd/estimation"
+	"master/cmd/flotte"
+	"master/cmd/joblog"
+)
+
+// lancerFlotte crée un master dans un dossier temporaire, démarre n workers simulés et
+// fait le premier relevé des workers comme au démarrage du master
+func lancerFlotte(t *testing.T, n int, c flotte.Comportement) (*Master, flotte.Flotte) {
+	t.Helper()
+	f, err := flotte.Lancer(n, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Arreter)
+	m := nouveauMaster(t, Config{WorkersIP: f.Adresses()})
+	t.Cleanup(func() {
+		if !m.attendreJobs(15 * time.Second) {
+			t.Error("des jobs sont encore en cours à la fin du test")
+		}
+	})
+	if dispos := m.firstConnectionToWorker(m.config.WorkersIP); len(dispos) != n {
+		t.Fatalf("%d workers disponibles sur %d", len(dispos), n)
+	}
+	return m, f
+}
+
+// nouveauMaster crée un master avec config, dans un dossier temporaire si config.Home
+// est vide
+func nouveauMaster(t *testing.T, config Config) *Master {
+	t.Helper()
+	if config.Home == "" {
+		config.Home = t.TempDir()
+	}
+	for _, dossier := range []string{"history", "data", "logs"} {
+		if err := os.MkdirAll(config.Home+"/"+dossier, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// attendreFin attend que le job soit terminé et renvoie son état final
+func attendreFin(t *testing.T, job *Job) Job {
+	t.Helper()
+	limite := time.Now().Add(20 * time.Second)
+	for time.Now().Before(limite) {
+		etat := job.snapshot()
+		if etat.State != JobQueued && etat.State != JobRunning {
+			return etat
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("job %s toujours %s", job.ID, job.snapshot().State)
+	return Job{}
+}
+
+// attendreLignes attend que le master ait reçu au moins n lignes de sortie du job
+func attendreLignes(t *testing.T, job *Job, n int) {
+	t.Helper()
+	limite := time.Now().Add(10 * time.Second)
+	for job.snapshot().ReceivedLines < n {
+		if time.Now().After(limite) {
+			t.Fatalf("job %s: %d lignes reçues sur %d", job.ID, job.snapshot().ReceivedLines, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sorties renvoie les lignes de sortie standard du job
+func sorties(job *Job) []string {
+	var lignes []string
+	for _, l := range job.logs.Lines() {
+		if l.Stream == joblog.StreamStdout {
+			lignes = append(lignes, l.Text)
+		}
+	}
+	return lignes
+}
+
+func TestJobSurLeWorkerLeMoinsCharge(t *testing.T) {
+	m, f := lancerFlotte(t, 3, flotte.Comportement{Lignes: 2})
+	f[0].Changer(flotte.Comportement{CPU: 80, Lignes: 2})
+	f[1].Changer(flotte.Comportement{CPU: 10, Lignes: 2})
+	f[2].Changer(flotte.Comportement{CPU: 50, Lignes: 2})
+	m.recupInfosWorkers(m.config.WorkersIP)
+
+	job := attendreFin(t, m.envoiCommandePython("", "a.laz"))
+	if job.State != JobSucceeded || job.WorkerAddr != f[1].Addr {
+		t.Fatalf("job %s sur %s, attendu success sur %s", job.State, job.WorkerAddr, f[1].Addr)
+	}
+
+	// un worker en maintenance ne reçoit plus de job
+	m.drainerWorker(f[1].Addr, 0)
+	job = attendreFin(t, m.envoiCommandePython("", "b.laz"))
+	if job.WorkerAddr != f[2].Addr {
+		t.Fatalf("job sur %s, attendu %s", job.WorkerAddr, f[2].Addr)
+	}
+}
+
+func TestWorkerLent(t *testing.T) {
+	m, _ := lancerFlotte(t, 1, flotte.Comportement{Lignes: 4, Intervalle: 100 * time.Millisecond})
+
+	enCours := m.envoiCommandePython("", "lent.laz")
+	attendreLignes(t, enCours, 2)
+	if etat := enCours.snapshot().State; etat != JobRunning {
+		t.Fatalf("job %s pendant son exécution, attendu running", etat)
+	}
+	job := attendreFin(t, enCours)
+	if job.State != JobSucceeded || len(sorties(enCours)) != 4 {
+		t.Fatalf("job %s avec %d lignes, attendu success avec 4", job.State, len(sorties(enCours)))
+	}
+	if job.Resources == nil || job.Resources.WallSeconds < 0.4 {
+		t.Fatalf("ressources du job non transmises: %+v", job.Resources)
+	}
+}
+
+func TestScriptEnEchec(t *testing.T) {
+	m, _ := lancerFlotte(t, 1, flotte.Comportement{Lignes: 1, Echec: true})
+
+	job := attendreFin(t, m.envoiCommandePython("", "faux.laz"))
+	if job.State != JobFailed || !strings.Contains(job.Error, "Erreur3") {
+		t.Fatalf("job %s (%s), attendu failed avec l'erreur du worker", job.State, job.Error)
+	}
+	if job.Attempts != 1 {
+		t.Fatalf("%d tentatives, un script en échec ne doit pas être relancé", job.Attempts)
+	}
+}
+
+func TestArretDuWorkerRelanceAilleurs(t *testing.T) {
+	m, f := lancerFlotte(t, 2, flotte.Comportement{Lignes: 2})
+	f[0].Changer(flotte.Comportement{CPU: 5, Lignes: 4, Arret: true})
+	f[1].Changer(flotte.Comportement{CPU: 50, Lignes: 2})
+	m.recupInfosWorkers(m.config.WorkersIP)
+
+	enCours := m.envoiCommandePython("", "relance.laz")
+	job := attendreFin(t, enCours)
+	if job.State != JobSucceeded || job.WorkerAddr != f[1].Addr || job.Attempts != 2 {
+		t.Fatalf("job %s sur %s en %d tentatives, attendu success sur %s en 2", job.State, job.WorkerAddr, job.Attempts, f[1].Addr)
+	}
+	if f[0].Lancements(job.ID) != 1 || f[1].Lancements(job.ID) != 1 {
+		t.Fatal("le job doit être lancé une fois sur chaque worker")
+	}
+}
+
+func TestEcheanceDeMaintenanceRelanceAilleurs(t *testing.T) {
+	m, f := lancerFlotte(t, 2, flotte.Comportement{Lignes: 2})
+	f[0].Changer(flotte.Comportement{CPU: 5, Lignes: 50, Intervalle: 50 * time.Millisecond})
+	f[1].Changer(flotte.Comportement{CPU: 50, Lignes: 2})
+	m.recupInfosWorkers(m.config.WorkersIP)
+
+	enCours := m.envoiCommandePython("", "maintenance.laz")
+	attendreLignes(t, enCours, 1)
+	m.drainerWorker(f[0].Addr, 10*time.Millisecond)
+	job := attendreFin(t, enCours)
+	if job.State != JobSucceeded || job.WorkerAddr != f[1].Addr || job.Attempts != 2 {
+		t.Fatalf("job %s sur %s en %d tentatives, attendu success sur %s en 2", job.State, job.WorkerAddr, job.Attempts, f[1].Addr)
+	}
+}
+
+// Le job se termine entre le relevé des jobs à annuler et la demande d'annulation: le
+// worker ne le connait plus comme en cours, sa réussite est gardée et il n'est pas relancé
+func TestEcheanceDeMaintenanceApresLaFinDuJob(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 3, Intervalle: 50 * time.Millisecond})
+
+	enCours := m.envoiCommandePython("", "fini.laz")
+	attendreLignes(t, enCours, 1)
+	m.jobsMutex.Lock()
+	enCours.annulations++
+	m.jobsMutex.Unlock()
+	time.Sleep(500 * time.Millisecond)
+
+	err := m.annulerSurWorker(f[0].Addr, enCours.ID)
+	if err == nil {
+		t.Fatal("annulation confirmée pour un job terminé")
+	}
+	enCours.finAnnulation(false, true)
+	job := attendreFin(t, enCours)
+	if job.State != JobSucceeded || f[0].Lancements(job.ID) != 1 {
+		t.Fatalf("job %s lancé %d fois, attendu success sans relance", job.State, f[0].Lancements(job.ID))
+	}
+}
+
+func TestCoupureDeConnexionRattachement(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 5, Intervalle: 20 * time.Millisecond, CoupureApres: 2})
+
+	enCours := m.envoiCommandePython("", "coupure.laz")
+	job := attendreFin(t, enCours)
+	if job.State != JobSucceeded {
+		t.Fatalf("job %s (%s), attendu success après rattachement", job.State, job.Error)
+	}
+	if f[0].Lancements(job.ID) != 1 {
+		t.Fatalf("job lancé %d fois, le master doit se rattacher sans relancer", f[0].Lancements(job.ID))
+	}
+	if lignes := sorties(enCours); len(lignes) != 5 || lignes[2] != "ligne 2" {
+		t.Fatalf("sortie %v, attendu les 5 lignes une seule fois", lignes)
+	}
+}
+
+func TestPanneEtRedemarrageDuWorker(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 6, Intervalle: 50 * time.Millisecond})
+
+	enCours := m.envoiCommandePython("", "panne.laz")
+	attendreLignes(t, enCours, 2)
+	// le worker meurt et redémarre sans le job: il est relancé au rattachement
+	f[0].Arreter()
+	if err := f[0].Redemarrer(); err != nil {
+		t.Fatal(err)
+	}
+	job := attendreFin(t, enCours)
+	if job.State != JobSucceeded || job.Attempts != 2 {
+		t.Fatalf("job %s en %d tentatives, attendu success en 2", job.State, job.Attempts)
+	}
+}
+
+func TestPanneDefinitiveDuWorker(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 6, Intervalle: 50 * time.Millisecond})
+
+	enCours := m.envoiCommandePython("", "panne.laz")
+	attendreLignes(t, enCours, 2)
+	f[0].Arreter()
+	job := attendreFin(t, enCours)
+	if job.State != JobFailed || !strings.Contains(job.Error, errConnexionPerdue.Error()) {
+		t.Fatalf("job %s (%s), attendu failed sur perte de connexion", job.State, job.Error)
+	}
+}
+
+func TestRepriseDeContactAvecUnWorker(t *testing.T) {
+	m, f := lancerFlotte(t, 2, flotte.Comportement{})
+
+	f[1].Arreter()
+	dispos := m.recupInfosWorkers(m.config.WorkersIP)
+	if len(dispos) != 1 || m.choisirWorker() != f[0].Addr {
+		t.Fatalf("workers disponibles %v, attendu seulement %s", dispos, f[0].Addr)
+	}
+	if retrouves := m.testRepriseContact(m.config.WorkersIP, dispos); len(retrouves) != 0 {
+		t.Fatalf("worker arrêté retrouvé: %v", retrouves)
+	}
+
+	if err := f[1].Redemarrer(); err != nil {
+		t.Fatal(err)
+	}
+	retrouves := m.testRepriseContact(m.config.WorkersIP, dispos)
+	if len(retrouves) != 1 || retrouves[0] != f[1].Addr {
+		t.Fatalf("workers retrouvés %v, attendu %s", retrouves, f[1].Addr)
+	}
+	if dispos = m.recupInfosWorkers(append(dispos, retrouves...)); len(dispos) != 2 {
+		t.Fatalf("workers disponibles %v après reprise de contact", dispos)
+	}
+}
+
+func TestWorkerMuetNeBloquePasLeReleve(t *testing.T) {
+	// un worker qui accepte la connexion sans jamais répondre
+	muet, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer muet.Close()
+	go func() {
+		for {
+			conn, err := muet.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	f, err := flotte.Lancer(1, flotte.Comportement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Arreter)
+	m := nouveauMaster(t, Config{WorkersIP: []string{muet.Addr().String(), f[0].Addr}, WorkerTimeout: 200 * time.Millisecond})
+
+	debut := time.Now()
+	dispos := m.recupInfosWorkers(m.config.WorkersIP)
+	if duree := time.Since(debut); duree > 2*time.Second {
+		t.Fatalf("relevé de %v avec un worker muet", duree)
+	}
+	if len(dispos) != 1 || dispos[0] != f[0].Addr {
+		t.Fatalf("workers disponibles %v, attendu seulement %s", dispos, f[0].Addr)
+	}
+}
+
+func TestAnnulationDUnJobEnCours(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 50, Intervalle: 50 * time.Millisecond})
+
+	enCours := m.envoiCommandePython("", "long.laz")
+	attendreLignes(t, enCours, 1)
+	workerAddr, err := enCours.annuler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.annulerEnCours(enCours, workerAddr, false); err != nil {
+		t.Fatal(err)
+	}
+	job := attendreFin(t, enCours)
+	if job.State != JobCanceled || f[0].Lancements(job.ID) != 1 {
+		t.Fatalf("job %s, attendu canceled sans relance", job.State)
+	}
+}
+
+func TestOubliDesJobsTermines(t *testing.T) {
+	m, _ := lancerFlotte(t, 1, flotte.Comportement{Lignes: 1})
+	m.config.MaxFinishedJobs = 2
+
+	var termines []*Job
+	for _, fichier := range []string{"a.laz", "b.laz", "c.laz"} {
+		job := m.envoiCommandePython("", fichier)
+		attendreFin(t, job)
+		termines = append(termines, job)
+	}
+	m.jobsMutex.Lock()
+	termines[0].FinishedAt--
+	m.jobsMutex.Unlock()
+	enAttente := m.creerJob("", Command{Command: "run_python"})
+
+	m.oublierJobsTermines()
+	if _, ok := m.getJob(termines[0].ID); ok {
+		t.Error("le job terminé le plus ancien est encore en mémoire")
+	}
+	for _, job := range append(termines[1:], enAttente) {
+		if _, ok := m.getJob(job.ID); !ok {
+			t.Errorf("job %s oublié", job.ID)
+		}
+	}
+
+	m.config.JobRetention = time.Minute
+	m.jobsMutex.Lock()
+	termines[1].FinishedAt -= 120
+	m.jobsMutex.Unlock()
+	m.oublierJobsTermines()
+	if _, ok := m.getJob(termines[1].ID); ok {
+		t.Error("job terminé depuis plus de job_retention encore en mémoire")
+	}
+	if _, ok := m.getJob(enAttente.ID); !ok {
+		t.Error("job en attente oublié")
+	}
+}
+
+// Le worker ne peut pas être joint: le job n'est pas marqué annulé et sa réussite est gardée
+func TestFermetureDeLaWebSocketDesLogs(t *testing.T) {
+	// un job qui n'écrit plus rien: seule la fermeture par le client peut arrêter l'envoi
+	m := nouveauMaster(t, Config{})
+	job := m.creerJob("", Command{Command: "run_python", Args: []string{"ws.laz"}})
+	defer job.logs.Close()
+	job.logs.Append(joblog.StreamStdout, "première ligne")
+
+	fini := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{id}/logs/ws", func(w http.ResponseWriter, r *http.Request) {
+		defer close(fini)
+		m.jobLogsWebSocket(w, r)
+	})
+	serveur := httptest.NewServer(mux)
+	defer serveur.Close()
+
+	url := "ws" + strings.TrimPrefix(serveur.URL, "http") + "/jobs/" + job.ID + "/logs/ws"
+	ws, err := websocket.Dial(url, "", serveur.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ligne joblog.Line
+	if err := websocket.JSON.Receive(ws, &ligne); err != nil || ligne.Text != "première ligne" {
+		t.Fatalf("ligne %+v (%v)", ligne, err)
+	}
+	ws.Close()
+	select {
+	case <-fini:
+	case <-time.After(time.Second):
+		t.Fatal("abonnement gardé après la fermeture de la WebSocket")
+	}
+}
+
+func TestAnnulationSansReponseDuWorker(t *testing.T) {
+	m, _ := lancerFlotte(t, 1, flotte.Comportement{Lignes: 5, Intervalle: 50 * time.Millisecond})
+
+	enCours := m.envoiCommandePython("", "injoignable.laz")
+	attendreLignes(t, enCours, 1)
+	if _, err := enCours.annuler(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.annulerEnCours(enCours, "127.0.0.1:1", false); err == nil {
+		t.Fatal("annulation confirmée par un worker injoignable")
+	}
+	if job := attendreFin(t, enCours); job.State != JobSucceeded {
+		t.Fatalf("job %s, attendu success", job.State)
+	}
+}
+
+func TestRechargementDeLaConfig(t *testing.T) {
+	m, f := lancerFlotte(t, 2, flotte.Comportement{Lignes: 10, Intervalle: 50 * time.Millisecond})
+	nouveau, err := flotte.Demarrer("simu_nouveau", flotte.Comportement{Lignes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nouveau.Arreter)
+	ecrireConfig := func(contenu string) {
+		t.Helper()
+		os.MkdirAll(m.conf().Home+"/config", 0755)
+		if err := os.WriteFile(fichierConfig(m.conf().Home), []byte(contenu), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// f[0] est retiré de la config pendant un job: il termine le job sans en recevoir d'autre
+	enCours := m.envoiCommandePython(f[0].Addr, "long.laz")
+	attendreLignes(t, enCours, 1)
+	ecrireConfig("workers_ip: [\"" + f[1].Addr + "\", \"" + nouveau.Addr + "\"]\npoll_interval: 500ms\n")
+	if err := m.Recharger(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.estDraine(f[0].Addr) || m.conf().PollInterval != 500*time.Millisecond {
+		t.Fatalf("config non appliquée: %+v", m.conf())
+	}
+	m.oublierWorkersRetires()
+	if !m.workerConnu(f[0].Addr) {
+		t.Fatal("worker retiré oublié avant la fin de son job")
+	}
+
+	// le worker ajouté est contacté au relevé suivant
+	dispos := m.recupInfosWorkers(garderWorkers(f.Adresses(), m.workersSurveilles()))
+	retrouves := m.testRepriseContact(m.workersSurveilles(), dispos)
+	if len(retrouves) != 1 || retrouves[0] != nouveau.Addr {
+		t.Fatalf("workers retrouvés %v, attendu %s", retrouves, nouveau.Addr)
+	}
+	m.recupInfosWorkers(append(dispos, retrouves...))
+	if choisi := m.choisirWorker(); choisi == f[0].Addr || choisi == "" {
+		t.Fatalf("worker choisi %q après rechargement", choisi)
+	}
+
+	if job := attendreFin(t, enCours); job.State != JobSucceeded {
+		t.Fatalf("job %s sur le worker retiré, attendu success", job.State)
+	}
+	m.oublierWorkersRetires()
+	if m.workerConnu(f[0].Addr) || m.estDraine(f[0].Addr) {
+		t.Fatal("worker retiré toujours connu après la fin de son job")
+	}
+
+	// une config invalide est rejetée en entier
+	ecrireConfig("workers_ip: [\"" + f[1].Addr + "\"]\npoll_interval: 1ms\n")
+	if err := m.Recharger(); err == nil || !strings.Contains(err.Error(), "poll_interval") {
+		t.Fatalf("config invalide acceptée: %v", err)
+	}
+	if len(m.conf().WorkersIP) != 2 || m.conf().PollInterval != 500*time.Millisecond {
+		t.Fatalf("config modifiée par un rechargement rejeté: %+v", m.conf())
+	}
+}
+
+// demarrer lance Run en arrière-plan et renvoie l'URL de l'API. Le master est arrêté à
+// la fin du test, Run doit alors rendre la main sans erreur.
+func demarrer(t *testing.T, m *Master) string {
+	t.Helper()
+	fin := make(chan error, 1)
+	go func() { fin <- m.Run(context.Background()) }()
+	t.Cleanup(func() {
+		m.Stop()
+		select {
+		case err := <-fin:
+			if err != nil {
+				t.Error("arrêt du master:", err)
+			}
+		case <-time.After(20 * time.Second):
+			t.Error("le master ne s'est pas arrêté")
+		}
+	})
+	addr := m.Addr()
+	if addr == "" {
+		t.Fatal("API du master non démarrée")
+	}
+	return "http://" + addr
+}
+
+// appeler envoie une requête JSON à l'API et décode la réponse dans resultat
+func appeler(t *testing.T, methode, url string, corps, resultat any) int {
+	t.Helper()
+	var lecteur io.Reader
+	if corps != nil {
+		contenu, _ := json.Marshal(corps)
+		lecteur = bytes.NewReader(contenu)
+	}
+	r, err := http.NewRequest(methode, url, lecteur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reponse, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reponse.Body.Close()
+	if resultat != nil {
+		json.NewDecoder(reponse.Body).Decode(resultat)
+	}
+	return reponse.StatusCode
+}
+
+func TestDeuxMastersDansLeMemeProcessus(t *testing.T) {
+	var urls []string
+	var flottes []flotte.Flotte
+	for i := 0; i < 2; i++ {
+		f, err := flotte.Lancer(1, flotte.Comportement{Lignes: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(f.Arreter)
+		m := nouveauMaster(t, Config{HTTPAddr: "127.0.0.1:0", WorkersIP: f.Adresses(), LeaseDuration: time.Second})
+		urls, flottes = append(urls, demarrer(t, m)), append(flottes, f)
+	}
+
+	for i, url := range urls {
+		// chaque master devient leader de son propre dossier d'état
+		limite := time.Now().Add(5 * time.Second)
+		var leader struct {
+			ID     string `json:"id"`
+			Leader bool   `json:"leader"`
+		}
+		for appeler(t, "GET", url+"/leader", nil, &leader); !leader.Leader; appeler(t, "GET", url+"/leader", nil, &leader) {
+			if time.Now().After(limite) {
+				t.Fatalf("master %d jamais leader", i)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		var job Job
+		if statut := appeler(t, "POST", url+"/jobs", SoumissionJob{Args: []string{"a.laz"}}, &job); statut != http.StatusCreated {
+			t.Fatalf("soumission au master %d: statut %d", i, statut)
+		}
+		limite = time.Now().Add(10 * time.Second)
+		for job.State != JobSucceeded {
+			if time.Now().After(limite) {
+				t.Fatalf("job %s du master %d toujours %s", job.ID, i, job.State)
+			}
+			time.Sleep(50 * time.Millisecond)
+			appeler(t, "GET", url+"/jobs/"+job.ID, nil, &job)
+		}
+		if job.WorkerAddr != flottes[i][0].Addr {
+			t.Fatalf("job du master %d envoyé à %s, attendu son worker %s", i, job.WorkerAddr, flottes[i][0].Addr)
+		}
+	}
+}
+
+func TestLeaderUniqueEntreDeuxMasters(t *testing.T) {
+	etat := t.TempDir()
+	var masters []*Master
+	var urls []string
+	for i := 0; i < 2; i++ {
+		m := nouveauMaster(t, Config{HTTPAddr: "127.0.0.1:0", StateDir: etat, LeaseDuration: time.Second})
+		masters, urls = append(masters, m), append(urls, demarrer(t, m))
+	}
+
+	limite := time.Now().Add(5 * time.Second)
+	for masters[0].estLeader.Load() == masters[1].estLeader.Load() {
+		if time.Now().After(limite) {
+			t.Fatal("aucun leader élu, ou deux leaders")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	follower := 0
+	if masters[0].estLeader.Load() {
+		follower = 1
+	}
+	// un follower sans adresse annoncée du leader refuse les écritures
+	if statut := appeler(t, "POST", urls[follower]+"/jobs", SoumissionJob{Args: []string{"a.laz"}}, nil); statut != http.StatusServiceUnavailable {
+		t.Fatalf("soumission au follower: statut %d, attendu 503", statut)
+	}
+}
+
+func TestEpochDuBail(t *testing.T) {
+	etat := t.TempDir()
+	ancien := nouveauMaster(t, Config{StateDir: etat})
+	nouveau := nouveauMaster(t, Config{StateDir: etat})
+
+	// l'epoch est gardée au renouvellement et augmente au changement de leader, même
+	// après une libération du bail
+	for i, attendu := range []int64{1, 1} {
+		bail, err := ancien.prendreBail(etat, "", time.Minute)
+		if err != nil || bail.Holder != ancien.idMaster || bail.Epoch != attendu {
+			t.Fatalf("prise %d: bail %+v (%v), attendu epoch %d", i, bail, err, attendu)
+		}
+	}
+	ancien.epoch.Store(1)
+	ancien.finMandat.Store(time.Now().Add(time.Minute).UnixNano())
+	if err := ancien.sauverEtat(nil); err != nil {
+		t.Fatal("sauvegarde par le leader:", err)
+	}
+	ancien.libererBail(etat)
+	bail, err := nouveau.prendreBail(etat, "", time.Minute)
+	if err != nil || bail.Holder != nouveau.idMaster || bail.Epoch != 2 {
+		t.Fatalf("bail du nouveau leader %+v (%v), attendu epoch 2", bail, err)
+	}
+	nouveau.epoch.Store(bail.Epoch)
+	nouveau.finMandat.Store(time.Now().Add(time.Minute).UnixNano())
+
+	// l'ancien leader ne peut plus écrire l'état ni envoyer de jobs
+	if err := ancien.sauverEtat(nil); !errors.Is(err, errMandatExpire) {
+		t.Fatalf("sauvegarde par l'ancien leader: %v, attendu errMandatExpire", err)
+	}
+	if err := nouveau.sauverEtat(nil); err != nil {
+		t.Fatal("sauvegarde par le nouveau leader:", err)
+	}
+	ancien.finMandat.Store(time.Now().Add(-time.Second).UnixNano())
+	if err := ancien.envoyerCommande(nil, "w:1", Command{Command: "run_python"}); !errors.Is(err, errMandatExpire) {
+		t.Fatalf("envoi par l'ancien leader: %v, attendu errMandatExpire", err)
+	}
+
+	contenu, err := os.ReadFile(nouveau.cheminEtat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sauve EtatMaster
+	if err := json.Unmarshal(contenu, &sauve); err != nil || sauve.Epoch != 2 {
+		t.Fatalf("état sauvegardé avec l'epoch %d (%v), attendu 2", sauve.Epoch, err)
+	}
+}
+
+func TestVueDuFollower(t *testing.T) {
+	etat := t.TempDir()
+	leader := nouveauMaster(t, Config{StateDir: etat})
+	follower := nouveauMaster(t, Config{StateDir: etat})
+	for _, id := range []string{"ancien", "recent"} {
+		leader.jobs[id] = &Job{m: leader, ID: id, State: JobSucceeded}
+	}
+	if err := leader.sauverEtat(nil); err != nil {
+		t.Fatal(err)
+	}
+	follower.chargerVue()
+	if len(follower.jobs) != 2 {
+		t.Fatalf("vue du follower: %d jobs, attendu 2", len(follower.jobs))
+	}
+
+	// le leader oublie un job: il disparaît aussi de la vue du follower
+	delete(leader.jobs, "ancien")
+	if err := leader.sauverEtat(nil); err != nil {
+		t.Fatal(err)
+	}
+	follower.chargerVue()
+	if _, connu := follower.getJob("ancien"); connu || len(follower.jobs) != 1 {
+		t.Fatalf("vue du follower après l'oubli: %d jobs, attendu 1", len(follower.jobs))
+	}
+}
+
+func TestAdoptionDesJobsTermines(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 1})
+	job := attendreFin(t, m.envoiCommande("", Command{Command: "run_python", Args: []string{"a.laz"}}))
+	if job.State != JobSucceeded {
+		t.Fatalf("job %s", job.State)
+	}
+
+	// le master a oublié le job, déjà dans son historique: il n'est pas repris
+	m.jobsMutex.Lock()
+	delete(m.jobs, job.ID)
+	m.jobsMutex.Unlock()
+	m.adopterJobsWorkers(f.Adresses(), time.Time{})
+	if _, repris := m.getJob(job.ID); repris {
+		t.Fatal("job déjà dans l'historique repris")
+	}
+
+	// un autre master sans cet historique: le job fini avant la sauvegarde de l'état a été
+	// oublié, celui fini après a pu être perdu par un arrêt brutal
+	autre := nouveauMaster(t, Config{WorkersIP: f.Adresses()})
+	autre.adopterJobsWorkers(f.Adresses(), time.Now().Add(time.Second))
+	if _, repris := autre.getJob(job.ID); repris {
+		t.Fatal("job terminé avant la sauvegarde repris")
+	}
+	autre.adopterJobsWorkers(f.Adresses(), time.Now().Add(-time.Hour))
+	repris, ok := autre.getJob(job.ID)
+	if !ok {
+		t.Fatal("job terminé après la sauvegarde non repris")
+	}
+	if fin := attendreFin(t, repris); fin.State != JobSucceeded {
+		t.Fatalf("job repris %s", fin.State)
+	}
+	if !autre.attendreJobs(5 * time.Second) {
+		t.Fatal("suivi du job repris toujours en cours")
+	}
+}
+
+func TestSoumissionAvecImage(t *testing.T) {
+	f, err := flotte.Lancer(1, flotte.Comportement{Lignes: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Arreter)
+	m := nouveauMaster(t, Config{HTTPAddr: "127.0.0.1:0", WorkersIP: f.Adresses(), LeaseDuration: time.Second})
+	url := demarrer(t, m)
+	limite := time.Now().Add(5 * time.Second)
+	for !m.estLeader.Load() {
+		if time.Now().After(limite) {
+			t.Fatal("master jamais leader")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// une image qui ressemble à une option du runtime est refusée avant l'envoi
+	soumission := SoumissionJob{Args: []string{"a.laz"}, Image: "-v=/:/hote"}
+	if statut := appeler(t, "POST", url+"/jobs", soumission, nil); statut != http.StatusBadRequest {
+		t.Fatalf("image invalide: statut %d, attendu 400", statut)
+	}
+	var job Job
+	soumission.Image = "registry.local/lidar/pdal:2.6"
+	if statut := appeler(t, "POST", url+"/jobs", soumission, &job); statut != http.StatusCreated {
+		t.Fatalf("soumission: statut %d", statut)
+	}
+	enCours, _ := m.getJob(job.ID)
+	if fin := attendreFin(t, enCours); fin.State != JobSucceeded || fin.Command.Image != soumission.Image {
+		t.Fatalf("job %s, image %q", fin.State, fin.Command.Image)
+	}
+}
+
+func TestEnvironnementPythonEnEchec(t *testing.T) {
+	m, _ := lancerFlotte(t, 1, flotte.Comportement{Lignes: 1, EnvironnementEnEchec: true})
+
+	job := attendreFin(t, m.envoiCommande("", Command{Command: "run_python", Args: []string{"a.laz"}, Requirements: "numpy==9.9\n"}))
+	if job.State != JobFailed || !strings.HasPrefix(job.Error, PrefixeErreurEnvironnement) {
+		t.Fatalf("job %s (%s), attendu failed avec l'erreur d'environnement", job.State, job.Error)
+	}
+	// l'historique distingue l'échec de l'environnement de celui du script
+	m.viderHistorique(true)
+	fichiers, _ := filepath.Glob(filepath.Join(m.conf().HistoryDir, "*"))
+	if len(fichiers) != 1 {
+		t.Fatalf("fichiers d'historique: %v", fichiers)
+	}
+	lignes, err := lireFichierHistorique(fichiers[0])
+	if err != nil || len(lignes) != 1 || lignes[0].Status != "env_failed" {
+		t.Fatalf("historique %+v, %v: attendu une ligne env_failed", lignes, err)
+	}
+}
+
+func TestHistoriqueEnSegments(t *testing.T) {
+	m := nouveauMaster(t, Config{})
+	dossier := m.conf().HistoryDir
+	// un fichier illisible n'est ni réécrit ni bloquant
+	illisible := filepath.Join(dossier, "command_history_2026-10-18.parquet")
+	if err := os.WriteFile(illisible, []byte("pas du parquet"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, statut := range []string{"success", "failed", "success"} {
+		job := &Job{ID: statut + string(rune('a'+i)), Command: Command{Command: "run_python"}}
+		m.logCommandToParquet("w1:8080", job, statut, "", nil)
+		if i < 2 {
+			m.viderHistorique(true)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dossier, "command_history_*_*.parquet"))
+	if len(segments) != 2 {
+		t.Fatalf("segments %v, attendu un par écriture", segments)
+	}
+	// la dernière ligne, pas encore écrite, est lue avec les segments
+	lignes, err := m.lireHistorique(FiltreHistorique{})
+	if err != nil || len(lignes) != 3 {
+		t.Fatalf("historique %+v, %v: attendu 3 lignes", lignes, err)
+	}
+	if lignes, _ := m.lireHistorique(FiltreHistorique{Status: "failed"}); len(lignes) != 1 {
+		t.Fatalf("filtre sur le statut: %+v", lignes)
+	}
+	if contenu, _ := os.ReadFile(illisible); string(contenu) != "pas du parquet" {
+		t.Fatal("fichier illisible modifié")
+	}
+}
+
+func TestFusionDeLHistorique(t *testing.T) {
+	m := nouveauMaster(t, Config{})
+	dossier := m.conf().HistoryDir
+	hier := time.Now().AddDate(0, 0, -1)
+	for i := 0; i < 3; i++ {
+		m.logCommandToParquet("w1:8080", &Job{ID: fmt.Sprintf("hier-%d", i), Command: Command{Command: "run_python"}}, "success", "", nil)
+		m.historyMutex.Lock()
+		m.historiqueDepuis = hier
+		m.historyMutex.Unlock()
+		m.viderHistorique(true)
+	}
+	// les segments du jour ne sont pas fusionnés
+	m.logCommandToParquet("w1:8080", &Job{ID: "aujourdhui", Command: Command{Command: "run_python"}}, "success", "", nil)
+	m.viderHistorique(true)
+
+	m.fusionnerHistorique()
+	segments, _ := filepath.Glob(filepath.Join(dossier, "command_history_*_*.parquet"))
+	if len(segments) != 1 || !strings.Contains(segments[0], time.Now().Format("2006-01-02")) {
+		t.Fatalf("segments après la fusion %v, attendu celui du jour", segments)
+	}
+	journalier := filepath.Join(dossier, "command_history_"+hier.Format("2006-01-02")+".parquet")
+	if lignes, err := lireFichierHistorique(journalier); err != nil || len(lignes) != 3 {
+		t.Fatalf("fichier du jour fusionné: %d lignes, %v", len(lignes), err)
+	}
+	if lignes, err := m.lireHistorique(FiltreHistorique{}); err != nil || len(lignes) != 4 {
+		t.Fatalf("historique après la fusion: %d lignes, %v", len(lignes), err)
+	}
+
+	for _, c := range []struct {
+		limit  string
+		statut int
+		lignes int
+	}{{"", http.StatusOK, 4}, {"2", http.StatusOK, 2}, {"0", http.StatusOK, 0}, {"-1", http.StatusBadRequest, 0}, {"dix", http.StatusBadRequest, 0}} {
+		enregistreur := httptest.NewRecorder()
+		m.historyHandler(enregistreur, httptest.NewRequest("GET", "/history?limit="+c.limit, nil))
+		var lignes []CommandHistory
+		if enregistreur.Code == http.StatusOK {
+			json.Unmarshal(enregistreur.Body.Bytes(), &lignes)
+		}
+		if enregistreur.Code != c.statut || len(lignes) != c.lignes {
+			t.Errorf("limit=%q: statut %d, %d lignes, attendu %d et %d lignes", c.limit, enregistreur.Code, len(lignes), c.statut, c.lignes)
+		}
+	}
+}
+
+func TestTacheDesJobs(t *testing.T) {
+	m := nouveauMaster(t, Config{})
+	for _, nom := range []string{"a.laz", "b.laz"} {
+		if err := os.WriteFile(filepath.Join(m.conf().DataDir, nom), []byte("lidar"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tache := func(cmd Command) string {
+		cmd.Command = "run_python"
+		return m.tacheJob(cmd)
+	}
+	// les fichiers d'entrée ne changent pas la tâche, les options et l'environnement si
+	if a, b := tache(Command{Args: []string{"a.laz"}}), tache(Command{Args: []string{"b.laz"}}); a != b || a != "run_python" {
+		t.Errorf("tâches %q et %q, attendu run_python", a, b)
+	}
+	vues := map[string]bool{}
+	for _, cmd := range []Command{
+		{Args: []string{"a.laz"}},
+		{Args: []string{"a.laz", "--sol"}},
+		{Args: []string{"a.laz"}, Image: "lidar:2"},
+		{Args: []string{"a.laz"}, Requirements: "numpy==2.0\n"},
+	} {
+		if vues[tache(cmd)] {
+			t.Errorf("tâche %q partagée par des jobs différents", tache(cmd))
+		}
+		vues[tache(cmd)] = true
+	}
+}
+
+func TestHeureDeFinDesJobsEnAttente(t *testing.T) {
+	m := nouveauMaster(t, Config{})
+	for i := 0; i < 3; i++ {
+		m.estimateur.Add(estimation.Observation{Task: "run_python", Worker: "w1:8080", Seconds: 100})
+	}
+	m.updateWorkerInfo("w1:8080", WorkerInfo{CPUUsage: map[string]float64{"cpu0": 0, "cpu1": 0}})
+	m.majDisponibilite([]string{"w1:8080"}, []string{"w1:8080"})
+
+	// un job en cours depuis 40s puis deux jobs en attente, sur un worker à deux cœurs
+	maintenant := time.Now().Unix()
+	enCours := m.creerJob("w1:8080", Command{Command: "run_python"})
+	m.jobsMutex.Lock()
+	enCours.State, enCours.StartedAt = JobRunning, maintenant-40
+	m.jobsMutex.Unlock()
+	premier := m.creerJob("", Command{Command: "run_python"})
+	second := m.creerJob("", Command{Command: "run_python"})
+
+	for _, c := range []struct {
+		job *Job
+		eta int64
+	}{
+		{enCours, maintenant + 60},
+		{premier, maintenant + 60/2 + 100},
+		{second, maintenant + (60+100)/2 + 100},
+	} {
+		if eta := c.job.snapshot().ETA; eta < c.eta-1 || eta > c.eta+1 {
+			t.Errorf("job %s: fin prévue dans %ds, attendu %ds", c.job.ID, eta-maintenant, c.eta-maintenant)
+		}
+	}
+
+	// sans worker pour les recevoir, l'attente des jobs en file est inconnue
+	m.majDisponibilite([]string{"w1:8080"}, nil)
+	if job := second.snapshot(); job.Estimate == nil || job.ETA != 0 {
+		t.Errorf("job en attente sans worker: estimation %v, fin prévue %d", job.Estimate, job.ETA)
+	}
+}
+
+// soumettreFichier envoie un fichier avec POST /jobs en multipart, directement au handler
+func soumettreFichier(m *Master, nom string, champs map[string]string) *httptest.ResponseRecorder {
+	var corps bytes.Buffer
+	formulaire := multipart.NewWriter(&corps)
+	for cle, valeur := range champs {
+		formulaire.WriteField(cle, valeur)
+	}
+	fichier, _ := formulaire.CreateFormFile("file", nom)
+	fichier.Write([]byte("lidar"))
+	formulaire.Close()
+	requete := httptest.NewRequest(http.MethodPost, "/jobs", &corps)
+	requete.Header.Set("Content-Type", formulaire.FormDataContentType())
+	reponse := httptest.NewRecorder()
+	m.submitJobHandler(reponse, requete)
+	return reponse
+}
+
+func TestDepotRefuseSansFichierDansData(t *testing.T) {
+	m, f := lancerFlotte(t, 1, flotte.Comportement{Lignes: 1})
+
+	refus := []map[string]string{
+		{"worker_addr": "inconnu:8080"},
+		{"venv": "venvs/relatif"},
+	}
+	for _, champs := range refus {
+		if reponse := soumettreFichier(m, "depot.laz", champs); reponse.Code != http.StatusBadRequest {
+			t.Fatalf("soumission %v: statut %d, attendu 400", champs, reponse.Code)
+		}
+	}
+	m.drainerWorker(f[0].Addr, 0)
+	if reponse := soumettreFichier(m, "depot.laz", map[string]string{"worker_addr": f[0].Addr}); reponse.Code != http.StatusConflict {
+		t.Fatalf("soumission vers un worker en maintenance: statut %d, attendu 409", reponse.Code)
+	}
+	if _, err := os.Stat(filepath.Join(m.conf().DataDir, "depot.laz")); !os.IsNotExist(err) {
+		t.Fatal("fichier d'une soumission refusée laissé dans data")
+	}
+
+	m.undrainWorker(f[0].Addr)
+	reponse := soumettreFichier(m, "depot.laz", nil)
+	if reponse.Code != http.StatusCreated {
+		t.Fatalf("nouvelle soumission: statut %d (%s)", reponse.Code, reponse.Body)
+	}
+	var job Job
+	json.NewDecoder(reponse.Body).Decode(&job)
+	enCours, _ := m.getJob(job.ID)
+	if fin := attendreFin(t, enCours); fin.State != JobSucceeded {
+		t.Fatalf("job %s, attendu success", fin.State)
+	}
+}
+
+func TestAuthentification(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jeton := sha256.Sum256([]byte("jeton-1"))
+	fichier := filepath.Join(t.TempDir(), "users.yaml")
+	contenu := fmt.Sprintf("users:\n  - name: alice\n    role: operator\n    password_hash: %q\n    token_hashes: [%q]\n", hash, hex.EncodeToString(jeton[:]))
+	if err := os.WriteFile(fichier, []byte(contenu), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := chargerAnnuaire(fichier, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cas := []struct {
+		nom         string
+		preparer    func(r *http.Request)
+		authentifie bool
+	}{
+		{"mot de passe", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, true},
+		{"mot de passe en cache", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, true},
+		{"mauvais mot de passe", func(r *http.Request) { r.SetBasicAuth("alice", "faux") }, false},
+		{"utilisateur inconnu", func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, false},
+		{"jeton", func(r *http.Request) { r.Header.Set("Authorization", "Bearer jeton-1") }, true},
+		{"mauvais jeton", func(r *http.Request) { r.Header.Set("Authorization", "Bearer jeton-2") }, false},
+		{"sans identifiants", func(r *http.Request) {}, false},
+	}
+	for _, c := range cas {
+		r := httptest.NewRequest("GET", "/jobs", nil)
+		c.preparer(r)
+		identite, ok := a.authentifier(r)
+		if ok != c.authentifie || (ok && (identite.Nom != "alice" || identite.Role != RoleOperator)) {
+			t.Errorf("%s: %+v, %v", c.nom, identite, ok)
+		}
+	}
+}
+
+func TestDernieresLignesDuJournalDAudit(t *testing.T) {
+	fichier := filepath.Join(t.TempDir(), "audit.log")
+	var contenu strings.Builder
+	for i := 0; i < 3000; i++ {
+		// des lignes de longueurs variées, à cheval sur les blocs lus
+		fmt.Fprintf(&contenu, "ligne %d %s\n", i, strings.Repeat("x", 1+i%150))
+	}
+	if err := os.WriteFile(fichier, []byte(contenu.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	toutes := strings.Split(strings.TrimSpace(contenu.String()), "\n")
+	for _, n := range []int{1, 10, 1000, 2999, 3000, 5000} {
+		lignes, err := dernieresLignes(fichier, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attendues := toutes[max(len(toutes)-n, 0):]
+		if !slices.Equal(lignes, attendues) {
+			t.Errorf("%d dernières lignes: %d lues, de %q à %q", n, len(lignes), lignes[0], lignes[len(lignes)-1])
+		}
+	}
+	if lignes, err := dernieresLignes(filepath.Join(filepath.Dir(fichier), "vide"), 5); err == nil || lignes != nil {
+		t.Errorf("fichier absent: %v, %v", lignes, err)
+	}
+}
@@ -0,0 +1,97 @@
+package master
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"master/cmd/timeseries"
+)
+
+// pointDepuisInfo convertit un relevé de worker en point de série temporelle
+func pointDepuisInfo(info WorkerInfo) timeseries.Point {
+	valeurs := make(map[string]float64, len(info.CPUUsage)+1)
+	for coeur, usage := range info.CPUUsage {
+		valeurs[coeur] = usage
+	}
+	valeurs["memory_usage"] = info.MemoryUsage
+	if h := info.Host; h != nil {
+		valeurs["load1"] = h.Load.Load1
+		valeurs["cpu_iowait"] = h.CPU.IOWait
+		valeurs["cpu_steal"] = h.CPU.Steal
+		valeurs["memory_used_bytes"] = float64(h.Memory.UsedBytes)
+		valeurs["swap_used_percent"] = h.Memory.SwapUsedPercent
+		for _, d := range h.Disks {
+			valeurs["disk_read_bytes_per_sec"] += d.ReadBytesPerSec
+			valeurs["disk_write_bytes_per_sec"] += d.WriteBytesPerSec
+		}
+		for _, n := range h.Network {
+			valeurs["net_rx_bytes_per_sec"] += n.RxBytesPerSec
+			valeurs["net_tx_bytes_per_sec"] += n.TxBytesPerSec
+		}
+		if p, ok := h.Pressure["cpu"]; ok {
+			valeurs["pressure_cpu_some_avg10"] = p.SomeAvg10
+		}
+	}
+	return timeseries.Point{Timestamp: time.Now().Unix(), Values: valeurs}
+}
+
+// parseInstant accepte un timestamp unix ou une durée relative à maintenant (ex: "-1h")
+func parseInstant(valeur string, defaut time.Time) (int64, error) {
+	if valeur == "" {
+		return defaut.Unix(), nil
+	}
+	if t, err := strconv.ParseInt(valeur, 10, 64); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(valeur)
+	if err != nil {
+		return 0, err
+	}
+	return time.Now().Add(d).Unix(), nil
+}
+
+// parseStep accepte un nombre de secondes ou une durée (ex: "5m")
+func parseStep(valeur string) (time.Duration, error) {
+	if valeur == "" {
+		return 0, nil
+	}
+	if s, err := strconv.ParseInt(valeur, 10, 64); err == nil {
+		return time.Duration(s) * time.Second, nil
+	}
+	return time.ParseDuration(valeur)
+}
+
+// workerMetricsHandler renvoie l'historique des relevés d'un worker avec
+// ?from=&to= (timestamp unix ou durée relative, ex: -6h) et &step= (secondes ou durée)
+func (m *Master) workerMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	q := r.URL.Query()
+
+	maintenant := time.Now()
+	from, err := parseInstant(q.Get("from"), maintenant.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "paramètre from invalide", http.StatusBadRequest)
+		return
+	}
+	to, err := parseInstant(q.Get("to"), maintenant)
+	if err != nil {
+		http.Error(w, "paramètre to invalide", http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(q.Get("step"))
+	if err != nil || step < 0 {
+		http.Error(w, "paramètre step invalide", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"worker": addr,
+		"from":   from,
+		"to":     to,
+		"step":   int64(step / time.Second),
+		"points": m.metriques.Query(addr, from, to, step),
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+
+	"commun/mtls"
+	"commun/signature"
+)
+
+// estSousCommande indique si le binaire est lancé pour une commande d'administration
+// ("master_test ca ...", "master_test passwd"...), qui ne démarre pas le master
+func estSousCommande() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	switch os.Args[1] {
+	case "ca", "passwd", "token", "signkey", "validate-config":
+		return true
+	}
+	return false
+}
+
+// sousCommande exécute la commande d'administration et renvoie le code de sortie du programme
+func sousCommande(args []string) int {
+	switch args[0] {
+	case "ca":
+		return commandeCA(args[1:])
+	case "passwd":
+		return commandePasswd()
+	case "token":
+		return commandeToken()
+	case "signkey":
+		return commandeSignkey(args[1:])
+	case "validate-config":
+		return commandeValidateConfig(args[1:])
+	}
+	return 2
+}
+
+// commandeValidateConfig vérifie la config sans démarrer le master, et affiche la config
+// effective: valeurs par défaut, variables d'environnement et options comprises
+func commandeValidateConfig(args []string) int {
+	config, err := lireConfig("master_test validate-config", args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration invalide:\n%v\n", err)
+		return 1
+	}
+	contenu, err := yaml.Marshal(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	fmt.Print(string(contenu))
+	fmt.Fprintln(os.Stderr, "Configuration valide:", filepath.Join(config.Home, "config", "config.yaml"))
+	return 0
+}
+
+// commandePasswd lit un mot de passe sur l'entrée standard et affiche son hash bcrypt
+// pour le champ password_hash du fichier des utilisateurs
+func commandePasswd() int {
+	fmt.Fprint(os.Stderr, "Mot de passe: ")
+	ligne, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	motDePasse := strings.TrimRight(ligne, "\r\n")
+	if motDePasse == "" {
+		fmt.Fprintln(os.Stderr, "Erreur: mot de passe vide", err)
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(motDePasse), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	fmt.Println(string(hash))
+	return 0
+}
+
+// commandeToken génère un jeton d'API et affiche son hash pour le champ token_hashes
+func commandeToken() int {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	jeton := hex.EncodeToString(b)
+	hash := sha256.Sum256([]byte(jeton))
+	fmt.Println("jeton (à donner à l'utilisateur):", jeton)
+	fmt.Println("token_hashes (à mettre dans le fichier des utilisateurs):", hex.EncodeToString(hash[:]))
+	return 0
+}
+
+const usageCA = `Gestion de la CA du cluster et des certificats mTLS master/workers:
+  master_test ca init   [-dir d] [-name nom] [-days n]
+  master_test ca master [-dir d] [-name master] [-days n]
+  master_test ca worker [-dir d] -hosts nom,ip [-name nom] [-days n]
+Réémettre un certificat le fait tourner: les daemons relisent les fichiers modifiés.
+`
+
+// commandeCA exécute "ca init|master|worker" et renvoie le code de sortie du programme
+func commandeCA(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usageCA)
+		return 2
+	}
+	flags := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	dossier := flags.String("dir", "pki", "dossier de la CA et des certificats")
+	nom := flags.String("name", "", "nom du certificat (CN)")
+	jours := flags.Int("days", 365, "durée de validité en jours")
+	hotes := flags.String("hosts", "", "noms et adresses IP du worker, séparés par des virgules")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	validite := time.Duration(*jours) * 24 * time.Hour
+
+	var err error
+	switch args[0] {
+	case "init":
+		if *nom == "" {
+			*nom = "compute_balancer CA"
+		}
+		if !estDrapeauDonne(flags, "days") {
+			validite = 10 * 365 * 24 * time.Hour
+		}
+		err = mtls.InitCA(*dossier, *nom, validite)
+	case "master":
+		if *nom == "" {
+			*nom = "master"
+		}
+		err = mtls.Emettre(*dossier, *nom, mtls.UsageMaster, nil, validite)
+	case "worker":
+		var liste []string
+		for _, hote := range strings.Split(*hotes, ",") {
+			if hote = strings.TrimSpace(hote); hote != "" {
+				liste = append(liste, hote)
+			}
+		}
+		if *nom == "" && len(liste) > 0 {
+			*nom = liste[0]
+		}
+		err = mtls.Emettre(*dossier, *nom, mtls.UsageWorker, liste, validite)
+	default:
+		fmt.Fprint(os.Stderr, usageCA)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	if args[0] == "init" {
+		fmt.Println("CA créée dans", *dossier)
+	} else {
+		fmt.Printf("Certificat %s/%s.pem émis\n", *dossier, *nom)
+	}
+	return 0
+}
+
+func estDrapeauDonne(flags *flag.FlagSet, nom string) bool {
+	donne := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == nom {
+			donne = true
+		}
+	})
+	return donne
+}
+
+// commandeSignkey crée la clé de signature des commandes:
+//
+//	master_test signkey ed25519 [-dir d]   sign.key pour le master, sign.pub pour les workers
+//	master_test signkey hmac [-dir d]      hmac.key, secret partagé par le master et les workers
+func commandeSignkey(args []string) int {
+	if len(args) < 1 || (args[0] != "ed25519" && args[0] != "hmac") {
+		fmt.Fprintln(os.Stderr, "Usage: master_test signkey ed25519|hmac [-dir d]")
+		return 2
+	}
+	flags := flag.NewFlagSet("signkey "+args[0], flag.ContinueOnError)
+	dossier := flags.String("dir", "pki", "dossier des clés")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if err := os.MkdirAll(*dossier, 0700); err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	var err error
+	if args[0] == "ed25519" {
+		err = signature.GenererEd25519(filepath.Join(*dossier, "sign.key"), filepath.Join(*dossier, "sign.pub"))
+	} else {
+		err = signature.GenererHMAC(filepath.Join(*dossier, "hmac.key"))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	fmt.Println("Clé de signature", args[0], "créée dans", *dossier)
+	return 0
+}
@@ -1,379 +1,97 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
+	"log/slog"
 	"os"
-	"sync"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/xitongsys/parquet-go/writer"
-	"gopkg.in/yaml.v3"
-
-	//"github.com/xitongsys/parquet-go/reader"
-	"github.com/xitongsys/parquet-go-source/local"
-)
-
-var logFile *os.File
-var configWorkersIP []string
-
-type Config struct {
-	WorkersIP []string `yaml:"workers_ip"`
-}
-
-type Command struct {
-	Command string   `json:"command"`
-	Args    []string `json:"args"`
-}
-
-type CommandHistory struct {
-	WorkerAddr   string   `parquet:"name=worker_addr, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-	Command      string   `parquet:"name=command, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-	Args         []string `parquet:"name=args, type=BYTE_ARRAY, repeated"`
-	Timestamp    int64    `parquet:"name=timestamp, type=INT64"`
-	Status       string   `parquet:"name=status, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-	ErrorMessage string   `parquet:"name=error_message, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-}
-
-type WorkerInfo struct {
-	Address        string             `json:"address"`
-	CPUUsage       map[string]float64 `json:"cpu_usage"` // Map pour chaque core
-	MemoryUsage    float64            `json:"memory_usage"`
-	Commands       []Command          `json:"commands"`
-	Machine        string             `json:"nom_machine"`
-	DateConnection string             `json:"date_connection"`
-}
-
-type WorkerEnVie struct {
-	EtatWorker           string `json:"etat"`
-	CommandeNonExectutee string `json:"commande_non_executee"`
-}
-
-var (
-	workersInfo = make(map[string]*WorkerInfo)
-	mutex       sync.Mutex
-	masterHome  string
+	"commun/configuration"
+	"commun/journalisation"
+	"master/cmd/master"
 )
 
-func init() {
-	// Ouvre le fichier de log dès l'initialisation
-	var err error
-	logFile, err = os.OpenFile("/var/log/masterc_cb.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Erreur lors de l'ouverture du fichier de log : %v", err)
-	}
-
-	// Redirige les logs à la fois vers le fichier et la sortie standard
-	mw := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(mw)
-
-	// Initialisation de la variable globale MASTER_HOME
-	masterHome = os.Getenv("MASTER_HOME")
-	if masterHome == "" {
-		log.Fatalf("MASTER_HOME non défini!!")
-	} else {
-		log.Println("MASTER_HOME défini :", masterHome)
+func main() {
+	if estSousCommande() {
+		os.Exit(sousCommande(os.Args[1:]))
 	}
 
-	// Lecture de la config
-	config := getConfig()
-	configWorkersIP = config.WorkersIP
-}
-
-func getConfig() Config {
-	var config Config
-	yamlFile, err := os.ReadFile(masterHome + "/config/config.yaml")
+	config, err := lireConfig("master_test", os.Args[1:])
 	if err != nil {
-		log.Println("Erreur dans la lecture du .yaml:", err)
+		log.Fatalf("Configuration invalide:\n%v", err)
 	}
 
-	err = yaml.Unmarshal(yamlFile, &config)
+	// Journal du master (fichier avec rotation, sortie standard ou journald), qui reçoit
+	// aussi les messages du package log
+	journal, err := journalisation.Ouvrir(config.Log)
 	if err != nil {
-		log.Println("Erreur dans le décodage du .yaml:", err)
+		log.Fatalf("Journalisation impossible: %v", err)
 	}
-	return config
-}
-
-func logCommandToParquet(workerAddr string, cmd Command, status, errorMsg string) error {
-	filename := fmt.Sprintf("command_history_%s.parquet", time.Now().Format("2006-01-02"))
+	defer journal.Close()
+	slog.SetDefault(journal.Logger)
+	slog.Info("Démarrage du master", "home", config.Home)
 
-	f, err := local.NewLocalFileWriter(masterHome + "/history/" + filename)
+	m, err := master.New(config)
 	if err != nil {
-		return fmt.Errorf("failed to open Parquet file: %v", err)
-	}
-	defer f.Close()
-
-	pw, err := writer.NewParquetWriter(f, new(CommandHistory), 4)
+		slog.Error("Démarrage du master impossible", "error", err)
+		journal.Close()
+		os.Exit(1)
+	}
+
+	// SIGHUP (systemctl reload) recharge la config, avec les mêmes options qu'au démarrage
+	m.SourceConfig(func() (master.Config, error) { return lireConfig("master_test", os.Args[1:]) })
+	rechargements := make(chan os.Signal, 1)
+	signal.Notify(rechargements, syscall.SIGHUP)
+	go func() {
+		for range rechargements {
+			slog.Info("SIGHUP reçu, rechargement de la config")
+			m.Recharger()
+		}
+	}()
+
+	// SIGTERM (systemctl stop/restart) ou SIGINT déclenchent un arrêt propre
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := m.Run(ctx); err != nil {
+		slog.Error("Arrêt du master", "error", err)
+		journal.Close()
+		os.Exit(1)
+	}
+}
+
+// lireConfig lit la config du master: config.yaml du dossier -home ($MASTER_HOME par
+// défaut), puis les variables MASTER_* et enfin les options de la ligne de commande. La
+// config renvoyée a ses valeurs par défaut et a été validée.
+func lireConfig(nom string, args []string) (master.Config, error) {
+	fs := flag.NewFlagSet(nom, flag.ExitOnError)
+	home := fs.String("home", os.Getenv("MASTER_HOME"), "dossier du master, $MASTER_HOME par défaut")
+	options := configuration.Declarer(fs, &master.Config{})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\nChaque option remplace la clé du config.yaml de même nom, "+
+			"de même que les variables %s_<CLE> (%s par exemple).\n\n", nom, master.PrefixeEnvironnement,
+			configuration.NomVariable(master.PrefixeEnvironnement, "http_addr"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return master.Config{}, fmt.Errorf("argument inattendu: %s", fs.Arg(0))
+	}
+	if *home == "" {
+		return master.Config{}, errors.New("MASTER_HOME non défini!!")
+	}
+
+	config, err := master.ChargerConfig(*home)
 	if err != nil {
-		return fmt.Errorf("failed to create Parquet writer: %v", err)
-	}
-	defer pw.WriteStop()
-
-	history := CommandHistory{
-		WorkerAddr:   workerAddr,
-		Command:      cmd.Command,
-		Args:         cmd.Args,
-		Timestamp:    time.Now().Unix(),
-		Status:       status,
-		ErrorMessage: errorMsg,
-	}
-
-	if err := pw.Write(history); err != nil {
-		return fmt.Errorf("failed to write to Parquet: %v", err)
-	}
-
-	return nil
-}
-
-func sendCommandToWorker(workerAddr string, cmd Command) error {
-	conn, err := net.Dial("tcp", workerAddr)
-	if err != nil {
-		logCommandToParquet(workerAddr, cmd, "failed", err.Error()) // Log en cas d'erreur de connexion
-		return fmt.Errorf("erreur de connection au worker pour envoie commande: %v", err)
-	}
-	defer conn.Close()
-
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(cmd); err != nil {
-		logCommandToParquet(workerAddr, cmd, "failed", err.Error()) // Log en cas d'échec d'envoi
-		return err
-	}
-
-	// Lire les réponses du worker jusqu'à la fermeture de la connexion
-	reader := bufio.NewReader(conn)
-	for {
-		status, err := reader.ReadString('\n')
-		if err != nil {
-			logCommandToParquet(workerAddr, cmd, "failed", err.Error()) // Log en cas d'échec de lecture
-			break                                                       // Sortir de la boucle si la connexion est fermée
-		}
-		fmt.Println("Worker Status:", status)
-		logCommandToParquet(workerAddr, cmd, "success", "") // Log de la réussite
-	}
-	return nil
-}
-
-func findMissing(list1, list2 []string) (missing []string) {
-	set := make(map[string]struct{}, len(list2))
-	for _, v := range list2 {
-		set[v] = struct{}{}
-	}
-	for _, v := range list1 {
-		if _, found := set[v]; !found {
-			missing = append(missing, v)
-		}
-	}
-	return
-}
-
-func recupInfosWorkers(workersAddr []string) []string {
-	var nouvIpDispos []string
-	// On boucle sur les adresses ip disponibles et on met à jour leurs états et on signale si un des workers est dead
-	for i := 0; i < len(workersAddr); i++ {
-		workerAddr := workersAddr[i]
-		conn, err := net.Dial("tcp", workerAddr)
-		if err != nil {
-			fmt.Println("Connection impossible au worker: ", workerAddr)
-			continue
-		}
-		defer conn.Close()
-
-		cmd_first_connection := Command{
-			Command: "infos",
-			Args:    []string{"cpu_usage", "memory_usage", "nom_worker", "date", "disponible"}, //argument se sert actuellement a rien
-		}
-
-		encoder := json.NewEncoder(conn)
-		if err := encoder.Encode(cmd_first_connection); err != nil {
-			fmt.Println("Envoie commande de première connection impossible au worker: ", workerAddr, "avec erreur: ", err)
-			continue
-		}
-
-		decoder := json.NewDecoder(conn)
-		var info WorkerInfo
-		if err := decoder.Decode(&info); err != nil {
-			fmt.Println("Erreur décodage infos du worker:", err)
-			continue
-		}
-		nouvIpDispos = append(nouvIpDispos, workerAddr)
-		updateWorkerInfo(workerAddr, info)
-	}
-	missing := findMissing(nouvIpDispos, workersAddr)
-	if len(missing) != 0 {
-		fmt.Println("Perte de contact avec: ", missing)
+		return config, err
 	}
-	return nouvIpDispos
-}
-
-func firstConnectionToWorker(workersAddr []string) []string {
-	var IPdispos []string
-	// On boucle sur les adresses ip présentent dans le yaml et on renvoie les adresses ip des workers disponibles.
-	for i := 0; i < len(workersAddr); i++ {
-		workerAddr := workersAddr[i]
-		conn, err := net.Dial("tcp", workerAddr)
-		if err != nil {
-			log.Println("Connection impossible au worker: ", workerAddr)
-			continue
-		}
-		defer conn.Close()
-
-		cmd_first_connection := Command{
-			Command: "infos",
-			Args:    []string{"cpu_usage", "memory_usage", "nom_worker", "date", "disponible"}, //argument se sert actuellement a rien
-		}
-
-		encoder := json.NewEncoder(conn)
-		if err := encoder.Encode(cmd_first_connection); err != nil {
-			log.Println("Envoie commande de première connection impossible au worker: ", workerAddr, "avec erreur: ", err)
-			continue
-		}
-
-		decoder := json.NewDecoder(conn)
-		var info WorkerInfo
-		if err := decoder.Decode(&info); err != nil {
-			log.Println("error decoding worker status:", err)
-			continue
-		}
-		IPdispos = append(IPdispos, workerAddr)
-		log.Println("Worker disponible:", info.Address)
-		updateWorkerInfo(workerAddr, info)
-	}
-	return IPdispos
-}
-
-// function qui envoie une commande python à workerAddr (ip:port) avec l'argument arg
-func envoiCommandePython(workerAddr string, arg string) {
-	cmd := Command{
-		Command: "run_python",
-		Args:    []string{arg}, //le chemin du scrypt python ne sera pas à donner
-	}
-	err := sendCommandToWorker(workerAddr, cmd)
-	if err != nil {
-		log.Println("Erreur envoie commande au worker ", workerAddr, ": ", err)
-		logCommandToParquet(workerAddr, cmd, "failed", err.Error()) // Log en cas d'échec
-	} else {
-		log.Println("Commande envoyée avec l'argument:", arg)
-		logCommandToParquet(workerAddr, cmd, "success", "") // Log de la réussite
-	}
-}
-
-func updateWorkerInfo(workerAddr string, info WorkerInfo) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	workersInfo[workerAddr] = &info
-	log.Printf("Worker info updated: %+v\n", info)
-}
-
-func workerInfoHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(workersInfo)
-}
-
-func startHTTPServer() {
-	// Serve static files from the "static" directory
-	fs := http.FileServer(http.Dir(masterHome + "/static"))
-	http.Handle("/", fs)
-
-	// Endpoint to get worker information
-	http.HandleFunc("/workers", workerInfoHandler)
-
-	log.Println("HTTP server running on :8082")
-	http.ListenAndServe(":8082", nil)
-}
-
-func lireFichiers(dossier string) (map[string]os.FileInfo, error) {
-	fichiers := make(map[string]os.FileInfo)
-	listeFichiers, err := ioutil.ReadDir(dossier)
-	if err != nil {
-		return nil, err
-	}
-	for _, fichier := range listeFichiers {
-		fichiers[fichier.Name()] = fichier
-	}
-	return fichiers, nil
-}
-
-func testRepriseContact(config_ip []string, worker_actuel []string) {
-	missing := findMissing(config_ip, worker_actuel) // si l'on perd des workers on rentre dans la boucle
-	for i := 0; i < len(missing); i++ {
-		workerAddr := missing[i]
-		conn, err := net.Dial("tcp", workerAddr)
-		if err != nil {
-			log.Println("Tentative de reconnection impossible au worker: ", workerAddr)
-			continue
-		}
-		defer conn.Close()
-
-		cmd_first_connection := Command{
-			Command: "vivantoupas",
-			Args:    []string{"est-ce que t'es vivant"}, //argument se sert actuellement a rien
-		}
-
-		encoder := json.NewEncoder(conn)
-		if err := encoder.Encode(cmd_first_connection); err != nil {
-			log.Println("Envoie commande de reconnection impossible au worker: ", workerAddr, "avec erreur: ", err)
-			continue
-		}
-
-		decoder := json.NewDecoder(conn)
-		var retour WorkerEnVie
-		if err := decoder.Decode(&retour); err != nil {
-			log.Println("Erreur décodage retour de commande pour reconnection", err)
-			continue
-		}
-		log.Println("Retour commande de reconnection du worker:", workerAddr, " ->")
-	}
-
-}
-
-func main() {
-	defer logFile.Close() // on s'ssaure que le fichier de log se ferme bien à la fin du prog
-
-	// pour chaque worker renseigné on essaye de se connecter à lui et de récupérer ses informations
-	WorkersDispos := firstConnectionToWorker(configWorkersIP)
-	log.Println("Worker dispo :", configWorkersIP)
-
-	go startHTTPServer() // Démarrer le serveur HTTP dans une goroutine
-
-	dossier := masterHome + "/data"
-	fichiersPrecedents, err := lireFichiers(dossier)
-	if err != nil {
-		log.Println("Erreur de lecture du dossier:", err)
-	}
-	for {
-		WorkersDispos = recupInfosWorkers(WorkersDispos)
-
-		fichiersActuels, err := lireFichiers(dossier)
-		if err != nil {
-			log.Println("Erreur de lecture du dossier:", err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
-
-		// Chercher les nouveaux fichiers en comparant avec les précédents
-		for fichier := range fichiersActuels {
-			if _, existaitDeja := fichiersPrecedents[fichier]; !existaitDeja {
-				log.Printf("Nouveau fichier détecté: %s\n", fichier)
-				// ICI faut faire le choix du worker auquel on envoie les boulot.......
-				log.Println("Worker choisi pour le boulot: ", "localhost pour le test")
-				go envoiCommandePython("localhost:8080", fichier) // utilisation d'un go routine pour envoyer la commande python
-			}
-		}
-
-		// Mettre à jour l'état précédent avec l'état actuel
-		fichiersPrecedents = fichiersActuels
-
-		// Pause avant la prochaine vérification (ex : 2 secondes)
-		time.Sleep(2 * time.Second)
-
-		go testRepriseContact(configWorkersIP, WorkersDispos)
+	if err := options.Appliquer(&config); err != nil {
+		return config, err
 	}
+	config = config.AvecDefauts()
+	return config, config.Valider()
 }
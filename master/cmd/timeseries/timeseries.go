@@ -0,0 +1,401 @@
+// Package timeseries conserve l'historique des relevés des workers : les points bruts
+// dans un buffer circulaire en mémoire, et des moyennes par minute en mémoire et
+// éventuellement sur disque dans des segments compressés.
+package timeseries
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RetentionBrute   = time.Hour          // durée de conservation des points bruts
+	RetentionMinutes = 7 * 24 * time.Hour // durée de conservation des moyennes par minute
+	tailleLotDisque  = 15                 // nombre de moyennes accumulées avant écriture d'un segment
+)
+
+// Point est un relevé à un instant donné, chaque métrique étant identifiée par son nom
+// (ex: "cpu0", "memory_usage")
+type Point struct {
+	Timestamp int64              `json:"t"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// ring est un buffer circulaire de points ordonnés dans le temps
+type ring struct {
+	points []Point
+	debut  int
+	taille int
+}
+
+func newRing(capacite int) *ring {
+	return &ring{points: make([]Point, capacite)}
+}
+
+// capaciteBrute renvoie le nombre de points bruts d'un worker relevé toutes les
+// intervalle pendant RetentionBrute, avec une marge pour les relevés en avance
+func capaciteBrute(intervalle time.Duration) int {
+	return int((RetentionBrute+intervalle-1)/intervalle) + 60
+}
+
+// redimensionner change la capacité du buffer en gardant les points les plus récents
+func (r *ring) redimensionner(capacite int) {
+	points := r.between(math.MinInt64, math.MaxInt64)
+	if len(points) > capacite {
+		points = points[len(points)-capacite:]
+	}
+	*r = ring{points: make([]Point, capacite), taille: len(points)}
+	copy(r.points, points)
+}
+
+func (r *ring) add(p Point) {
+	capacite := len(r.points)
+	if r.taille < capacite {
+		r.points[(r.debut+r.taille)%capacite] = p
+		r.taille++
+		return
+	}
+	r.points[r.debut] = p
+	r.debut = (r.debut + 1) % capacite
+}
+
+// between renvoie les points dont le timestamp est dans [from, to]
+func (r *ring) between(from, to int64) []Point {
+	var out []Point
+	for i := 0; i < r.taille; i++ {
+		p := r.points[(r.debut+i)%len(r.points)]
+		if p.Timestamp >= from && p.Timestamp <= to {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// serie regroupe les données d'un worker
+type serie struct {
+	brute   *ring
+	minutes []Point // moyennes par minute, triées dans le temps
+
+	minuteCourante int64   // début de la minute en cours d'agrégation
+	cumul          []Point // points bruts de la minute en cours
+	aEcrire        []Point // moyennes pas encore écrites sur disque
+}
+
+// Store garde les séries de tous les workers
+type Store struct {
+	mu       sync.Mutex
+	series   map[string]*serie
+	capacite int // points bruts gardés par worker, selon l'intervalle des relevés
+	dossier  string
+	log      *slog.Logger
+}
+
+// New crée un store pour des relevés faits toutes les intervalle. Si dossier n'est pas
+// vide, les moyennes par minute y sont écrites dans des segments gzip journaliers et
+// rechargées au démarrage. Les erreurs d'écriture sont envoyées à journal.
+func New(dossier string, intervalle time.Duration, journal *slog.Logger) (*Store, error) {
+	s := &Store{series: make(map[string]*serie), capacite: capaciteBrute(intervalle), dossier: dossier, log: journal}
+	if dossier == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dossier, 0755); err != nil {
+		return s, fmt.Errorf("création du dossier de métriques impossible: %v", err)
+	}
+	return s, s.charger()
+}
+
+func (s *Store) serie(worker string) *serie {
+	se, ok := s.series[worker]
+	if !ok {
+		se = &serie{brute: newRing(s.capacite)}
+		s.series[worker] = se
+	}
+	return se
+}
+
+// Intervalle adapte la capacité des points bruts à un nouvel intervalle des relevés, pour
+// toujours garder RetentionBrute de points bruts
+func (s *Store) Intervalle(intervalle time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	capacite := capaciteBrute(intervalle)
+	if capacite == s.capacite {
+		return
+	}
+	s.capacite = capacite
+	for _, se := range s.series {
+		se.brute.redimensionner(capacite)
+	}
+}
+
+// Add enregistre un relevé d'un worker
+func (s *Store) Add(worker string, p Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	se := s.serie(worker)
+	se.brute.add(p)
+
+	minute := p.Timestamp - p.Timestamp%60
+	if se.minuteCourante != 0 && minute != se.minuteCourante && len(se.cumul) > 0 {
+		moyenne := moyenner(se.minuteCourante, se.cumul)
+		se.minutes = append(se.minutes, moyenne)
+		se.cumul = nil
+		s.purger(se, p.Timestamp)
+		if s.dossier != "" {
+			se.aEcrire = append(se.aEcrire, moyenne)
+			if len(se.aEcrire) >= tailleLotDisque {
+				s.ecrire(worker, se)
+			}
+		}
+	}
+	se.minuteCourante = minute
+	se.cumul = append(se.cumul, p)
+}
+
+// purger retire les moyennes plus vieilles que la rétention
+func (s *Store) purger(se *serie, maintenant int64) {
+	limite := maintenant - int64(RetentionMinutes/time.Second)
+	i := sort.Search(len(se.minutes), func(i int) bool { return se.minutes[i].Timestamp >= limite })
+	if i > 0 {
+		se.minutes = append([]Point(nil), se.minutes[i:]...)
+	}
+}
+
+// Workers renvoie la liste des workers ayant des relevés
+func (s *Store) Workers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var workers []string
+	for w := range s.series {
+		workers = append(workers, w)
+	}
+	sort.Strings(workers)
+	return workers
+}
+
+// Query renvoie les relevés d'un worker entre from et to (timestamps unix), moyennés par
+// intervalle de step. Les points bruts sont utilisés tant qu'ils couvrent la période
+// demandée et que step est inférieur à la minute, sinon les moyennes par minute.
+func (s *Store) Query(worker string, from, to int64, step time.Duration) []Point {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	se, ok := s.series[worker]
+	if !ok {
+		return []Point{}
+	}
+
+	var points []Point
+	limiteBrute := time.Now().Add(-RetentionBrute).Unix()
+	if step < time.Minute && from >= limiteBrute {
+		points = se.brute.between(from, to)
+	} else {
+		debut := sort.Search(len(se.minutes), func(i int) bool { return se.minutes[i].Timestamp >= from })
+		for _, p := range se.minutes[debut:] {
+			if p.Timestamp > to {
+				break
+			}
+			points = append(points, p)
+		}
+		// la minute en cours n'est pas encore agrégée, on la complète avec les points bruts
+		if len(se.cumul) > 0 && se.minuteCourante >= from && se.minuteCourante <= to {
+			points = append(points, moyenner(se.minuteCourante, se.cumul))
+		}
+	}
+	return reechantillonner(points, step)
+}
+
+// reechantillonner moyenne les points par intervalles de step
+func reechantillonner(points []Point, step time.Duration) []Point {
+	secondes := int64(step / time.Second)
+	if secondes <= 1 || len(points) == 0 {
+		if points == nil {
+			return []Point{}
+		}
+		return points
+	}
+	var out []Point
+	var groupe []Point
+	var debutGroupe int64
+	for _, p := range points {
+		debut := p.Timestamp - p.Timestamp%secondes
+		if len(groupe) > 0 && debut != debutGroupe {
+			out = append(out, moyenner(debutGroupe, groupe))
+			groupe = nil
+		}
+		debutGroupe = debut
+		groupe = append(groupe, p)
+	}
+	if len(groupe) > 0 {
+		out = append(out, moyenner(debutGroupe, groupe))
+	}
+	return out
+}
+
+// moyenner calcule la moyenne de chaque métrique présente dans les points
+func moyenner(timestamp int64, points []Point) Point {
+	sommes := make(map[string]float64)
+	nombres := make(map[string]int)
+	for _, p := range points {
+		for cle, v := range p.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			sommes[cle] += v
+			nombres[cle]++
+		}
+	}
+	valeurs := make(map[string]float64, len(sommes))
+	for cle, somme := range sommes {
+		valeurs[cle] = somme / float64(nombres[cle])
+	}
+	return Point{Timestamp: timestamp, Values: valeurs}
+}
+
+// Flush écrit sur disque les moyennes en attente de tous les workers
+func (s *Store) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dossier == "" {
+		return
+	}
+	for worker, se := range s.series {
+		s.ecrire(worker, se)
+	}
+}
+
+func (s *Store) dossierWorker(worker string) string {
+	return filepath.Join(s.dossier, url.PathEscape(worker))
+}
+
+// ecrire ajoute les moyennes en attente au segment du jour sous forme d'un nouveau membre gzip
+func (s *Store) ecrire(worker string, se *serie) {
+	if len(se.aEcrire) == 0 {
+		return
+	}
+	dossier := s.dossierWorker(worker)
+	if err := os.MkdirAll(dossier, 0755); err != nil {
+		s.log.Error("Ecriture des métriques impossible", "worker", worker, "error", err)
+		return
+	}
+
+	// regroupement des moyennes par jour, un segment par jour
+	parJour := make(map[string][]Point)
+	for _, p := range se.aEcrire {
+		jour := time.Unix(p.Timestamp, 0).Format("2006-01-02")
+		parJour[jour] = append(parJour[jour], p)
+	}
+	for jour, points := range parJour {
+		if err := ecrireSegment(filepath.Join(dossier, jour+".jsonl.gz"), points); err != nil {
+			s.log.Error("Ecriture des métriques impossible", "worker", worker, "error", err)
+			return
+		}
+	}
+	se.aEcrire = nil
+	supprimerVieuxSegments(dossier)
+}
+
+func ecrireSegment(chemin string, points []Point) error {
+	f, err := os.OpenFile(chemin, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	for _, p := range points {
+		if err := encoder.Encode(p); err != nil {
+			gz.Close()
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+func supprimerVieuxSegments(dossier string) {
+	limite := time.Now().Add(-RetentionMinutes).Format("2006-01-02")
+	segments, _ := filepath.Glob(filepath.Join(dossier, "*.jsonl.gz"))
+	for _, segment := range segments {
+		if strings.TrimSuffix(filepath.Base(segment), ".jsonl.gz") < limite {
+			os.Remove(segment)
+		}
+	}
+}
+
+// charger relit les segments encore dans la période de rétention
+func (s *Store) charger() error {
+	dossiers, err := os.ReadDir(s.dossier)
+	if err != nil {
+		return err
+	}
+	limite := time.Now().Add(-RetentionMinutes).Unix()
+	for _, d := range dossiers {
+		if !d.IsDir() {
+			continue
+		}
+		worker, err := url.PathUnescape(d.Name())
+		if err != nil {
+			continue
+		}
+		segments, _ := filepath.Glob(filepath.Join(s.dossier, d.Name(), "*.jsonl.gz"))
+		sort.Strings(segments)
+		se := s.serie(worker)
+		for _, segment := range segments {
+			points, err := lireSegment(segment)
+			if err != nil {
+				s.log.Warn("Segment de métriques illisible", "file", segment, "error", err)
+			}
+			for _, p := range points {
+				if p.Timestamp >= limite {
+					se.minutes = append(se.minutes, p)
+				}
+			}
+		}
+		sort.Slice(se.minutes, func(i, j int) bool { return se.minutes[i].Timestamp < se.minutes[j].Timestamp })
+	}
+	return nil
+}
+
+// lireSegment lit tous les points d'un segment, y compris s'il contient plusieurs membres gzip
+func lireSegment(chemin string) ([]Point, error) {
+	f, err := os.Open(chemin)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var points []Point
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var p Point
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return points, err
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return points, err
+	}
+	return points, nil
+}
@@ -0,0 +1,348 @@
+// Interface web du master : vues workers, jobs, détail d'un job, historique et soumission.
+
+const TAILLE_HISTORIQUE = 60; // nombre de points affichés dans les sparklines
+const FENETRE_SPARKLINE = "-10m"; // période couverte par les sparklines
+const PAS_SPARKLINE = 10; // secondes par point des sparklines
+
+let minuteur = null;
+let fluxLogs = null;
+
+function el(tag, attributs = {}, ...enfants) {
+    const noeud = document.createElement(tag);
+    for (const [cle, valeur] of Object.entries(attributs)) {
+        if (cle === "class") {
+            noeud.className = valeur;
+        } else if (cle.startsWith("on")) {
+            noeud.addEventListener(cle.substring(2), valeur);
+        } else {
+            noeud.setAttribute(cle, valeur);
+        }
+    }
+    for (const enfant of enfants) {
+        noeud.append(enfant instanceof Node ? enfant : document.createTextNode(enfant ?? ""));
+    }
+    return noeud;
+}
+
+function sparkline(valeurs, classe = "") {
+    const largeur = 150, hauteur = 30;
+    const svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+    svg.setAttribute("class", "sparkline " + classe);
+    svg.setAttribute("width", largeur);
+    svg.setAttribute("height", hauteur);
+    const pas = largeur / Math.max(TAILLE_HISTORIQUE - 1, 1);
+    const points = valeurs.map((v, i) => `${(i * pas).toFixed(1)},${(hauteur - (Math.min(v, 100) / 100) * hauteur).toFixed(1)}`);
+    const ligne = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+    ligne.setAttribute("points", points.join(" "));
+    svg.appendChild(ligne);
+    return svg;
+}
+
+function badgeEtat(etat) {
+    return el("span", { class: "etat etat-" + etat }, etat);
+}
+
+function formatDate(timestamp) {
+    return timestamp ? new Date(timestamp * 1000).toLocaleString() : "";
+}
+
+function formatProgression(progress) {
+    if (!progress) {
+        return "";
+    }
+    let texte = `${progress.percent.toFixed(1)}%`;
+    if (progress.stage) {
+        texte += ` - ${progress.stage}`;
+    }
+    if (progress.eta) {
+        texte += ` (reste ${progress.eta}s)`;
+    }
+    return texte;
+}
+
+async function getJSON(url) {
+    const response = await fetch(url);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+}
+
+// ---- Vue workers ----
+
+function formatOctets(octets) {
+    const unites = ["o", "Ko", "Mo", "Go", "To"];
+    let i = 0;
+    while (octets >= 1024 && i < unites.length - 1) {
+        octets /= 1024;
+        i++;
+    }
+    return `${octets.toFixed(1)} ${unites[i]}`;
+}
+
+function boutonMaintenance(adresse, drain) {
+    const action = drain ? "undrain" : "drain";
+    const bouton = el("button", {
+        onclick: async () => {
+            const response = await fetch(`/workers/${encodeURIComponent(adresse)}/${action}`, { method: "POST" });
+            if (!response.ok) {
+                alert("Erreur : " + await response.text());
+            }
+            afficher();
+        },
+    }, drain ? "Remettre en service" : "Mettre en maintenance");
+    const etat = drain
+        ? `En maintenance depuis ${formatDate(drain.since)}` + (drain.deadline ? `, annulation des jobs à ${formatDate(drain.deadline)}` : "")
+        : "En service";
+    return el("div", { class: "sous-titre" }, etat, " ", bouton);
+}
+
+function detailMachine(host) {
+    const lignes = [
+        `Charge ${host.load.load1.toFixed(2)} / ${host.load.load5.toFixed(2)} / ${host.load.load15.toFixed(2)}`,
+        `iowait ${host.cpu.iowait.toFixed(1)}% - steal ${host.cpu.steal.toFixed(1)}%`,
+        `RAM ${formatOctets(host.memory.used_bytes)} / ${formatOctets(host.memory.total_bytes)} - swap ${host.memory.swap_used_percent.toFixed(1)}%`,
+    ];
+    for (const disque of host.disks || []) {
+        lignes.push(`${disque.mount} ${disque.used_percent.toFixed(1)}% de ${formatOctets(disque.total_bytes)} (L ${formatOctets(disque.read_bytes_per_sec)}/s, E ${formatOctets(disque.write_bytes_per_sec)}/s)`);
+    }
+    for (const carte of host.network || []) {
+        lignes.push(`${carte.interface} ↓ ${formatOctets(carte.rx_bytes_per_sec)}/s ↑ ${formatOctets(carte.tx_bytes_per_sec)}/s`);
+    }
+    if (host.pressure && host.pressure.cpu) {
+        lignes.push(`Pression CPU ${host.pressure.cpu.some_avg10.toFixed(1)}% - mémoire ${host.pressure.memory.some_avg10.toFixed(1)}% - I/O ${host.pressure.io.some_avg10.toFixed(1)}%`);
+    }
+    if (host.top_cpu && host.top_cpu.length) {
+        lignes.push("CPU : " + host.top_cpu.map(p => `${p.name} (${p.pid}) ${p.cpu_percent.toFixed(1)}%`).join(", "));
+    }
+    if (host.top_rss && host.top_rss.length) {
+        lignes.push("RAM : " + host.top_rss.map(p => `${p.name} (${p.pid}) ${formatOctets(p.rss_bytes)}`).join(", "));
+    }
+    return el("div", { class: "sous-titre" }, ...lignes.flatMap(l => [l, el("br")]));
+}
+
+async function vueWorkers(vue) {
+    const workersInfo = await getJSON("/workers");
+    const cartes = el("div", { class: "cartes" });
+
+    for (const [adresse, info] of Object.entries(workersInfo).sort()) {
+        const metriques = await getJSON(`/workers/${encodeURIComponent(adresse)}/metrics?from=${FENETRE_SPARKLINE}&step=${PAS_SPARKLINE}`);
+        const points = metriques.points.slice(-TAILLE_HISTORIQUE);
+        const serie = (cle) => points.map(p => p.values[cle]).filter(v => v !== undefined);
+
+        const carte = el("div", { class: "carte" },
+            el("h2", {}, info.nom_machine || adresse),
+            el("div", { class: "sous-titre" }, `${adresse} - dernier relevé ${info.date_connection}`));
+
+        for (const [coeur, usage] of Object.entries(info.cpu_usage).sort((a, b) => a[0].localeCompare(b[0], undefined, { numeric: true }))) {
+            carte.append(el("div", { class: "coeur" }, `${coeur} ${usage.toFixed(1)}%`, sparkline(serie(coeur))));
+        }
+        carte.append(el("div", { class: "coeur" }, `RAM ${info.memory_usage.toFixed(1)}%`, sparkline(serie("memory_usage"), "memoire")));
+        if (info.host) {
+            carte.append(detailMachine(info.host));
+        }
+        carte.append(boutonMaintenance(adresse, info.drain));
+        cartes.append(carte);
+    }
+    vue.replaceChildren(el("h2", {}, "Workers"), cartes);
+}
+
+// ---- Vue liste des jobs ----
+
+let filtreEtat = "";
+
+async function vueJobs(vue) {
+    const jobs = await getJSON("/jobs");
+
+    const filtres = el("div", { class: "filtres" });
+    for (const etat of ["", "queued", "running", "success", "failed", "canceled"]) {
+        filtres.append(el("button", {
+            class: etat === filtreEtat ? "actif" : "",
+            onclick: () => { filtreEtat = etat; afficher(); },
+        }, etat || "tous"));
+    }
+
+    const corps = el("tbody");
+    for (const job of jobs.filter(j => !filtreEtat || j.state === filtreEtat)) {
+        const barre = el("div", { class: "barre" }, el("div", { style: `width: ${job.progress ? job.progress.percent : 0}%` }));
+        corps.append(el("tr", {},
+            el("td", {}, el("a", { href: `#/jobs/${job.id}` }, job.id)),
+            el("td", {}, job.worker_addr),
+            el("td", {}, job.command.args.join(" ")),
+            el("td", {}, badgeEtat(job.state)),
+            el("td", {}, barre, formatProgression(job.progress)),
+            el("td", {}, formatDate(job.created_at)),
+            el("td", {}, formatDate(job.eta))));
+    }
+
+    const table = el("table", {},
+        el("thead", {}, el("tr", {}, ...["Job", "Worker", "Arguments", "Etat", "Avancement", "Créé le", "Fin prévue"].map(t => el("th", {}, t)))),
+        corps);
+    vue.replaceChildren(el("h2", {}, "Jobs"), filtres, table);
+}
+
+// ---- Vue détail d'un job avec logs en direct ----
+
+function formatRessources(r) {
+    if (!r) {
+        return "";
+    }
+    return `code ${r.exit_code}, ${r.wall_seconds.toFixed(1)}s, CPU ${(r.user_cpu_seconds + r.system_cpu_seconds).toFixed(1)}s, ` +
+        `RSS max ${formatOctets(r.max_rss_bytes)}, lu ${formatOctets(r.read_bytes)}, écrit ${formatOctets(r.write_bytes)}`;
+}
+
+async function vueJob(vue, id) {
+    const job = await getJSON(`/jobs/${id}`);
+    const detail = el("div", { id: "detail-job" });
+    const logs = el("pre", { class: "logs" });
+
+    const remplirDetail = (job) => {
+        detail.replaceChildren(
+            el("p", {}, "Worker : ", job.worker_addr),
+            el("p", {}, "Commande : ", `${job.command.command} ${job.command.args.join(" ")}`),
+            el("p", {}, "Etat : ", badgeEtat(job.state), job.error ? ` ${job.error}` : ""),
+            el("p", {}, "Avancement : ", formatProgression(job.progress)),
+            el("p", {}, "Fin prévue : ", job.estimate ? `${formatDate(job.eta)} (durée estimée ${job.estimate.seconds.toFixed(0)}s)` : "inconnue"),
+            el("p", {}, "Créé : ", formatDate(job.created_at), " / démarré : ", formatDate(job.started_at), " / terminé : ", formatDate(job.finished_at)),
+            el("p", {}, "Ressources : ", formatRessources(job.resources)));
+    };
+    remplirDetail(job);
+    vue.replaceChildren(el("h2", {}, `Job ${id}`), detail, logs);
+
+    fluxLogs = new EventSource(`/jobs/${id}/logs?follow=true`);
+    const ajouterLigne = (event) => {
+        const ligne = JSON.parse(event.data);
+        logs.append(el("span", { class: ligne.stream }, `[${new Date(ligne.timestamp * 1000).toLocaleTimeString()}] ${ligne.text}\n`));
+        logs.scrollTop = logs.scrollHeight;
+    };
+    for (const flux of ["stdout", "stderr", "progress"]) {
+        fluxLogs.addEventListener(flux, ajouterLigne);
+    }
+    fluxLogs.addEventListener("progress", async () => remplirDetail(await getJSON(`/jobs/${id}`)));
+    fluxLogs.addEventListener("end", async () => {
+        fluxLogs.close();
+        remplirDetail(await getJSON(`/jobs/${id}`));
+    });
+}
+
+// ---- Vue historique ----
+
+async function vueHistorique(vue) {
+    const formulaire = el("form", { class: "filtres" });
+    const champs = {
+        worker: el("input", { placeholder: "worker" }),
+        status: el("select", {}, el("option", { value: "" }, "tous"), el("option", { value: "success" }, "success"), el("option", { value: "failed" }, "failed"), el("option", { value: "canceled" }, "canceled")),
+        from: el("input", { type: "date" }),
+        to: el("input", { type: "date" }),
+    };
+    formulaire.append(...Object.values(champs), el("button", { type: "submit" }, "Filtrer"));
+
+    const corps = el("tbody");
+    const table = el("table", {},
+        el("thead", {}, el("tr", {}, ...["Date", "Job", "Worker", "Commande", "Arguments", "Statut", "Durée", "RSS max", "Erreur"].map(t => el("th", {}, t)))),
+        corps);
+
+    const charger = async () => {
+        const params = new URLSearchParams({ limit: 500 });
+        if (champs.worker.value) params.set("worker", champs.worker.value);
+        if (champs.status.value) params.set("status", champs.status.value);
+        if (champs.from.value) params.set("from", Math.floor(new Date(champs.from.value).getTime() / 1000));
+        if (champs.to.value) params.set("to", Math.floor(new Date(champs.to.value).getTime() / 1000) + 86400);
+        const lignes = await getJSON(`/history?${params}`);
+        corps.replaceChildren(...lignes.map(h => el("tr", {},
+            el("td", {}, formatDate(h.timestamp)),
+            el("td", {}, h.job_id ? el("a", { href: `#/jobs/${h.job_id}` }, h.job_id) : ""),
+            el("td", {}, h.worker_addr),
+            el("td", {}, h.command),
+            el("td", {}, (h.args || []).join(" ")),
+            el("td", {}, badgeEtat(h.status)),
+            el("td", {}, h.wall_seconds ? `${h.wall_seconds.toFixed(1)}s` : ""),
+            el("td", {}, h.max_rss_bytes ? formatOctets(h.max_rss_bytes) : ""),
+            el("td", {}, h.error_message))));
+    };
+    formulaire.addEventListener("submit", (e) => { e.preventDefault(); charger(); });
+
+    vue.replaceChildren(el("h2", {}, "Historique des commandes"), formulaire, table);
+    await charger();
+}
+
+// ---- Vue soumission d'un job ----
+
+async function vueSoumission(vue) {
+    const workersInfo = await getJSON("/workers");
+    const worker = el("select", { name: "worker" }, ...Object.keys(workersInfo).sort().map(a => el("option", { value: a }, a)));
+    const args = el("input", { name: "args", placeholder: "fichier.laz" });
+    const message = el("div", { class: "message" });
+
+    const formulaire = el("form", {},
+        el("label", {}, "Worker"), worker,
+        el("label", {}, "Arguments (séparés par des espaces)"), args,
+        el("div", {}, el("button", { type: "submit" }, "Lancer")),
+        message);
+
+    formulaire.addEventListener("submit", async (e) => {
+        e.preventDefault();
+        const response = await fetch("/jobs", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ worker_addr: worker.value, args: args.value.split(/\s+/).filter(a => a) }),
+        });
+        if (!response.ok) {
+            message.textContent = "Erreur : " + await response.text();
+            return;
+        }
+        const job = await response.json();
+        location.hash = `#/jobs/${job.id}`;
+    });
+
+    vue.replaceChildren(el("h2", {}, "Nouveau job"), formulaire);
+}
+
+// ---- Routage ----
+
+async function afficher() {
+    const vue = document.getElementById("vue");
+    const route = location.hash.replace(/^#/, "") || "/workers";
+
+    for (const lien of document.querySelectorAll("nav a")) {
+        lien.classList.toggle("actif", route.startsWith(lien.getAttribute("href").substring(1)));
+    }
+
+    try {
+        const morceaux = route.split("/").filter(m => m);
+        if (morceaux[0] === "jobs" && morceaux[1]) {
+            await vueJob(vue, morceaux[1]);
+        } else if (morceaux[0] === "jobs") {
+            await vueJobs(vue);
+        } else if (morceaux[0] === "history") {
+            await vueHistorique(vue);
+        } else if (morceaux[0] === "submit") {
+            await vueSoumission(vue);
+        } else {
+            await vueWorkers(vue);
+        }
+    } catch (error) {
+        console.error("Erreur d'affichage de la vue:", error);
+        vue.replaceChildren(el("p", {}, "Erreur : " + error.message));
+    }
+}
+
+// Seules les vues workers et jobs sont rafraîchies périodiquement
+function rafraichir() {
+    const route = location.hash.replace(/^#/, "") || "/workers";
+    if (route === "/workers" || route === "/jobs") {
+        afficher();
+    }
+}
+
+window.addEventListener("hashchange", () => {
+    if (fluxLogs) {
+        fluxLogs.close();
+        fluxLogs = null;
+    }
+    afficher();
+});
+window.addEventListener("load", () => {
+    afficher();
+    minuteur = setInterval(rafraichir, 5000);
+});
@@ -0,0 +1,7 @@
+// Package static embarque l'interface web du master dans le binaire.
+package static
+
+import "embed"
+
+//go:embed index.html app.js style.css
+var Files embed.FS
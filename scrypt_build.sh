@@ -1,4 +1,5 @@
 cd ./worker
-sudo -E /usr/local/go/bin/go build -o /usr/local/bin/worker_test ./cmd/test_worker.go
+sudo -E /usr/local/go/bin/go build -o /usr/local/bin/worker_test ./cmd
 cd .././master
-sudo -E /usr/local/go/bin/go build -o /usr/local/bin/master_test ./cmd/test_master.go
+sudo -E /usr/local/go/bin/go build -o /usr/local/bin/master_test ./cmd
+sudo -E /usr/local/go/bin/go build -o /usr/local/bin/cbctl ./cmd/cbctl
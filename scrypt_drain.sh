@@ -0,0 +1,48 @@
+#!/bin/bash
+
+# Met un worker en maintenance (drain) ou le remet en service (undrain) via l'API du master
+# Usage: ./scrypt_drain.sh drain <ip:port worker> [délai avant annulation, ex: 10m]
+#        ./scrypt_drain.sh undrain <ip:port worker>
+
+# Si l'API est protégée: MASTER_TOKEN=jeton ou MASTER_USER=nom:mot_de_passe (rôle operator)
+
+MASTER_URL=${MASTER_URL:-http://localhost:8082}
+AUTH=()
+if [ -n "$MASTER_TOKEN" ]; then
+    AUTH=(-H "Authorization: Bearer $MASTER_TOKEN")
+elif [ -n "$MASTER_USER" ]; then
+    AUTH=(-u "$MASTER_USER")
+fi
+
+ACTION=$1
+WORKER=$2
+DELAI=$3
+
+if [ -z "$ACTION" ] || [ -z "$WORKER" ]; then
+    echo "Usage: $0 drain|undrain <ip:port worker> [délai]"
+    exit 1
+fi
+
+case "$ACTION" in
+    drain)
+        URL="$MASTER_URL/workers/$WORKER/drain"
+        if [ -n "$DELAI" ]; then
+            URL="$URL?deadline=$DELAI"
+        fi
+        ;;
+    undrain)
+        URL="$MASTER_URL/workers/$WORKER/undrain"
+        ;;
+    *)
+        echo "Action inconnue: $ACTION"
+        exit 1
+        ;;
+esac
+
+if curl -sfL "${AUTH[@]}" -X POST "$URL"; then
+    echo
+    echo "$ACTION de $WORKER effectué."
+else
+    echo "Erreur: $ACTION de $WORKER impossible."
+    exit 1
+fi
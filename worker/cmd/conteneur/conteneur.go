@@ -0,0 +1,207 @@
+// Package conteneur lance les jobs dans un conteneur OCI avec le CLI d'un runtime local
+// (podman ou docker): le dossier des entrées est monté en lecture seule, un dossier de
+// sortie propre au job en lecture-écriture, et les limites de ressources sont appliquées.
+// Chaque job peut demander son image parmi celles autorisées par le worker.
+package conteneur
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chemins vus par le script dans le conteneur
+const (
+	DossierEntrees = "/input"
+	DossierSorties = "/output"
+	CheminScript   = "/opt/compute_balancer/script.py"
+)
+
+// Config est la section container du config.yaml du worker. Les jobs s'exécutent
+// directement sur la machine si aucune image n'est configurée.
+type Config struct {
+	Runtime string   `yaml:"runtime"` // CLI du runtime, podman par défaut (docker accepté)
+	Image   string   `yaml:"image"`   // image des jobs qui n'en demandent pas
+	Images  []string `yaml:"images"`  // autres images que les jobs peuvent demander
+	Python  string   `yaml:"python"`  // interpréteur dans l'image, python3 par défaut
+	// Dossier des fichiers d'entrée, monté en lecture seule sur /input ($WORKER_HOME/data par défaut)
+	InputDir string `yaml:"input_dir"`
+	// Chaque job écrit dans OutputDir/<job_id>, monté sur /output ($WORKER_HOME/output par défaut)
+	OutputDir string `yaml:"output_dir"`
+	// Limites de ressources de chaque conteneur, sans limite si vides
+	CPUs      float64 `yaml:"cpus"`       // nombre de cœurs, 1.5 par exemple
+	Memory    string  `yaml:"memory"`     // mémoire maximale au format du runtime: 512m, 2g...
+	PidsLimit int     `yaml:"pids_limit"` // nombre maximal de processus
+	Network   string  `yaml:"network"`    // réseau du conteneur, none par défaut
+}
+
+func (c Config) Active() bool {
+	return c.Image != ""
+}
+
+// AvecDefauts renvoie la config où les valeurs non renseignées ont leur valeur par
+// défaut, les dossiers étant pris dans home
+func (c Config) AvecDefauts(home string) Config {
+	if c.Runtime == "" {
+		c.Runtime = "podman"
+	}
+	if c.Python == "" {
+		c.Python = "python3"
+	}
+	if c.InputDir == "" {
+		c.InputDir = filepath.Join(home, "data")
+	}
+	if c.OutputDir == "" {
+		c.OutputDir = filepath.Join(home, "output")
+	}
+	if c.Network == "" {
+		c.Network = "none"
+	}
+	return c
+}
+
+// Valider vérifie la section, chaque erreur étant préfixée de prefixe et de sa clé yaml
+func (c Config) Valider(prefixe string) error {
+	var erreurs []error
+	verifier := func(cle string, err error) {
+		if err != nil {
+			erreurs = append(erreurs, fmt.Errorf("%s%s: %v", prefixe, cle, err))
+		}
+	}
+	if _, err := exec.LookPath(c.Runtime); err != nil {
+		verifier("runtime", fmt.Errorf("%q introuvable", c.Runtime))
+	}
+	verifier("image", nomImage(c.Image))
+	for _, image := range c.Images {
+		verifier("images", nomImage(image))
+	}
+	if info, err := os.Stat(c.InputDir); err != nil {
+		verifier("input_dir", err)
+	} else if !info.IsDir() {
+		verifier("input_dir", fmt.Errorf("%s n'est pas un dossier", c.InputDir))
+	}
+	if c.CPUs < 0 {
+		verifier("cpus", fmt.Errorf("valeur négative %v", c.CPUs))
+	}
+	if c.PidsLimit < 0 {
+		verifier("pids_limit", fmt.Errorf("valeur négative %d", c.PidsLimit))
+	}
+	if c.Memory != "" && !formatMemoire.MatchString(c.Memory) {
+		verifier("memory", fmt.Errorf("taille invalide %q, 512m ou 2g par exemple", c.Memory))
+	}
+	return errors.Join(erreurs...)
+}
+
+var (
+	// Une référence d'image: registre, chemin, tag et digest, sans espace ni option du CLI
+	formatImage   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/:@+-]*$`)
+	formatMemoire = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+	// caractères interdits dans un nom de conteneur ou de dossier de sortie
+	horsNom = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+func nomImage(image string) error {
+	if !formatImage.MatchString(image) {
+		return fmt.Errorf("nom d'image invalide %q", image)
+	}
+	return nil
+}
+
+// Autorisee indique si un job peut demander image: l'image par défaut ou une de Images
+func (c Config) Autorisee(image string) bool {
+	return image == c.Image || slices.Contains(c.Images, image)
+}
+
+// Nom renvoie le nom du conteneur d'un job, qui permet de le tuer
+func Nom(job string) string {
+	return "compute-balancer-" + horsNom.ReplaceAllString(job, "_")
+}
+
+// Commande prépare le dossier de sortie du job et renvoie la commande qui exécute script
+// avec args dans un conteneur de l'image. Le script a pour dossier courant /output et
+// trouve ses entrées dans /input, ce que rappellent CB_INPUT_DIR et CB_OUTPUT_DIR.
+// Un job relancé repart de zéro: le conteneur d'une exécution précédente encore connu du
+// runtime est supprimé et le dossier de sortie est vidé.
+func (c Config) Commande(job, image, script string, args ...string) (*exec.Cmd, error) {
+	if image == "" {
+		image = c.Image
+	}
+	if !c.Autorisee(image) {
+		return nil, fmt.Errorf("image non autorisée sur ce worker: %s", image)
+	}
+	if err := c.supprimer(job); err != nil {
+		return nil, fmt.Errorf("suppression du conteneur précédent du job: %v", err)
+	}
+	// le runtime n'accepte que des chemins absolus pour les montages
+	sorties, err := filepath.Abs(filepath.Join(c.OutputDir, horsNom.ReplaceAllString(job, "_")))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(sorties); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(sorties, 0o755); err != nil {
+		return nil, err
+	}
+	entrees, err := filepath.Abs(c.InputDir)
+	if err != nil {
+		return nil, err
+	}
+	if script, err = filepath.Abs(script); err != nil {
+		return nil, err
+	}
+
+	options := []string{"run", "--rm", "--name", Nom(job),
+		"--network", c.Network,
+		"-v", entrees + ":" + DossierEntrees + ":ro",
+		"-v", sorties + ":" + DossierSorties + ":rw",
+		"-v", script + ":" + CheminScript + ":ro",
+		"-w", DossierSorties,
+		"-e", "CB_INPUT_DIR=" + DossierEntrees,
+		"-e", "CB_OUTPUT_DIR=" + DossierSorties,
+		"-e", "CB_JOB_ID=" + job,
+	}
+	if c.CPUs > 0 {
+		options = append(options, "--cpus", strconv.FormatFloat(c.CPUs, 'f', -1, 64))
+	}
+	if c.Memory != "" {
+		options = append(options, "--memory", c.Memory)
+	}
+	if c.PidsLimit > 0 {
+		options = append(options, "--pids-limit", strconv.Itoa(c.PidsLimit))
+	}
+	options = append(options, image, c.Python, CheminScript)
+	return exec.Command(c.Runtime, append(options, args...)...), nil
+}
+
+// supprimer force la suppression du conteneur d'un job, laissé par exemple par un
+// redémarrage du worker pendant le job, qui bloquerait le nom du nouveau conteneur.
+// L'absence de conteneur n'est pas une erreur.
+func (c Config) supprimer(job string) error {
+	ctx, annuler := context.WithTimeout(context.Background(), 30*time.Second)
+	defer annuler()
+	sortie, err := exec.CommandContext(ctx, c.Runtime, "rm", "-f", Nom(job)).CombinedOutput()
+	if err != nil && !strings.Contains(strings.ToLower(string(sortie)), "no such container") {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(sortie)))
+	}
+	return nil
+}
+
+// Tuer arrête le conteneur d'un job. Tuer le CLI du runtime ne suffit pas: le conteneur
+// continuerait sans lui.
+func (c Config) Tuer(job string) error {
+	ctx, annuler := context.WithTimeout(context.Background(), 10*time.Second)
+	defer annuler()
+	if sortie, err := exec.CommandContext(ctx, c.Runtime, "kill", Nom(job)).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(sortie)))
+	}
+	return nil
+}
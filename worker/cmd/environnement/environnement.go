@@ -0,0 +1,328 @@
+// Package environnement prépare l'interpréteur python d'un job: un environnement virtuel
+// épinglé par le job, ou créé à partir de ses requirements. Les environnements créés sont
+// gardés en cache sous le hash de leurs requirements et les paquets ne viennent que du
+// dossier local de wheels (pip --no-index), jamais d'internet.
+package environnement
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config est la section venv du config.yaml du worker. Les jobs qui demandent un
+// environnement sont refusés si la section est absente.
+type Config struct {
+	Dir    string `yaml:"dir"`    // cache des environnements créés, $WORKER_HOME/venvs par défaut
+	Wheels string `yaml:"wheels"` // dossier des wheels, seule source des paquets installés
+	Python string `yaml:"python"` // interpréteur qui crée les environnements, celui du worker par défaut
+	// Dossiers dans lesquels un job peut désigner un environnement existant (venv)
+	Pinned  []string      `yaml:"pinned"`
+	MaxEnvs int           `yaml:"max_envs"` // environnements gardés en cache, 20 par défaut
+	Timeout time.Duration `yaml:"timeout"`  // durée maximale de création d'un environnement, 10m par défaut
+}
+
+func (c Config) Active() bool {
+	return c.Wheels != "" || len(c.Pinned) > 0
+}
+
+// AvecDefauts renvoie la config où les valeurs non renseignées ont leur valeur par
+// défaut, le cache étant pris dans home
+func (c Config) AvecDefauts(home, python string) Config {
+	if c.Dir == "" {
+		c.Dir = filepath.Join(home, "venvs")
+	}
+	if c.Python == "" {
+		c.Python = python
+	}
+	if c.MaxEnvs == 0 {
+		c.MaxEnvs = 20
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Minute
+	}
+	return c
+}
+
+// Valider vérifie la section, chaque erreur étant préfixée de prefixe et de sa clé yaml
+func (c Config) Valider(prefixe string) error {
+	var erreurs []error
+	verifier := func(cle string, err error) {
+		if err != nil {
+			erreurs = append(erreurs, fmt.Errorf("%s%s: %v", prefixe, cle, err))
+		}
+	}
+	if c.Wheels != "" {
+		verifier("wheels", dossier(c.Wheels))
+		if _, err := exec.LookPath(c.Python); err != nil {
+			verifier("python", fmt.Errorf("%q introuvable", c.Python))
+		}
+	}
+	for _, epingle := range c.Pinned {
+		if !filepath.IsAbs(epingle) {
+			verifier("pinned", fmt.Errorf("chemin absolu attendu: %q", epingle))
+			continue
+		}
+		verifier("pinned", dossier(epingle))
+	}
+	if c.MaxEnvs < 1 {
+		verifier("max_envs", fmt.Errorf("au moins 1, pas %d", c.MaxEnvs))
+	}
+	if c.Timeout < 0 {
+		verifier("timeout", fmt.Errorf("durée négative %v", c.Timeout))
+	}
+	return errors.Join(erreurs...)
+}
+
+func dossier(chemin string) error {
+	info, err := os.Stat(chemin)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s n'est pas un dossier", chemin)
+	}
+	return nil
+}
+
+// Fichier témoin d'un environnement complet, sa date est celle de la dernière utilisation
+const temoin = ".pret"
+
+// creation est un environnement en cours de création, attendu par les autres jobs qui
+// ont les mêmes requirements
+type creation struct {
+	fini chan struct{}
+}
+
+// Gestionnaire crée les environnements des jobs et limite la taille du cache
+type Gestionnaire struct {
+	config Config
+	log    *slog.Logger
+
+	mu         sync.Mutex
+	enCreation map[string]*creation
+	utilises   map[string]int // nombre de jobs en cours par environnement, jamais supprimés du cache
+}
+
+func Nouveau(config Config, log *slog.Logger) *Gestionnaire {
+	return &Gestionnaire{
+		config:     config,
+		log:        log,
+		enCreation: make(map[string]*creation),
+		utilises:   make(map[string]int),
+	}
+}
+
+// Epingle renvoie l'interpréteur de l'environnement existant venv, qui doit se trouver
+// dans un des dossiers pinned de la config
+func (g *Gestionnaire) Epingle(venv string) (string, error) {
+	if !filepath.IsAbs(venv) {
+		return "", fmt.Errorf("chemin absolu attendu pour l'environnement: %q", venv)
+	}
+	// les liens symboliques sont résolus pour qu'un lien ne fasse pas sortir des dossiers autorisés
+	reel, err := filepath.EvalSymlinks(venv)
+	if err != nil {
+		return "", err
+	}
+	for _, epingle := range g.config.Pinned {
+		base, err := filepath.EvalSymlinks(epingle)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(base, reel); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			python := filepath.Join(venv, "bin", "python")
+			if _, err := os.Stat(python); err != nil {
+				return "", fmt.Errorf("%s n'est pas un environnement python: %v", venv, err)
+			}
+			return python, nil
+		}
+	}
+	return "", fmt.Errorf("environnement %s hors des dossiers autorisés sur ce worker", venv)
+}
+
+// Requirements renvoie les lignes utiles d'un requirements.txt, triées pour que l'ordre
+// ne change pas l'environnement. Seuls des noms de paquets avec leurs versions sont
+// acceptés: une option de pip, une URL ou un chemin pourrait installer autre chose que
+// les wheels du worker.
+func Requirements(contenu string) ([]string, error) {
+	var lignes []string
+	for _, ligne := range strings.Split(contenu, "\n") {
+		if i := strings.Index(ligne, "#"); i >= 0 {
+			ligne = ligne[:i]
+		}
+		ligne = strings.TrimSpace(ligne)
+		switch {
+		case ligne == "":
+			continue
+		case strings.HasPrefix(ligne, "-"):
+			return nil, fmt.Errorf("option de pip refusée dans les requirements: %q", ligne)
+		case strings.ContainsAny(ligne, "@/\\"):
+			return nil, fmt.Errorf("URL ou chemin refusé dans les requirements: %q", ligne)
+		}
+		lignes = append(lignes, ligne)
+	}
+	if len(lignes) == 0 {
+		return nil, errors.New("requirements vides")
+	}
+	sort.Strings(lignes)
+	return lignes, nil
+}
+
+// Cle renvoie le nom de l'environnement des requirements, qui dépend aussi de
+// l'interpréteur qui le crée
+func Cle(python string, lignes []string) string {
+	somme := sha256.Sum256([]byte(python + "\n" + strings.Join(lignes, "\n")))
+	return hex.EncodeToString(somme[:8])
+}
+
+// Preparer renvoie l'interpréteur de l'environnement des requirements, en le créant s'il
+// n'est pas en cache (cree). liberer doit être appelé à la fin du job: un environnement
+// utilisé n'est pas supprimé du cache.
+func (g *Gestionnaire) Preparer(requirements string) (python string, cree bool, liberer func(), err error) {
+	if g.config.Wheels == "" {
+		return "", false, nil, errors.New("pas de dossier de wheels sur ce worker, requirements non supportés")
+	}
+	lignes, err := Requirements(requirements)
+	if err != nil {
+		return "", false, nil, err
+	}
+	cle := Cle(g.config.Python, lignes)
+	chemin := filepath.Join(g.config.Dir, cle)
+	python = filepath.Join(chemin, "bin", "python")
+
+	g.mu.Lock()
+	for {
+		// un autre job crée déjà cet environnement: on attend qu'il ait fini
+		c, ok := g.enCreation[cle]
+		if !ok {
+			break
+		}
+		g.mu.Unlock()
+		<-c.fini
+		g.mu.Lock()
+	}
+	g.utilises[cle]++
+	liberer = func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.utilises[cle]--; g.utilises[cle] <= 0 {
+			delete(g.utilises, cle)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(chemin, temoin)); err == nil {
+		g.mu.Unlock()
+		maintenant := time.Now()
+		os.Chtimes(filepath.Join(chemin, temoin), maintenant, maintenant)
+		return python, false, liberer, nil
+	}
+	c := &creation{fini: make(chan struct{})}
+	g.enCreation[cle] = c
+	g.mu.Unlock()
+
+	debut := time.Now()
+	err = g.creer(chemin, lignes)
+	g.mu.Lock()
+	delete(g.enCreation, cle)
+	close(c.fini)
+	g.mu.Unlock()
+	if err != nil {
+		liberer()
+		return "", false, nil, err
+	}
+	g.log.Info("Environnement python créé", "venv", cle, "requirements", lignes, "duration", time.Since(debut).Round(time.Millisecond))
+	g.nettoyer()
+	return python, true, liberer, nil
+}
+
+// creer crée l'environnement dans chemin et y installe les requirements depuis les wheels.
+// Un environnement incomplet, laissé par un échec ou un arrêt du worker, est recréé.
+func (g *Gestionnaire) creer(chemin string, lignes []string) error {
+	if err := os.RemoveAll(chemin); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(g.config.Dir, 0o755); err != nil {
+		return err
+	}
+	ctx, annuler := context.WithTimeout(context.Background(), g.config.Timeout)
+	defer annuler()
+	if err := executer(ctx, g.config.Python, "-m", "venv", chemin); err != nil {
+		os.RemoveAll(chemin)
+		return fmt.Errorf("création du venv: %w", err)
+	}
+	requirements := filepath.Join(chemin, "requirements.txt")
+	if err := os.WriteFile(requirements, []byte(strings.Join(lignes, "\n")+"\n"), 0o644); err != nil {
+		os.RemoveAll(chemin)
+		return err
+	}
+	err := executer(ctx, filepath.Join(chemin, "bin", "python"), "-m", "pip", "install",
+		"--no-index", "--find-links", g.config.Wheels, "--disable-pip-version-check", "--no-input",
+		"-r", requirements)
+	if err != nil {
+		os.RemoveAll(chemin)
+		return fmt.Errorf("installation des requirements: %w", err)
+	}
+	return os.WriteFile(filepath.Join(chemin, temoin), nil, 0o644)
+}
+
+// executer lance une commande et renvoie en cas d'échec la fin de sa sortie, qui
+// explique l'erreur de pip
+func executer(ctx context.Context, nom string, args ...string) error {
+	sortie, err := exec.CommandContext(ctx, nom, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	lignes := strings.Split(string(bytes.TrimSpace(sortie)), "\n")
+	if len(lignes) > 5 {
+		lignes = lignes[len(lignes)-5:]
+	}
+	return fmt.Errorf("%v: %s", err, strings.Join(lignes, " | "))
+}
+
+// nettoyer supprime les environnements les moins récemment utilisés au delà de max_envs,
+// sauf ceux des jobs en cours
+func (g *Gestionnaire) nettoyer() {
+	entrees, err := os.ReadDir(g.config.Dir)
+	if err != nil {
+		return
+	}
+	type environnement struct {
+		cle         string
+		utilisation time.Time
+	}
+	var liste []environnement
+	for _, entree := range entrees {
+		info, err := os.Stat(filepath.Join(g.config.Dir, entree.Name(), temoin))
+		if err != nil {
+			continue
+		}
+		liste = append(liste, environnement{entree.Name(), info.ModTime()})
+	}
+	sort.Slice(liste, func(i, j int) bool { return liste[i].utilisation.After(liste[j].utilisation) })
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, env := range liste[min(len(liste), g.config.MaxEnvs):] {
+		if g.utilises[env.cle] > 0 || g.enCreation[env.cle] != nil {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(g.config.Dir, env.cle)); err != nil {
+			g.log.Warn("Suppression de l'environnement impossible", "venv", env.cle, "error", err)
+			continue
+		}
+		g.log.Info("Environnement python supprimé du cache", "venv", env.cle)
+	}
+}
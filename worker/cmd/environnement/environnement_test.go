@@ -0,0 +1,116 @@
+package environnement
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequirements(t *testing.T) {
+	cas := []struct {
+		nom     string
+		contenu string
+		lignes  []string // nil si les requirements doivent être refusés
+	}{
+		{"versions triées", "numpy==1.26.4\n# pour la lecture\nlaspy>=2.5  # lidar\n\n", []string{"laspy>=2.5", "numpy==1.26.4"}},
+		{"extras et marqueurs", "pdal[full]==3.4 ; python_version >= \"3.10\"\r\n", []string{"pdal[full]==3.4 ; python_version >= \"3.10\""}},
+		{"vides", "", nil},
+		{"commentaires seuls", "# rien\n   \n", nil},
+		{"installation éditable", "-e .\n", nil},
+		{"index", "numpy\n--index-url https://pypi.example.org/simple\n", nil},
+		{"index supplémentaire", "  --extra-index-url=https://pypi.example.org\n", nil},
+		{"fichier inclus", "-r autres.txt\n", nil},
+		{"contraintes", "-c contraintes.txt\n", nil},
+		{"référence directe", "numpy @ https://example.org/numpy.whl\n", nil},
+		{"dépôt git", "git+https://example.org/depot.git\n", nil},
+		{"chemin relatif", "./numpy-1.26.4.whl\n", nil},
+		{"chemin absolu", "/tmp/numpy-1.26.4.whl\n", nil},
+		{"chemin windows", "C:\\wheels\\numpy.whl\n", nil},
+	}
+	for _, c := range cas {
+		lignes, err := Requirements(c.contenu)
+		if c.lignes == nil {
+			if err == nil {
+				t.Errorf("%s: requirements acceptés %q", c.nom, lignes)
+			}
+			continue
+		}
+		if err != nil || strings.Join(lignes, "|") != strings.Join(c.lignes, "|") {
+			t.Errorf("%s: %q (%v), attendu %q", c.nom, lignes, err, c.lignes)
+		}
+	}
+}
+
+func TestCleIndependanteDeLOrdre(t *testing.T) {
+	a, _ := Requirements("numpy==1.26.4\nlaspy==2.5\n")
+	b, _ := Requirements("laspy==2.5\n\nnumpy==1.26.4 # tri\n")
+	if Cle("python3", a) != Cle("python3", b) {
+		t.Error("l'ordre des requirements change l'environnement")
+	}
+	if Cle("python3", a) == Cle("python3.12", a) {
+		t.Error("l'interpréteur ne change pas l'environnement")
+	}
+}
+
+// venv crée un environnement minimal, un dossier avec bin/python
+func venv(t *testing.T, chemin string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(chemin, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chemin, "bin", "python"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return chemin
+}
+
+func TestEpingle(t *testing.T) {
+	racine := t.TempDir()
+	autorise := filepath.Join(racine, "venvs")
+	ailleurs := filepath.Join(racine, "ailleurs")
+	venv(t, filepath.Join(autorise, "pdal"))
+	venv(t, filepath.Join(ailleurs, "pirate"))
+	if err := os.MkdirAll(filepath.Join(autorise, "vide"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// un lien dans le dossier autorisé qui mène ailleurs, et un lien vers le dossier autorisé
+	if err := os.Symlink(filepath.Join(ailleurs, "pirate"), filepath.Join(autorise, "lien")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(ailleurs, filepath.Join(autorise, "sortie")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(autorise, "pdal"), filepath.Join(ailleurs, "raccourci")); err != nil {
+		t.Fatal(err)
+	}
+	g := Nouveau(Config{Pinned: []string{autorise}}, slog.Default())
+
+	cas := []struct {
+		nom    string
+		venv   string
+		valide bool
+	}{
+		{"dans le dossier autorisé", filepath.Join(autorise, "pdal"), true},
+		{"lien vers le dossier autorisé", filepath.Join(ailleurs, "raccourci"), true},
+		{"chemin relatif", "venvs/pdal", false},
+		{"hors du dossier autorisé", filepath.Join(ailleurs, "pirate"), false},
+		{"remontée par ..", filepath.Join(autorise, "..", "ailleurs", "pirate"), false},
+		{"lien qui sort du dossier autorisé", filepath.Join(autorise, "lien"), false},
+		{"dossier sous un lien qui sort", filepath.Join(autorise, "sortie", "pirate"), false},
+		{"dossier autorisé lui-même", autorise, false},
+		{"sans interpréteur", filepath.Join(autorise, "vide"), false},
+		{"inexistant", filepath.Join(autorise, "absent"), false},
+	}
+	for _, c := range cas {
+		python, err := g.Epingle(c.venv)
+		if (err == nil) != c.valide {
+			t.Errorf("%s: %q, erreur %v", c.nom, python, err)
+			continue
+		}
+		if c.valide && python != filepath.Join(c.venv, "bin", "python") {
+			t.Errorf("%s: interpréteur %q", c.nom, python)
+		}
+	}
+}
@@ -3,26 +3,54 @@ package handler
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"commun/journalisation"
+	"commun/signature"
+	"worker/cmd/conteneur"
+	"worker/cmd/environnement"
 	"worker/cmd/informationmachine"
 )
 
 type Command struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args"`
+	JobID   string   `json:"job_id,omitempty"`
+	// Image du conteneur demandée par le job, celle du worker si vide
+	Image string `json:"image,omitempty"`
+	// Environnement python du job: chemin d'un venv existant ou contenu d'un
+	// requirements.txt, l'interpréteur du worker si les deux sont vides
+	Venv         string `json:"venv,omitempty"`
+	Requirements string `json:"requirements,omitempty"`
+	// Epoch du bail du leader qui envoie la commande, 0 pour un master sans élection
+	Epoch int64 `json:"epoch,omitempty"`
+	// Signature de la commande par le master, vérifiée si Verificateur est configuré. Worker
+	// est l'adresse de ce worker pour le master, couverte par la signature.
+	Worker    string `json:"worker,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`
+	Signature string `json:"sig,omitempty"`
 }
 
 type WorkerInfo struct {
-	Address        string             `json:"address"`
-	CPUUsage       map[string]float64 `json:"cpu_usage"` // Changement: map pour chaque core
-	MemoryUsage    float64            `json:"memory_usage"`
-	Machine        string             `json:"nom_machine"`
-	DateConnection string             `json:"date_connection"`
+	Address            string                       `json:"address"`
+	CPUUsage           map[string]float64           `json:"cpu_usage"` // Changement: map pour chaque core, lissé si le sampler tourne
+	CPUUsageInstant    map[string]float64           `json:"cpu_usage_instant,omitempty"`
+	MemoryUsage        float64                      `json:"memory_usage"`
+	MemoryUsageInstant float64                      `json:"memory_usage_instant,omitempty"`
+	Machine            string                       `json:"nom_machine"`
+	DateConnection     string                       `json:"date_connection"`
+	Host               *informationmachine.HostInfo `json:"host,omitempty"`
 }
 
 type WorkerEnVie struct {
@@ -30,30 +58,124 @@ type WorkerEnVie struct {
 	CommandeNonExectutee string `json:"commande_non_executee"`
 }
 
+// execution renvoie l'environnement demandé par la commande, couvert par sa signature
+func (c Command) execution() map[string]string {
+	execution := map[string]string{}
+	for cle, valeur := range map[string]string{"image": c.Image, "venv": c.Venv, "requirements": c.Requirements} {
+		if valeur != "" {
+			execution[cle] = valeur
+		}
+	}
+	return execution
+}
+
 // reportProgress envoie la progression au client
-func ReportProgress(conn net.Conn, progress string) error {
+func ReportProgress(conn io.Writer, progress string) error {
 	_, err := conn.Write([]byte(progress + "\n"))
 	return err
 }
 
-// reportStatus envoie l'état du worker au client
-func reportStatus(conn net.Conn) {
-	// Récupération de l'utilisation CPU et mémoire
-	cpuUsage, err := informationmachine.GetCPUUsage()
+// Config regroupe ce dont le handler a besoin pour exécuter les commandes du master
+type Config struct {
+	Script string // script exécuté pour chaque job
+	Python string // interpréteur du script, python3 par défaut
+	// Conteneur exécute les jobs dans un conteneur, directement sur la machine si nil
+	Conteneur *conteneur.Config
+	// Environnements prépare les venvs demandés par les jobs, refusés si nil
+	Environnements *environnement.Gestionnaire
+	// Verificateur vérifie la signature des commandes du master, nil pour accepter les
+	// commandes non signées
+	Verificateur *signature.Verificateur
+	// ConservationJobs est la durée pendant laquelle un job terminé reste consultable,
+	// pour qu'un master redémarré puisse en récupérer le résultat (1h par défaut)
+	ConservationJobs time.Duration
+	// Echantillonneur relève l'état de la machine en tâche de fond. S'il est nil ou
+	// pas encore prêt, l'état est mesuré à chaque demande.
+	Echantillonneur *informationmachine.Sampler
+	// Logger reçoit les messages du handler, slog.Default() si nil
+	Logger *slog.Logger
+}
+
+// Handler exécute les commandes reçues par un worker et garde ses jobs
+type Handler struct {
+	script           string
+	python           string
+	conteneur        *conteneur.Config
+	environnements   *environnement.Gestionnaire
+	verificateur     *signature.Verificateur
+	conservationJobs time.Duration
+	echantillonneur  *informationmachine.Sampler
+	log              *slog.Logger
+	prom             *metriquesProm
+
+	// jobsEnCours associe l'id de chaque job, en cours ou terminé récemment, à son processus
+	jobsEnCours map[string]*jobEnCours
+	jobsMutex   sync.Mutex
+
+	// epoch est la plus grande epoch de leader reçue: les jobs et annulations d'un leader
+	// plus ancien, qui n'a pas encore vu qu'il a perdu son bail, sont refusés
+	epoch atomic.Int64
+}
+
+// New crée le handler des commandes d'un worker
+func New(config Config) *Handler {
+	h := &Handler{
+		script:           config.Script,
+		python:           config.Python,
+		conteneur:        config.Conteneur,
+		environnements:   config.Environnements,
+		verificateur:     config.Verificateur,
+		conservationJobs: config.ConservationJobs,
+		echantillonneur:  config.Echantillonneur,
+		jobsEnCours:      make(map[string]*jobEnCours),
+	}
+	h.log = config.Logger
+	if h.log == nil {
+		h.log = slog.Default()
+	}
+	if h.python == "" {
+		h.python = "python3"
+	}
+	if h.conservationJobs <= 0 {
+		h.conservationJobs = time.Hour
+	}
+	h.prom = nouvellesMetriquesProm(h)
+	return h
+}
+
+// etatMachine renvoie le dernier état connu de la machine
+func (h *Handler) etatMachine() (informationmachine.Echantillon, error) {
+	if h.echantillonneur != nil {
+		if echantillon, pret := h.echantillonneur.Dernier(); pret {
+			return echantillon, nil
+		}
+	}
+	cpuUsage, host, err := informationmachine.Mesurer(100 * time.Millisecond)
 	if err != nil {
-		log.Println("Erreur lors de la récupération de l'utilisation CPU:", err)
-		return
+		return informationmachine.Echantillon{}, err
 	}
+	return informationmachine.Echantillon{
+		At:                 time.Now(),
+		CPUUsage:           cpuUsage,
+		CPUUsageInstant:    cpuUsage,
+		MemoryUsage:        host.Memory.UsedPercent,
+		MemoryUsageInstant: host.Memory.UsedPercent,
+		Host:               host,
+	}, nil
+}
 
-	//memoryUsage := getMemoryUsage()
-	memoryUsage, err := informationmachine.GetRAMUsage()
+// reportStatus envoie l'état du worker au client
+func (h *Handler) reportStatus(conn net.Conn) {
+	// Récupération de l'utilisation CPU et de l'état de la machine
+	echantillon, err := h.etatMachine()
 	if err != nil {
-		log.Println("Erreur lors de la récupération de l'utilisation RAM:", err)
+		h.log.Error("Erreur lors de la récupération de l'état de la machine", "error", err)
 		return
 	}
+
 	nomMachine, err := os.Hostname()
 	if err != nil {
-		log.Println("Erreur lors de la récupération le nom de la machine:", err)
+		h.log.Error("Erreur lors de la récupération du nom de la machine", "error", err)
 		return
 	}
 
@@ -61,60 +183,213 @@ func reportStatus(conn net.Conn) {
 	myAddr := "localhost" //recupérer son adresse ip
 	// Création de l'objet avec les informations du worker
 	workerStatus := WorkerInfo{
-		Address:        myAddr,
-		CPUUsage:       cpuUsage, // Utilisation CPU par cœur
-		MemoryUsage:    memoryUsage,
-		Machine:        nomMachine,
-		DateConnection: now.Format("2006-01-02 15:04:05"),
+		Address:            myAddr,
+		CPUUsage:           echantillon.CPUUsage, // Utilisation CPU par cœur
+		CPUUsageInstant:    echantillon.CPUUsageInstant,
+		MemoryUsage:        echantillon.MemoryUsage,
+		MemoryUsageInstant: echantillon.MemoryUsageInstant,
+		Machine:            nomMachine,
+		DateConnection:     now.Format("2006-01-02 15:04:05"),
+		Host:               &echantillon.Host,
 	}
 
 	// Envoi de l'état au client
 	encoder := json.NewEncoder(conn)
 	if err := encoder.Encode(workerStatus); err != nil {
-		log.Println("Erreur lors de l'envoi de l'état du worker:", err)
+		h.log.Warn("Erreur lors de l'envoi de l'état du worker", "error", err)
 	}
 }
 
-func handleRunPython(conn net.Conn, cmd_python Command, workerHome string) {
+func (h *Handler) handleRunPython(conn net.Conn, cmd_python Command) {
 	if len(cmd_python.Args) < 1 {
 		ReportProgress(conn, "Erreur: nombre d'arguments insuffisant")
 		return
 	}
 	// Exécution du script Python
 	//script := cmd_python.Args[0]
-	script := workerHome + "/test/test_scrypt.py"
+	script := h.script
 	arg := cmd_python.Args[0]
 
-	cmd := exec.Command("python3", script, arg)
+	// le master renvoie la commande d'un job encore en cours: on se rattache au job
+	// existant. Un job terminé ici (tué par une annulation ou une maintenance) puis relancé
+	// par le master garde son id et doit être exécuté à nouveau.
+	if cmd_python.JobID != "" {
+		if job, existe := h.trouverJobEnCours(cmd_python.JobID); existe {
+			job.log().Info("Job déjà lancé, rattachement")
+			h.suivreJob(conn, job, 0)
+			return
+		}
+	}
+
+	python, liberer, err := h.interpreteurJob(conn, cmd_python)
+	if err != nil {
+		// distinct d'un échec du script: le job n'a pas été lancé
+		h.log.Warn("Environnement python du job impossible", journalisation.CleJob, cmd_python.JobID, "venv", cmd_python.Venv, "error", err)
+		h.prom.environnements.WithLabelValues("failed").Inc()
+		ReportProgress(conn, fmt.Sprintf("Erreur_env: %v", err))
+		return
+	}
+	lance := false
+	defer func() {
+		if !lance {
+			liberer()
+		}
+	}()
+
+	cmd, nomConteneur, err := h.commandeJob(cmd_python, python, script, arg)
+	if err != nil {
+		h.log.Warn("Job refusé", journalisation.CleJob, cmd_python.JobID, "image", cmd_python.Image, "error", err)
+		ReportProgress(conn, fmt.Sprintf("Erreur: %v", err))
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // permet d'annuler le script et ses sous-processus
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		ReportProgress(conn, fmt.Sprintf("Erreur1: %v", err))
 		return
 	}
-	scanner := bufio.NewScanner(stdout)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		ReportProgress(conn, fmt.Sprintf("Erreur1: %v", err))
+		return
+	}
 	if err := cmd.Start(); err != nil {
+		h.log.Error("Lancement du script impossible", journalisation.CleJob, cmd_python.JobID, "script", script, "error", err)
 		ReportProgress(conn, fmt.Sprintf("Erreur2: %v", err))
 		return
 	}
+	job := h.enregistrerJob(cleJob(cmd_python.JobID, cmd), cmd_python, cmd, nomConteneur)
+	if nomConteneur != "" {
+		image := cmd_python.Image
+		if image == "" {
+			image = h.conteneur.Image
+		}
+		job.log().Info("Job lancé en conteneur", journalisation.CleCommande, cmd_python.Command, "args", cmd_python.Args,
+			"image", image, "container", conteneur.Nom(nomConteneur))
+	} else {
+		job.log().Info("Job lancé", journalisation.CleCommande, cmd_python.Command, "args", cmd_python.Args, "python", python, "pid", cmd.Process.Pid)
+	}
+
+	// le script continue si la connexion est perdue, le master pourra se rattacher au job
+	lance = true
+	go h.executerScript(job, stdout, stderr, liberer)
+	h.suivreJob(conn, job, 0)
+}
+
+// interpreteurJob renvoie l'interpréteur python du job: celui du venv qu'il désigne ou
+// de l'environnement créé à partir de ses requirements, celui du worker sinon. liberer
+// est à appeler à la fin du job, pour que son environnement puisse quitter le cache.
+func (h *Handler) interpreteurJob(conn net.Conn, commande Command) (python string, liberer func(), err error) {
+	if commande.Venv == "" && commande.Requirements == "" {
+		return h.python, func() {}, nil
+	}
+	switch {
+	case h.environnements == nil:
+		return "", nil, errors.New("environnements python non gérés par ce worker (section venv absente)")
+	case h.conteneur != nil:
+		return "", nil, errors.New("environnements python non gérés en conteneur, l'image du job fournit ses paquets")
+	case commande.Venv != "" && commande.Requirements != "":
+		return "", nil, errors.New("venv et requirements sont exclusifs")
+	case commande.Venv != "":
+		if python, err = h.environnements.Epingle(commande.Venv); err != nil {
+			return "", nil, err
+		}
+		h.prom.environnements.WithLabelValues("pinned").Inc()
+		return python, func() {}, nil
+	}
+
+	// la création peut prendre plusieurs minutes, le master affiche l'étape en attendant
+	reportTypedProgress(conn, Progress{Stage: "environnement python"})
+	python, cree, liberer, err := h.environnements.Preparer(commande.Requirements)
+	if err != nil {
+		return "", nil, err
+	}
+	if cree {
+		h.prom.environnements.WithLabelValues("created").Inc()
+	} else {
+		h.prom.environnements.WithLabelValues("cached").Inc()
+	}
+	return python, liberer, nil
+}
+
+// commandeJob prépare l'exécution du script avec l'interpréteur python: dans un conteneur
+// si le worker en a un de configuré, directement sur la machine sinon. Le nom du job pour
+// le runtime est renvoyé pour pouvoir tuer son conteneur.
+func (h *Handler) commandeJob(commande Command, python, script, arg string) (*exec.Cmd, string, error) {
+	if h.conteneur == nil {
+		if commande.Image != "" {
+			return nil, "", fmt.Errorf("image %s demandée, mais ce worker n'exécute pas les jobs en conteneur", commande.Image)
+		}
+		return exec.Command(python, script, arg), "", nil
+	}
+	nom := commande.JobID
+	if nom == "" {
+		nom = fmt.Sprintf("sans-id-%d", time.Now().UnixNano())
+	}
+	cmd, err := h.conteneur.Commande(nom, commande.Image, script, arg)
+	return cmd, nom, err
+}
+
+// executerScript relaie la sortie du script dans celle du job jusqu'à la fin de son
+// exécution, puis libère son environnement python
+func (h *Handler) executerScript(job *jobEnCours, stdout, stderr io.Reader, liberer func()) {
+	defer liberer()
+	defer h.terminerJob(job)
+	cmd := job.cmd
+	h.prom.runningJobs.Inc()
+	defer h.prom.runningJobs.Dec()
+	defer h.compterCodeSortie(cmd)
 
+	// La sortie d'erreur est relayée en parallèle pour ne pas bloquer le script
+	stderrFini := make(chan struct{})
+	go func() {
+		defer close(stderrFini)
+		scannerErr := bufio.NewScanner(stderr)
+		for scannerErr.Scan() {
+			ReportProgress(job, fmt.Sprintf("Stderr: %s", scannerErr.Text()))
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		line := scanner.Text()
-		ReportProgress(conn, fmt.Sprintf("Output: %s", line))
+		progress, estProgression, err := parseProgress(line)
+		switch {
+		case estProgression && err == nil:
+			reportTypedProgress(job, progress)
+		case estProgression:
+			job.log().Warn("Ligne de progression ignorée", "error", err)
+			ReportProgress(job, fmt.Sprintf("Output: %s", line))
+		default:
+			ReportProgress(job, fmt.Sprintf("Output: %s", line))
+		}
 	}
 	if scanner.Err() != nil {
-		cmd.Process.Kill()
+		h.tuerJob(job)
 		cmd.Wait()
-		ReportProgress(conn, fmt.Sprintf("Erreur_scann: %v", scanner.Err()))
+		ReportProgress(job, fmt.Sprintf("Erreur_scann: %v", scanner.Err()))
+	}
+	<-stderrFini
+	errWait := cmd.Wait()
+	if err := reportResources(job, mesurerRessources(cmd, job.debut)); err != nil {
+		job.log().Warn("Erreur lors de l'envoi des ressources du job", "error", err)
+	}
+	if h.estInterrompu(job.cle) {
+		job.log().Warn("Job interrompu par l'arrêt du worker")
+		ReportProgress(job, "Interrupted: job tué par l'arrêt du worker")
+		return
 	}
-	if err := cmd.Wait(); err != nil {
-		ReportProgress(conn, fmt.Sprintf("Erreur3: %v", err))
+	if errWait != nil {
+		job.log().Warn("Job en échec", "error", errWait)
+		ReportProgress(job, fmt.Sprintf("Erreur3: %v", errWait))
 		return
 	}
+	job.log().Info("Job terminé", "duration", time.Since(job.debut).Round(time.Millisecond))
 
-	ReportProgress(conn, "T'as réussi bg le script s'est exécuté!")
+	ReportProgress(job, "T'as réussi bg le script s'est exécuté!")
 }
 
-func handleVivantOuPas(conn net.Conn) {
+func (h *Handler) handleVivantOuPas(conn net.Conn) {
 	//test
 	workerAlive := WorkerEnVie{
 		EtatWorker:           "disponible",
@@ -124,19 +399,67 @@ func handleVivantOuPas(conn net.Conn) {
 	// Envoi de l'état au client
 	encoder := json.NewEncoder(conn)
 	if err := encoder.Encode(workerAlive); err != nil {
-		log.Println("Erreur lors de l'envoi de l'état du worker pour tentative de reconnection:", err)
+		h.log.Warn("Erreur lors de la réponse à une reprise de contact", "error", err)
+	}
+}
+
+// errAncienLeader: la commande vient d'un leader dont un autre a pris le bail
+var errAncienLeader = errors.New("commande d'un ancien leader")
+
+// commandeAutorisee vérifie la signature et l'epoch de la commande et signale au master un refus
+func (h *Handler) commandeAutorisee(conn net.Conn, cmd Command) bool {
+	var err error
+	if h.verificateur != nil {
+		err = h.verificateur.Verifier(cmd.Worker, cmd.Epoch, cmd.Command, cmd.Args, cmd.JobID, cmd.execution(), cmd.Nonce, cmd.Timestamp, cmd.Signature)
+	}
+	if err == nil {
+		err = h.verifierEpoch(cmd)
+	}
+	if err == nil {
+		return true
+	}
+	h.log.Warn("Commande refusée", journalisation.CleCommande, cmd.Command, journalisation.CleJob, cmd.JobID, "remote", conn.RemoteAddr().String(), "destinataire", cmd.Worker, "epoch", cmd.Epoch, "error", err)
+	h.prom.rejectedCommands.WithLabelValues(err.Error()).Inc()
+	ReportProgress(conn, "Erreur: commande refusée, "+err.Error())
+	return false
+}
+
+// verifierEpoch refuse les jobs et annulations d'une epoch antérieure à la plus récente vue,
+// et retient leur epoch. Les autres commandes (relevés, listes) ne changent pas l'état des
+// jobs: elles ne sont pas comparées et ne font pas monter l'epoch retenue.
+func (h *Handler) verifierEpoch(cmd Command) error {
+	if cmd.Command != "run_python" && cmd.Command != "cancel" {
+		return nil
+	}
+	for {
+		vue := h.epoch.Load()
+		if cmd.Epoch < vue {
+			return errAncienLeader
+		}
+		if cmd.Epoch == vue || h.epoch.CompareAndSwap(vue, cmd.Epoch) {
+			return nil
+		}
 	}
 }
 
 // handleCommand gère les différentes commandes reçues
-func HandleCommand(conn net.Conn, cmd Command, workerHome string) {
+func (h *Handler) HandleCommand(conn net.Conn, cmd Command) {
+	if !h.commandeAutorisee(conn, cmd) {
+		return
+	}
 	switch cmd.Command {
 	case "run_python":
-		handleRunPython(conn, cmd, workerHome)
+		h.handleRunPython(conn, cmd)
 	case "infos":
-		reportStatus(conn)
+		h.reportStatus(conn)
 	case "vivantoupas":
-		handleVivantOuPas(conn)
+		h.handleVivantOuPas(conn)
+	case "cancel":
+		h.handleCancel(conn, cmd)
+	case "attach":
+		h.handleAttach(conn, cmd)
+	case "jobs":
+		h.handleJobs(conn)
 	default:
 		ReportProgress(conn, "Commande inconnue")
 	}
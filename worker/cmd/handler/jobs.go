@@ -0,0 +1,316 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"commun/journalisation"
+)
+
+// Nombre de lignes de sortie gardées par job pour un master qui se rattache
+const tailleSortieJob = 10000
+
+// jobEnCours est un script lancé par le worker. Son exécution ne dépend pas de la
+// connexion du master: la sortie est gardée et chaque connexion rattachée la suit.
+type jobEnCours struct {
+	cle        string
+	commande   Command
+	cmd        *exec.Cmd
+	conteneur  string // nom du job pour le runtime de conteneurs, vide sur la machine
+	debut      time.Time
+	fin        time.Time
+	termine    bool
+	interrompu bool // tué par l'arrêt du worker, le master doit le relancer ailleurs
+
+	// sortie contient les lignes numérotées de premiere à premiere+len(sortie)-1
+	sortie   []string
+	premiere int
+	nouveau  *sync.Cond // signale une nouvelle ligne ou la fin du job, protégé par jobsMutex
+	h        *Handler
+}
+
+// log renvoie le journal du handler avec l'id de ce job
+func (job *jobEnCours) log() *slog.Logger {
+	return job.h.log.With(journalisation.CleJob, job.cle)
+}
+
+// JobWorker décrit un job du worker dans la réponse à la commande "jobs"
+type JobWorker struct {
+	JobID   string   `json:"job_id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Image   string   `json:"image,omitempty"`
+	Venv    string   `json:"venv,omitempty"`
+	// Requirements est le contenu du requirements.txt du job
+	Requirements string `json:"requirements,omitempty"`
+	State        string `json:"state"` // running ou finished
+	StartedAt    int64  `json:"started_at"`
+	FinishedAt   int64  `json:"finished_at,omitempty"`
+	Lines        int    `json:"lines"`
+}
+
+// cleJob renvoie la clé d'un job dans jobsEnCours, le pid pour les commandes sans id
+func cleJob(jobID string, cmd *exec.Cmd) string {
+	if jobID != "" {
+		return jobID
+	}
+	return fmt.Sprintf("pid-%d", cmd.Process.Pid)
+}
+
+func (h *Handler) enregistrerJob(cle string, commande Command, cmd *exec.Cmd, conteneur string) *jobEnCours {
+	h.jobsMutex.Lock()
+	defer h.jobsMutex.Unlock()
+	job := &jobEnCours{cle: cle, commande: commande, cmd: cmd, conteneur: conteneur, debut: time.Now(), h: h}
+	job.nouveau = sync.NewCond(&h.jobsMutex)
+	h.jobsEnCours[cle] = job
+	return job
+}
+
+func (h *Handler) trouverJob(cle string) (*jobEnCours, bool) {
+	h.jobsMutex.Lock()
+	defer h.jobsMutex.Unlock()
+	job, ok := h.jobsEnCours[cle]
+	return job, ok
+}
+
+// trouverJobEnCours renvoie le job s'il n'est pas terminé
+func (h *Handler) trouverJobEnCours(cle string) (*jobEnCours, bool) {
+	h.jobsMutex.Lock()
+	defer h.jobsMutex.Unlock()
+	job, ok := h.jobsEnCours[cle]
+	return job, ok && !job.termine
+}
+
+// terminerJob marque le job fini et le garde conservationJobs pour un rattachement tardif
+func (h *Handler) terminerJob(job *jobEnCours) {
+	h.jobsMutex.Lock()
+	job.termine = true
+	job.fin = time.Now()
+	job.nouveau.Broadcast()
+	h.jobsMutex.Unlock()
+
+	time.AfterFunc(h.conservationJobs, func() {
+		h.jobsMutex.Lock()
+		defer h.jobsMutex.Unlock()
+		if h.jobsEnCours[job.cle] == job {
+			delete(h.jobsEnCours, job.cle)
+		}
+	})
+}
+
+// Write ajoute une ou plusieurs lignes à la sortie du job, pour ReportProgress
+func (job *jobEnCours) Write(p []byte) (int, error) {
+	job.h.jobsMutex.Lock()
+	defer job.h.jobsMutex.Unlock()
+	for _, ligne := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		job.sortie = append(job.sortie, ligne)
+	}
+	if depasse := len(job.sortie) - tailleSortieJob; depasse > 0 {
+		job.sortie = append([]string(nil), job.sortie[depasse:]...)
+		job.premiere += depasse
+	}
+	job.nouveau.Broadcast()
+	return len(p), nil
+}
+
+// suivreJob envoie sur conn la sortie du job à partir de la ligne depuis, puis les lignes
+// suivantes jusqu'à la fin du job. Une erreur d'écriture détache la connexion sans
+// toucher au job.
+func (h *Handler) suivreJob(conn net.Conn, job *jobEnCours, depuis int) error {
+	h.jobsMutex.Lock()
+	if depuis < job.premiere {
+		// les lignes plus anciennes ne sont plus gardées
+		depuis = job.premiere
+	}
+	h.jobsMutex.Unlock()
+	if err := ReportProgress(conn, fmt.Sprintf("Attached: %d", depuis)); err != nil {
+		return err
+	}
+
+	for {
+		h.jobsMutex.Lock()
+		for depuis >= job.premiere+len(job.sortie) && !job.termine {
+			job.nouveau.Wait()
+		}
+		if depuis < job.premiere {
+			depuis = job.premiere
+		}
+		lignes := append([]string(nil), job.sortie[depuis-job.premiere:]...)
+		fini := job.termine
+		h.jobsMutex.Unlock()
+
+		for _, ligne := range lignes {
+			if err := ReportProgress(conn, ligne); err != nil {
+				job.log().Warn("Connexion du master perdue, job détaché", "error", err)
+				return err
+			}
+		}
+		depuis += len(lignes)
+		if fini {
+			return nil
+		}
+	}
+}
+
+func (h *Handler) estInterrompu(cle string) bool {
+	h.jobsMutex.Lock()
+	defer h.jobsMutex.Unlock()
+	job, ok := h.jobsEnCours[cle]
+	return ok && job.interrompu
+}
+
+// tuerGroupe tue le script et ses sous-processus, lancés dans leur propre groupe
+func tuerGroupe(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	// -pid vise tout le groupe de processus
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// tuerJob tue le script du job et son conteneur s'il en a un: tuer le CLI du runtime
+// n'arrête pas le conteneur
+func (h *Handler) tuerJob(job *jobEnCours) {
+	if job.conteneur != "" {
+		if err := h.conteneur.Tuer(job.conteneur); err != nil {
+			job.log().Warn("Arrêt du conteneur impossible", "error", err)
+		}
+	}
+	tuerGroupe(job.cmd)
+}
+
+// annulerJob tue le groupe de processus du job, sous-processus compris
+func (h *Handler) annulerJob(jobID string) bool {
+	job, enCours := h.trouverJobEnCours(jobID)
+	if !enCours {
+		return false
+	}
+	h.tuerJob(job)
+	return true
+}
+
+func (h *Handler) handleCancel(conn net.Conn, cmd Command) {
+	if len(cmd.Args) < 1 {
+		ReportProgress(conn, "Erreur: nombre d'arguments insuffisant")
+		return
+	}
+	if !h.annulerJob(cmd.Args[0]) {
+		ReportProgress(conn, "Erreur: job inconnu "+cmd.Args[0])
+		return
+	}
+	ReportProgress(conn, "Job annulé "+cmd.Args[0])
+}
+
+// handleAttach rattache la connexion à un job: args[0] est l'id du job, args[1] le
+// nombre de lignes de sortie déjà reçues par le master
+func (h *Handler) handleAttach(conn net.Conn, cmd Command) {
+	if len(cmd.Args) < 1 {
+		ReportProgress(conn, "Erreur: nombre d'arguments insuffisant")
+		return
+	}
+	job, ok := h.trouverJob(cmd.Args[0])
+	if !ok {
+		ReportProgress(conn, "Erreur: job inconnu "+cmd.Args[0])
+		return
+	}
+	depuis := 0
+	if len(cmd.Args) > 1 {
+		var err error
+		if depuis, err = strconv.Atoi(cmd.Args[1]); err != nil || depuis < 0 {
+			ReportProgress(conn, "Erreur: position invalide "+cmd.Args[1])
+			return
+		}
+	}
+	job.log().Info("Rattachement au job", "from_line", depuis)
+	h.suivreJob(conn, job, depuis)
+}
+
+// handleJobs envoie la liste des jobs en cours et terminés récemment
+func (h *Handler) handleJobs(conn net.Conn) {
+	h.jobsMutex.Lock()
+	liste := make([]JobWorker, 0, len(h.jobsEnCours))
+	for cle, job := range h.jobsEnCours {
+		info := JobWorker{
+			JobID:        cle,
+			Command:      job.commande.Command,
+			Args:         job.commande.Args,
+			Image:        job.commande.Image,
+			Venv:         job.commande.Venv,
+			Requirements: job.commande.Requirements,
+			State:        "running",
+			StartedAt:    job.debut.Unix(),
+			Lines:        job.premiere + len(job.sortie),
+		}
+		if job.termine {
+			info.State = "finished"
+			info.FinishedAt = job.fin.Unix()
+		}
+		liste = append(liste, info)
+	}
+	h.jobsMutex.Unlock()
+
+	sort.Slice(liste, func(i, j int) bool { return liste[i].StartedAt < liste[j].StartedAt })
+	if err := json.NewEncoder(conn).Encode(liste); err != nil {
+		h.log.Warn("Erreur lors de l'envoi de la liste des jobs", "error", err)
+	}
+}
+
+func (h *Handler) nombreJobsEnCours() int {
+	h.jobsMutex.Lock()
+	defer h.jobsMutex.Unlock()
+	n := 0
+	for _, job := range h.jobsEnCours {
+		if !job.termine {
+			n++
+		}
+	}
+	return n
+}
+
+// Arreter prévient le master que le worker s'arrête, laisse grace aux jobs en cours pour
+// se terminer puis tue les restants, qui sont signalés interrompus pour être relancés ailleurs
+func (h *Handler) Arreter(grace time.Duration) {
+	h.jobsMutex.Lock()
+	var enCours []*jobEnCours
+	for _, job := range h.jobsEnCours {
+		if !job.termine {
+			enCours = append(enCours, job)
+		}
+	}
+	h.jobsMutex.Unlock()
+	for _, job := range enCours {
+		ReportProgress(job, fmt.Sprintf("Leaving: arrêt du worker, délai de grâce %s", grace))
+	}
+
+	echeance := time.Now().Add(grace)
+	for h.nombreJobsEnCours() > 0 && time.Now().Before(echeance) {
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	h.jobsMutex.Lock()
+	enCours = enCours[:0]
+	for _, job := range h.jobsEnCours {
+		if job.termine {
+			continue
+		}
+		job.log().Warn("Délai de grâce écoulé, interruption du job")
+		job.interrompu = true
+		enCours = append(enCours, job)
+	}
+	h.jobsMutex.Unlock()
+	// l'arrêt d'un conteneur passe par le runtime, hors du verrou
+	for _, job := range enCours {
+		h.tuerJob(job)
+	}
+}
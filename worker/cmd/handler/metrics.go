@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"net/http"
+	"os/exec"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	cpuUsageDesc = prometheus.NewDesc(
+		"compute_balancer_worker_cpu_usage_percent",
+		"Utilisation de chaque cœur CPU en pourcentage, moyenne lissée (window=\"smoothed\") ou sur le dernier relevé (window=\"instant\").",
+		[]string{"core", "window"}, nil,
+	)
+	ramUsageDesc = prometheus.NewDesc(
+		"compute_balancer_worker_ram_usage_percent",
+		"Utilisation de la RAM en pourcentage, moyenne lissée (window=\"smoothed\") ou au dernier relevé (window=\"instant\").",
+		[]string{"window"}, nil,
+	)
+)
+
+// metriquesProm sont les métriques Prometheus d'un worker, dans son propre registre pour
+// que plusieurs workers puissent tourner dans le même processus
+type metriquesProm struct {
+	registre         *prometheus.Registry
+	runningJobs      prometheus.Gauge
+	jobExitCodes     *prometheus.CounterVec
+	rejectedCommands *prometheus.CounterVec
+	environnements   *prometheus.CounterVec
+}
+
+func nouvellesMetriquesProm(h *Handler) *metriquesProm {
+	p := &metriquesProm{
+		registre: prometheus.NewRegistry(),
+		runningJobs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "compute_balancer_worker_running_jobs",
+			Help: "Nombre de jobs en cours d'exécution sur le worker.",
+		}),
+		jobExitCodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "compute_balancer_worker_job_exit_codes_total",
+			Help: "Nombre de jobs terminés, par code de sortie du script (-1 si tué par un signal).",
+		}, []string{"code"}),
+		rejectedCommands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "compute_balancer_worker_rejected_commands_total",
+			Help: "Nombre de commandes refusées, par raison (non signée, signature invalide, périmée, rejouée).",
+		}, []string{"reason"}),
+		environnements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "compute_balancer_worker_python_envs_total",
+			Help: "Environnements python préparés pour les jobs, par résultat (created, cached, pinned, failed).",
+		}, []string{"result"}),
+	}
+	p.registre.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		p.runningJobs, p.jobExitCodes, p.rejectedCommands, p.environnements, machineCollector{h},
+	)
+	return p
+}
+
+// machineCollector relève l'état de la machine au moment du scrape
+type machineCollector struct {
+	h *Handler
+}
+
+func (machineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cpuUsageDesc
+	ch <- ramUsageDesc
+}
+
+func (c machineCollector) Collect(ch chan<- prometheus.Metric) {
+	echantillon, err := c.h.etatMachine()
+	if err != nil {
+		c.h.log.Error("Erreur lors de la récupération de l'état de la machine", "error", err)
+		return
+	}
+	// les mêmes fenêtres pour le CPU et la RAM: "smoothed" est ce que le master voit dans
+	// infos, "instant" le dernier intervalle du sampler
+	for core, usage := range echantillon.CPUUsage {
+		ch <- prometheus.MustNewConstMetric(cpuUsageDesc, prometheus.GaugeValue, usage, core, "smoothed")
+	}
+	for core, usage := range echantillon.CPUUsageInstant {
+		ch <- prometheus.MustNewConstMetric(cpuUsageDesc, prometheus.GaugeValue, usage, core, "instant")
+	}
+	ch <- prometheus.MustNewConstMetric(ramUsageDesc, prometheus.GaugeValue, echantillon.MemoryUsage, "smoothed")
+	ch <- prometheus.MustNewConstMetric(ramUsageDesc, prometheus.GaugeValue, echantillon.MemoryUsageInstant, "instant")
+}
+
+// MetricsHandler expose les métriques Prometheus du worker
+func (h *Handler) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(h.prom.registre, promhttp.HandlerOpts{})
+}
+
+// compterCodeSortie enregistre le code de sortie d'un script terminé
+func (h *Handler) compterCodeSortie(cmd *exec.Cmd) {
+	if cmd.ProcessState == nil {
+		return
+	}
+	h.prom.jobExitCodes.WithLabelValues(strconv.Itoa(cmd.ProcessState.ExitCode())).Inc()
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MarqueurProgression préfixe les lignes de stdout par lesquelles un script signale son avancement.
+// Exemple en python :
+//
+//	print('##PROGRESS## {"percent": 42.5, "stage": "tuilage", "eta": 120}', flush=True)
+const MarqueurProgression = "##PROGRESS##"
+
+// Progress décrit l'avancement d'un job tel que reporté par le script
+type Progress struct {
+	Percent float64 `json:"percent"`
+	Stage   string  `json:"stage,omitempty"`
+	ETA     int64   `json:"eta,omitempty"` // secondes restantes estimées par le script
+}
+
+// parseProgress extrait l'avancement d'une ligne de sortie du script.
+// Le booléen est faux si la ligne ne porte pas le marqueur.
+func parseProgress(line string) (Progress, bool, error) {
+	reste, ok := strings.CutPrefix(strings.TrimSpace(line), MarqueurProgression)
+	if !ok {
+		return Progress{}, false, nil
+	}
+	var p Progress
+	if err := json.Unmarshal([]byte(strings.TrimSpace(reste)), &p); err != nil {
+		return Progress{}, true, fmt.Errorf("progression mal formée: %v", err)
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return Progress{}, true, fmt.Errorf("pourcentage hors limites: %v", p.Percent)
+	}
+	if p.ETA < 0 {
+		p.ETA = 0
+	}
+	return p, true, nil
+}
+
+// reportTypedProgress envoie l'avancement structuré au master
+func reportTypedProgress(conn io.Writer, p Progress) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return ReportProgress(conn, "Progress: "+string(data))
+}
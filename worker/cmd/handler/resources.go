@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// ResourceUsage résume les ressources consommées par un script et ses sous-processus
+type ResourceUsage struct {
+	ExitCode      int     `json:"exit_code"`
+	WallSeconds   float64 `json:"wall_seconds"`
+	UserSeconds   float64 `json:"user_cpu_seconds"`
+	SystemSeconds float64 `json:"system_cpu_seconds"`
+	MaxRSSBytes   int64   `json:"max_rss_bytes"`
+	ReadBytes     int64   `json:"read_bytes"`
+	WriteBytes    int64   `json:"write_bytes"`
+}
+
+// mesurerRessources lit le rusage du processus terminé. Le noyau y cumule les
+// sous-processus que le script a attendus, le pic de RSS étant celui du plus gros.
+func mesurerRessources(cmd *exec.Cmd, debut time.Time) ResourceUsage {
+	usage := ResourceUsage{ExitCode: -1, WallSeconds: time.Since(debut).Seconds()}
+	if cmd.ProcessState == nil {
+		return usage
+	}
+	usage.ExitCode = cmd.ProcessState.ExitCode()
+	usage.UserSeconds = cmd.ProcessState.UserTime().Seconds()
+	usage.SystemSeconds = cmd.ProcessState.SystemTime().Seconds()
+	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSSBytes = rusage.Maxrss * 1024 // ru_maxrss est en Ko sous Linux
+		// inblock et oublock sont comptés en blocs de 512 octets
+		usage.ReadBytes = rusage.Inblock * 512
+		usage.WriteBytes = rusage.Oublock * 512
+	}
+	return usage
+}
+
+// reportResources envoie au master le bilan des ressources du job
+func reportResources(conn io.Writer, usage ResourceUsage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return ReportProgress(conn, "Resources: "+string(data))
+}
@@ -0,0 +1,467 @@
+package informationmachine
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Taille d'un secteur dans /proc/diskstats, toujours 512 octets quel que soit le disque
+	tailleSecteur = 512
+	// Ticks par seconde des temps CPU de /proc/[pid]/stat (USER_HZ), 100 sur Linux
+	ticksParSeconde = 100
+	// Processus gardés dans les classements par CPU et par mémoire
+	nombreProcessus = 5
+)
+
+type LoadAvg struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// CPUDetail répartit le temps CPU global (tous cœurs confondus) en pourcentages
+type CPUDetail struct {
+	User   float64 `json:"user"`
+	System float64 `json:"system"`
+	IOWait float64 `json:"iowait"`
+	Steal  float64 `json:"steal"`
+	Idle   float64 `json:"idle"`
+}
+
+type MemoryInfo struct {
+	TotalBytes      uint64  `json:"total_bytes"`
+	AvailableBytes  uint64  `json:"available_bytes"`
+	UsedBytes       uint64  `json:"used_bytes"`
+	UsedPercent     float64 `json:"used_percent"`
+	SwapTotalBytes  uint64  `json:"swap_total_bytes"`
+	SwapUsedBytes   uint64  `json:"swap_used_bytes"`
+	SwapUsedPercent float64 `json:"swap_used_percent"`
+}
+
+type DiskInfo struct {
+	Mount            string  `json:"mount"`
+	Device           string  `json:"device"`
+	FSType           string  `json:"fs_type"`
+	TotalBytes       uint64  `json:"total_bytes"`
+	UsedBytes        uint64  `json:"used_bytes"`
+	AvailableBytes   uint64  `json:"available_bytes"`
+	UsedPercent      float64 `json:"used_percent"`
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"`
+}
+
+type NetInfo struct {
+	Interface     string  `json:"interface"`
+	RxBytes       uint64  `json:"rx_bytes"`
+	TxBytes       uint64  `json:"tx_bytes"`
+	RxBytesPerSec float64 `json:"rx_bytes_per_sec"`
+	TxBytesPerSec float64 `json:"tx_bytes_per_sec"`
+}
+
+// PressureInfo reprend les moyennes de /proc/pressure/<ressource> (pourcentage de temps bloqué)
+type PressureInfo struct {
+	SomeAvg10  float64 `json:"some_avg10"`
+	SomeAvg60  float64 `json:"some_avg60"`
+	SomeAvg300 float64 `json:"some_avg300"`
+	FullAvg10  float64 `json:"full_avg10"`
+	FullAvg60  float64 `json:"full_avg60"`
+	FullAvg300 float64 `json:"full_avg300"`
+}
+
+// ProcessInfo décrit un processus de la machine: CPU sur l'intervalle du relevé (100% pour
+// un cœur entier) et mémoire résidente au moment du relevé
+type ProcessInfo struct {
+	PID        int     `json:"pid"`
+	Name       string  `json:"name"`
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+}
+
+// HostInfo regroupe l'état de la machine au-delà de l'utilisation par cœur
+type HostInfo struct {
+	Load     LoadAvg                 `json:"load"`
+	CPU      CPUDetail               `json:"cpu"`
+	Memory   MemoryInfo              `json:"memory"`
+	Disks    []DiskInfo              `json:"disks"`
+	Network  []NetInfo               `json:"network"`
+	Pressure map[string]PressureInfo `json:"pressure,omitempty"` // absent si le noyau ne fournit pas le PSI
+	// Processus qui consomment le plus de CPU et de mémoire, les plus gros en premier
+	TopCPU []ProcessInfo `json:"top_cpu"`
+	TopRSS []ProcessInfo `json:"top_rss"`
+}
+
+// Snapshot contient les compteurs cumulés de la machine à un instant donné.
+// Deux snapshots permettent de calculer l'utilisation CPU et les débits.
+type Snapshot struct {
+	At      time.Time
+	Cores   map[string][]uint64
+	Global  []uint64
+	Disques map[string][2]uint64 // secteurs lus et écrits par périphérique
+	Reseau  map[string][2]uint64 // octets reçus et émis par interface
+	// Processus donne le temps CPU (utime+stime, en ticks) de chaque processus
+	Processus map[int]uint64
+}
+
+// Prelever lit les compteurs courants de /proc
+func Prelever() (*Snapshot, error) {
+	cores, global, err := lireStat()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{At: time.Now(), Cores: cores, Global: global}
+	// les disques et le réseau sont facultatifs, une erreur ne doit pas bloquer le relevé CPU
+	snap.Disques, _ = lireDiskstats()
+	snap.Reseau, _ = lireNetDev()
+	snap.Processus = lireTempsProcessus()
+	return snap, nil
+}
+
+// Mesurer prend deux snapshots séparés de intervalle et renvoie l'utilisation de chaque
+// cœur ainsi que l'état complet de la machine
+func Mesurer(intervalle time.Duration) (map[string]float64, HostInfo, error) {
+	first, err := Prelever()
+	if err != nil {
+		return nil, HostInfo{}, err
+	}
+	time.Sleep(intervalle)
+	second, err := Prelever()
+	if err != nil {
+		return nil, HostInfo{}, err
+	}
+	host, err := HostInfoEntre(first, second)
+	return CPUUsageEntre(first, second), host, err
+}
+
+// CPUUsageEntre calcule l'utilisation de chaque cœur entre deux snapshots
+func CPUUsageEntre(first, second *Snapshot) map[string]float64 {
+	return cpuUsageEntre(first.Cores, second.Cores)
+}
+
+// HostInfoEntre calcule l'état de la machine: les débits et la répartition CPU sur
+// l'intervalle entre les deux snapshots, le reste est lu au moment de l'appel
+func HostInfoEntre(first, second *Snapshot) (HostInfo, error) {
+	var host HostInfo
+	var err error
+
+	host.CPU = cpuDetailEntre(first.Global, second.Global)
+	if host.Load, err = lireLoadAvg(); err != nil {
+		return host, err
+	}
+	if host.Memory, err = lireMemoryInfo(); err != nil {
+		return host, err
+	}
+
+	secondes := second.At.Sub(first.At).Seconds()
+	host.Disks = lireDisques(first.Disques, second.Disques, secondes)
+	host.Network = reseauEntre(first.Reseau, second.Reseau, secondes)
+	host.Pressure = lirePressure()
+	host.TopCPU, host.TopRSS = processusEntre(first.Processus, second.Processus, secondes)
+	return host, nil
+}
+
+func cpuDetailEntre(first, second []uint64) CPUDetail {
+	if len(first) < 7 || len(second) < 7 {
+		return CPUDetail{}
+	}
+	diff := func(i int) float64 {
+		if i >= len(first) || i >= len(second) || second[i] < first[i] {
+			return 0
+		}
+		return float64(second[i] - first[i])
+	}
+	totalDiff := float64(total(second)) - float64(total(first))
+	if totalDiff <= 0 {
+		return CPUDetail{}
+	}
+	return CPUDetail{
+		User:   (diff(0) + diff(1)) / totalDiff * 100,
+		System: (diff(2) + diff(5) + diff(6)) / totalDiff * 100,
+		IOWait: diff(4) / totalDiff * 100,
+		Steal:  diff(7) / totalDiff * 100,
+		Idle:   diff(3) / totalDiff * 100,
+	}
+}
+
+func lireLoadAvg() (LoadAvg, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return LoadAvg{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return LoadAvg{}, nil
+	}
+	var load LoadAvg
+	load.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	load.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	load.Load15, _ = strconv.ParseFloat(fields[2], 64)
+	return load, nil
+}
+
+func lireMemoryInfo() (MemoryInfo, error) {
+	meminfo, err := lireMeminfo()
+	if err != nil {
+		return MemoryInfo{}, err
+	}
+	mem := MemoryInfo{
+		TotalBytes:     meminfo["MemTotal"],
+		AvailableBytes: meminfo["MemAvailable"],
+		SwapTotalBytes: meminfo["SwapTotal"],
+	}
+	if mem.TotalBytes >= mem.AvailableBytes {
+		mem.UsedBytes = mem.TotalBytes - mem.AvailableBytes
+	}
+	if mem.TotalBytes > 0 {
+		mem.UsedPercent = float64(mem.UsedBytes) / float64(mem.TotalBytes) * 100
+	}
+	if mem.SwapTotalBytes >= meminfo["SwapFree"] {
+		mem.SwapUsedBytes = mem.SwapTotalBytes - meminfo["SwapFree"]
+	}
+	if mem.SwapTotalBytes > 0 {
+		mem.SwapUsedPercent = float64(mem.SwapUsedBytes) / float64(mem.SwapTotalBytes) * 100
+	}
+	return mem, nil
+}
+
+// lireDiskstats renvoie les secteurs lus et écrits de chaque périphérique bloc
+func lireDiskstats() (map[string][2]uint64, error) {
+	data, err := os.ReadFile("/proc/diskstats")
+	if err != nil {
+		return nil, err
+	}
+	disques := make(map[string][2]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		lus, _ := strconv.ParseUint(fields[5], 10, 64)
+		ecrits, _ := strconv.ParseUint(fields[9], 10, 64)
+		disques[fields[2]] = [2]uint64{lus, ecrits}
+	}
+	return disques, nil
+}
+
+// lireDisques renvoie l'occupation de chaque système de fichiers monté sur un périphérique
+// bloc et ses débits de lecture et d'écriture
+func lireDisques(first, second map[string][2]uint64, secondes float64) []DiskInfo {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil
+	}
+	disques := []DiskInfo{}
+	vus := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") || vus[fields[0]] {
+			continue
+		}
+		vus[fields[0]] = true
+
+		// les espaces dans les points de montage sont encodés en octal dans /proc/mounts
+		mount := strings.ReplaceAll(fields[1], "\\040", " ")
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(mount, &stat); err != nil {
+			continue
+		}
+		disque := DiskInfo{
+			Mount:          mount,
+			Device:         fields[0],
+			FSType:         fields[2],
+			TotalBytes:     stat.Blocks * uint64(stat.Bsize),
+			AvailableBytes: stat.Bavail * uint64(stat.Bsize),
+		}
+		libres := stat.Bfree * uint64(stat.Bsize)
+		if disque.TotalBytes >= libres {
+			disque.UsedBytes = disque.TotalBytes - libres
+		}
+		if disque.UsedBytes+disque.AvailableBytes > 0 {
+			disque.UsedPercent = float64(disque.UsedBytes) / float64(disque.UsedBytes+disque.AvailableBytes) * 100
+		}
+
+		// /dev/mapper/xxx et /dev/disk/by-* sont des liens vers le vrai périphérique (dm-0, sda1...)
+		nom := filepath.Base(fields[0])
+		if cible, err := filepath.EvalSymlinks(fields[0]); err == nil {
+			nom = filepath.Base(cible)
+		}
+		if avant, ok := first[nom]; ok && secondes > 0 {
+			if apres, ok := second[nom]; ok && apres[0] >= avant[0] && apres[1] >= avant[1] {
+				disque.ReadBytesPerSec = float64((apres[0]-avant[0])*tailleSecteur) / secondes
+				disque.WriteBytesPerSec = float64((apres[1]-avant[1])*tailleSecteur) / secondes
+			}
+		}
+		disques = append(disques, disque)
+	}
+	return disques
+}
+
+// lireNetDev renvoie les octets reçus et émis par chaque interface réseau hors loopback
+func lireNetDev() (map[string][2]uint64, error) {
+	data, err := os.ReadFile("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	reseau := make(map[string][2]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		nom, compteurs, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		nom = strings.TrimSpace(nom)
+		fields := strings.Fields(compteurs)
+		if nom == "lo" || len(fields) < 9 {
+			continue
+		}
+		recus, _ := strconv.ParseUint(fields[0], 10, 64)
+		emis, _ := strconv.ParseUint(fields[8], 10, 64)
+		reseau[nom] = [2]uint64{recus, emis}
+	}
+	return reseau, nil
+}
+
+func reseauEntre(first, second map[string][2]uint64, secondes float64) []NetInfo {
+	reseau := []NetInfo{}
+	for nom, apres := range second {
+		info := NetInfo{Interface: nom, RxBytes: apres[0], TxBytes: apres[1]}
+		if avant, ok := first[nom]; ok && secondes > 0 && apres[0] >= avant[0] && apres[1] >= avant[1] {
+			info.RxBytesPerSec = float64(apres[0]-avant[0]) / secondes
+			info.TxBytesPerSec = float64(apres[1]-avant[1]) / secondes
+		}
+		reseau = append(reseau, info)
+	}
+	sort.Slice(reseau, func(i, j int) bool { return reseau[i].Interface < reseau[j].Interface })
+	return reseau
+}
+
+// lirePressure lit les informations de pression (PSI) du CPU, de la mémoire et des I/O
+func lirePressure() map[string]PressureInfo {
+	pressions := make(map[string]PressureInfo)
+	for _, ressource := range []string{"cpu", "memory", "io"} {
+		data, err := os.ReadFile("/proc/pressure/" + ressource)
+		if err != nil {
+			continue
+		}
+		var p PressureInfo
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			valeurs := make(map[string]float64)
+			for _, f := range fields[1:] {
+				cle, valeur, ok := strings.Cut(f, "=")
+				if ok {
+					valeurs[cle], _ = strconv.ParseFloat(valeur, 64)
+				}
+			}
+			switch fields[0] {
+			case "some":
+				p.SomeAvg10, p.SomeAvg60, p.SomeAvg300 = valeurs["avg10"], valeurs["avg60"], valeurs["avg300"]
+			case "full":
+				p.FullAvg10, p.FullAvg60, p.FullAvg300 = valeurs["avg10"], valeurs["avg60"], valeurs["avg300"]
+			}
+		}
+		pressions[ressource] = p
+	}
+	if len(pressions) == 0 {
+		return nil
+	}
+	return pressions
+}
+
+// lireTempsProcessus renvoie le temps CPU consommé par chaque processus, lu dans
+// /proc/[pid]/stat. Un processus terminé pendant la lecture est ignoré.
+func lireTempsProcessus() map[int]uint64 {
+	entrees, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	temps := make(map[int]uint64)
+	for _, entree := range entrees {
+		pid, err := strconv.Atoi(entree.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entree.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// le nom entre parenthèses peut contenir des espaces: les champs commencent après
+		// la dernière parenthèse, par l'état (champ 3 de proc(5))
+		fin := strings.LastIndexByte(string(data), ')')
+		if fin < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[fin+1:]))
+		if len(fields) < 13 {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		temps[pid] = utime + stime
+	}
+	return temps
+}
+
+// lireStatusProcessus renvoie le nom et la mémoire résidente d'un processus, lus dans
+// /proc/[pid]/status. Les threads noyau n'ont pas de VmRSS et comptent pour zéro.
+func lireStatusProcessus(pid int) (string, uint64, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return "", 0, false
+	}
+	var nom string
+	var rss uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		cle, valeur, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch cle {
+		case "Name":
+			nom = strings.TrimSpace(valeur)
+		case "VmRSS":
+			fields := strings.Fields(valeur)
+			if len(fields) > 0 {
+				rss, _ = strconv.ParseUint(fields[0], 10, 64)
+				rss *= 1024 // en kB dans /proc
+			}
+		}
+	}
+	return nom, rss, true
+}
+
+// processusEntre classe les processus par CPU consommé entre les deux relevés et par
+// mémoire résidente, et garde les nombreProcessus premiers de chaque classement
+func processusEntre(first, second map[int]uint64, secondes float64) (topCPU, topRSS []ProcessInfo) {
+	tous := make([]ProcessInfo, 0, len(second))
+	for pid, apres := range second {
+		nom, rss, ok := lireStatusProcessus(pid)
+		if !ok {
+			continue
+		}
+		p := ProcessInfo{PID: pid, Name: nom, RSSBytes: rss}
+		if avant, ok := first[pid]; ok && secondes > 0 && apres >= avant {
+			p.CPUPercent = float64(apres-avant) / ticksParSeconde / secondes * 100
+		}
+		tous = append(tous, p)
+	}
+	premiers := func(valeur func(ProcessInfo) float64) []ProcessInfo {
+		sort.Slice(tous, func(i, j int) bool {
+			if a, b := valeur(tous[i]), valeur(tous[j]); a != b {
+				return a > b
+			}
+			return tous[i].PID < tous[j].PID
+		})
+		return append([]ProcessInfo{}, tous[:min(nombreProcessus, len(tous))]...)
+	}
+	topCPU = premiers(func(p ProcessInfo) float64 { return p.CPUPercent })
+	topRSS = premiers(func(p ProcessInfo) float64 { return float64(p.RSSBytes) })
+	return topCPU, topRSS
+}
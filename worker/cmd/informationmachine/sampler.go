@@ -0,0 +1,120 @@
+package informationmachine
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// Echantillon est le dernier état de la machine connu du sampler. Les valeurs lissées
+// sont des moyennes mobiles exponentielles (EWMA), les valeurs instantanées portent sur
+// le dernier intervalle d'échantillonnage.
+type Echantillon struct {
+	At                 time.Time
+	CPUUsage           map[string]float64
+	CPUUsageInstant    map[string]float64
+	MemoryUsage        float64
+	MemoryUsageInstant float64
+	Host               HostInfo
+}
+
+// Sampler relève l'état de la machine en tâche de fond à intervalle régulier, pour que
+// les demandes d'infos soient servies immédiatement
+type Sampler struct {
+	intervalle time.Duration
+	alpha      float64
+	log        *slog.Logger
+
+	mu      sync.Mutex
+	dernier *Snapshot
+	courant Echantillon
+	pret    bool
+}
+
+// NewSampler crée un sampler relevant la machine tous les intervalle. fenetre est la
+// constante de temps de la moyenne mobile: un changement de charge est pris en compte
+// à 63% au bout de fenetre. Les erreurs de relevé sont envoyées à journal.
+func NewSampler(intervalle, fenetre time.Duration, journal *slog.Logger) *Sampler {
+	if intervalle <= 0 {
+		intervalle = 2 * time.Second
+	}
+	alpha := 1.0
+	if fenetre > intervalle {
+		alpha = 1 - math.Exp(-float64(intervalle)/float64(fenetre))
+	}
+	return &Sampler{intervalle: intervalle, alpha: alpha, log: journal}
+}
+
+// Run échantillonne jusqu'à la fermeture de stop
+func (s *Sampler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.intervalle)
+	defer ticker.Stop()
+
+	s.echantillonner()
+	for {
+		select {
+		case <-ticker.C:
+			s.echantillonner()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Sampler) echantillonner() {
+	snap, err := Prelever()
+	if err != nil {
+		s.log.Error("Erreur lors du relevé de la machine", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	precedent := s.dernier
+	s.dernier = snap
+	s.mu.Unlock()
+	if precedent == nil {
+		return
+	}
+
+	cpuInstant := CPUUsageEntre(precedent, snap)
+	host, err := HostInfoEntre(precedent, snap)
+	if err != nil {
+		s.log.Error("Erreur lors du relevé de la machine", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lisse := make(map[string]float64, len(cpuInstant))
+	for core, usage := range cpuInstant {
+		if ancien, ok := s.courant.CPUUsage[core]; ok && s.pret {
+			lisse[core] = ancien + s.alpha*(usage-ancien)
+		} else {
+			lisse[core] = usage
+		}
+	}
+	memoire := host.Memory.UsedPercent
+	if s.pret {
+		memoire = s.courant.MemoryUsage + s.alpha*(host.Memory.UsedPercent-s.courant.MemoryUsage)
+	}
+
+	s.courant = Echantillon{
+		At:                 snap.At,
+		CPUUsage:           lisse,
+		CPUUsageInstant:    cpuInstant,
+		MemoryUsage:        memoire,
+		MemoryUsageInstant: host.Memory.UsedPercent,
+		Host:               host,
+	}
+	s.pret = true
+}
+
+// Dernier renvoie le dernier échantillon, le booléen est faux tant qu'aucun intervalle
+// complet n'a été mesuré
+func (s *Sampler) Dernier() (Echantillon, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.courant, s.pret
+}
@@ -1,93 +1,106 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
-	"net"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"gopkg.in/yaml.v3"
 
-	"worker/cmd/handler"
+	"commun/configuration"
+	"commun/journalisation"
+	"worker/cmd/worker"
 )
 
-var workerHome string
-var masterAddr string
-var logFile *os.File
-
-// Configuration structure
-type Config struct {
-	MasterIP string `yaml:"master_ip"`
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(commandeValidateConfig(os.Args[2:]))
+	}
 
-func getConfig() Config {
-	var config Config
-	yamlFile, err := os.ReadFile(workerHome + "/config/config.yaml")
+	config, err := lireConfig("worker_test", os.Args[1:])
 	if err != nil {
-		log.Fatalf("Erreur dans la lecture du .yaml: %v", err)
+		log.Fatalf("Configuration invalide:\n%v", err)
 	}
 
-	err = yaml.Unmarshal(yamlFile, &config)
+	// Journal du worker (fichier avec rotation, sortie standard ou journald), qui reçoit
+	// aussi les messages du package log
+	journal, err := journalisation.Ouvrir(config.Log)
 	if err != nil {
-		log.Fatalf("Erreur dans le décodage du .yaml: %v", err)
+		log.Fatalf("Journalisation impossible: %v", err)
 	}
-	return config
-}
+	defer journal.Close()
+	slog.SetDefault(journal.Logger)
+	slog.Info("Démarrage du worker", "home", config.Home)
 
-func init() {
-	// Ouvre le fichier de log dès l'initialisation
-	var err error
-	logFile, err = os.OpenFile("/var/log/worker_cb.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	w, err := worker.New(config)
 	if err != nil {
-		log.Fatalf("Erreur lors de l'ouverture du fichier de log : %v", err)
+		slog.Error("Démarrage du worker impossible", "error", err)
+		journal.Close()
+		os.Exit(1)
 	}
 
-	// Redirige les logs à la fois vers le fichier et la sortie standard
-	mw := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(mw)
-
-	// Initialisation de la variable globale WORKER_HOME
-	workerHome = os.Getenv("WORKER_HOME")
-	if workerHome == "" {
-		log.Fatalf("WORKER_HOME non défini!!")
-	} else {
-		log.Println("WORKER_HOME défini :", workerHome)
+	// À la réception de SIGTERM (systemctl stop) ou SIGINT, le worker s'arrête proprement
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := w.Run(ctx); err != nil {
+		slog.Error("Arrêt du worker", "error", err)
+		journal.Close()
+		os.Exit(1)
 	}
-
-	// Configuration adresse worker
-	config := getConfig()
-	masterAddr = config.MasterIP
 }
 
-func main() {
-	defer logFile.Close() // on s'ssaure que le fichier de log se ferme bien à la fin du prog
-
-	ln, err := net.Listen("tcp", masterAddr)
+// commandeValidateConfig vérifie la config sans démarrer le worker, et affiche la config
+// effective: valeurs par défaut, variables d'environnement et options comprises
+func commandeValidateConfig(args []string) int {
+	config, err := lireConfig("worker_test validate-config", args)
 	if err != nil {
-		log.Fatalf("Erreur lors de la création d'un listener: %v", err)
+		fmt.Fprintf(os.Stderr, "Configuration invalide:\n%v\n", err)
+		return 1
 	}
-	log.Println("Worker ecoute sur le port 8080")
-	defer ln.Close()
+	contenu, err := yaml.Marshal(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Erreur:", err)
+		return 1
+	}
+	fmt.Print(string(contenu))
+	fmt.Fprintln(os.Stderr, "Configuration valide:", filepath.Join(config.Home, "config", "config.yaml"))
+	return 0
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println("Erreur pour accepter la connexion:", err)
-			continue
-		}
+// lireConfig lit la config du worker: config.yaml, variables WORKER_* puis options de la
+// ligne de commande, et la valide
+func lireConfig(nom string, args []string) (worker.Config, error) {
+	fs := flag.NewFlagSet(nom, flag.ExitOnError)
+	home := fs.String("home", os.Getenv("WORKER_HOME"), "dossier du worker, $WORKER_HOME par défaut")
+	options := configuration.Declarer(fs, &worker.Config{})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\nChaque option remplace la clé du config.yaml de même nom, "+
+			"de même que les variables %s_<CLE> (%s par exemple).\n\n", nom, worker.PrefixeEnvironnement,
+			configuration.NomVariable(worker.PrefixeEnvironnement, "master_ip"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return worker.Config{}, fmt.Errorf("argument inattendu: %s", fs.Arg(0))
+	}
+	if *home == "" {
+		return worker.Config{}, errors.New("WORKER_HOME non défini!!")
+	}
 
-		go func(conn net.Conn) {
-			defer conn.Close()
-			decoder := json.NewDecoder(conn)
-			var cmd handler.Command
-			if err := decoder.Decode(&cmd); err != nil {
-				handler.ReportProgress(conn, "Erreur dans le décodage de la commande")
-				log.Println("Erreur dans le décodage de la commande")
-				return
-			}
-			log.Println("Commande reçu du master : ", cmd.Command)
-			handler.HandleCommand(conn, cmd, workerHome)
-		}(conn)
+	config, err := worker.ChargerConfig(*home)
+	if err != nil {
+		return config, err
+	}
+	if err := options.Appliquer(&config); err != nil {
+		return config, err
 	}
+	config = config.AvecDefauts()
+	return config, config.Valider()
 }
@@ -0,0 +1,184 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"commun/configuration"
+	"commun/journalisation"
+	"commun/mtls"
+	"commun/signature"
+	"worker/cmd/conteneur"
+	"worker/cmd/environnement"
+)
+
+// Préfixe des variables d'environnement qui surchargent la config: WORKER_MASTER_IP...
+const PrefixeEnvironnement = "WORKER"
+
+// Config est la configuration d'un worker, lue dans $WORKER_HOME/config/config.yaml. Les
+// valeurs vides prennent leur valeur par défaut (AvecDefauts).
+type Config struct {
+	// Home est le dossier du worker ($WORKER_HOME): config et scripts
+	Home        string `yaml:"-"`
+	MasterIP    string `yaml:"master_ip"`    // adresse d'écoute des commandes du master
+	MetricsAddr string `yaml:"metrics_addr"` // adresse d'écoute de l'endpoint Prometheus, vide pour désactiver
+	// Journalisation: fichier (/var/log/worker_cb.log par défaut), format, niveaux, rotation
+	Log journalisation.Config `yaml:"log"`
+	// Logger reçoit les messages du worker, slog.Default() si nil
+	Logger *slog.Logger `yaml:"-"`
+	// Script exécuté pour chaque job, $WORKER_HOME/test/test_scrypt.py par défaut
+	Script string `yaml:"script"`
+	Python string `yaml:"python"` // interpréteur du script, python3 par défaut
+	// Environnements python demandés par les jobs (venv épinglé ou requirements), refusés si absent
+	Venv environnement.Config `yaml:"venv"`
+	// Exécution des jobs dans un conteneur (podman, docker), sur la machine si la section est absente
+	Container conteneur.Config `yaml:"container"`
+	// Relevé de la machine en tâche de fond
+	SampleInterval time.Duration `yaml:"sample_interval"` // 2s par défaut
+	SampleWindow   time.Duration `yaml:"sample_window"`   // constante de temps du lissage, 30s par défaut
+	// Délai laissé aux jobs en cours pour se terminer à l'arrêt du worker, 30s par défaut
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+	// Durée de conservation des jobs terminés pour un master qui se rattache, 1h par défaut
+	JobRetention time.Duration `yaml:"job_retention"`
+	// Connexions du master en TLS mutuel, en clair si la section est absente
+	TLS mtls.Config `yaml:"tls"`
+	// Vérification des commandes signées par le master, commandes non signées acceptées si absent
+	Signing signature.ConfigVerificateur `yaml:"signing"`
+}
+
+// ChargerConfig lit la config du worker dans home/config/config.yaml, puis applique les
+// variables d'environnement WORKER_*. Une clé inconnue ou une valeur illisible est une
+// erreur. La config n'est pas encore validée, voir Valider.
+func ChargerConfig(home string) (Config, error) {
+	config := Config{Home: home}
+	if err := configuration.Lire(filepath.Join(home, "config", "config.yaml"), &config); err != nil {
+		return config, err
+	}
+	if err := configuration.Environnement(PrefixeEnvironnement, &config); err != nil {
+		return config, err
+	}
+	config.Home = home
+	return config, nil
+}
+
+// AvecDefauts renvoie la config où les valeurs non renseignées ont leur valeur par défaut
+func (c Config) AvecDefauts() Config {
+	if c.Log.File == "" {
+		c.Log.File = "/var/log/worker_cb.log"
+	}
+	c.Log = c.Log.AvecDefauts()
+	if c.Script == "" {
+		c.Script = filepath.Join(c.Home, "test", "test_scrypt.py")
+	}
+	if c.Python == "" {
+		c.Python = "python3"
+	}
+	if c.Venv.Active() {
+		c.Venv = c.Venv.AvecDefauts(c.Home, c.Python)
+	}
+	if c.Container.Active() {
+		c.Container = c.Container.AvecDefauts(c.Home)
+	}
+	if c.SampleInterval == 0 {
+		c.SampleInterval = 2 * time.Second
+	}
+	if c.SampleWindow == 0 {
+		c.SampleWindow = 30 * time.Second
+	}
+	if c.ShutdownGrace == 0 {
+		c.ShutdownGrace = 30 * time.Second
+	}
+	if c.JobRetention == 0 {
+		c.JobRetention = time.Hour
+	}
+	if c.Signing.Active() && len(c.Signing.Addresses) == 0 {
+		c.Signing.Addresses = adressesLocales(c.MasterIP)
+	}
+	return c
+}
+
+// adressesLocales renvoie les adresses par lesquelles le master peut joindre un worker qui
+// écoute sur ecoute: le nom de la machine, localhost et chaque adresse IP de la machine,
+// avec le port d'écoute. Une adresse d'écoute précise n'est joignable que telle quelle.
+func adressesLocales(ecoute string) []string {
+	hote, port, err := net.SplitHostPort(ecoute)
+	if err != nil {
+		return nil
+	}
+	if hote != "" && hote != "0.0.0.0" && hote != "::" {
+		return []string{ecoute}
+	}
+	adresses := []string{net.JoinHostPort("localhost", port)}
+	if nom, err := os.Hostname(); err == nil {
+		adresses = append(adresses, net.JoinHostPort(nom, port))
+	}
+	if interfaces, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range interfaces {
+			if ip, ok := a.(*net.IPNet); ok {
+				adresses = append(adresses, net.JoinHostPort(ip.IP.String(), port))
+			}
+		}
+	}
+	return adresses
+}
+
+// Valider vérifie la config avec ses valeurs par défaut et renvoie toutes les erreurs
+// trouvées, une par ligne, chacune préfixée de la clé yaml concernée
+func (c Config) Valider() error {
+	c = c.AvecDefauts()
+	var erreurs []error
+	verifier := func(cle string, err error) {
+		if err != nil {
+			erreurs = append(erreurs, fmt.Errorf("%s: %v", cle, err))
+		}
+	}
+
+	if c.Home == "" {
+		verifier("home", errors.New("dossier du worker (WORKER_HOME) non défini"))
+	}
+	if c.MasterIP == "" {
+		verifier("master_ip", errors.New("adresse d'écoute non renseignée"))
+	} else {
+		verifier("master_ip", configuration.Adresse(c.MasterIP, true))
+	}
+	if err := c.Log.Valider("log."); err != nil {
+		erreurs = append(erreurs, err)
+	}
+	if c.MetricsAddr != "" {
+		verifier("metrics_addr", configuration.Adresse(c.MetricsAddr, true))
+	}
+	verifier("script", configuration.Fichier(c.Script))
+	if c.Venv.Active() {
+		if err := c.Venv.Valider("venv."); err != nil {
+			erreurs = append(erreurs, err)
+		}
+	}
+	if c.Container.Active() {
+		if err := c.Container.Valider("container."); err != nil {
+			erreurs = append(erreurs, err)
+		}
+	}
+	verifier("sample_interval", configuration.Duree(c.SampleInterval, 100*time.Millisecond, time.Hour))
+	if c.SampleWindow < c.SampleInterval {
+		verifier("sample_window", fmt.Errorf("%v inférieur à sample_interval (%v)", c.SampleWindow, c.SampleInterval))
+	}
+	verifier("shutdown_grace", configuration.Duree(c.ShutdownGrace, time.Second, time.Hour))
+	verifier("job_retention", configuration.Duree(c.JobRetention, time.Minute, 7*24*time.Hour))
+	if c.TLS.Active() {
+		_, err := mtls.ServeurConfig(c.TLS)
+		verifier("tls", err)
+	}
+	if c.Signing.Active() {
+		if c.Signing.MaxAge < 0 {
+			verifier("signing.max_age", fmt.Errorf("durée négative %v", c.Signing.MaxAge))
+		}
+		_, err := signature.ChargerVerificateur(c.Signing)
+		verifier("signing", err)
+	}
+	return errors.Join(erreurs...)
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"commun/signature"
+)
+
+func TestValiderConfig(t *testing.T) {
+	home := t.TempDir()
+	script := filepath.Join(home, "test", "test_scrypt.py")
+	if err := os.MkdirAll(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("print('ok')\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cle := filepath.Join(home, "hmac.key")
+	if err := signature.GenererHMAC(cle); err != nil {
+		t.Fatal(err)
+	}
+
+	cas := []struct {
+		nom     string
+		config  Config
+		erreurs []string // clés en erreur, aucune si la config est valide
+	}{
+		{"défauts", Config{Home: home, MasterIP: ":8080"}, nil},
+		{"signature avec les adresses par défaut", Config{Home: home, MasterIP: ":8080", Signing: signature.ConfigVerificateur{HMACKey: cle}}, nil},
+		{"sans écoute", Config{Home: home}, []string{"master_ip"}},
+		{"écoute invalide", Config{Home: home, MasterIP: "8080"}, []string{"master_ip"}},
+		{"script absent", Config{Home: home, MasterIP: ":8080", Script: filepath.Join(home, "absent.py")}, []string{"script"}},
+		{"fenêtre plus courte que le relevé", Config{Home: home, MasterIP: ":8080", SampleInterval: time.Minute, SampleWindow: time.Second}, []string{"sample_window"}},
+		{"adresse signée sans port", Config{Home: home, MasterIP: ":8080", Signing: signature.ConfigVerificateur{HMACKey: cle, Addresses: []string{"worker1"}}}, []string{"signing"}},
+		{"âge négatif", Config{Home: home, MasterIP: ":8080", Signing: signature.ConfigVerificateur{HMACKey: cle, MaxAge: -time.Second}}, []string{"signing.max_age"}},
+		{"plusieurs erreurs", Config{MasterIP: "x", Script: script}, []string{"home", "master_ip"}},
+	}
+	for _, c := range cas {
+		err := c.config.Valider()
+		if len(c.erreurs) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", c.nom, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: config acceptée, attendu une erreur sur %v", c.nom, c.erreurs)
+			continue
+		}
+		lignes := strings.Split(err.Error(), "\n")
+		if len(lignes) != len(c.erreurs) {
+			t.Errorf("%s: %d erreurs, attendu %d:\n%v", c.nom, len(lignes), len(c.erreurs), err)
+			continue
+		}
+		for i, cle := range c.erreurs {
+			if !strings.HasPrefix(lignes[i], cle+": ") {
+				t.Errorf("%s: erreur %q, attendu la clé %s", c.nom, lignes[i], cle)
+			}
+		}
+	}
+}
+
+func TestAdressesLocales(t *testing.T) {
+	// une écoute sur toutes les interfaces accepte le nom de la machine et ses adresses
+	adresses := adressesLocales(":8080")
+	nom, _ := os.Hostname()
+	for _, attendue := range []string{"localhost:8080", nom + ":8080", "127.0.0.1:8080"} {
+		if !slices.Contains(adresses, attendue) {
+			t.Errorf("%s absente de %v", attendue, adresses)
+		}
+	}
+	// une écoute sur une adresse précise n'est joignable que par elle
+	if adresses := adressesLocales("10.0.0.5:8080"); !slices.Equal(adresses, []string{"10.0.0.5:8080"}) {
+		t.Errorf("adresses %v, attendu [10.0.0.5:8080]", adresses)
+	}
+	if adresses := adressesLocales("8080"); adresses != nil {
+		t.Errorf("adresses %v pour une écoute invalide", adresses)
+	}
+}
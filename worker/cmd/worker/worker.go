@@ -0,0 +1,219 @@
+// Package worker exécute les commandes envoyées par le master. Un worker se crée avec New
+// et tourne avec Run: plusieurs workers peuvent tourner dans le même processus.
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"commun/journalisation"
+	"commun/mtls"
+	"commun/signature"
+	"worker/cmd/conteneur"
+	"worker/cmd/environnement"
+	"worker/cmd/handler"
+	"worker/cmd/informationmachine"
+)
+
+// Worker attend les commandes du master et exécute ses jobs
+type Worker struct {
+	config          Config
+	handler         *handler.Handler
+	echantillonneur *informationmachine.Sampler
+	tlsServeur      *tls.Config // nil pour des connexions en clair
+	log             *slog.Logger
+
+	listener     net.Listener
+	arretEnCours atomic.Bool
+	pret         chan struct{} // fermé quand le worker écoute
+	arret        chan struct{} // fermé par Stop
+	arretUne     sync.Once
+}
+
+// New valide la config et prépare un worker: signature, TLS et relevé de la machine. Rien n'est lancé avant Run.
+func New(config Config) (*Worker, error) {
+	config = config.AvecDefauts()
+	if err := config.Valider(); err != nil {
+		return nil, fmt.Errorf("config invalide:\n%w", err)
+	}
+	journal := config.Logger
+	if journal == nil {
+		journal = slog.Default()
+	}
+	w := &Worker{
+		config: config,
+		echantillonneur: informationmachine.NewSampler(config.SampleInterval, config.SampleWindow,
+			journal.With(journalisation.CleComposant, "machine")),
+		log:   journal.With(journalisation.CleComposant, "worker"),
+		pret:  make(chan struct{}),
+		arret: make(chan struct{}),
+	}
+
+	var verificateur *signature.Verificateur
+	var err error
+	if config.Signing.Active() {
+		if verificateur, err = signature.ChargerVerificateur(config.Signing); err != nil {
+			return nil, fmt.Errorf("configuration de signature invalide: %v", err)
+		}
+		w.log.Info("Seules les commandes signées par le master sont acceptées")
+	}
+	if config.TLS.Active() {
+		if w.tlsServeur, err = mtls.ServeurConfig(config.TLS); err != nil {
+			return nil, fmt.Errorf("configuration TLS invalide: %v", err)
+		}
+	}
+	var execution *conteneur.Config
+	if config.Container.Active() {
+		execution = &config.Container
+		w.log.Info("Jobs exécutés en conteneur", "runtime", config.Container.Runtime, "image", config.Container.Image)
+	}
+	var environnements *environnement.Gestionnaire
+	if config.Venv.Active() {
+		environnements = environnement.Nouveau(config.Venv, journal.With(journalisation.CleComposant, "venv"))
+	}
+	w.handler = handler.New(handler.Config{
+		Script:           config.Script,
+		Python:           config.Python,
+		Conteneur:        execution,
+		Environnements:   environnements,
+		Verificateur:     verificateur,
+		ConservationJobs: config.JobRetention,
+		Echantillonneur:  w.echantillonneur,
+		Logger:           journal.With(journalisation.CleComposant, "jobs"),
+	})
+	return w, nil
+}
+
+// Stop demande l'arrêt du worker, Run rend la main une fois les jobs terminés ou interrompus
+func (w *Worker) Stop() {
+	w.arretUne.Do(func() { close(w.arret) })
+}
+
+// Addr renvoie l'adresse sur laquelle écoute le worker, en attendant que Run l'ait ouverte.
+// Elle est vide si le worker est arrêté avant.
+func (w *Worker) Addr() string {
+	select {
+	case <-w.pret:
+		return w.listener.Addr().String()
+	case <-w.arret:
+		return ""
+	}
+}
+
+// startMetricsServer expose les métriques Prometheus du worker
+func (w *Worker) startMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", w.handler.MetricsHandler())
+	serveur := &http.Server{Addr: w.config.MetricsAddr, Handler: mux}
+	go func() {
+		w.log.Info("Endpoint Prometheus en écoute", "addr", w.config.MetricsAddr)
+		if err := serveur.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			w.log.Error("Erreur du serveur de métriques", "error", err)
+		}
+	}()
+	return serveur
+}
+
+// Run accepte les commandes du master jusqu'à l'annulation de ctx ou l'appel de Stop. On
+// n'accepte alors plus de commande et on laisse aux jobs en cours le délai de grâce avant
+// de les interrompre.
+func (w *Worker) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", w.config.MasterIP)
+	if err != nil {
+		return fmt.Errorf("erreur lors de la création d'un listener: %v", err)
+	}
+	if w.tlsServeur != nil {
+		ln = tls.NewListener(ln, w.tlsServeur)
+		w.log.Info("Connexions du master en TLS mutuel")
+	}
+	w.listener = ln
+	close(w.pret)
+	w.log.Info("Worker en écoute", "addr", ln.Addr().String())
+	defer ln.Close()
+
+	// Relevé de la machine en tâche de fond, les demandes d'infos lisent le dernier relevé
+	stopSampler := make(chan struct{})
+	defer close(stopSampler)
+	go w.echantillonneur.Run(stopSampler)
+
+	if w.config.MetricsAddr != "" {
+		serveurMetriques := w.startMetricsServer()
+		defer serveurMetriques.Close()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.log.Info("Arrêt du worker", "cause", context.Cause(ctx))
+		case <-w.arret:
+			w.log.Info("Arrêt du worker demandé")
+		}
+		w.arretEnCours.Store(true)
+		ln.Close()
+	}()
+
+	var connexions sync.WaitGroup
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if w.arretEnCours.Load() {
+				break
+			}
+			w.log.Error("Erreur pour accepter la connexion", "error", err)
+			continue
+		}
+
+		connexions.Add(1)
+		go func(conn net.Conn) {
+			defer connexions.Done()
+			defer conn.Close()
+			w.servir(conn)
+		}(conn)
+	}
+
+	w.handler.Arreter(w.config.ShutdownGrace)
+
+	// on laisse aux connexions le temps d'envoyer les derniers messages au master
+	fini := make(chan struct{})
+	go func() {
+		connexions.Wait()
+		close(fini)
+	}()
+	select {
+	case <-fini:
+	case <-time.After(5 * time.Second):
+		w.log.Warn("Des connexions sont encore ouvertes, arrêt forcé")
+	}
+	w.log.Info("Worker arrêté")
+	return nil
+}
+
+// servir lit la commande du master sur conn et l'exécute
+func (w *Worker) servir(conn net.Conn) {
+	if connTLS, ok := conn.(*tls.Conn); ok {
+		// un client sans certificat valide est refusé avant de lire une commande
+		connTLS.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := connTLS.Handshake(); err != nil {
+			w.log.Warn("Connexion TLS refusée", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		connTLS.SetDeadline(time.Time{})
+	}
+	decoder := json.NewDecoder(conn)
+	var cmd handler.Command
+	if err := decoder.Decode(&cmd); err != nil {
+		handler.ReportProgress(conn, "Erreur dans le décodage de la commande")
+		w.log.Warn("Erreur dans le décodage de la commande", "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	w.log.Debug("Commande reçue du master", journalisation.CleCommande, cmd.Command, journalisation.CleJob, cmd.JobID)
+	w.handler.HandleCommand(conn, cmd)
+}
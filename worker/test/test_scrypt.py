@@ -1,6 +1,8 @@
 import sys
 
 if len(sys.argv) > 1:
+    print('##PROGRESS## {"percent": 0, "stage": "ecriture"}', flush=True)
     with open("./test.txt", "w") as f:
         f.write(sys.argv[1])
+    print('##PROGRESS## {"percent": 100, "stage": "ecriture"}', flush=True)
 #print(sys.argv[1])